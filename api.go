@@ -6,9 +6,13 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
+	"github.com/TykTechnologies/tyk-identity-broker/deprovisioning"
 	tykerror "github.com/TykTechnologies/tyk-identity-broker/error"
 
+	"github.com/TykTechnologies/tyk-identity-broker/providers"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	"github.com/TykTechnologies/tyk-identity-broker/webhooks"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
@@ -44,8 +48,8 @@ func HandleAPIOK(data interface{}, id string, code int, w http.ResponseWriter, _
 	w.Write(responseMsg) //nolint:errcheck
 }
 
-func HandleAPIError(tag string, errorMsg string, rawErr error, code int, w http.ResponseWriter, _ *http.Request) {
-	log.WithFields(logrus.Fields{
+func HandleAPIError(tag string, errorMsg string, rawErr error, code int, w http.ResponseWriter, r *http.Request) {
+	log.WithContext(r.Context()).WithFields(logrus.Fields{
 		"prefix": tag,
 		"error":  errorMsg,
 	}).Error(rawErr)
@@ -127,6 +131,7 @@ func HandleAddProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	auditProfile(r, audit.ProfileCreated, thisProfile)
 	HandleAPIOK(thisProfile, key, 201, w, r)
 }
 
@@ -152,17 +157,189 @@ func HandleUpdateProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	auditProfile(r, audit.ProfileUpdated, thisProfile)
 	HandleAPIOK(thisProfile, key, 200, w, r)
 }
 
 func HandleDeleteProfile(w http.ResponseWriter, r *http.Request) {
 	key := mux.Vars(r)["id"]
+	// kept for the audit log, which needs the organisation of the profile
+	deleted := tap.Profile{ID: key}
+	AuthConfigStore.GetKey(key, "", &deleted)
+
 	err := tap.DeleteProfile(key, "", AuthConfigStore, GlobalDataLoader.Flush)
 	if err != nil {
 		HandleAPIError(APILogTag, err.Message, err.Error, err.Code, w, r)
 		return
 	}
 
+	auditProfile(r, audit.ProfileDeleted, deleted)
 	data := make(map[string]string)
 	HandleAPIOK(data, key, 200, w, r)
 }
+
+// auditProfile records a change made to a profile through the API, with the admin key that made it
+func auditProfile(r *http.Request, event string, profile tap.Profile) {
+	audit.Log(r, audit.Event{
+		Type:      event,
+		OrgID:     profile.OrgID,
+		ProfileID: profile.ID,
+		Provider:  profile.ProviderName,
+		Actor:     r.Header.Get("Authorization"),
+	})
+}
+
+// RevokeResult is returned by the token revocation endpoints
+type RevokeResult struct {
+	Revoked int
+}
+
+func HandleRevokeProfileTokens(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["id"]
+
+	thisIdentityHandler, _, err := providers.GetTykIdentityHandler(r.Context(), AuthConfigStore, IdentityKeyStore, key, TykAPIHandler)
+	if err != nil {
+		HandleAPIError(APILogTag, err.Message, err.Error, err.Code, w, r)
+		return
+	}
+
+	revoked, rErr := thisIdentityHandler.RevokeProfileTokens()
+	if rErr != nil {
+		HandleAPIError(APILogTag, "Revocation failed", rErr, 500, w, r)
+		return
+	}
+
+	HandleAPIOK(RevokeResult{Revoked: revoked}, key, 200, w, r)
+}
+
+func HandleRevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["id"]
+	userID := mux.Vars(r)["userId"]
+
+	thisIdentityHandler, _, err := providers.GetTykIdentityHandler(r.Context(), AuthConfigStore, IdentityKeyStore, key, TykAPIHandler)
+	if err != nil {
+		HandleAPIError(APILogTag, err.Message, err.Error, err.Code, w, r)
+		return
+	}
+
+	revoked, rErr := thisIdentityHandler.RevokeUserTokens(userID)
+	if rErr != nil {
+		HandleAPIError(APILogTag, "Revocation failed", rErr, 500, w, r)
+		return
+	}
+
+	HandleAPIOK(RevokeResult{Revoked: revoked}, key, 200, w, r)
+}
+
+func HandleDeprovision(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["id"]
+	thisProfile := tap.Profile{}
+
+	keyErr := AuthConfigStore.GetKey(key, thisProfile.OrgID, &thisProfile)
+	if keyErr != nil {
+		HandleAPIError(APILogTag, "Profile not found", keyErr, 404, w, r)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report, err := DeprovisioningSyncer.Run(thisProfile, dryRun)
+	if err == deprovisioning.ErrNotConfigured {
+		HandleAPIError(APILogTag, err.Error(), err, 400, w, r)
+		return
+	}
+	if err != nil {
+		HandleAPIError(APILogTag, "Deprovisioning failed", err, 500, w, r)
+		return
+	}
+
+	HandleAPIOK(report, key, 200, w, r)
+}
+
+// ------ Webhook subscriptions -------
+
+func HandleGetWebhookList(w http.ResponseWriter, r *http.Request) {
+	orgID := mux.Vars(r)["orgId"]
+	subscriptions := Webhooks.List(orgID)
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	HandleAPIOK(subscriptions, "", 200, w, r)
+}
+
+func HandleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sub, err := Webhooks.Get(vars["orgId"], vars["id"])
+	if err != nil {
+		HandleAPIError(APILogTag, "Webhook not found", err, 404, w, r)
+		return
+	}
+
+	sub.Secret = ""
+	HandleAPIOK(sub, sub.ID, 200, w, r)
+}
+
+// HandleAddWebhook creates a subscription, its secret is only ever returned here
+func HandleAddWebhook(w http.ResponseWriter, r *http.Request) {
+	sub, ok := decodeWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	sub, err := Webhooks.Add(sub)
+	if err != nil {
+		HandleAPIError(APILogTag, err.Error(), err, 400, w, r)
+		return
+	}
+	HandleAPIOK(sub, sub.ID, 201, w, r)
+}
+
+func HandleUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	sub, ok := decodeWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	sub.ID = mux.Vars(r)["id"]
+	sub, err := Webhooks.Update(sub)
+	if err == webhooks.ErrSubscriptionNotFound {
+		HandleAPIError(APILogTag, "Webhook not found", err, 404, w, r)
+		return
+	}
+	if err != nil {
+		HandleAPIError(APILogTag, err.Error(), err, 400, w, r)
+		return
+	}
+
+	sub.Secret = ""
+	HandleAPIOK(sub, sub.ID, 200, w, r)
+}
+
+func HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := Webhooks.Delete(vars["orgId"], vars["id"]); err != nil {
+		HandleAPIError(APILogTag, "Webhook not found", err, 404, w, r)
+		return
+	}
+	HandleAPIOK(map[string]string{}, vars["id"], 200, w, r)
+}
+
+func HandleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deliveries, err := Webhooks.Deliveries(vars["orgId"], vars["id"])
+	if err != nil {
+		HandleAPIError(APILogTag, "Webhook not found", err, 404, w, r)
+		return
+	}
+	HandleAPIOK(deliveries, vars["id"], 200, w, r)
+}
+
+// decodeWebhook reads a subscription from the body of a request, for the organisation in its URL
+func decodeWebhook(w http.ResponseWriter, r *http.Request) (webhooks.Subscription, bool) {
+	sub := webhooks.Subscription{}
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		HandleAPIError(APILogTag, "Failed to decode body data", err, 400, w, r)
+		return sub, false
+	}
+	sub.OrgID = mux.Vars(r)["orgId"]
+	return sub, true
+}
@@ -0,0 +1,242 @@
+/*
+Package audit records authentication and admin events, such as logins, issued tokens and changes to profiles, as a
+stream of JSON events kept apart from the logs of TIB.
+*/
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+)
+
+// SchemaVersion is the version of the Event schema, fields are only ever added to a version
+const SchemaVersion = 1
+
+// Event types
+const (
+	LoginSuccess   = "login.success"
+	LoginFailure   = "login.failure"
+	TokenIssued    = "token.issued"
+	TokenRevoked   = "token.revoked"
+	ProfileCreated = "profile.created"
+	ProfileUpdated = "profile.updated"
+	ProfileDeleted = "profile.deleted"
+)
+
+// Redacted replaces the values of details that hold secrets
+const Redacted = "[REDACTED]"
+
+var log = logger.Get()
+var auditLogTag = "AUDIT"
+var auditLogger = log.WithField("prefix", auditLogTag)
+
+// Event is a line of the audit log. Token and Actor are set to the secret they identify and only written as its
+// fingerprint, details whose name looks like a secret are redacted.
+type Event struct {
+	SchemaVersion int                    `json:"schema_version"`
+	Time          time.Time              `json:"time"`
+	Type          string                 `json:"type"`
+	OrgID         string                 `json:"org_id,omitempty"`
+	ProfileID     string                 `json:"profile_id,omitempty"`
+	Provider      string                 `json:"provider,omitempty"`
+	User          string                 `json:"user,omitempty"`
+	Token         string                 `json:"token,omitempty"`
+	Reason        string                 `json:"reason,omitempty"`
+	Actor         string                 `json:"actor,omitempty"`
+	RemoteAddr    string                 `json:"remote_addr,omitempty"`
+	Details       map[string]interface{} `json:"details,omitempty"`
+}
+
+// Sink writes the JSON lines of the audit log
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Settings configure the audit log
+type Settings struct {
+	Enabled bool
+	// Sink is where events are written, "file" (the default), "syslog" or "webhook"
+	Sink    string
+	File    FileSettings
+	Syslog  SyslogSettings
+	Webhook WebhookSettings
+	// FingerprintKey keys the fingerprints of tokens and admin keys, so that they can't be brute-forced from the log.
+	// Instances that write to the same log should share it, a random key is used when it is empty.
+	FingerprintKey string
+}
+
+var (
+	sinkLock  sync.RWMutex
+	sink      Sink
+	listeners []func(Event)
+)
+
+// Setup opens the sink of the audit log, events are dropped until it is called with the log enabled
+func Setup(settings Settings) error {
+	if settings.FingerprintKey != "" {
+		SetFingerprintKey([]byte(settings.FingerprintKey))
+	} else if settings.Enabled {
+		auditLogger.Warning("Audit.FingerprintKey is not set, fingerprints will change when TIB restarts")
+	}
+	if !settings.Enabled {
+		return nil
+	}
+
+	var s Sink
+	var err error
+	switch settings.Sink {
+	case "", "file":
+		s, err = NewFileSink(settings.File)
+	case "syslog":
+		s, err = NewSyslogSink(settings.Syslog)
+	case "webhook":
+		s, err = NewWebhookSink(settings.Webhook)
+	default:
+		return errors.New("unknown audit sink " + settings.Sink)
+	}
+	if err != nil {
+		return err
+	}
+
+	SetSink(s)
+	return nil
+}
+
+// SetSink replaces the sink of the audit log, the previous sink is closed
+func SetSink(s Sink) {
+	sinkLock.Lock()
+	previous := sink
+	sink = s
+	sinkLock.Unlock()
+
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			auditLogger.WithError(err).Error("closing audit sink")
+		}
+	}
+}
+
+// Subscribe calls listener with every event logged from now on, with its secrets already redacted. Listeners are
+// called whether or not the audit log is enabled, and must not block.
+func Subscribe(listener func(Event)) {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	listeners = append(listeners, listener)
+}
+
+// Close flushes and closes the sink of the audit log
+func Close() {
+	SetSink(nil)
+}
+
+// Log writes event to the audit log, r is the request that caused the event if there is one
+func Log(r *http.Request, event Event) {
+	sinkLock.RLock()
+	defer sinkLock.RUnlock()
+	if sink == nil && len(listeners) == 0 {
+		return
+	}
+
+	event.SchemaVersion = SchemaVersion
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if r != nil && event.RemoteAddr == "" {
+		event.RemoteAddr = r.RemoteAddr
+	}
+	event.Token = Fingerprint(event.Token)
+	event.Actor = Fingerprint(event.Actor)
+	event.Details = redact(event.Details)
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+	if sink == nil {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		auditLogger.WithError(err).Error("encoding audit event")
+		return
+	}
+	if err := sink.Write(append(line, '\n')); err != nil {
+		auditLogger.WithError(err).WithField("event", event.Type).Error("writing audit event")
+	}
+}
+
+var (
+	fingerprintLock sync.RWMutex
+	fingerprintKey  = randomFingerprintKey()
+)
+
+func randomFingerprintKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// SetFingerprintKey sets the key of the fingerprints
+func SetFingerprintKey(key []byte) {
+	fingerprintLock.Lock()
+	defer fingerprintLock.Unlock()
+	fingerprintKey = key
+}
+
+// Fingerprint identifies a secret without revealing it, the same secret always has the same fingerprint under the
+// same key. It is an HMAC, so that a weak secret can't be guessed from it without the key.
+func Fingerprint(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	fingerprintLock.RLock()
+	mac := hmac.New(sha256.New, fingerprintKey)
+	fingerprintLock.RUnlock()
+	mac.Write([]byte(secret)) //nolint:errcheck
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// secretNames are parts of the names of details that hold secrets
+var secretNames = []string{"password", "secret", "token", "key", "authorization", "cookie", "assertion", "samlresponse"}
+
+func redact(details map[string]interface{}) map[string]interface{} {
+	if len(details) == 0 {
+		return nil
+	}
+
+	redacted := make(map[string]interface{}, len(details))
+	for name, value := range details {
+		if isSecret(name) {
+			redacted[name] = Redacted
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = redact(nested)
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secretNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
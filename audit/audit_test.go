@@ -0,0 +1,142 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memorySink struct {
+	lines  []string
+	closed bool
+}
+
+func (m *memorySink) Write(line []byte) error {
+	m.lines = append(m.lines, string(line))
+	return nil
+}
+
+func (m *memorySink) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestLog(t *testing.T) {
+	Log(nil, Event{Type: LoginSuccess})
+
+	sink := &memorySink{}
+	SetSink(sink)
+	defer Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/profiles/1", nil)
+	Log(r, Event{
+		Type:      ProfileCreated,
+		ProfileID: "1",
+		Actor:     "admin-secret",
+		Token:     "issued-key",
+		Details: map[string]interface{}{
+			"base_api_id":   "api",
+			"client_secret": "shh",
+			"upstream":      map[string]interface{}{"Authorization": "Bearer abc", "host": "idp"},
+		},
+	})
+	require.Len(t, sink.lines, 1)
+	assert.True(t, strings.HasSuffix(sink.lines[0], "\n"))
+	assert.NotContains(t, sink.lines[0], "admin-secret")
+	assert.NotContains(t, sink.lines[0], "issued-key")
+	assert.NotContains(t, sink.lines[0], "shh")
+	assert.NotContains(t, sink.lines[0], "Bearer abc")
+
+	event := Event{}
+	require.NoError(t, json.Unmarshal([]byte(sink.lines[0]), &event))
+	assert.Equal(t, SchemaVersion, event.SchemaVersion)
+	assert.Equal(t, ProfileCreated, event.Type)
+	assert.False(t, event.Time.IsZero())
+	assert.Equal(t, r.RemoteAddr, event.RemoteAddr)
+	assert.Equal(t, Fingerprint("admin-secret"), event.Actor)
+	assert.Equal(t, Fingerprint("issued-key"), event.Token)
+	assert.Equal(t, "api", event.Details["base_api_id"])
+	assert.Equal(t, Redacted, event.Details["client_secret"])
+	assert.Equal(t, map[string]interface{}{"Authorization": Redacted, "host": "idp"}, event.Details["upstream"])
+
+	SetSink(&memorySink{})
+	assert.True(t, sink.closed)
+}
+
+func TestFingerprint(t *testing.T) {
+	assert.Equal(t, "", Fingerprint(""))
+	assert.Equal(t, Fingerprint("key"), Fingerprint("key"))
+	assert.NotEqual(t, Fingerprint("key"), Fingerprint("other-key"))
+	assert.True(t, strings.HasPrefix(Fingerprint("key"), "hmac-sha256:"))
+
+	// fingerprints depend on the key, so weak secrets can't be looked up without it
+	defer SetFingerprintKey(randomFingerprintKey())
+	assert.NoError(t, Setup(Settings{FingerprintKey: "key-1"}))
+	first := Fingerprint("admin")
+	SetFingerprintKey([]byte("key-2"))
+	assert.NotEqual(t, first, Fingerprint("admin"))
+	SetFingerprintKey([]byte("key-1"))
+	assert.Equal(t, first, Fingerprint("admin"))
+}
+
+func TestSetup(t *testing.T) {
+	assert.NoError(t, Setup(Settings{Sink: "unknown"}))
+	assert.Error(t, Setup(Settings{Enabled: true, Sink: "unknown"}))
+	assert.Error(t, Setup(Settings{Enabled: true}))
+	assert.Error(t, Setup(Settings{Enabled: true, Sink: "webhook"}))
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, Setup(Settings{Enabled: true, File: FileSettings{Path: path}}))
+	Log(nil, Event{Type: LoginFailure, Reason: "access_denied"})
+	Log(nil, Event{Type: LoginSuccess, User: "user@example.com"})
+	Close()
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"reason":"access_denied"`)
+	assert.Contains(t, lines[1], `"user":"user@example.com"`)
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "siem", r.Header.Get("X-Source"))
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookSink(WebhookSettings{URL: server.URL, Headers: map[string]string{"X-Source": "siem"}})
+	require.NoError(t, err)
+	SetSink(sink)
+	Log(nil, Event{Type: TokenRevoked, Token: "key", Reason: "revoked"})
+	Close()
+
+	require.Len(t, received, 1)
+	event := Event{}
+	require.NoError(t, json.Unmarshal([]byte(<-received), &event))
+	assert.Equal(t, TokenRevoked, event.Type)
+	assert.Equal(t, Fingerprint("key"), event.Token)
+}
+
+func TestSubscribe(t *testing.T) {
+	received := []Event{}
+	Subscribe(func(event Event) { received = append(received, event) })
+
+	// listeners get events while the audit log is disabled
+	Log(nil, Event{Type: TokenIssued, Token: "issued-key"})
+	require.Len(t, received, 1)
+	assert.Equal(t, Fingerprint("issued-key"), received[0].Token)
+	assert.Equal(t, SchemaVersion, received[0].SchemaVersion)
+}
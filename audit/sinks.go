@@ -0,0 +1,169 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"log/syslog"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// FileSettings configure the file sink, the file is rotated once it reaches MaxSize megabytes
+type FileSettings struct {
+	Path string
+	// MaxSize is the size in megabytes of the file before it is rotated, 100 by default
+	MaxSize int
+	// MaxBackups is the number of rotated files kept, all of them by default
+	MaxBackups int
+	// MaxAge is the number of days rotated files are kept, they are kept forever by default
+	MaxAge   int
+	Compress bool
+}
+
+// SyslogSettings configure the syslog sink, events go to the local syslog when Address is empty
+type SyslogSettings struct {
+	Network string
+	Address string
+	Tag     string
+}
+
+// WebhookSettings configure the webhook sink, each event is POSTed to URL as JSON
+type WebhookSettings struct {
+	URL     string
+	Headers map[string]string
+	// Timeout is the timeout in seconds of a delivery, 5 by default
+	Timeout int
+	// QueueSize is the number of events waiting to be delivered before new events are dropped, 1000 by default
+	QueueSize int
+}
+
+// NewFileSink returns a sink that appends events to a file and rotates it
+func NewFileSink(settings FileSettings) (Sink, error) {
+	if settings.Path == "" {
+		return nil, errors.New("the audit log file needs a path")
+	}
+	return &fileSink{logger: &lumberjack.Logger{
+		Filename:   settings.Path,
+		MaxSize:    settings.MaxSize,
+		MaxBackups: settings.MaxBackups,
+		MaxAge:     settings.MaxAge,
+		Compress:   settings.Compress,
+	}}, nil
+}
+
+type fileSink struct {
+	logger *lumberjack.Logger
+}
+
+func (f *fileSink) Write(line []byte) error {
+	_, err := f.logger.Write(line)
+	return err
+}
+
+func (f *fileSink) Close() error {
+	return f.logger.Close()
+}
+
+// NewSyslogSink returns a sink that sends events to syslog with the auth facility
+func NewSyslogSink(settings SyslogSettings) (Sink, error) {
+	tag := settings.Tag
+	if tag == "" {
+		tag = "tyk-identity-broker"
+	}
+	writer, err := syslog.Dial(settings.Network, settings.Address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	return s.writer.Info(string(bytes.TrimSuffix(line, []byte("\n"))))
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
+
+// NewWebhookSink returns a sink that POSTs events to a URL. Events are delivered in the background so that logins
+// don't wait on the webhook, and are dropped when it can't keep up.
+func NewWebhookSink(settings WebhookSettings) (Sink, error) {
+	if settings.URL == "" {
+		return nil, errors.New("the audit webhook needs a URL")
+	}
+	if settings.Timeout == 0 {
+		settings.Timeout = 5
+	}
+	if settings.QueueSize == 0 {
+		settings.QueueSize = 1000
+	}
+
+	w := &webhookSink{
+		settings: settings,
+		client:   &http.Client{Timeout: time.Duration(settings.Timeout) * time.Second},
+		queue:    make(chan []byte, settings.QueueSize),
+	}
+	w.done.Add(1)
+	go w.deliver()
+	return w, nil
+}
+
+type webhookSink struct {
+	settings WebhookSettings
+	client   *http.Client
+	queue    chan []byte
+	done     sync.WaitGroup
+}
+
+func (w *webhookSink) Write(line []byte) error {
+	select {
+	case w.queue <- line:
+		return nil
+	default:
+		return errors.New("audit webhook queue is full, event dropped")
+	}
+}
+
+// Close delivers the events still queued
+func (w *webhookSink) Close() error {
+	close(w.queue)
+	w.done.Wait()
+	return nil
+}
+
+func (w *webhookSink) deliver() {
+	defer w.done.Done()
+	for line := range w.queue {
+		if err := w.post(line); err != nil {
+			auditLogger.WithError(err).Error("delivering audit event to webhook")
+		}
+	}
+}
+
+func (w *webhookSink) post(line []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.settings.URL, bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.settings.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return errors.New("audit webhook responded " + resp.Status)
+	}
+	return nil
+}
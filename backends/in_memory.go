@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/TykTechnologies/tyk-identity-broker/log"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
@@ -81,6 +82,40 @@ func (m *InMemoryBackend) GetKey(key string, orgId string, target interface{}) e
 	return nil
 }
 
+// SetKeyIfNotExist sets the value of a key in the map unless it is already set, keys kept in memory do not expire
+func (m *InMemoryBackend) SetKeyIfNotExist(key string, orgId string, val interface{}, ttl time.Duration) (bool, error) {
+	if m.kv == nil {
+		return false, errors.New("store not initialised!")
+	}
+
+	asByte, encErr := json.Marshal(val)
+	if encErr != nil {
+		return false, encErr
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.kv[key]; ok {
+		return false, nil
+	}
+	m.kv[key] = asByte
+	return true, nil
+}
+
+// ConsumeKey returns the value of a key and removes it from the map
+func (m *InMemoryBackend) ConsumeKey(key string, orgId string, target interface{}) error {
+	m.lock.Lock()
+	v, ok := m.kv[key]
+	delete(m.kv, key)
+	m.lock.Unlock()
+
+	if !ok {
+		return errors.New("not found")
+	}
+
+	return json.Unmarshal(v.([]byte), target)
+}
+
 func (m *InMemoryBackend) GetAll(orgId string) []interface{} {
 
 	m.lock.RLock()
@@ -32,3 +32,25 @@ func TestInMemoryBackend_GetAndSetKey(t *testing.T) {
 		t.Error("Expected 'Test' as key val, got: ", target.Thing)
 	}
 }
+
+func TestInMemoryBackend_ConsumeKey(t *testing.T) {
+	backend := &InMemoryBackend{}
+	backend.Init(nil)
+
+	set, err := backend.SetKeyIfNotExist("code", "", "first", 0)
+	if err != nil || !set {
+		t.Fatal("Expected the key to be set, got: ", set, err)
+	}
+	set, _ = backend.SetKeyIfNotExist("code", "", "second", 0)
+	if set {
+		t.Error("Expected a key that exists not to be set again")
+	}
+
+	value := ""
+	if err := backend.ConsumeKey("code", "", &value); err != nil || value != "first" {
+		t.Error("Expected to consume 'first', got: ", value, err)
+	}
+	if err := backend.ConsumeKey("code", "", &value); err == nil {
+		t.Error("Expected a consumed key to be gone")
+	}
+}
@@ -3,18 +3,26 @@ package backends
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/TykTechnologies/tyk-identity-broker/configuration"
 
 	"github.com/TykTechnologies/storage/temporal/connector"
 	temporal "github.com/TykTechnologies/storage/temporal/keyvalue"
 	"github.com/TykTechnologies/storage/temporal/model"
+	"github.com/TykTechnologies/storage/temporal/set"
 
 	"github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var redisLoggerTag = "TIB REDIS STORE"
@@ -29,9 +37,14 @@ type RedisConfig configuration.IdentityBackendSettings
 
 type RedisBackend struct {
 	kv        temporal.KeyValue
+	sets      set.Set
 	config    *RedisConfig
 	HashKeys  bool
 	KeyPrefix string
+	// client runs the commands the storage library has no call for, such as the scripts of schedules
+	client redis.UniversalClient
+	// reqCtx is the context of the request the backend is used for, its commands are traced as part of it
+	reqCtx context.Context
 }
 
 type KeyError struct{}
@@ -81,6 +94,16 @@ func (r *RedisBackend) Connect() error {
 		return err
 	}
 
+	r.sets, err = set.NewSet(connector)
+	if err != nil {
+		redisLogger.WithError(err).Error("creating set store")
+		return err
+	}
+
+	if !connector.As(&r.client) {
+		redisLogger.Warning("schedules are not supported by this connection")
+	}
+
 	return nil
 }
 
@@ -125,18 +148,20 @@ func toJSONString(val interface{}) (string, error) {
 }
 
 func (r *RedisBackend) SetKey(key string, orgId string, val interface{}) error {
-	var err error
-	strVal, ok := val.(string)
-	if !ok {
-		// Handle the case where val is not a string. Convert it via json marshaller
-		strVal, err = toJSONString(val)
-		if err != nil {
-			redisLogger.WithError(err).Error("cannot store interface in redis")
-			return err
-		}
+	return r.SetKeyWithTTL(key, orgId, val, 0)
+}
+
+// SetKeyWithTTL sets a key that Redis expires after ttl, a ttl of 0 keeps the key until it is deleted
+func (r *RedisBackend) SetKeyWithTTL(key string, orgId string, val interface{}, ttl time.Duration) error {
+	strVal, err := encode(val)
+	if err != nil {
+		return err
 	}
 
-	if err = r.kv.Set(ctx, r.fixKey(key), strVal, 0); err != nil {
+	spanCtx, span := r.startSpan("SET")
+	err = r.kv.Set(spanCtx, r.fixKey(key), strVal, ttl)
+	tracing.End(span, err)
+	if err != nil {
 		redisLogger.WithError(err).Debug("Error trying to set value")
 		return err
 	}
@@ -144,14 +169,77 @@ func (r *RedisBackend) SetKey(key string, orgId string, val interface{}) error {
 	return nil
 }
 
+// SetKeyIfNotExist sets a key that Redis expires after ttl unless the key is already set, and reports whether it was
+// set
+func (r *RedisBackend) SetKeyIfNotExist(key string, orgId string, val interface{}, ttl time.Duration) (bool, error) {
+	strVal, err := encode(val)
+	if err != nil {
+		return false, err
+	}
+
+	spanCtx, span := r.startSpan("SETNX")
+	set, err := r.kv.SetIfNotExist(spanCtx, r.fixKey(key), strVal, ttl)
+	tracing.End(span, err)
+	return set, err
+}
+
 func (r *RedisBackend) GetKey(key string, orgId string, val interface{}) error {
-	result, err := r.kv.Get(ctx, r.fixKey(key))
+	spanCtx, span := r.startSpan("GET")
+	result, err := r.kv.Get(spanCtx, r.fixKey(key))
+	tracing.End(span, err)
 	if err != nil {
 		return err
 	}
 
+	return decode(result, val)
+}
+
+// ConsumeKey gets a key and deletes it. Only the caller whose delete removed the key gets its value, so a key is
+// consumed once even when several instances consume it at the same time.
+func (r *RedisBackend) ConsumeKey(key string, orgId string, val interface{}) error {
+	spanCtx, span := r.startSpan("GET")
+	result, err := r.kv.Get(spanCtx, r.fixKey(key))
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+
+	spanCtx, span = r.startSpan("DEL")
+	deleted, err := r.kv.DeleteKeys(spanCtx, []string{r.fixKey(key)})
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return KeyError{}
+	}
+
+	return decode(result, val)
+}
+
+// encode returns the value stored for val, strings are stored as they are and other values as json
+func encode(val interface{}) (string, error) {
+	if strVal, ok := val.(string); ok {
+		return strVal, nil
+	}
+
+	strVal, err := toJSONString(val)
+	if err != nil {
+		redisLogger.WithError(err).Error("cannot store interface in redis")
+	}
+	return strVal, err
+}
+
+// decode unmarshals a stored value into val
+func decode(result string, val interface{}) error {
 	// if AuthConfigStore is redis adapter, then redis return string
-	if err = json.Unmarshal([]byte(result), &val); err != nil {
+	err := json.Unmarshal([]byte(result), &val)
+	if err != nil {
+		// SetKey stores plain strings as they are, so they are not valid json
+		if strVal, ok := val.(*string); ok {
+			*strVal = result
+			return nil
+		}
 		redisLogger.WithError(err).Error("unmarshalling redis result into interface")
 	}
 
@@ -160,7 +248,9 @@ func (r *RedisBackend) GetKey(key string, orgId string, val interface{}) error {
 
 // GetKeys will return all keys according to the filter (filter is a prefix - e.g. tyk.keys.*)
 func (r *RedisBackend) GetKeys(filter string) []string {
-	keys, err := r.kv.Keys(ctx, filter)
+	spanCtx, span := r.startSpan("KEYS")
+	keys, err := r.kv.Keys(spanCtx, filter)
+	tracing.End(span, err)
 	if err != nil {
 		redisLogger.WithError(err).Error("getting keys")
 	}
@@ -173,7 +263,9 @@ func (r *RedisBackend) GetKeys(filter string) []string {
 
 func (r *RedisBackend) GetAll(orgId string) []interface{} {
 
-	keys, err := r.kv.Keys(ctx, r.KeyPrefix)
+	spanCtx, span := r.startSpan("KEYS")
+	keys, err := r.kv.Keys(spanCtx, r.KeyPrefix)
+	tracing.End(span, err)
 	if err != nil {
 		redisLogger.WithError(err).Error("retrieving keys from redis")
 		return nil
@@ -204,7 +296,144 @@ func (r *RedisBackend) cleanKey(keyName string) string {
 }
 
 func (r *RedisBackend) DeleteKey(key string, orgId string) error {
-	return r.kv.Delete(ctx, r.fixKey(key))
+	spanCtx, span := r.startSpan("DEL")
+	err := r.kv.Delete(spanCtx, r.fixKey(key))
+	tracing.End(span, err)
+	return err
+}
+
+// AddMember adds member to the set at key and makes the set expire after ttl, a ttl of 0 leaves its expiry as it is
+func (r *RedisBackend) AddMember(key string, orgId string, member string, ttl time.Duration) error {
+	if r.sets == nil {
+		return errors.New("sets are not supported by this connection")
+	}
+	spanCtx, span := r.startSpan("SADD")
+	err := r.sets.AddMember(spanCtx, r.fixKey(key), member)
+	tracing.End(span, err)
+	if err != nil || ttl <= 0 {
+		return err
+	}
+
+	spanCtx, span = r.startSpan("EXPIRE")
+	err = r.kv.Expire(spanCtx, r.fixKey(key), ttl)
+	tracing.End(span, err)
+	return err
+}
+
+// Members returns the members of the set at key
+func (r *RedisBackend) Members(key string, orgId string) ([]string, error) {
+	if r.sets == nil {
+		return nil, errors.New("sets are not supported by this connection")
+	}
+	spanCtx, span := r.startSpan("SMEMBERS")
+	members, err := r.sets.Members(spanCtx, r.fixKey(key))
+	tracing.End(span, err)
+	return members, err
+}
+
+// RemoveMember removes member from the set at key
+func (r *RedisBackend) RemoveMember(key string, orgId string, member string) error {
+	if r.sets == nil {
+		return errors.New("sets are not supported by this connection")
+	}
+	spanCtx, span := r.startSpan("SREM")
+	err := r.sets.RemoveMember(spanCtx, r.fixKey(key), member)
+	tracing.End(span, err)
+	return err
+}
+
+// PushCapped adds value to the head of the list at key and trims the list to its first size values, in one
+// transaction
+func (r *RedisBackend) PushCapped(key string, orgId string, value []byte, size int64) error {
+	if r.client == nil {
+		return errors.New("lists are not supported by this connection")
+	}
+	spanCtx, span := r.startSpan("LPUSH")
+	_, err := r.client.TxPipelined(spanCtx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(spanCtx, r.fixKey(key), value)
+		pipe.LTrim(spanCtx, r.fixKey(key), 0, size-1)
+		return nil
+	})
+	tracing.End(span, err)
+	return err
+}
+
+// Range returns the values of the list at key, head first
+func (r *RedisBackend) Range(key string, orgId string) ([]string, error) {
+	if r.client == nil {
+		return nil, errors.New("lists are not supported by this connection")
+	}
+	spanCtx, span := r.startSpan("LRANGE")
+	values, err := r.client.LRange(spanCtx, r.fixKey(key), 0, -1).Result()
+	tracing.End(span, err)
+	return values, err
+}
+
+// claimScript reschedules the members of a schedule that are due at the end of their lease and returns them, as one
+// command so that two instances never claim the same member
+var claimScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for _, member in ipairs(due) do
+	redis.call("ZADD", KEYS[1], ARGV[3], member)
+end
+return due
+`)
+
+// Schedule adds member to a schedule, or moves it, so that it is due at the given time
+func (r *RedisBackend) Schedule(schedule string, member string, at time.Time) error {
+	if r.client == nil {
+		return errors.New("schedules are not supported by this connection")
+	}
+	spanCtx, span := r.startSpan("ZADD")
+	err := r.client.ZAdd(spanCtx, r.fixKey(schedule), redis.Z{Score: float64(at.UnixMilli()), Member: member}).Err()
+	tracing.End(span, err)
+	return err
+}
+
+// Claim returns up to count members of a schedule that are due at now, and reschedules them at the end of lease
+func (r *RedisBackend) Claim(schedule string, now time.Time, count int64, lease time.Duration) ([]string, error) {
+	if r.client == nil {
+		return nil, errors.New("schedules are not supported by this connection")
+	}
+	spanCtx, span := r.startSpan("EVALSHA")
+	members, err := claimScript.Run(spanCtx, r.client, []string{r.fixKey(schedule)}, now.UnixMilli(), count, now.Add(lease).UnixMilli()).StringSlice()
+	tracing.End(span, err)
+	return members, err
+}
+
+// Unschedule removes member from a schedule
+func (r *RedisBackend) Unschedule(schedule string, member string) error {
+	if r.client == nil {
+		return errors.New("schedules are not supported by this connection")
+	}
+	spanCtx, span := r.startSpan("ZREM")
+	err := r.client.ZRem(spanCtx, r.fixKey(schedule), member).Err()
+	tracing.End(span, err)
+	return err
+}
+
+// WithContext returns a copy of the backend whose commands are traced as part of ctx
+func (r *RedisBackend) WithContext(ctx context.Context) tap.AuthRegisterBackend {
+	bound := *r
+	bound.reqCtx = ctx
+	return &bound
+}
+
+func (r *RedisBackend) startSpan(command string) (context.Context, trace.Span) {
+	parent := r.reqCtx
+	if parent == nil {
+		parent = ctx
+	}
+	return tracing.Start(parent, "redis "+command, attribute.String("db.system", "redis"), attribute.String("db.operation", command))
+}
+
+// Ping checks that Redis can be reached
+func (r *RedisBackend) Ping() error {
+	if r.kv == nil {
+		return errors.New("not connected")
+	}
+	_, err := r.kv.Exists(ctx, r.fixKey("ping"))
+	return err
 }
 
 func (r *RedisBackend) fixKey(keyName string) string {
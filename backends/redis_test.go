@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"testing"
@@ -9,8 +10,15 @@ import (
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
 
 	mocks "github.com/TykTechnologies/storage/temporal/tempmocks"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func mockRedisBackend(t *testing.T) (*RedisBackend, *mocks.KeyValue) {
@@ -205,6 +213,19 @@ func TestRedis_SetKey(t *testing.T) {
 	testObj.AssertExpectations(t)
 }
 
+func TestRedis_SetKeyWithTTL(t *testing.T) {
+	rb, testObj := mockRedisBackend(t)
+
+	keyName := "key"
+	value := "test-val"
+	ttl := 10 * time.Minute
+
+	testObj.On("Set", mock.Anything, rb.KeyPrefix+keyName, value, ttl).Return(nil)
+	err := tap.SetKeyWithTTL(rb, keyName, "", value, ttl)
+	assert.Nil(t, err)
+	testObj.AssertExpectations(t)
+}
+
 func TestRedis_GetKey(t *testing.T) {
 	// Setting up mocks
 	rb, testObj := mockRedisBackend(t)
@@ -239,6 +260,27 @@ func TestRedis_GetKey(t *testing.T) {
 	testObj.AssertExpectations(t)
 }
 
+func TestRedis_GetKeyPlainString(t *testing.T) {
+	rb, testObj := mockRedisBackend(t)
+
+	keyName := "key"
+	value := "some-token"
+	var ttl time.Duration
+
+	testObj.On("Set", mock.Anything, rb.KeyPrefix+keyName, value, ttl).Return(nil)
+	testObj.On("Get", mock.Anything, rb.KeyPrefix+keyName).Return(value, nil)
+
+	err := rb.SetKey(keyName, "", value)
+	assert.Nil(t, err)
+
+	newVal := ""
+	err = rb.GetKey(keyName, "", &newVal)
+	assert.Nil(t, err)
+	assert.Equal(t, value, newVal)
+
+	testObj.AssertExpectations(t)
+}
+
 func TestRedis_DeleteKey(t *testing.T) {
 	rb, testObj := mockRedisBackend(t)
 	key := "keyName"
@@ -251,6 +293,66 @@ func TestRedis_DeleteKey(t *testing.T) {
 	testObj.AssertExpectations(t)
 }
 
+func TestRedis_SetKeyIfNotExist(t *testing.T) {
+	rb, testObj := mockRedisBackend(t)
+	ttl := time.Minute
+
+	testObj.On("SetIfNotExist", mock.Anything, rb.KeyPrefix+"claimed", "value", ttl).Return(false, nil)
+	testObj.On("SetIfNotExist", mock.Anything, rb.KeyPrefix+"free", "value", ttl).Return(true, nil)
+
+	set, err := tap.SetKeyIfNotExist(rb, "claimed", "", "value", ttl)
+	assert.NoError(t, err)
+	assert.False(t, set)
+	set, err = tap.SetKeyIfNotExist(rb, "free", "", "value", ttl)
+	assert.NoError(t, err)
+	assert.True(t, set)
+}
+
+func TestRedis_ConsumeKey(t *testing.T) {
+	rb, testObj := mockRedisBackend(t)
+
+	testObj.On("Get", mock.Anything, rb.KeyPrefix+"code").Return(`{"ID":"some-profile"}`, nil)
+	testObj.On("DeleteKeys", mock.Anything, []string{rb.KeyPrefix + "code"}).Return(int64(1), nil).Once()
+
+	profile := tap.Profile{}
+	assert.NoError(t, tap.ConsumeKey(rb, "code", "", &profile))
+	assert.Equal(t, "some-profile", profile.ID)
+
+	// another instance deleted the key between the get and the delete
+	testObj.On("DeleteKeys", mock.Anything, []string{rb.KeyPrefix + "code"}).Return(int64(0), nil).Once()
+	assert.Equal(t, KeyError{}, rb.ConsumeKey("code", "", &profile))
+}
+
+func TestRedis_WithContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	rb, testObj := mockRedisBackend(t)
+	testObj.On("Get", mock.Anything, rb.KeyPrefix+"key").Return("some-token", nil)
+	testObj.On("Delete", mock.Anything, rb.KeyPrefix+"key").Return(errors.New("connection refused"))
+
+	ctx, request := otel.Tracer("test").Start(context.Background(), "request")
+	bound := tap.WithContext(ctx, rb)
+	value := ""
+	assert.NoError(t, bound.GetKey("key", "", &value))
+	assert.Error(t, bound.DeleteKey("key", ""))
+	request.End()
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 3) {
+		assert.Equal(t, "redis GET", spans[0].Name)
+		assert.Equal(t, "redis DEL", spans[1].Name)
+		assert.Equal(t, codes.Error, spans[1].Status.Code)
+		for _, span := range spans[:2] {
+			assert.Equal(t, request.SpanContext().SpanID(), span.Parent.SpanID())
+		}
+	}
+
+	// the backend itself is left unbound
+	assert.Nil(t, rb.reqCtx)
+}
+
 func TestRedis_GetAll(t *testing.T) {
 	rb, testObj := mockRedisBackend(t)
 
@@ -296,3 +398,64 @@ func TestToJSONString(t *testing.T) {
 		}
 	}
 }
+
+func TestRedis_Schedule(t *testing.T) {
+	rb, _ := mockRedisBackend(t)
+	_, err := rb.Claim("schedule", time.Now(), 1, time.Second)
+	assert.Error(t, err)
+
+	client, redisMock := redismock.NewClientMock()
+	rb.client = client
+	now := time.UnixMilli(1760000000000)
+	redisMock.ExpectZAdd(rb.KeyPrefix+"schedule", redis.Z{Score: float64(now.UnixMilli()), Member: "first"}).SetVal(1)
+	redisMock.ExpectEvalSha(claimScript.Hash(), []string{rb.KeyPrefix + "schedule"}, now.UnixMilli(), int64(10), now.Add(time.Minute).UnixMilli()).
+		SetVal([]interface{}{"first"})
+	redisMock.ExpectZRem(rb.KeyPrefix+"schedule", "first").SetVal(1)
+
+	var schedule tap.ScheduleBackend = rb
+	assert.NoError(t, schedule.Schedule("schedule", "first", now))
+	members, err := schedule.Claim("schedule", now, 10, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first"}, members)
+	assert.NoError(t, schedule.Unschedule("schedule", "first"))
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestRedis_Lists(t *testing.T) {
+	rb, _ := mockRedisBackend(t)
+	assert.Error(t, rb.PushCapped("log", "", []byte("first"), 2))
+
+	client, redisMock := redismock.NewClientMock()
+	rb.client = client
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectLPush(rb.KeyPrefix+"log", []byte("second")).SetVal(2)
+	redisMock.ExpectLTrim(rb.KeyPrefix+"log", 0, 1).SetVal("OK")
+	redisMock.ExpectTxPipelineExec()
+	redisMock.ExpectLRange(rb.KeyPrefix+"log", 0, -1).SetVal([]string{"second", "first"})
+
+	var lists tap.ListBackend = rb
+	assert.NoError(t, lists.PushCapped("log", "", []byte("second"), 2))
+	values, err := lists.Range("log", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"second", "first"}, values)
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestRedis_Sets(t *testing.T) {
+	rb, testObj := mockRedisBackend(t)
+	_, err := rb.Members("set", "")
+	assert.Error(t, err)
+
+	sets := mocks.NewSet(t)
+	rb.sets = sets
+	sets.On("AddMember", mock.Anything, rb.KeyPrefix+"set", "first").Return(nil)
+	sets.On("AddMember", mock.Anything, rb.KeyPrefix+"set", "second").Return(nil)
+	sets.On("Members", mock.Anything, rb.KeyPrefix+"set").Return([]string{"first", "second"}, nil)
+	sets.On("RemoveMember", mock.Anything, rb.KeyPrefix+"set", "first").Return(nil)
+	testObj.On("Expire", mock.Anything, rb.KeyPrefix+"set", time.Hour).Return(nil).Once()
+
+	assert.NoError(t, tap.AddMember(rb, "set", "", "first", 0))
+	assert.NoError(t, tap.AddMember(rb, "set", "", "second", time.Hour))
+	assert.Equal(t, []string{"first", "second"}, tap.Members(rb, "set", ""))
+	assert.NoError(t, tap.RemoveMember(rb, "set", "", "first"))
+}
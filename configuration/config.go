@@ -6,14 +6,18 @@ import (
 	"os"
 	"strings"
 
+	otelconfig "github.com/TykTechnologies/opentelemetry/config"
 	"github.com/TykTechnologies/storage/persistent"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/sirupsen/logrus"
 
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
 	"github.com/TykTechnologies/tyk-identity-broker/tothic"
 	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+	"github.com/TykTechnologies/tyk-identity-broker/webhooks"
 )
 
 var failCount int
@@ -87,9 +91,11 @@ type Backend struct {
 
 // Configuration holds all configuration settings for TAP
 type Configuration struct {
-	Secret            string
-	Port              int
-	ProfileDir        string
+	Secret     string
+	Port       int
+	ProfileDir string
+	// TemplateDir holds the template files profiles use to replace the built-in pages, it defaults to ./templates
+	TemplateDir       string
 	BackEnd           Backend
 	TykAPISettings    tyk.TykAPI
 	HttpServerOptions struct {
@@ -100,6 +106,12 @@ type Configuration struct {
 	}
 	SSLInsecureSkipVerify bool
 	Storage               *Storage
+	Session               tothic.SessionSettings
+	Metrics               metrics.Settings
+	OpenTelemetry         otelconfig.OpenTelemetry
+	Audit                 audit.Settings
+	Webhooks              webhooks.Settings
+	Log                   logger.Settings
 }
 
 // LoadConfig will load the config from a file
@@ -132,10 +144,11 @@ func LoadConfig(filePath string, conf *Configuration) {
 	if err = envconfig.Process(tothic.EnvPrefix, conf); err != nil {
 		mainLogger.Errorf("Failed to process config env vars: %v", err)
 	}
+	logger.Configure(conf.Log)
 
 	mainLogger.Debugf("\nConfig Loaded: %+v \n", conf)
 	mainLogger.Debugf("\n Storage conf: %+v \n", conf.Storage)
-	mainLogger.Debug("Settings Struct: ", conf.TykAPISettings)
+	mainLogger.Debugf("Settings Struct: %+v", conf.TykAPISettings)
 }
 
 // GetMongoDriver returns a valid mongo driver to use, it receives the
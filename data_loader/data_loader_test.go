@@ -2,6 +2,7 @@ package data_loader
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/TykTechnologies/storage/persistent"
@@ -9,6 +10,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/TykTechnologies/tyk-identity-broker/configuration"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
 )
 
 func TestCreateDataMongoLoader(t *testing.T) {
@@ -63,6 +65,27 @@ func TestFlush(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestFileLoaderSkipsInvalidProfiles(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "profiles.json")
+	assert.NoError(t, os.WriteFile(fileName, []byte(`[
+		{"ID": "relative", "ReturnURL": "/portal/sso", "ProviderConfig": {"FailureRedirect": "/?fail=true"}},
+		{"ID": "script", "ReturnURL": "javascript:alert(1)"},
+		{"ID": "template", "LoginForm": {"Template": "/etc/passwd"}}
+	]`), 0600))
+
+	loader := FileLoader{}
+	assert.NoError(t, loader.Init(configuration.FileLoaderConf{FileName: fileName}))
+
+	store := &backends.InMemoryBackend{}
+	store.Init(nil)
+	assert.NoError(t, loader.LoadIntoStore(store))
+
+	profile := tap.Profile{}
+	assert.NoError(t, store.GetKey("relative", "", &profile))
+	assert.Error(t, store.GetKey("script", "", &profile))
+	assert.Error(t, store.GetKey("template", "", &profile))
+}
+
 func isMongoEnv() bool {
 	storageType := os.Getenv("TYK_IB_STORAGE_STORAGETYPE")
 
@@ -44,6 +44,10 @@ func (f *FileLoader) LoadIntoStore(store tap.AuthRegisterBackend) error {
 
 	var loaded int
 	for _, profile := range profiles {
+		if vErr := profile.Validate(); vErr != nil {
+			dataLogger.WithField("profile", profile.ID).WithError(vErr).Error("Skipping invalid profile")
+			continue
+		}
 		inputErr := store.SetKey(profile.ID, profile.OrgID, profile)
 		if inputErr != nil {
 			dataLogger.WithField("error", inputErr).Error("Couldn't encode configuration")
@@ -59,6 +59,10 @@ func (m *MongoLoader) LoadIntoStore(store tap.AuthRegisterBackend) error {
 	}
 
 	for _, profile := range profiles {
+		if vErr := profile.Validate(); vErr != nil {
+			dataLogger.WithField("profile", profile.ID).WithError(vErr).Error("Skipping invalid profile")
+			continue
+		}
 		inputErr := store.SetKey(profile.ID, profile.OrgID, profile)
 		if inputErr != nil {
 			dataLogger.WithField("error", inputErr).Error("Couldn't encode configuration")
@@ -0,0 +1,174 @@
+package deprovisioning
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// scimPageSize is the number of users requested per page from a SCIM service provider
+const scimPageSize = 100
+
+// Directory lists the users that are still part of an identity provider
+type Directory interface {
+	// ListUsers returns the lower case email addresses of every active user in scope
+	ListUsers() ([]string, error)
+}
+
+// NewDirectory returns the directory configured as the source of a profile's deprovisioning sync
+func NewDirectory(conf tap.DeprovisioningConfig) (Directory, error) {
+	switch conf.Source {
+	case tap.DirectoryLDAP:
+		return &LDAPDirectory{config: conf.LDAP}, nil
+	case tap.DirectorySCIM:
+		return &SCIMDirectory{config: conf.SCIM, client: http.DefaultClient}, nil
+	}
+
+	return nil, fmt.Errorf("invalid directory source %q", conf.Source)
+}
+
+// LDAPDirectory lists users with a search on an LDAP server
+type LDAPDirectory struct {
+	config tap.LDAPDirectoryConfig
+}
+
+func (d *LDAPDirectory) ListUsers() ([]string, error) {
+	address := d.config.Server + ":" + d.config.Port
+
+	var conn *ldap.Conn
+	var err error
+	if d.config.UseSSL {
+		conn, err = ldap.DialTLS("tcp", address, &tls.Config{ServerName: d.config.Server})
+	} else {
+		conn, err = ldap.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if d.config.BindDN != "" {
+		if err := conn.Bind(d.config.BindDN, d.config.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	filter := d.config.Filter
+	if filter == "" {
+		filter = "(objectclass=person)"
+	}
+	emailAttribute := d.config.EmailAttribute
+	if emailAttribute == "" {
+		emailAttribute = "mail"
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		d.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		0,
+		false,
+		filter,
+		[]string{emailAttribute},
+		nil)
+
+	sr, err := conn.SearchWithPaging(searchRequest, 500)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	for _, entry := range sr.Entries {
+		if email := entry.GetAttributeValue(emailAttribute); email != "" {
+			users = append(users, strings.ToLower(email))
+		}
+	}
+
+	return users, nil
+}
+
+// SCIMDirectory lists users from the /Users endpoint of a SCIM 2.0 service provider
+type SCIMDirectory struct {
+	config tap.SCIMDirectoryConfig
+	client *http.Client
+}
+
+type scimListResponse struct {
+	TotalResults int        `json:"totalResults"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []scimUser `json:"Resources"`
+}
+
+type scimUser struct {
+	UserName string `json:"userName"`
+	Active   *bool  `json:"active"`
+	Emails   []struct {
+		Value   string `json:"value"`
+		Primary bool   `json:"primary"`
+	} `json:"emails"`
+}
+
+// email returns the primary email of a SCIM user, falling back to the user name
+func (u scimUser) email() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return u.UserName
+}
+
+func (d *SCIMDirectory) ListUsers() ([]string, error) {
+	users := []string{}
+	baseURL := strings.TrimSuffix(d.config.URL, "/")
+
+	for startIndex := 1; ; {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/Users?startIndex=%d&count=%d", baseURL, startIndex, scimPageSize), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+d.config.Token)
+		req.Header.Set("Accept", "application/scim+json")
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		page := scimListResponse{}
+		decErr := json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("SCIM service provider responded with %d", resp.StatusCode)
+		}
+		if decErr != nil {
+			return nil, decErr
+		}
+
+		for _, user := range page.Resources {
+			if user.Active != nil && !*user.Active {
+				continue
+			}
+			if email := user.email(); email != "" {
+				users = append(users, strings.ToLower(email))
+			}
+		}
+
+		startIndex += len(page.Resources)
+		if len(page.Resources) == 0 || startIndex > page.TotalResults {
+			break
+		}
+	}
+
+	return users, nil
+}
@@ -0,0 +1,75 @@
+package deprovisioning
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// DefaultCheckInterval is how often the scheduler looks for profiles with a sync due
+const DefaultCheckInterval = time.Minute
+
+// Scheduler runs the sync of every profile with deprovisioning enabled and an Interval set. Profiles are read
+// from the config store on every check, so changes made through the API are picked up without a restart.
+type Scheduler struct {
+	Syncer        *Syncer
+	CheckInterval time.Duration
+
+	lastRun map[string]time.Time
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// Start runs the scheduler in the background until Stop is called
+func (s *Scheduler) Start() {
+	reloadDeprovisioningLogger()
+
+	if s.CheckInterval == 0 {
+		s.CheckInterval = DefaultCheckInterval
+	}
+	s.lastRun = map[string]time.Time{}
+	s.stop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(s.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				s.runDue(now)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the background scheduler
+func (s *Scheduler) Stop() {
+	s.once.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+		}
+	})
+}
+
+func (s *Scheduler) runDue(now time.Time) {
+	for _, p := range s.Syncer.AuthConfigStore.GetAll("") {
+		profile, ok := p.(tap.Profile)
+		if !ok || profile.Deprovisioning == nil || !profile.Deprovisioning.Enabled || profile.Deprovisioning.Interval <= 0 {
+			continue
+		}
+
+		interval := time.Duration(profile.Deprovisioning.Interval) * time.Second
+		if last, ran := s.lastRun[profile.ID]; ran && now.Sub(last) < interval {
+			continue
+		}
+		s.lastRun[profile.ID] = now
+
+		if _, err := s.Syncer.Run(profile, false); err != nil {
+			deprovisioningLogger.WithField("profile", profile.ID).WithError(err).Error("Deprovisioning sync failed")
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package deprovisioning
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	identityHandlers "github.com/TykTechnologies/tyk-identity-broker/tap/identity-handlers"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+var log = logger.Get()
+var deprovisioningLogTag = "DEPROVISIONING"
+var deprovisioningLogger = log.WithField("prefix", deprovisioningLogTag)
+
+var (
+	ErrNotConfigured  = errors.New("deprovisioning is not configured for this profile")
+	ErrEmptyDirectory = errors.New("directory returned no users, refusing to deprovision every user")
+)
+
+func reloadDeprovisioningLogger() {
+	log = logger.Get()
+	deprovisioningLogger = &logrus.Entry{Logger: log}
+	deprovisioningLogger = deprovisioningLogger.Logger.WithField("prefix", deprovisioningLogTag)
+}
+
+// Report is the outcome of a sync, in dry-run mode it lists the users that would have been deprovisioned
+type Report struct {
+	ProfileID      string
+	DryRun         bool
+	Action         string
+	StartedAt      time.Time
+	DirectoryUsers int
+	SSOUsers       int
+	Deprovisioned  []ReportEntry
+}
+
+// ReportEntry is a Dashboard user that is no longer in the directory
+type ReportEntry struct {
+	Email         string
+	UserID        string
+	RevokedTokens int
+	Error         string `json:",omitempty"`
+}
+
+// Syncer compares the Dashboard users logged in through a profile with its directory, and deprovisions those that
+// left
+type Syncer struct {
+	API              *tyk.TykAPI
+	AuthConfigStore  tap.AuthRegisterBackend
+	IdentityKeyStore tap.AuthRegisterBackend
+	// NewDirectory can be replaced to use a different directory implementation, e.g. in tests
+	NewDirectory func(conf tap.DeprovisioningConfig) (Directory, error)
+}
+
+// Run syncs a profile, dryRun overrides the DryRun setting of the profile when it is true
+func (s *Syncer) Run(profile tap.Profile, dryRun bool) (*Report, error) {
+	conf := profile.Deprovisioning
+	if conf == nil {
+		return nil, ErrNotConfigured
+	}
+
+	action := conf.Action
+	if action == "" {
+		action = tap.DeprovisionDisable
+	}
+
+	report := &Report{
+		ProfileID:     profile.ID,
+		DryRun:        dryRun || conf.DryRun,
+		Action:        action,
+		StartedAt:     time.Now(),
+		Deprovisioned: []ReportEntry{},
+	}
+
+	newDirectory := s.NewDirectory
+	if newDirectory == nil {
+		newDirectory = NewDirectory
+	}
+	directory, err := newDirectory(*conf)
+	if err != nil {
+		return nil, err
+	}
+
+	directoryUsers, err := directory.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	if len(directoryUsers) == 0 {
+		return nil, ErrEmptyDirectory
+	}
+	report.DirectoryUsers = len(directoryUsers)
+
+	inDirectory := map[string]bool{}
+	for _, email := range directoryUsers {
+		inDirectory[strings.ToLower(email)] = true
+	}
+
+	// only users that were logged in through this profile are considered, other Dashboard users are left alone
+	ssoUsers := map[string]bool{}
+	for _, email := range identityHandlers.SSOUsers(s.IdentityKeyStore, profile.ID) {
+		ssoUsers[strings.ToLower(email)] = true
+	}
+	report.SSOUsers = len(ssoUsers)
+
+	dashboardCred, _ := profile.IdentityHandlerConfig["DashboardCredential"].(string)
+	dashboardUsers, err := s.API.GetDashboardUsers(dashboardCred)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range dashboardUsers {
+		email := strings.ToLower(user.EmailAddress)
+		if !ssoUsers[email] || inDirectory[email] {
+			continue
+		}
+		if action == tap.DeprovisionDisable && !user.Active {
+			continue
+		}
+
+		entry := ReportEntry{Email: email, UserID: user.ID}
+		if !report.DryRun {
+			if err := s.deprovision(profile, dashboardCred, action, user, &entry); err != nil {
+				entry.Error = err.Error()
+			}
+		}
+		report.Deprovisioned = append(report.Deprovisioned, entry)
+	}
+
+	deprovisioningLogger.WithFields(logrus.Fields{
+		"profile":       profile.ID,
+		"dry_run":       report.DryRun,
+		"deprovisioned": len(report.Deprovisioned),
+	}).Info("Deprovisioning sync finished")
+
+	return report, nil
+}
+
+func (s *Syncer) deprovision(profile tap.Profile, dashboardCred, action string, user tyk.DashboardUser, entry *ReportEntry) error {
+	var err error
+	if action == tap.DeprovisionDelete {
+		err = s.API.DeleteDashboardUser(dashboardCred, user.ID)
+	} else {
+		err = s.API.DisableDashboardUser(dashboardCred, user.ID)
+	}
+	if err != nil {
+		deprovisioningLogger.WithField("user", entry.Email).WithError(err).Error("Failed to deprovision Dashboard user")
+		return err
+	}
+
+	for _, profileID := range profile.Deprovisioning.RevokeTokenProfiles {
+		revoked, rErr := identityHandlers.RevokeUserTokensInProfile(s.API, s.AuthConfigStore, s.IdentityKeyStore, profileID, entry.Email)
+		entry.RevokedTokens += revoked
+		if rErr != nil {
+			deprovisioningLogger.WithField("user", entry.Email).WithField("token_profile", profileID).WithError(rErr).Error("Failed to revoke tokens")
+			err = rErr
+		}
+	}
+
+	if action == tap.DeprovisionDelete {
+		identityHandlers.ForgetSSOUser(s.IdentityKeyStore, profile.ID, entry.Email)
+	}
+
+	deprovisioningLogger.WithField("user", entry.Email).WithField("action", action).Info("Dashboard user deprovisioned")
+	return err
+}
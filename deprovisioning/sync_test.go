@@ -0,0 +1,213 @@
+package deprovisioning
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/backends"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	identityHandlers "github.com/TykTechnologies/tyk-identity-broker/tap/identity-handlers"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+type staticDirectory []string
+
+func (d staticDirectory) ListUsers() ([]string, error) {
+	return d, nil
+}
+
+// mockDashboard serves the SSO, user and key endpoints of the Dashboard API
+type mockDashboard struct {
+	users       map[string]*tyk.DashboardUser
+	deleted     []string
+	invalidated []string
+	issued      int
+}
+
+func (d *mockDashboard) dispatch(target tyk.Endpoint, method string, _ string, body io.Reader) ([]byte, int, error) {
+	path := strings.Split(string(target), "?")[0]
+	userID := strings.TrimPrefix(path, string(tyk.DASH_USERS)+"/")
+
+	switch {
+	case target == tyk.SSO_REGULAR:
+		return []byte(`{"Meta":"nonce"}`), http.StatusOK, nil
+	case target == tyk.STANDARD_TOKENS:
+		d.issued++
+		return []byte(fmt.Sprintf(`{"key_id":"key-%d"}`, d.issued)), http.StatusOK, nil
+	case method == http.MethodDelete && strings.Contains(path, "/keys/"):
+		d.invalidated = append(d.invalidated, path[strings.LastIndex(path, "/")+1:])
+		return []byte(`{}`), http.StatusOK, nil
+	case path == string(tyk.DASH_USERS):
+		users := []tyk.DashboardUser{}
+		for _, user := range d.users {
+			users = append(users, *user)
+		}
+		raw, _ := json.Marshal(map[string]interface{}{"users": users})
+		return raw, http.StatusOK, nil
+	case method == http.MethodGet:
+		raw, _ := json.Marshal(d.users[userID])
+		return raw, http.StatusOK, nil
+	case method == http.MethodPut:
+		update := map[string]interface{}{}
+		raw, _ := io.ReadAll(body)
+		json.Unmarshal(raw, &update)
+		d.users[userID].Active = update["active"].(bool)
+	case method == http.MethodDelete:
+		d.deleted = append(d.deleted, userID)
+		delete(d.users, userID)
+	}
+
+	return []byte(`{}`), http.StatusOK, nil
+}
+
+func TestSyncer(t *testing.T) {
+	setup := func(action string) (*Syncer, *mockDashboard, tap.Profile) {
+		profiles := &backends.InMemoryBackend{}
+		profiles.Init(nil)
+		identities := &backends.InMemoryBackend{}
+		identities.Init(nil)
+
+		dash := &mockDashboard{users: map[string]*tyk.DashboardUser{
+			"1": {ID: "1", EmailAddress: "alice@tyk.io", Active: true},
+			"2": {ID: "2", EmailAddress: "bob@tyk.io", Active: true},
+			"3": {ID: "3", EmailAddress: "admin@tyk.io", Active: true},
+		}}
+		api := &tyk.TykAPI{CustomDispatcher: dash.dispatch}
+
+		dashboardProfile := tap.Profile{
+			ID:                    "dashboard",
+			ActionType:            tap.GenerateOrLoginUserProfile,
+			IdentityHandlerConfig: map[string]interface{}{"DashboardCredential": "cred"},
+			Deprovisioning: &tap.DeprovisioningConfig{
+				Enabled:             true,
+				Source:              tap.DirectorySCIM,
+				Action:              action,
+				RevokeTokenProfiles: []string{"tokens"},
+			},
+		}
+		tokenProfile := tap.Profile{
+			ID:         "tokens",
+			ActionType: tap.GenerateTemporaryAuthToken,
+			IdentityHandlerConfig: map[string]interface{}{
+				"DashboardCredential": "cred",
+				"TokenAuth":           map[string]interface{}{"BaseAPIID": "api-1"},
+			},
+		}
+		profiles.SetKey(dashboardProfile.ID, "", dashboardProfile)
+		profiles.SetKey(tokenProfile.ID, "", tokenProfile)
+
+		// alice and bob log into the Dashboard through TIB, bob also holds a token, admin never used SSO. The IdP
+		// that issued bob's token sent his email in another case.
+		dashboardHandler := &identityHandlers.TykIdentityHandler{API: api, Store: identities}
+		assert.NoError(t, dashboardHandler.Init(dashboardProfile))
+		tokenHandler := &identityHandlers.TykIdentityHandler{API: api, Store: identities}
+		assert.NoError(t, tokenHandler.Init(tokenProfile))
+		for _, email := range []string{"alice@tyk.io", "bob@tyk.io"} {
+			_, err := dashboardHandler.CreateIdentity(goth.User{Email: email})
+			assert.NoError(t, err)
+		}
+		tokenHandler.CompleteIdentityActionForTokenAuth(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil),
+			goth.User{UserID: "bob", Email: "Bob@Tyk.io"}, tokenProfile)
+
+		syncer := &Syncer{
+			API:              api,
+			AuthConfigStore:  profiles,
+			IdentityKeyStore: identities,
+			NewDirectory: func(tap.DeprovisioningConfig) (Directory, error) {
+				return staticDirectory{"alice@tyk.io"}, nil
+			},
+		}
+		return syncer, dash, dashboardProfile
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		syncer, dash, profile := setup("")
+		report, err := syncer.Run(profile, true)
+		assert.NoError(t, err)
+		assert.True(t, report.DryRun)
+		assert.Equal(t, 2, report.SSOUsers)
+		assert.Equal(t, []ReportEntry{{Email: "bob@tyk.io", UserID: "2"}}, report.Deprovisioned)
+		assert.True(t, dash.users["2"].Active)
+		assert.Empty(t, dash.invalidated)
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		syncer, dash, profile := setup(tap.DeprovisionDisable)
+		report, err := syncer.Run(profile, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []ReportEntry{{Email: "bob@tyk.io", UserID: "2", RevokedTokens: 1}}, report.Deprovisioned)
+		assert.False(t, dash.users["2"].Active)
+		assert.True(t, dash.users["1"].Active)
+		assert.True(t, dash.users["3"].Active)
+		assert.Equal(t, []string{"key-1"}, dash.invalidated)
+
+		// already disabled users are not reported again
+		report, err = syncer.Run(profile, false)
+		assert.NoError(t, err)
+		assert.Empty(t, report.Deprovisioned)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		syncer, dash, profile := setup(tap.DeprovisionDelete)
+		_, err := syncer.Run(profile, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"2"}, dash.deleted)
+		assert.Equal(t, []string{"alice@tyk.io"}, identityHandlers.SSOUsers(syncer.IdentityKeyStore, profile.ID))
+	})
+
+	t.Run("empty directory is refused", func(t *testing.T) {
+		syncer, dash, profile := setup(tap.DeprovisionDelete)
+		syncer.NewDirectory = func(tap.DeprovisioningConfig) (Directory, error) {
+			return staticDirectory{}, nil
+		}
+		_, err := syncer.Run(profile, false)
+		assert.Equal(t, ErrEmptyDirectory, err)
+		assert.Empty(t, dash.deleted)
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		syncer, _, _ := setup("")
+		_, err := syncer.Run(tap.Profile{ID: "other"}, false)
+		assert.Equal(t, ErrNotConfigured, err)
+	})
+}
+
+func TestSCIMDirectory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer scim-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// two users per page regardless of the requested count
+		pages := map[string]string{
+			"1": `{"totalResults":3,"Resources":[
+				{"userName":"alice","emails":[{"value":"work@alice.io"},{"value":"Alice@tyk.io","primary":true}]},
+				{"userName":"bob@tyk.io","active":false}]}`,
+			"3": `{"totalResults":3,"Resources":[{"userName":"carol@tyk.io","active":true}]}`,
+		}
+		w.Write([]byte(pages[r.URL.Query().Get("startIndex")]))
+	}))
+	defer server.Close()
+
+	directory, err := NewDirectory(tap.DeprovisioningConfig{
+		Source: tap.DirectorySCIM,
+		SCIM:   tap.SCIMDirectoryConfig{URL: server.URL + "/", Token: "scim-token"},
+	})
+	assert.NoError(t, err)
+
+	users, err := directory.ListUsers()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice@tyk.io", "carol@tyk.io"}, users)
+
+	_, err = NewDirectory(tap.DeprovisioningConfig{Source: "unknown"})
+	assert.Error(t, err)
+}
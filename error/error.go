@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
 	"github.com/sirupsen/logrus"
 )
 
@@ -12,18 +13,27 @@ var log = logger.Get()
 
 // APIErrorMessage is an object that defines when a generic error occurred
 type APIErrorMessage struct {
-	Status string
-	Error  string
+	Status        string
+	Error         string
+	Code          string
+	CorrelationID string
 }
 
-// HandleError is a generic error handler
-func HandleError(tag string, errorMsg string, rawErr error, code int, w http.ResponseWriter, _ *http.Request) {
+// HandleError is a generic error handler, browsers get an HTML error page and other clients get JSON
+func HandleError(tag string, errorMsg string, rawErr error, code int, w http.ResponseWriter, r *http.Request) {
+	correlationID := pages.CorrelationID(r)
 	log.WithFields(logrus.Fields{
-		"prefix":   tag,
-		"errorMsg": errorMsg,
+		"prefix":         tag,
+		"errorMsg":       errorMsg,
+		"correlation_id": correlationID,
 	}).Error(rawErr)
 
-	errorObj := APIErrorMessage{"error", errorMsg}
+	if pages.WantsHTML(r) {
+		pages.RenderErrorWithStatus(w, r, nil, code, pages.CodeFor(code), errorMsg, correlationID)
+		return
+	}
+
+	errorObj := APIErrorMessage{"error", errorMsg, pages.CodeFor(code), correlationID}
 	responseMsg, err := json.Marshal(&errorObj)
 
 	if err != nil {
@@ -33,6 +43,7 @@ func HandleError(tag string, errorMsg string, rawErr error, code int, w http.Res
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(pages.CorrelationIDHeader, correlationID)
 	w.WriteHeader(code)
 	w.Write(responseMsg) //nolint:errcheck
 }
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -89,3 +90,42 @@ func TestHandleError_ResponseBody(t *testing.T) {
 	body := w.Body.Bytes()
 	assert.True(t, json.Valid(body), "response body should be valid JSON")
 }
+
+func TestHandleError_Browser(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/auth/1/openid-connect", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+
+	HandleError("TAG", "could not find a matching session", errors.New("raw"), http.StatusBadRequest, w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "could not find a matching session")
+	assert.NotEmpty(t, w.Header().Get("X-Correlation-ID"))
+	assert.Contains(t, w.Body.String(), w.Header().Get("X-Correlation-ID"))
+	// the correlation ID of the log line is passed to the page, the request is left as it was
+	assert.Empty(t, r.Header.Get("X-Correlation-ID"))
+}
+
+func TestHandleError_CodeAndCorrelationID(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/auth/1/openid-connect", nil)
+	r.Header.Set("X-Correlation-ID", "corr-1")
+
+	HandleError("TAG", "not found", errors.New("raw"), http.StatusNotFound, w, r)
+
+	var got APIErrorMessage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, "not_found", got.Code)
+	assert.Equal(t, "corr-1", got.CorrelationID)
+	assert.Equal(t, "corr-1", w.Header().Get("X-Correlation-ID"))
+}
+
+func TestHandleError_LeavesLoginReason(t *testing.T) {
+	// only the login and callback handlers know that an error ended a login, the generic handler leaves the reason alone
+	recorder := metrics.NewLoginRecorder(httptest.NewRecorder(), "error-test", "test")
+
+	HandleError("TAG", "not found", errors.New("raw"), http.StatusNotFound, recorder, nil)
+
+	assert.Equal(t, "status_404", recorder.Finish(false))
+}
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
 	"github.com/TykTechnologies/tyk-identity-broker/constants"
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
 	"github.com/TykTechnologies/tyk-identity-broker/providers"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
 
 	tykerrors "github.com/TykTechnologies/tyk-identity-broker/error"
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
+	identityHandlers "github.com/TykTechnologies/tyk-identity-broker/tap/identity-handlers"
 	"github.com/gorilla/mux"
 )
 
@@ -33,16 +45,43 @@ func HandleAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	thisIdentityProvider, thisProfile, err := providers.GetTapProfile(AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	thisIdentityProvider, thisProfile, err := providers.GetTapProfile(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
 	if err != nil {
 		return
 	}
 
+	metrics.LoginStarted(thisProfile.ID, thisProfile.ProviderName)
+	recorder := metrics.NewLoginRecorder(w, thisProfile.ID, thisProfile.ProviderName)
+	// passthrough providers complete the login in this request, the others redirect to the provider
+	defer finishLogin(recorder, r, thisProfile, thisIdentityProvider.ProviderType() == tap.PASSTHROUGH_PROVIDER, "")
+
+	r, ok := providers.WithReturnTo(recorder, r, thisProfile, r.URL.Query().Get(tap.ReturnToParam))
+	if !ok {
+		return
+	}
+
 	pathParams := mux.Vars(r)
-	thisIdentityProvider.Handle(w, r, pathParams, thisProfile)
+	thisIdentityProvider.Handle(recorder, r, pathParams, thisProfile)
 	return
 }
 
+// finishLogin counts the login recorded by recorder and writes failed logins to the audit log, user is the username
+// that was tried when the login form collected it
+func finishLogin(recorder *metrics.LoginRecorder, r *http.Request, profile tap.Profile, callback bool, user string) {
+	reason := recorder.Finish(callback)
+	if reason == "" {
+		return
+	}
+	audit.Log(r, audit.Event{
+		Type:      audit.LoginFailure,
+		OrgID:     profile.OrgID,
+		ProfileID: profile.ID,
+		Provider:  profile.ProviderName,
+		User:      user,
+		Reason:    reason,
+	})
+}
+
 // HandleAuthCallback Is a callback URL passed to OAuth providers such as Social, handles completing an auth request
 func HandleAuthCallback(w http.ResponseWriter, r *http.Request) {
 
@@ -52,15 +91,114 @@ func HandleAuthCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	thisIdentityProvider, thisProfile, err := providers.GetTapProfile(AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	thisIdentityProvider, thisProfile, err := providers.GetTapProfile(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
 	if err != nil {
 		tykerrors.HandleError(constants.HandlerLogTag, err.Message, err.Error, err.Code, w, r)
 		return
 	}
-	thisIdentityProvider.HandleCallback(w, r, tykerrors.HandleError, thisProfile)
+	recorder := metrics.NewLoginRecorder(w, thisProfile.ID, thisProfile.ProviderName)
+	defer finishLogin(recorder, r, thisProfile, true, "")
+	thisIdentityProvider.HandleCallback(recorder, r, handleLoginError, thisProfile)
 	return
 }
 
+// handleLoginError is the error handler of the callbacks, it counts the login as failed with the code of the
+// error before handing it to the generic error handler
+func handleLoginError(tag string, errorMsg string, rawErr error, code int, w http.ResponseWriter, r *http.Request) {
+	metrics.LoginFailed(w, pages.CodeFor(code))
+	tykerrors.HandleError(tag, errorMsg, rawErr, code, w, r)
+}
+
+// HandleTokenRefresh exchanges a refresh token issued with a GenerateTemporaryAuthToken profile for a new token
+// (i.e. POST /auth/:profile-id/token/refresh)
+func HandleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	thisId, idErr := getId(r)
+	if idErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Could not retrieve ID", idErr, 400, w, r)
+		return
+	}
+
+	refreshToken := r.FormValue("refresh_token")
+	if refreshToken == "" {
+		tykerrors.HandleError(constants.HandlerLogTag, "No refresh token provided", errors.New("refresh_token is empty"), 400, w, r)
+		return
+	}
+
+	thisIdentityHandler, _, err := providers.GetTykIdentityHandler(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	if err != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, err.Message, err.Error, err.Code, w, r)
+		return
+	}
+
+	resp, rErr := thisIdentityHandler.RefreshTokenAuth(refreshToken)
+	if rErr != nil {
+		code := http.StatusUnauthorized
+		if rErr == identityHandlers.ErrRefreshTokenDisabled {
+			code = http.StatusBadRequest
+		}
+		tykerrors.HandleError(constants.HandlerLogTag, "Token refresh failed", rErr, code, w, r)
+		return
+	}
+
+	asJson, jErr := json.Marshal(resp)
+	if jErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Marshalling failure", jErr, 500, w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(asJson) //nolint:errcheck
+}
+
+// getTokenFromRequest reads the token a user wants to log out from the Authorization header or the request body, it
+// is never taken from the query string so that it stays out of access logs
+func getTokenFromRequest(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader != "" {
+		return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	}
+	return r.PostFormValue("token")
+}
+
+// HandleLogout revokes the token of the caller that was issued by the profile (i.e. /auth/:profile-id/logout), if
+// the profile has a LogoutURL the user is then sent to the IdP to end their session there as well
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	thisId, idErr := getId(r)
+	if idErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Could not retrieve ID", idErr, 400, w, r)
+		return
+	}
+
+	token := getTokenFromRequest(r)
+	if token == "" {
+		tykerrors.HandleError(constants.HandlerLogTag, "No token provided", errors.New("token is empty"), 400, w, r)
+		return
+	}
+
+	thisIdentityHandler, thisProfile, err := providers.GetTykIdentityHandler(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	if err != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, err.Message, err.Error, err.Code, w, r)
+		return
+	}
+
+	rErr := thisIdentityHandler.RevokeToken(token)
+	if rErr != nil {
+		code := http.StatusInternalServerError
+		if rErr == identityHandlers.ErrTokenNotFound {
+			code = http.StatusNotFound
+		}
+		tykerrors.HandleError(constants.HandlerLogTag, "Logout failed", rErr, code, w, r)
+		return
+	}
+
+	if thisProfile.LogoutURL != "" {
+		http.Redirect(w, r, thisProfile.LogoutURL, http.StatusFound)
+		return
+	}
+
+	HandleAPIOK(map[string]string{}, thisId, 200, w, r)
+}
+
 func HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
@@ -72,7 +210,7 @@ func HandleMetadata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	thisIdentityProvider, _, err := providers.GetTapProfile(AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	thisIdentityProvider, _, err := providers.GetTapProfile(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
 	if err != nil {
 		tykerrors.HandleError(constants.HandlerLogTag, err.Message, err.Error, err.Code, w, r)
 		return
@@ -80,3 +218,313 @@ func HandleMetadata(w http.ResponseWriter, r *http.Request) {
 	thisIdentityProvider.HandleMetadata(w, r)
 	return
 }
+
+// deviceError is the error response of the device token endpoint
+type deviceError struct {
+	Error string `json:"error"`
+}
+
+func writeDeviceJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data) //nolint:errcheck
+}
+
+// HandleDeviceAuthorization starts a device login and returns the device and user codes
+// (i.e. POST /auth/:profile-id/device)
+func HandleDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	thisId, idErr := getId(r)
+	if idErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Could not retrieve ID", idErr, 400, w, r)
+		return
+	}
+
+	thisIdentityHandler, _, err := providers.GetTykIdentityHandler(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	if err != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, err.Message, err.Error, err.Code, w, r)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	verificationURI := scheme + "://" + r.Host + "/auth/" + thisId + "/device/verify"
+
+	resp, dErr := thisIdentityHandler.StartDeviceAuthorization(verificationURI)
+	if dErr == identityHandlers.ErrDeviceNotEnabled {
+		tykerrors.HandleError(constants.HandlerLogTag, dErr.Error(), dErr, 400, w, r)
+		return
+	}
+	if dErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Device authorization failed", dErr, 500, w, r)
+		return
+	}
+
+	writeDeviceJSON(w, http.StatusOK, resp)
+}
+
+// HandleDeviceVerification is the page where users enter the code shown on their device and confirm it, only the
+// confirmation, a POST carrying the CSRF token of the page, starts the provider flow of the profile
+// (i.e. /auth/:profile-id/device/verify)
+func HandleDeviceVerification(w http.ResponseWriter, r *http.Request) {
+	thisId, idErr := getId(r)
+	if idErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Could not retrieve ID", idErr, 400, w, r)
+		return
+	}
+
+	thisIdentityHandler, thisProfile, err := providers.GetTykIdentityHandler(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	if err != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, err.Message, err.Error, err.Code, w, r)
+		return
+	}
+
+	userCode := r.FormValue("user_code")
+	confirmed := r.Method == http.MethodPost && r.PostFormValue("confirm") != ""
+	if confirmed && !pages.ValidCSRFToken(r) {
+		pages.RenderDevice(w, http.StatusForbidden, thisProfile.Pages, pages.DevicePage{UserCode: userCode, Error: "Your session has expired, please try again."}) //nolint:errcheck
+		return
+	}
+
+	if userCode == "" {
+		pages.RenderDevice(w, http.StatusOK, thisProfile.Pages, pages.DevicePage{}) //nolint:errcheck
+		return
+	}
+
+	pending, vErr := thisIdentityHandler.VerifyDeviceUserCode(userCode)
+	if vErr != nil {
+		pages.RenderDevice(w, http.StatusBadRequest, thisProfile.Pages, pages.DevicePage{UserCode: userCode, Error: "The code is invalid or has expired."}) //nolint:errcheck
+		return
+	}
+
+	if !confirmed {
+		csrfToken, cErr := pages.NewCSRFToken(w, r, "/auth/"+thisId+"/device/verify")
+		if cErr != nil {
+			tykerrors.HandleError(constants.HandlerLogTag, "Failed to create CSRF token", cErr, 500, w, r)
+			return
+		}
+		pages.RenderDevice(w, http.StatusOK, thisProfile.Pages, pages.DevicePage{UserCode: pending.DisplayUserCode(), Confirm: true, CSRFToken: csrfToken}) //nolint:errcheck
+		return
+	}
+
+	identityHandlers.SetDeviceCookie(w, r, pending)
+	http.Redirect(w, r, "/auth/"+thisId+"/"+thisIdentityHandler.DeviceProviderPath(), http.StatusFound)
+}
+
+// HandleDeviceToken is polled by the device until the user has logged in (i.e. POST /auth/:profile-id/device/token)
+func HandleDeviceToken(w http.ResponseWriter, r *http.Request) {
+	thisId, idErr := getId(r)
+	if idErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Could not retrieve ID", idErr, 400, w, r)
+		return
+	}
+
+	if r.FormValue("grant_type") != identityHandlers.DeviceCodeGrantType {
+		writeDeviceJSON(w, http.StatusBadRequest, deviceError{Error: "unsupported_grant_type"})
+		return
+	}
+
+	thisIdentityHandler, _, err := providers.GetTykIdentityHandler(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	if err != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, err.Message, err.Error, err.Code, w, r)
+		return
+	}
+
+	resp, pErr := thisIdentityHandler.PollDeviceToken(r.FormValue("device_code"))
+	if deviceErr, ok := pErr.(*identityHandlers.DeviceError); ok {
+		writeDeviceJSON(w, http.StatusBadRequest, deviceError{Error: deviceErr.Code})
+		return
+	}
+	if pErr == identityHandlers.ErrDeviceNotEnabled {
+		writeDeviceJSON(w, http.StatusBadRequest, deviceError{Error: "unauthorized_client"})
+		return
+	}
+	if pErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Device token request failed", pErr, 500, w, r)
+		return
+	}
+
+	writeDeviceJSON(w, http.StatusOK, resp)
+}
+
+// HandleLoginForm serves the built-in login form of passthrough profiles (i.e. /auth/:profile-id/login), a posted
+// form is checked for CSRF and handed to the provider, failed logins show the form again with an error
+func HandleLoginForm(w http.ResponseWriter, r *http.Request) {
+	thisId, idErr := getId(r)
+	if idErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Could not retrieve ID", idErr, 400, w, r)
+		return
+	}
+
+	thisIdentityProvider, thisProfile, err := providers.GetTapProfile(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	if err != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, err.Message, err.Error, err.Code, w, r)
+		return
+	}
+
+	if thisIdentityProvider.ProviderType() != tap.PASSTHROUGH_PROVIDER {
+		tykerrors.HandleError(constants.HandlerLogTag, "Login form is only available for passthrough providers", errors.New("provider is not passthrough"), 404, w, r)
+		return
+	}
+
+	returnTo := r.URL.Query().Get(tap.ReturnToParam)
+	r, ok := providers.WithReturnTo(w, r, thisProfile, returnTo)
+	if !ok {
+		return
+	}
+
+	loginPath := "/auth/" + thisId + "/login"
+	page := pages.LoginPage{ProfileID: thisId, Action: loginPath}
+	if returnTo != "" {
+		page.Action += "?" + tap.ReturnToParam + "=" + url.QueryEscape(returnTo)
+	}
+	templatePath := ""
+	if thisProfile.LoginForm != nil {
+		page.Title = thisProfile.LoginForm.Title
+		page.LogoURL = thisProfile.LoginForm.LogoURL
+		page.StylesheetURL = thisProfile.LoginForm.StylesheetURL
+		templatePath = thisProfile.LoginForm.Template
+	}
+
+	renderForm := func(w http.ResponseWriter, r *http.Request, code int, errorMsg string) {
+		token, tErr := pages.NewCSRFToken(w, r, loginPath)
+		if tErr != nil {
+			tykerrors.HandleError(constants.HandlerLogTag, "Could not create CSRF token", tErr, 500, w, r)
+			return
+		}
+		page.CSRFToken = token
+		page.Error = errorMsg
+		pages.RenderLogin(w, code, templatePath, page) //nolint:errcheck
+	}
+
+	if r.Method != http.MethodPost {
+		renderForm(w, r, http.StatusOK, "")
+		return
+	}
+
+	// the body is kept for providers that forward the request, such as the proxy provider
+	body, rErr := ioutil.ReadAll(r.Body)
+	if rErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Invalid request data", rErr, 400, w, r)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ParseForm() //nolint:errcheck
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	page.Username = r.PostFormValue("username")
+	if !pages.ValidCSRFToken(r) {
+		renderForm(w, r, http.StatusForbidden, "Your session has expired, please try again.")
+		return
+	}
+
+	metrics.LoginStarted(thisProfile.ID, thisProfile.ProviderName)
+	recorder := metrics.NewLoginRecorder(w, thisProfile.ID, thisProfile.ProviderName)
+	defer finishLogin(recorder, r, thisProfile, true, page.Username)
+
+	r = providers.WithLoginFailureHandler(r, func(w http.ResponseWriter, r *http.Request) {
+		metrics.LoginFailed(w, pages.CodeLoginFailed)
+		renderForm(w, r, http.StatusUnauthorized, "Invalid username or password.")
+	})
+	thisIdentityProvider.Handle(recorder, r, mux.Vars(r), thisProfile)
+}
+
+// HandleDiscovery sends users to the login of the profile that matches their email domain or the host they use
+// (i.e. /auth/discover), users are asked for their email when neither picks a profile
+func HandleDiscovery(w http.ResponseWriter, r *http.Request) {
+	email := strings.TrimSpace(r.FormValue("email"))
+	page := pages.DiscoverPage{Action: "/auth/discover", Email: email}
+	if returnTo := r.FormValue(tap.ReturnToParam); returnTo != "" {
+		page.Action += "?" + tap.ReturnToParam + "=" + url.QueryEscape(returnTo)
+	}
+
+	if email != "" && !strings.Contains(email, "@") {
+		page.Error = "Enter a valid email address."
+		pages.RenderDiscover(w, http.StatusBadRequest, page) //nolint:errcheck
+		return
+	}
+
+	thisProfile, dErr := providers.DiscoverProfile(AuthConfigStore, email, r.Host)
+	if dErr != nil {
+		if email == "" {
+			pages.RenderDiscover(w, http.StatusOK, page) //nolint:errcheck
+			return
+		}
+		if !pages.WantsHTML(r) {
+			tykerrors.HandleError(constants.HandlerLogTag, "No login is configured for this email address", dErr, 404, w, r)
+			return
+		}
+		page.Error = "No login is configured for this email address."
+		pages.RenderDiscover(w, http.StatusNotFound, page) //nolint:errcheck
+		return
+	}
+
+	loginPath, pErr := providers.LoginPath(thisProfile)
+	if pErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Could not start login for profile "+thisProfile.ID, pErr, 500, w, r)
+		return
+	}
+
+	if returnTo := r.FormValue(tap.ReturnToParam); returnTo != "" {
+		// checked against the profile when the login starts
+		loginPath += "?" + tap.ReturnToParam + "=" + url.QueryEscape(returnTo)
+	}
+
+	http.Redirect(w, r, loginPath, tap.RedirectStatus(r))
+}
+
+// HandleProviderCatalogue lists the profiles users can log in with, with only the data a login page needs
+// (i.e. /auth/providers?org=:org-id). It is public, so responses can be cached and are open to any origin.
+func HandleProviderCatalogue(w http.ResponseWriter, r *http.Request) {
+	catalogue := providers.Catalogue(AuthConfigStore, r.URL.Query().Get("org"))
+
+	responseMsg, err := json.Marshal(&APIOKMessage{Status: "ok", Data: catalogue})
+	if err != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Marshalling failure", err, 500, w, r)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(responseMsg))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseMsg) //nolint:errcheck
+}
+
+// HandleCodeExchange exchanges a one-time code sent to the ReturnURL of a profile with code delivery for the nonce
+// or token it stands for (i.e. POST /auth/:profile-id/exchange), it is called server-to-server by the target
+func HandleCodeExchange(w http.ResponseWriter, r *http.Request) {
+	thisId, idErr := getId(r)
+	if idErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, "Could not retrieve ID", idErr, 400, w, r)
+		return
+	}
+
+	thisIdentityHandler, _, err := providers.GetTykIdentityHandler(r.Context(), AuthConfigStore, IdentityKeyStore, thisId, TykAPIHandler)
+	if err != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, err.Message, err.Error, err.Code, w, r)
+		return
+	}
+
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !thisIdentityHandler.ValidExchangeSecret(secret) {
+		tykerrors.HandleError(constants.HandlerLogTag, "Not authorised", errors.New("invalid exchange secret"), 401, w, r)
+		return
+	}
+
+	values, eErr := thisIdentityHandler.ExchangeDeliveryCode(r.PostFormValue("code"))
+	if eErr != nil {
+		tykerrors.HandleError(constants.HandlerLogTag, eErr.Error(), eErr, 400, w, r)
+		return
+	}
+
+	writeDeviceJSON(w, http.StatusOK, values)
+}
@@ -0,0 +1,85 @@
+package log
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// CorrelationIDHeader carries the correlation ID of a request, it is taken from the caller when given and returned
+// in the response
+const CorrelationIDHeader = "X-Correlation-ID"
+
+// RequestIDHeader is also accepted from callers, and carries the correlation ID on the requests TIB makes to the
+// Dashboard and the Gateway
+const RequestIDHeader = "X-Request-Id"
+
+// CorrelationIDField is the field log lines of a request carry its correlation ID in
+const CorrelationIDField = "correlation_id"
+
+type correlationIDKey struct{}
+
+// validCorrelationID limits the IDs accepted from callers, so that they can't be used to forge log lines
+var validCorrelationID = regexp.MustCompile(`^[\w.:-]{1,128}$`)
+
+// NewCorrelationID returns a random correlation ID
+func NewCorrelationID() string {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// WithCorrelationID returns a copy of ctx that carries a correlation ID
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx, if any
+func CorrelationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// RequestCorrelationID returns the correlation ID sent by the caller of r when it is valid, or else a new one
+func RequestCorrelationID(r *http.Request) string {
+	id := r.Header.Get(CorrelationIDHeader)
+	if id == "" {
+		id = r.Header.Get(RequestIDHeader)
+	}
+	if !validCorrelationID.MatchString(id) {
+		return NewCorrelationID()
+	}
+	return id
+}
+
+// CorrelationIDHandler gives each request a correlation ID, the one sent by the caller or a new one, and returns it
+// in the response. Lines logged with the context of the request carry it.
+func CorrelationIDHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := RequestCorrelationID(r)
+		w.Header().Set(CorrelationIDHeader, id)
+		handler.ServeHTTP(w, r.WithContext(WithCorrelationID(r.Context(), id)))
+	})
+}
+
+// correlationIDHook adds the correlation ID to entries logged with the context of a request
+type correlationIDHook struct{}
+
+func (correlationIDHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (correlationIDHook) Fire(entry *logrus.Entry) error {
+	if id := CorrelationID(entry.Context); id != "" {
+		entry.Data[CorrelationIDField] = id
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorrelationIDHandler(t *testing.T) {
+	var seen string
+	handler := CorrelationIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = CorrelationID(r.Context())
+	}))
+
+	tests := []struct {
+		name, header, value string
+		kept                bool
+	}{
+		{"correlation ID from caller", CorrelationIDHeader, "abc-123", true},
+		{"request ID from caller", RequestIDHeader, "req.456", true},
+		{"invalid ID replaced", CorrelationIDHeader, "abc\nlevel=error", false},
+		{"generated", "", "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/auth/1/saml", nil)
+			if tc.header != "" {
+				r.Header.Set(tc.header, tc.value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			assert.NotEmpty(t, seen)
+			assert.Equal(t, seen, w.Header().Get(CorrelationIDHeader))
+			if tc.kept {
+				assert.Equal(t, tc.value, seen)
+			} else {
+				assert.NotEqual(t, tc.value, seen)
+			}
+		})
+	}
+}
+
+func TestCorrelationIDHook(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := newTestLogger(buf)
+
+	logger.WithContext(WithCorrelationID(context.Background(), "abc-123")).Info("with request")
+	logger.WithContext(context.Background()).Info("without request")
+
+	decoder := json.NewDecoder(buf)
+	entry := map[string]interface{}{}
+	require.NoError(t, decoder.Decode(&entry))
+	assert.Equal(t, "abc-123", entry[CorrelationIDField])
+
+	entry = map[string]interface{}{}
+	require.NoError(t, decoder.Decode(&entry))
+	assert.NotContains(t, entry, CorrelationIDField)
+}
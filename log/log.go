@@ -3,6 +3,7 @@ package log
 import (
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
@@ -17,15 +18,39 @@ func (f *RawFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return []byte(entry.Message), nil
 }
 
-func init() {
-	formatter := new(prefixed.TextFormatter)
-	formatter.TimestampFormat = `Jan 02 15:04:05`
-	formatter.FullTimestamp = true
+// Settings configure the logs of TIB, they override the TYK_LOGLEVEL and TYK_LOGFORMAT environment variables when
+// set
+type Settings struct {
+	// Level is "error", "warn", "info" or "debug"
+	Level string
+	// Format is "text" (the default) or "json"
+	Format string
+}
 
-	log.Formatter = formatter
+func init() {
 	rawLog.Formatter = new(RawFormatter)
 
-	switch strings.ToLower(os.Getenv("TYK_LOGLEVEL")) {
+	log.AddHook(redactHook{})
+	log.AddHook(correlationIDHook{})
+	Configure(Settings{Level: "info", Format: "text"})
+	Configure(Settings{Level: os.Getenv("TYK_LOGLEVEL"), Format: os.Getenv("TYK_LOGFORMAT")})
+}
+
+// Configure sets the level and format of the TIB logger, settings left empty are not changed
+func Configure(settings Settings) {
+	switch strings.ToLower(settings.Format) {
+	case "":
+	case "json":
+		log.Formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	default:
+		formatter := new(prefixed.TextFormatter)
+		formatter.TimestampFormat = `Jan 02 15:04:05`
+		formatter.FullTimestamp = true
+		log.Formatter = formatter
+	}
+
+	switch strings.ToLower(settings.Level) {
+	case "":
 	case "error":
 		log.SetLevel(logrus.ErrorLevel)
 	case "warn":
@@ -5,6 +5,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
 
 // TestGetIsPureGetter verifies that calling Get() multiple times never mutates
@@ -37,3 +38,22 @@ func TestSetLoggerLevelNotOverwritten(t *testing.T) {
 
 	assert.Equal(t, logrus.ErrorLevel, Get().Level)
 }
+
+func TestConfigure(t *testing.T) {
+	t.Cleanup(func() {
+		Configure(Settings{Level: "info", Format: "text"})
+	})
+
+	Configure(Settings{Level: "debug", Format: "json"})
+	assert.Equal(t, logrus.DebugLevel, Get().Level)
+	assert.IsType(t, &logrus.JSONFormatter{}, Get().Formatter)
+
+	// empty settings leave the logger as it is
+	Configure(Settings{})
+	assert.Equal(t, logrus.DebugLevel, Get().Level)
+	assert.IsType(t, &logrus.JSONFormatter{}, Get().Formatter)
+
+	Configure(Settings{Level: "warn", Format: "text"})
+	assert.Equal(t, logrus.WarnLevel, Get().Level)
+	assert.IsType(t, &prefixed.TextFormatter{}, Get().Formatter)
+}
@@ -0,0 +1,68 @@
+package log
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted replaces secrets in log lines
+const Redacted = "[REDACTED]"
+
+// secretNames are parts of the names of fields, parameters and headers that hold secrets
+var secretNames = []string{
+	"password", "passwd", "secret", "token", "authorization", "cookie", "assertion", "samlresponse", "apikey",
+	"api_key", "privatekey", "private_key", "key_id", "keyid", "nonce",
+}
+
+var (
+	// secretValue matches a secret given as name=value (forms, query strings), name: value or name:value (headers,
+	// structs printed with %+v) and "name":"value" (JSON), along with the scheme of an Authorization header
+	secretValue = regexp.MustCompile(`(?i)("?[\w-]*(?:` + strings.Join(secretNames, "|") + `)[\w-]*"?\s*[:=]\s*)((?:bearer|basic)\s+[^\s,&;}\])]+|"[^"]*"|\[[^\]]*\]|map\[[^\]]*\]|[^\s,&;}\])]+)`)
+	// credentials matches the credentials of an Authorization header on their own
+	credentials = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[\w.~+/=-]+`)
+)
+
+// IsSecretField reports whether a field with this name holds a secret
+func IsSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secretNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact replaces the secrets found in s, such as passwords, tokens, cookies and SAML assertions
+func Redact(s string) string {
+	s = secretValue.ReplaceAllString(s, "${1}"+Redacted)
+	return credentials.ReplaceAllString(s, "${1} "+Redacted)
+}
+
+// redactHook redacts the message and fields of every entry before it is written
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for name, value := range entry.Data {
+		if IsSecretField(name) {
+			entry.Data[name] = Redacted
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			entry.Data[name] = Redact(v)
+		case error:
+			if redacted := Redact(v.Error()); redacted != v.Error() {
+				entry.Data[name] = redacted
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name, in, out string
+	}{
+		{"form", "username=jo&password=hunter2&remember=1", "username=jo&password=" + Redacted + "&remember=1"},
+		{"query", "/callback?code=abc&access_token=xyz", "/callback?code=abc&access_token=" + Redacted},
+		{"struct", "{Username:jo Secret:s3cr3t Host:idp}", "{Username:jo Secret:" + Redacted + " Host:idp}"},
+		{"json", `{"client_secret":"s3cr3t","host":"idp"}`, `{"client_secret":` + Redacted + `,"host":"idp"}`},
+		{"header", "Cookie: session=abc", "Cookie: " + Redacted},
+		{"header map", "map[Cookie:[session=abc] Accept:[*/*]]", "map[Cookie:" + Redacted + " Accept:[*/*]]"},
+		{"saml", "SAMLResponse=PHNhbWw+&RelayState=x", "SAMLResponse=" + Redacted + "&RelayState=x"},
+		{"bearer", "calling with Bearer eyJhbGciOi.payload.sig", "calling with Bearer " + Redacted},
+		{"basic", "Basic dXNlcjpwYXNz", "Basic " + Redacted},
+		{"plain", "User bind successful", "User bind successful"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.out, Redact(tc.in))
+		})
+	}
+}
+
+func TestIsSecretField(t *testing.T) {
+	assert.True(t, IsSecretField("Password"))
+	assert.True(t, IsSecretField("client_secret"))
+	assert.True(t, IsSecretField("refreshToken"))
+	assert.True(t, IsSecretField("Set-Cookie"))
+	assert.False(t, IsSecretField("username"))
+	assert.False(t, IsSecretField("profile"))
+}
+
+func newTestLogger(buf *bytes.Buffer) *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	logger.AddHook(redactHook{})
+	logger.AddHook(correlationIDHook{})
+	return logger
+}
+
+func TestRedactHook(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := newTestLogger(buf)
+
+	fields := logrus.Fields{
+		"password": "hunter2",
+		"user":     "jo",
+		"request":  "Authorization: Bearer abc",
+		"error":    errors.New("bind failed for password=hunter2"),
+	}
+	logger.WithFields(fields).Info("login with token=abc")
+
+	entry := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "login with token="+Redacted, entry["msg"])
+	assert.Equal(t, Redacted, entry["password"])
+	assert.Equal(t, "jo", entry["user"])
+	assert.Equal(t, "Authorization: "+Redacted, entry["request"])
+	assert.Equal(t, "bind failed for password="+Redacted, entry["error"])
+	assert.NotContains(t, buf.String(), "hunter2")
+
+	// the fields of the caller are left alone
+	assert.Equal(t, "hunter2", fields["password"])
+}
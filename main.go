@@ -1,22 +1,31 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"net"
 	"net/http"
 	"strconv"
 
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
 	"github.com/TykTechnologies/tyk-identity-broker/backends"
 	"github.com/TykTechnologies/tyk-identity-broker/configuration"
+	"github.com/TykTechnologies/tyk-identity-broker/constants"
 	"github.com/TykTechnologies/tyk-identity-broker/data_loader"
+	"github.com/TykTechnologies/tyk-identity-broker/deprovisioning"
 	"github.com/TykTechnologies/tyk-identity-broker/initializer"
+	"github.com/TykTechnologies/tyk-identity-broker/scim"
 
 	errors "github.com/TykTechnologies/tyk-identity-broker/error"
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
 	"github.com/TykTechnologies/tyk-identity-broker/tothic"
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
 	"github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+	"github.com/TykTechnologies/tyk-identity-broker/webhooks"
 	"github.com/gorilla/mux"
 )
 
@@ -34,6 +43,12 @@ var TykAPIHandler tyk.TykAPI
 
 var GlobalDataLoader data_loader.DataLoader
 
+// DeprovisioningSyncer removes Dashboard users that left the directory of their profile
+var DeprovisioningSyncer *deprovisioning.Syncer
+
+// Webhooks delivers the events of organisations to their webhook subscriptions, it is nil when webhooks are disabled
+var Webhooks *webhooks.Service
+
 var log = logger.Get()
 var mainLogger = log.WithField("prefix", "MAIN")
 var ProfileFilename, confFile string
@@ -55,6 +70,11 @@ func init() {
 	initializer.SetConfigHandler(configStore)
 
 	TykAPIHandler = config.TykAPISettings
+	DeprovisioningSyncer = &deprovisioning.Syncer{
+		API:              &TykAPIHandler,
+		AuthConfigStore:  AuthConfigStore,
+		IdentityKeyStore: IdentityKeyStore,
+	}
 
 	// In OIDC there are calls to the https://{IDP-DOMAIN}/.well-know/openid-configuration and other endpoints
 	// We set the http client's Transport to do InsecureSkipVerify to avoid error in case the certificate
@@ -77,11 +97,80 @@ func init() {
 	}
 
 	tothic.TothErrorHandler = errors.HandleError
-	tothic.SetupSessionStore()
+	pages.SetTemplateDir(config.TemplateDir)
+	var sessionStore tap.AuthRegisterBackend
+	if config.Session.Store == tothic.RedisSessionStore {
+		sessionStore = &backends.RedisBackend{KeyPrefix: "tib-session-"}
+		sessionStore.Init(config.BackEnd.IdentityBackendSettings)
+	}
+	if err := tothic.SetupSessionStore(config.Session, sessionStore); err != nil {
+		// only Social profiles use sessions, other deployments can run without a session secret
+		if err != tothic.ErrNoSessionSecret || usesSessions() {
+			mainLogger.Fatalf("Could not set up the session store: %v", err)
+		}
+		mainLogger.Warning("TYK_IB_SESSION_SECRET is not set, Social profiles can't log users in until it is")
+	}
+
+	if pinger, ok := IdentityKeyStore.(metrics.Pinger); ok {
+		metrics.RegisterBackend("identity", pinger)
+	}
+	if pinger, ok := AuthConfigStore.(metrics.Pinger); ok {
+		metrics.RegisterBackend("profiles", pinger)
+	}
+	if err := metrics.RegisterProfiles(countProfiles); err != nil {
+		mainLogger.WithError(err).Error("registering the profiles metric")
+	}
+
+	if err := tracing.Init(&config.OpenTelemetry, Version); err != nil {
+		mainLogger.WithError(err).Error("setting up tracing")
+	}
+
+	if err := audit.Setup(config.Audit); err != nil {
+		mainLogger.Fatalf("Could not set up the audit log: %v", err)
+	}
+
+	if config.Webhooks.Enabled {
+		webhookStore := &backends.RedisBackend{KeyPrefix: "tib-webhooks-"}
+		webhookStore.Init(config.BackEnd.IdentityBackendSettings)
+		var err error
+		if Webhooks, err = webhooks.New(webhookStore, config.Webhooks); err != nil {
+			mainLogger.Fatalf("Could not set up webhooks: %v", err)
+		}
+	}
+}
+
+// usesSessions reports whether a loaded profile logs users in with a provider that keeps a session
+func usesSessions() bool {
+	for _, p := range AuthConfigStore.GetAll("") {
+		if profile, ok := p.(tap.Profile); ok && profile.ProviderName == constants.SocialProvider {
+			return true
+		}
+	}
+	return false
+}
+
+// countProfiles counts the loaded profiles by provider for the metrics
+func countProfiles() map[string]int {
+	counts := map[string]int{}
+	for _, p := range AuthConfigStore.GetAll("") {
+		if profile, ok := p.(tap.Profile); ok {
+			counts[profile.ProviderName]++
+		}
+	}
+	return counts
 }
 
 func main() {
 	p := mux.NewRouter()
+	p.Handle("/auth/providers", http.HandlerFunc(HandleProviderCatalogue)).Methods("GET")
+	p.Handle("/auth/discover", http.HandlerFunc(HandleDiscovery)).Methods("GET", "POST")
+	p.Handle("/auth/{id}/token/refresh", http.HandlerFunc(HandleTokenRefresh)).Methods("POST")
+	p.Handle("/auth/{id}/logout", http.HandlerFunc(HandleLogout)).Methods("POST")
+	p.Handle("/auth/{id}/login", http.HandlerFunc(HandleLoginForm)).Methods("GET", "POST")
+	p.Handle("/auth/{id}/exchange", http.HandlerFunc(HandleCodeExchange)).Methods("POST")
+	p.Handle("/auth/{id}/device", http.HandlerFunc(HandleDeviceAuthorization)).Methods("POST")
+	p.Handle("/auth/{id}/device/verify", http.HandlerFunc(HandleDeviceVerification)).Methods("GET", "POST")
+	p.Handle("/auth/{id}/device/token", http.HandlerFunc(HandleDeviceToken)).Methods("POST")
 	p.Handle("/auth/{id}/{provider}/callback", http.HandlerFunc(HandleAuthCallback))
 	p.Handle("/auth/{id}/{provider}", http.HandlerFunc(HandleAuth))
 	p.Handle("/auth/{id}/saml/metadata", http.HandlerFunc(HandleMetadata))
@@ -91,15 +180,56 @@ func main() {
 	p.Handle("/api/profiles/{id}", IsAuthenticated(http.HandlerFunc(HandleUpdateProfile))).Methods("PUT")
 	p.Handle("/api/profiles/{id}", IsAuthenticated(http.HandlerFunc(HandleDeleteProfile))).Methods("DELETE")
 
+	p.Handle("/api/profiles/{id}/tokens", IsAuthenticated(http.HandlerFunc(HandleRevokeProfileTokens))).Methods("DELETE")
+	p.Handle("/api/profiles/{id}/users/{userId}/tokens", IsAuthenticated(http.HandlerFunc(HandleRevokeUserTokens))).Methods("DELETE")
+
+	p.Handle("/api/profiles/{id}/deprovision", IsAuthenticated(http.HandlerFunc(HandleDeprovision))).Methods("POST")
+
 	p.Handle("/api/profiles", IsAuthenticated(http.HandlerFunc(HandleGetProfileList))).Methods("GET")
 
+	if Webhooks != nil {
+		p.Handle("/api/webhooks/{orgId}", IsAuthenticated(http.HandlerFunc(HandleGetWebhookList))).Methods("GET")
+		p.Handle("/api/webhooks/{orgId}", IsAuthenticated(http.HandlerFunc(HandleAddWebhook))).Methods("POST")
+		p.Handle("/api/webhooks/{orgId}/{id}", IsAuthenticated(http.HandlerFunc(HandleGetWebhook))).Methods("GET")
+		p.Handle("/api/webhooks/{orgId}/{id}", IsAuthenticated(http.HandlerFunc(HandleUpdateWebhook))).Methods("PUT")
+		p.Handle("/api/webhooks/{orgId}/{id}", IsAuthenticated(http.HandlerFunc(HandleDeleteWebhook))).Methods("DELETE")
+		p.Handle("/api/webhooks/{orgId}/{id}/deliveries", IsAuthenticated(http.HandlerFunc(HandleGetWebhookDeliveries))).Methods("GET")
+
+		Webhooks.Start()
+		defer Webhooks.Stop()
+	}
+
+	scimServer := &scim.Server{API: &TykAPIHandler, AuthConfigStore: AuthConfigStore, IdentityKeyStore: IdentityKeyStore}
+	scimServer.Register(p)
+
 	p.Handle("/health", http.HandlerFunc(HandleHealthCheck)).Methods("GET")
 
+	scheduler := &deprovisioning.Scheduler{Syncer: DeprovisioningSyncer}
+	scheduler.Start()
+	defer scheduler.Stop()
+	defer tracing.Shutdown(context.Background())
+	defer audit.Close()
+
 	listenPort := 3010
 	if config.Port != 0 {
 		listenPort = config.Port
 	}
 
+	if config.Metrics.Enabled {
+		if config.Metrics.Port == 0 || config.Metrics.Port == listenPort {
+			// on the public listener metrics need the secret of the API, like the rest of the admin endpoints
+			p.Handle("/metrics", IsAuthenticated(metrics.Handler())).Methods("GET")
+		} else {
+			mainLogger.Info("--> Serving metrics on port ", config.Metrics.Port)
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle("/metrics", metrics.Handler())
+			go func() {
+				err := http.ListenAndServe(":"+strconv.Itoa(config.Metrics.Port), metricsMux)
+				mainLogger.WithError(err).Error("metrics server stopped")
+			}()
+		}
+	}
+
 	var tibServer net.Listener
 	if config.HttpServerOptions.UseSSL {
 		mainLogger.Info("--> Using SSL (https) for TIB")
@@ -119,7 +249,7 @@ func main() {
 		mainLogger.Info("--> Standard listener (http) for TIB")
 		tibServer = createListener(listenPort, nil)
 	}
-	_ = http.Serve(tibServer, p)
+	_ = http.Serve(tibServer, logger.CorrelationIDHandler(tracing.Handler(p)))
 
 }
 
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Pinger is a backend whose connectivity is reported by backend_up
+type Pinger interface {
+	Ping() error
+}
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]Pinger{}
+)
+
+// RegisterBackend reports the connectivity of a backend under name
+func RegisterBackend(name string, backend Pinger) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[name] = backend
+}
+
+func checkBackends() {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	for name, backend := range backends {
+		up := 1.0
+		if err := backend.Ping(); err != nil {
+			up = 0
+		}
+		backendUp.WithLabelValues(name).Set(up)
+	}
+}
+
+// profilesCollector reports the profiles TIB has loaded, by provider
+type profilesCollector struct {
+	desc  *prometheus.Desc
+	count func() map[string]int
+}
+
+func (c profilesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c profilesCollector) Collect(ch chan<- prometheus.Metric) {
+	for provider, count := range c.count() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), provider)
+	}
+}
+
+// RegisterProfiles reports the number of loaded profiles by provider, count is called on every scrape
+func RegisterProfiles(count func() map[string]int) error {
+	return Registry.Register(profilesCollector{
+		desc:  prometheus.NewDesc(prometheus.BuildFQName(Namespace, "", "profiles"), "Profiles loaded, by provider.", []string{"provider"}, nil),
+		count: count,
+	})
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// FailureRedirect is the reason of a failed login that was redirected to the FailureRedirect of its profile
+const FailureRedirect = "failure_redirect"
+
+// LoginRecorder follows a login through the providers and the identity handler to count how it ended
+type LoginRecorder struct {
+	http.ResponseWriter
+	profileID string
+	provider  string
+	status    int
+	succeeded bool
+	reason    string
+}
+
+// NewLoginRecorder returns a writer that records the outcome of the login of a profile
+func NewLoginRecorder(w http.ResponseWriter, profileID string, provider string) *LoginRecorder {
+	return &LoginRecorder{ResponseWriter: w, profileID: profileID, provider: provider}
+}
+
+func (l *LoginRecorder) WriteHeader(code int) {
+	if l.status == 0 {
+		l.status = code
+	}
+	l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *LoginRecorder) Write(b []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	return l.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the writer underneath
+func (l *LoginRecorder) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
+
+// Finish counts the login once its response has been written. A callback that neither completed the login nor
+// failed with an error was redirected to the FailureRedirect of the profile, other requests may just have redirected
+// the user to the provider. It returns the reason of a failed login and nothing otherwise.
+func (l *LoginRecorder) Finish(callback bool) string {
+	reason := ""
+	switch {
+	case l.succeeded:
+		loginsSucceeded.WithLabelValues(l.profileID, l.provider).Inc()
+		return ""
+	case l.reason != "":
+		reason = l.reason
+	case l.status >= http.StatusBadRequest:
+		reason = "status_" + strconv.Itoa(l.status)
+	case callback:
+		reason = FailureRedirect
+	default:
+		return ""
+	}
+	loginsFailed.WithLabelValues(l.profileID, l.provider, reason).Inc()
+	return reason
+}
+
+// LoginSucceeded marks the login of w as completed, it is called by the identity handlers
+func LoginSucceeded(w http.ResponseWriter) {
+	if recorder, ok := w.(*LoginRecorder); ok {
+		recorder.succeeded = true
+	}
+}
+
+// LoginFailed marks the login of w as failed with the code of the error shown to the user
+func LoginFailed(w http.ResponseWriter, reason string) {
+	if recorder, ok := w.(*LoginRecorder); ok && recorder.reason == "" && !recorder.succeeded {
+		recorder.reason = reason
+	}
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginRecorder(t *testing.T) {
+	tests := []struct {
+		name      string
+		callback  bool
+		login     func(w http.ResponseWriter)
+		succeeded bool
+		reason    string
+	}{
+		{
+			name: "succeeded",
+			login: func(w http.ResponseWriter) {
+				LoginSucceeded(w)
+				redirect(w, "/")
+			},
+			succeeded: true,
+		},
+		{
+			name:   "failed with a code",
+			login:  func(w http.ResponseWriter) { LoginFailed(w, "access_denied"); w.WriteHeader(http.StatusForbidden) },
+			reason: "access_denied",
+		},
+		{
+			name:   "failed with a status",
+			login:  func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) },
+			reason: "status_502",
+		},
+		{
+			name:     "redirected to the failure redirect",
+			callback: true,
+			login:    func(w http.ResponseWriter) { redirect(w, "/failed") },
+			reason:   FailureRedirect,
+		},
+		{
+			name:  "redirected to the provider",
+			login: func(w http.ResponseWriter) { redirect(w, "/idp") },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			succeeded, failed := testutil.CollectAndCount(loginsSucceeded), testutil.CollectAndCount(loginsFailed)
+
+			profile := test.name
+			recorder := NewLoginRecorder(httptest.NewRecorder(), profile, "test")
+			test.login(recorder)
+			assert.Equal(t, test.reason, recorder.Finish(test.callback))
+
+			if test.succeeded {
+				succeeded++
+				assert.Equal(t, 1.0, testutil.ToFloat64(loginsSucceeded.WithLabelValues(profile, "test")))
+			}
+			if test.reason != "" {
+				failed++
+				assert.Equal(t, 1.0, testutil.ToFloat64(loginsFailed.WithLabelValues(profile, "test", test.reason)))
+			}
+			assert.Equal(t, succeeded, testutil.CollectAndCount(loginsSucceeded))
+			assert.Equal(t, failed, testutil.CollectAndCount(loginsFailed))
+		})
+	}
+
+	t.Run("success wins over a later failure", func(t *testing.T) {
+		failed := testutil.CollectAndCount(loginsFailed)
+		recorder := NewLoginRecorder(httptest.NewRecorder(), "late-failure", "test")
+		LoginSucceeded(recorder)
+		LoginFailed(recorder, "server_error")
+		recorder.Finish(true)
+		assert.Equal(t, 1.0, testutil.ToFloat64(loginsSucceeded.WithLabelValues("late-failure", "test")))
+		assert.Equal(t, failed, testutil.CollectAndCount(loginsFailed))
+	})
+
+	t.Run("other writers are left alone", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		LoginSucceeded(w)
+		LoginFailed(w, "server_error")
+	})
+}
+
+func redirect(w http.ResponseWriter, url string) {
+	http.Redirect(w, httptest.NewRequest(http.MethodGet, "/", nil), url, http.StatusFound)
+}
+
+type pinger struct {
+	err error
+}
+
+func (p pinger) Ping() error {
+	return p.err
+}
+
+func TestHandler(t *testing.T) {
+	RegisterBackend("up", pinger{})
+	RegisterBackend("down", pinger{err: errors.New("connection refused")})
+	assert.NoError(t, RegisterProfiles(func() map[string]int {
+		return map[string]int{"SocialProvider": 2, "ADProvider": 1}
+	}))
+	LoginStarted("handler", "SocialProvider")
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body := w.Body.String()
+	assert.Contains(t, body, `tib_backend_up{backend="up"} 1`)
+	assert.Contains(t, body, `tib_backend_up{backend="down"} 0`)
+	assert.Contains(t, body, `tib_profiles{provider="SocialProvider"} 2`)
+	assert.Contains(t, body, `tib_logins_started_total{profile="handler",provider="SocialProvider"} 1`)
+	assert.Contains(t, body, "go_goroutines")
+}
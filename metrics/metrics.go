@@ -0,0 +1,112 @@
+/*
+Package metrics exposes Prometheus metrics for logins, identity providers and the Tyk APIs TIB calls.
+*/
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const Namespace = "tib"
+
+// Settings configure the /metrics endpoint
+type Settings struct {
+	Enabled bool
+	// Port serves /metrics on its own port instead of the port of TIB when set
+	Port int
+}
+
+// Registry holds the metrics of TIB
+var Registry = prometheus.NewRegistry()
+
+var (
+	loginsStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "logins_started_total",
+		Help:      "Logins started, by profile and provider.",
+	}, []string{"profile", "provider"})
+
+	loginsSucceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "logins_succeeded_total",
+		Help:      "Logins completed by the identity handler, by profile and provider.",
+	}, []string{"profile", "provider"})
+
+	loginsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "logins_failed_total",
+		Help:      "Logins that failed, by profile, provider and the code of the error shown to the user.",
+	}, []string{"profile", "provider", "reason"})
+
+	idpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "idp_request_duration_seconds",
+		Help:      "Time spent calling the identity provider during a login.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"profile", "provider"})
+
+	ldapDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "ldap_duration_seconds",
+		Help:      "Time spent on LDAP operations, by profile and operation (bind or search).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"profile", "operation"})
+
+	tykAPIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "tyk_api_request_duration_seconds",
+		Help:      "Time spent calling the Tyk APIs, by API, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api", "method", "code"})
+
+	backendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "backend_up",
+		Help:      "Whether TIB can reach a backend, checked on every scrape.",
+	}, []string{"backend"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		loginsStarted, loginsSucceeded, loginsFailed,
+		idpDuration, ldapDuration, tykAPIDuration,
+		backendUp,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	handler := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checkBackends()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// LoginStarted counts a login that has been started
+func LoginStarted(profileID string, provider string) {
+	loginsStarted.WithLabelValues(profileID, provider).Inc()
+}
+
+// ObserveIdP records a call to an identity provider that started at start
+func ObserveIdP(profileID string, provider string, start time.Time) {
+	idpDuration.WithLabelValues(profileID, provider).Observe(time.Since(start).Seconds())
+}
+
+// ObserveLDAP records an LDAP bind or search that started at start
+func ObserveLDAP(profileID string, operation string, start time.Time) {
+	ldapDuration.WithLabelValues(profileID, operation).Observe(time.Since(start).Seconds())
+}
+
+// ObserveTykAPI records a call to a Tyk API (dashboard, dashboard_admin, gateway or portal) that started at start
+func ObserveTykAPI(api string, method string, code int, start time.Time) {
+	tykAPIDuration.WithLabelValues(api, method, strconv.Itoa(code)).Observe(time.Since(start).Seconds())
+}
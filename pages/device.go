@@ -0,0 +1,68 @@
+package pages
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// DevicePage is the data available to device verification templates. The page first asks for the code shown on the
+// device, then asks the user to confirm it before the login starts, so that a link with someone else's code can't log
+// the user in on that device (RFC 8628 section 5.4).
+type DevicePage struct {
+	UserCode  string
+	Error     string
+	Confirm   bool
+	CSRFField string
+	CSRFToken string
+}
+
+var deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Device login</title>
+	<style>
+		body { font-family: sans-serif; background: #f4f4f7; }
+		form { max-width: 320px; margin: 10vh auto; padding: 2em; background: #fff; border-radius: 4px; }
+		label, input, button { display: block; width: 100%; box-sizing: border-box; margin-bottom: 1em; }
+		input, button { padding: .6em; }
+		.code { font-size: 1.5em; letter-spacing: .1em; }
+		.error { color: #b00020; }
+	</style>
+</head>
+<body>
+	{{if .Confirm}}
+	<form method="POST">
+		<h1>Device login</h1>
+		<p>A device is asking to log in with your account. Only continue if you started this login yourself and your device shows this code:</p>
+		<p class="code"><strong>{{.UserCode}}</strong></p>
+		<input type="hidden" name="user_code" value="{{.UserCode}}">
+		<input type="hidden" name="{{.CSRFField}}" value="{{.CSRFToken}}">
+		<button type="submit" name="confirm" value="1">Continue</button>
+	</form>
+	{{else}}
+	<form method="GET">
+		<h1>Device login</h1>
+		{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+		<label for="user_code">Enter the code shown on your device</label>
+		<input id="user_code" name="user_code" value="{{.UserCode}}" autocomplete="off" autofocus required>
+		<button type="submit">Next</button>
+	</form>
+	{{end}}
+</body>
+</html>`))
+
+// RenderDevice writes the device verification page, the DeviceTemplate of templates replaces the built-in page when
+// it is set
+func RenderDevice(w http.ResponseWriter, code int, templates *tap.PagesConfig, data DevicePage) error {
+	templatePath := ""
+	if templates != nil {
+		templatePath = templates.DeviceTemplate
+	}
+	data.CSRFField = CSRFFieldName
+
+	return render(w, code, deviceTemplate, templatePath, data)
+}
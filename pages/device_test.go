@@ -0,0 +1,45 @@
+package pages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+func TestRenderDevice(t *testing.T) {
+	w := httptest.NewRecorder()
+	assert.NoError(t, RenderDevice(w, http.StatusBadRequest, nil, DevicePage{UserCode: "<ABCD>", Error: "The code is invalid or has expired."}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	body := w.Body.String()
+	assert.Contains(t, body, `<form method="GET">`)
+	assert.Contains(t, body, `value="&lt;ABCD&gt;"`)
+	assert.Contains(t, body, "The code is invalid or has expired.")
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, RenderDevice(w, http.StatusOK, nil, DevicePage{UserCode: "ABCD-EFGH", Confirm: true, CSRFToken: "token-1"}))
+	body = w.Body.String()
+	assert.Contains(t, body, `<form method="POST">`)
+	assert.Contains(t, body, "<strong>ABCD-EFGH</strong>")
+	assert.Contains(t, body, `name="csrf_token" value="token-1"`)
+
+	dir := t.TempDir()
+	SetTemplateDir(dir)
+	t.Cleanup(func() { SetTemplateDir("") })
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "device.html"), []byte(`{{if .Confirm}}<b>{{.UserCode}}</b><input name="{{.CSRFField}}" value="{{.CSRFToken}}">{{end}}`), 0600))
+
+	w = httptest.NewRecorder()
+	assert.NoError(t, RenderDevice(w, http.StatusOK, &tap.PagesConfig{DeviceTemplate: "device.html"}, DevicePage{UserCode: "ABCD-EFGH", Confirm: true, CSRFToken: "token-1"}))
+	assert.Equal(t, `<b>ABCD-EFGH</b><input name="csrf_token" value="token-1">`, w.Body.String())
+
+	// files outside of the template directory fall back to the built-in page
+	w = httptest.NewRecorder()
+	assert.NoError(t, RenderDevice(w, http.StatusOK, &tap.PagesConfig{DeviceTemplate: "../" + filepath.Base(dir) + "/device.html"}, DevicePage{}))
+	assert.Contains(t, w.Body.String(), "<title>Device login</title>")
+}
@@ -0,0 +1,43 @@
+package pages
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// DiscoverPage is the data of the home-realm discovery page, which asks users for their email address
+type DiscoverPage struct {
+	Action string
+	Email  string
+	Error  string
+}
+
+var discoverTemplate = template.Must(template.New("discover").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Log in</title>
+	<style>
+		body { font-family: sans-serif; background: #f4f4f7; }
+		form { max-width: 320px; margin: 10vh auto; padding: 2em; background: #fff; border-radius: 4px; }
+		label, input, button { display: block; width: 100%; box-sizing: border-box; margin-bottom: 1em; }
+		input, button { padding: .6em; }
+		.error { color: #b00020; }
+	</style>
+</head>
+<body>
+	<form method="POST" action="{{.Action}}">
+		<h1>Log in</h1>
+		{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+		<label for="email">Email address</label>
+		<input id="email" name="email" type="email" value="{{.Email}}" autocomplete="email" autofocus required>
+		<button type="submit">Continue</button>
+	</form>
+</body>
+</html>`))
+
+// RenderDiscover writes the home-realm discovery page
+func RenderDiscover(w http.ResponseWriter, code int, data DiscoverPage) error {
+	return render(w, code, discoverTemplate, "", data)
+}
@@ -0,0 +1,54 @@
+package pages
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// FormField is a hidden field of an auto-submitting form
+type FormField struct {
+	Name  string
+	Value string
+}
+
+type formPostPage struct {
+	Action      string
+	Fields      []FormField
+	ScriptNonce string
+}
+
+var formPostTemplate = template.Must(template.New("form_post").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Logging in...</title>
+</head>
+<body>
+	<form method="POST" action="{{.Action}}">
+		{{range .Fields}}<input type="hidden" name="{{.Name}}" value="{{.Value}}">
+		{{end}}<noscript><button type="submit">Continue</button></noscript>
+	</form>
+	<script nonce="{{.ScriptNonce}}">document.forms[0].submit();</script>
+</body>
+</html>`))
+
+// RenderFormPost writes a page that POSTs fields to action as soon as it loads, so that they never appear in a URL
+func RenderFormPost(w http.ResponseWriter, action string, fields []FormField) error {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	page := formPostPage{Action: action, Fields: fields, ScriptNonce: base64.RawURLEncoding.EncodeToString(raw)}
+
+	formAction := "'self'"
+	if target, err := url.Parse(action); err == nil && target.Scheme != "" {
+		formAction = target.Scheme + "://" + target.Host
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'nonce-"+page.ScriptNonce+"'; form-action "+formAction)
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	return render(w, http.StatusOK, formPostTemplate, "", page)
+}
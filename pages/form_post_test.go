@@ -0,0 +1,37 @@
+package pages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderFormPost(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := RenderFormPost(w, "https://dashboard.example.com/tap?x=1", []FormField{{Name: "nonce", Value: `"><script>`}})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-referrer", w.Header().Get("Referrer-Policy"))
+
+	csp := w.Header().Get("Content-Security-Policy")
+	assert.Contains(t, csp, "default-src 'none'")
+	assert.Contains(t, csp, "form-action https://dashboard.example.com")
+
+	body := w.Body.String()
+	assert.Contains(t, body, `method="POST"`)
+	assert.Contains(t, body, `action="https://dashboard.example.com/tap?x=1"`)
+	assert.Contains(t, body, `name="nonce" value="&#34;&gt;&lt;script&gt;"`)
+
+	// the script is only allowed to run with the nonce of the policy
+	nonce := strings.TrimSuffix(strings.SplitN(csp, "'nonce-", 2)[1], "'; form-action https://dashboard.example.com")
+	assert.Contains(t, body, `<script nonce="`+nonce+`">`)
+
+	t.Run("relative action", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		assert.NoError(t, RenderFormPost(w, "/tap", nil))
+		assert.Contains(t, w.Header().Get("Content-Security-Policy"), "form-action 'self'")
+	})
+}
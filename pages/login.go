@@ -0,0 +1,97 @@
+package pages
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+)
+
+const (
+	// CSRFCookieName and CSRFFieldName hold the two copies of the token that protects the login form
+	CSRFCookieName = "tib-login-csrf"
+	CSRFFieldName  = "csrf_token"
+)
+
+// LoginPage is the data available to login form templates
+type LoginPage struct {
+	ProfileID     string
+	Action        string
+	Title         string
+	LogoURL       string
+	StylesheetURL string
+	Username      string
+	Error         string
+	CSRFField     string
+	CSRFToken     string
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{.Title}}</title>
+	{{if .StylesheetURL}}<link rel="stylesheet" href="{{.StylesheetURL}}">{{else}}<style>
+		body { font-family: sans-serif; background: #f4f4f7; }
+		form { max-width: 320px; margin: 10vh auto; padding: 2em; background: #fff; border-radius: 4px; }
+		label, input, button { display: block; width: 100%; box-sizing: border-box; margin-bottom: 1em; }
+		input, button { padding: .6em; }
+		.error { color: #b00020; }
+	</style>{{end}}
+</head>
+<body>
+	<form method="POST" action="{{.Action}}">
+		{{if .LogoURL}}<img src="{{.LogoURL}}" alt="">{{end}}
+		<h1>{{.Title}}</h1>
+		{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+		<input type="hidden" name="{{.CSRFField}}" value="{{.CSRFToken}}">
+		<label for="username">Username</label>
+		<input id="username" name="username" value="{{.Username}}" autocomplete="username" autofocus required>
+		<label for="password">Password</label>
+		<input id="password" name="password" type="password" autocomplete="current-password" required>
+		<button type="submit">Log in</button>
+	</form>
+</body>
+</html>`))
+
+// RenderLogin writes the login form, templatePath replaces the built-in form when it is set
+func RenderLogin(w http.ResponseWriter, code int, templatePath string, data LoginPage) error {
+	if data.Title == "" {
+		data.Title = "Log in"
+	}
+	data.CSRFField = CSRFFieldName
+
+	return render(w, code, loginTemplate, templatePath, data)
+}
+
+// NewCSRFToken sets a new CSRF cookie scoped to path and returns the token to embed in the form
+func NewCSRFToken(w http.ResponseWriter, r *http.Request, path string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     path,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// ValidCSRFToken checks that the token posted with the form matches the CSRF cookie
+func ValidCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	posted := r.PostFormValue(CSRFFieldName)
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(posted)) == 1
+}
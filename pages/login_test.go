@@ -0,0 +1,76 @@
+package pages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderLogin(t *testing.T) {
+	page := LoginPage{ProfileID: "ldap", Action: "/auth/ldap/login", Username: "<alice>", Error: "Invalid username or password.", CSRFToken: "token-1"}
+
+	w := httptest.NewRecorder()
+	assert.NoError(t, RenderLogin(w, http.StatusUnauthorized, "", page))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, `<title>Log in</title>`)
+	assert.Contains(t, body, `action="/auth/ldap/login"`)
+	assert.Contains(t, body, `name="csrf_token" value="token-1"`)
+	assert.Contains(t, body, `value="&lt;alice&gt;"`)
+	assert.Contains(t, body, "Invalid username or password.")
+
+	dir := t.TempDir()
+	SetTemplateDir(dir)
+	t.Cleanup(func() { SetTemplateDir("") })
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "login.html"), []byte(`<h1>{{.Title}}</h1><input name="{{.CSRFField}}" value="{{.CSRFToken}}">`), 0600))
+
+	page.Title = "Acme SSO"
+	w = httptest.NewRecorder()
+	assert.NoError(t, RenderLogin(w, http.StatusOK, "login.html", page))
+	assert.Equal(t, `<h1>Acme SSO</h1><input name="csrf_token" value="token-1">`, w.Body.String())
+
+	// a broken template file falls back to the built-in form
+	w = httptest.NewRecorder()
+	assert.NoError(t, RenderLogin(w, http.StatusOK, "missing.html", page))
+	assert.Contains(t, w.Body.String(), `<title>Acme SSO</title>`)
+
+	// and so do files outside of the template directory
+	for _, path := range []string{filepath.Join(dir, "login.html"), "../" + filepath.Base(dir) + "/login.html"} {
+		w = httptest.NewRecorder()
+		assert.NoError(t, RenderLogin(w, http.StatusOK, path, page))
+		assert.Contains(t, w.Body.String(), `<title>Acme SSO</title>`, path)
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	w := httptest.NewRecorder()
+	token, err := NewCSRFToken(w, httptest.NewRequest(http.MethodGet, "/auth/ldap/login", nil), "/auth/ldap/login")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+	cookie := w.Result().Cookies()[0]
+	assert.Equal(t, CSRFCookieName, cookie.Name)
+	assert.Equal(t, "/auth/ldap/login", cookie.Path)
+	assert.True(t, cookie.HttpOnly)
+
+	post := func(formToken string, withCookie bool) *http.Request {
+		form := url.Values{CSRFFieldName: {formToken}}
+		r := httptest.NewRequest(http.MethodPost, "/auth/ldap/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if withCookie {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+
+	assert.True(t, ValidCSRFToken(post(token, true)))
+	assert.False(t, ValidCSRFToken(post("forged", true)))
+	assert.False(t, ValidCSRFToken(post(token, false)))
+	assert.False(t, ValidCSRFToken(post("", true)))
+}
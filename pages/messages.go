@@ -0,0 +1,127 @@
+package pages
+
+import "net/http"
+
+// Codes identify what happened on error and result pages, templates and API clients can rely on them
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeLoginFailed          = "login_failed"
+	CodeAuthenticationFailed = "authentication_failed"
+	CodeAccessDenied         = "access_denied"
+	CodeNotFound             = "not_found"
+	CodeTokenFailed          = "token_failed"
+	CodeNoReturnURL          = "no_return_url"
+	CodeInvalidDeviceCode    = "invalid_device_code"
+	CodeServerError          = "server_error"
+
+	CodeLoginComplete       = "login_complete"
+	CodeDeviceLoginComplete = "device_login_complete"
+)
+
+// statuses are the HTTP status codes of error codes
+var statuses = map[string]int{
+	CodeInvalidRequest:       http.StatusBadRequest,
+	CodeLoginFailed:          http.StatusUnauthorized,
+	CodeAuthenticationFailed: http.StatusUnauthorized,
+	CodeAccessDenied:         http.StatusForbidden,
+	CodeNotFound:             http.StatusNotFound,
+	CodeTokenFailed:          http.StatusInternalServerError,
+	CodeNoReturnURL:          http.StatusInternalServerError,
+	CodeInvalidDeviceCode:    http.StatusBadRequest,
+	CodeServerError:          http.StatusInternalServerError,
+}
+
+// StatusFor returns the HTTP status code of an error code
+func StatusFor(code string) int {
+	if status, ok := statuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// CodeFor returns the error code shown for an HTTP status code
+func CodeFor(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeAuthenticationFailed
+	case http.StatusForbidden:
+		return CodeAccessDenied
+	case http.StatusNotFound:
+		return CodeNotFound
+	}
+	return CodeServerError
+}
+
+type message struct {
+	Title string
+	Text  string
+}
+
+// messages holds the built-in text of each code by locale, DefaultLocale must have all of them
+var messages = map[string]map[string]message{
+	"en": {
+		CodeInvalidRequest:       {"Invalid request", "The request could not be processed."},
+		CodeLoginFailed:          {"Login failed", "We could not log you in. Please try again or contact your administrator."},
+		CodeAuthenticationFailed: {"Authentication failed", "Your credentials could not be verified."},
+		CodeAccessDenied:         {"Access denied", "You are not allowed to log in here. Contact your administrator."},
+		CodeNotFound:             {"Not found", "The page you are looking for does not exist."},
+		CodeTokenFailed:          {"Login failed", "Your access token could not be created. Please try again later."},
+		CodeNoReturnURL:          {"Login incomplete", "There is no return URL for this login. Contact your administrator."},
+		CodeInvalidDeviceCode:    {"Device login failed", "The code is invalid or has expired."},
+		CodeServerError:          {"Something went wrong", "An unexpected error occurred. Please try again later."},
+		CodeLoginComplete:        {"Logged in", "You are logged in, but there is no return URL for this login."},
+		CodeDeviceLoginComplete:  {"Login complete", "Login complete, you can return to your device."},
+	},
+	"de": {
+		CodeInvalidRequest:       {"Ungültige Anfrage", "Die Anfrage konnte nicht verarbeitet werden."},
+		CodeLoginFailed:          {"Anmeldung fehlgeschlagen", "Die Anmeldung ist fehlgeschlagen. Bitte versuchen Sie es erneut oder wenden Sie sich an Ihren Administrator."},
+		CodeAuthenticationFailed: {"Authentifizierung fehlgeschlagen", "Ihre Anmeldedaten konnten nicht überprüft werden."},
+		CodeAccessDenied:         {"Zugriff verweigert", "Sie dürfen sich hier nicht anmelden. Wenden Sie sich an Ihren Administrator."},
+		CodeNotFound:             {"Nicht gefunden", "Die gesuchte Seite existiert nicht."},
+		CodeTokenFailed:          {"Anmeldung fehlgeschlagen", "Ihr Zugriffstoken konnte nicht erstellt werden. Bitte versuchen Sie es später erneut."},
+		CodeNoReturnURL:          {"Anmeldung unvollständig", "Für diese Anmeldung ist keine Rückkehr-URL hinterlegt. Wenden Sie sich an Ihren Administrator."},
+		CodeInvalidDeviceCode:    {"Geräteanmeldung fehlgeschlagen", "Der Code ist ungültig oder abgelaufen."},
+		CodeServerError:          {"Etwas ist schiefgelaufen", "Ein unerwarteter Fehler ist aufgetreten. Bitte versuchen Sie es später erneut."},
+		CodeLoginComplete:        {"Angemeldet", "Sie sind angemeldet, aber für diese Anmeldung ist keine Rückkehr-URL hinterlegt."},
+		CodeDeviceLoginComplete:  {"Anmeldung abgeschlossen", "Anmeldung abgeschlossen, Sie können zu Ihrem Gerät zurückkehren."},
+	},
+	"fr": {
+		CodeInvalidRequest:       {"Requête invalide", "La requête n'a pas pu être traitée."},
+		CodeLoginFailed:          {"Échec de la connexion", "Nous n'avons pas pu vous connecter. Réessayez ou contactez votre administrateur."},
+		CodeAuthenticationFailed: {"Échec de l'authentification", "Vos identifiants n'ont pas pu être vérifiés."},
+		CodeAccessDenied:         {"Accès refusé", "Vous n'êtes pas autorisé à vous connecter ici. Contactez votre administrateur."},
+		CodeNotFound:             {"Introuvable", "La page demandée n'existe pas."},
+		CodeTokenFailed:          {"Échec de la connexion", "Votre jeton d'accès n'a pas pu être créé. Réessayez plus tard."},
+		CodeNoReturnURL:          {"Connexion incomplète", "Aucune URL de retour n'est définie pour cette connexion. Contactez votre administrateur."},
+		CodeInvalidDeviceCode:    {"Échec de la connexion de l'appareil", "Le code est invalide ou a expiré."},
+		CodeServerError:          {"Une erreur est survenue", "Une erreur inattendue est survenue. Réessayez plus tard."},
+		CodeLoginComplete:        {"Connecté", "Vous êtes connecté, mais aucune URL de retour n'est définie pour cette connexion."},
+		CodeDeviceLoginComplete:  {"Connexion terminée", "Connexion terminée, vous pouvez retourner sur votre appareil."},
+	},
+	"es": {
+		CodeInvalidRequest:       {"Solicitud no válida", "No se pudo procesar la solicitud."},
+		CodeLoginFailed:          {"Error al iniciar sesión", "No pudimos iniciar su sesión. Inténtelo de nuevo o contacte con su administrador."},
+		CodeAuthenticationFailed: {"Error de autenticación", "No se pudieron verificar sus credenciales."},
+		CodeAccessDenied:         {"Acceso denegado", "No tiene permiso para iniciar sesión aquí. Contacte con su administrador."},
+		CodeNotFound:             {"No encontrado", "La página que busca no existe."},
+		CodeTokenFailed:          {"Error al iniciar sesión", "No se pudo crear su token de acceso. Inténtelo de nuevo más tarde."},
+		CodeNoReturnURL:          {"Inicio de sesión incompleto", "No hay una URL de retorno para este inicio de sesión. Contacte con su administrador."},
+		CodeInvalidDeviceCode:    {"Error al iniciar sesión en el dispositivo", "El código no es válido o ha caducado."},
+		CodeServerError:          {"Algo salió mal", "Se produjo un error inesperado. Inténtelo de nuevo más tarde."},
+		CodeLoginComplete:        {"Sesión iniciada", "Ha iniciado sesión, pero no hay una URL de retorno para este inicio de sesión."},
+		CodeDeviceLoginComplete:  {"Inicio de sesión completado", "Inicio de sesión completado, puede volver a su dispositivo."},
+	},
+}
+
+// lookup returns the text of a code in locale, falling back to DefaultLocale
+func lookup(locale string, code string) message {
+	if msg, ok := messages[locale][code]; ok {
+		return msg
+	}
+	if msg, ok := messages[DefaultLocale][code]; ok {
+		return msg
+	}
+	return messages[DefaultLocale][CodeServerError]
+}
@@ -0,0 +1,99 @@
+package pages
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+)
+
+// CorrelationIDHeader is read from the request, or set on the response when the request has none, so that a page a
+// user reports can be matched with the logs
+const CorrelationIDHeader = logger.CorrelationIDHeader
+
+// DefaultLocale is used when none of the languages in Accept-Language are supported
+const DefaultLocale = "en"
+
+type weighted struct {
+	value string
+	q     float64
+	index int
+}
+
+// parseWeighted splits an Accept style header in its values, ordered by preference
+func parseWeighted(header string) []weighted {
+	values := []weighted{}
+	for i, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(fields[0]))
+		if value == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		values = append(values, weighted{value: value, q: q, index: i})
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].q > values[j].q
+	})
+	return values
+}
+
+// WantsHTML reports whether the client prefers an HTML page to JSON, which is the case for browsers. Clients that
+// don't name text/html explicitly get JSON.
+func WantsHTML(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+
+	for _, accepted := range parseWeighted(r.Header.Get("Accept")) {
+		switch accepted.value {
+		case "text/html", "application/xhtml+xml":
+			return true
+		case "application/json", "application/problem+json":
+			return false
+		}
+	}
+	return false
+}
+
+// Locale picks the first language of Accept-Language that has built-in messages
+func Locale(r *http.Request) string {
+	if r == nil {
+		return DefaultLocale
+	}
+
+	for _, lang := range parseWeighted(r.Header.Get("Accept-Language")) {
+		base := strings.SplitN(lang.value, "-", 2)[0]
+		if _, ok := messages[base]; ok {
+			return base
+		}
+	}
+	return DefaultLocale
+}
+
+// CorrelationID returns the correlation ID given to the request by logger.CorrelationIDHandler. A request that
+// didn't go through it gets the ID the handler would have given it.
+func CorrelationID(r *http.Request) string {
+	if r == nil {
+		return logger.NewCorrelationID()
+	}
+	if id := logger.CorrelationID(r.Context()); id != "" {
+		return id
+	}
+	return logger.RequestCorrelationID(r)
+}
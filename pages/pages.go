@@ -0,0 +1,73 @@
+// Package pages renders the HTML pages TIB serves to browsers, the built-in templates can be replaced per profile
+// with template files
+package pages
+
+import (
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// DefaultTemplateDir holds the template files of profiles when the configuration doesn't set a TemplateDir
+const DefaultTemplateDir = "templates"
+
+var onceReloadPagesLogger sync.Once
+var log = logger.Get()
+var pagesLogTag = "PAGES"
+var pagesLogger = log.WithField("prefix", pagesLogTag)
+
+var templateDir = DefaultTemplateDir
+
+// SetTemplateDir sets the directory the template files of profiles are read from
+func SetTemplateDir(dir string) {
+	if dir == "" {
+		dir = DefaultTemplateDir
+	}
+	templateDir = dir
+}
+
+// templateFile returns the file of a template set on a profile, it can't be outside of the template directory
+func templateFile(path string) (string, error) {
+	if err := tap.ValidTemplatePath(path); err != nil {
+		return "", err
+	}
+	return filepath.Join(templateDir, path), nil
+}
+
+func reloadPagesLogger() {
+	log = logger.Get()
+	pagesLogger = &logrus.Entry{Logger: log}
+	pagesLogger = pagesLogger.Logger.WithField("prefix", pagesLogTag)
+}
+
+// render writes a page with the template file at path in the template directory, or with the built-in template when
+// path is empty or the file can't be parsed. Files are parsed on every request so that changes don't need a restart.
+func render(w http.ResponseWriter, code int, builtIn *template.Template, path string, data interface{}) error {
+	//if an external logger was set, then lets reload it to inherit those configs
+	onceReloadPagesLogger.Do(reloadPagesLogger)
+
+	tmpl := builtIn
+	if path != "" {
+		file, err := templateFile(path)
+		var custom *template.Template
+		if err == nil {
+			custom, err = template.ParseFiles(file)
+		}
+		if err != nil {
+			pagesLogger.WithField("template", path).WithError(err).Error("Failed to parse template, using the built-in one")
+		} else {
+			tmpl = custom
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	return tmpl.Execute(w, data)
+}
@@ -0,0 +1,124 @@
+package pages
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// ResultPage is the data available to error and success page templates
+type ResultPage struct {
+	Success       bool
+	Status        int
+	Code          string
+	Title         string
+	Message       string
+	Detail        string
+	Locale        string
+	CorrelationID string
+}
+
+// Result is the JSON body sent instead of a page to clients that don't ask for HTML, Status and Error match the body
+// of the broker's other API errors
+type Result struct {
+	Status        string
+	Error         string `json:",omitempty"`
+	Message       string `json:",omitempty"`
+	Code          string
+	CorrelationID string
+}
+
+var resultTemplate = template.Must(template.New("result").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{.Title}}</title>
+	<style>
+		body { font-family: sans-serif; background: #f4f4f7; }
+		main { max-width: 480px; margin: 10vh auto; padding: 2em; background: #fff; border-radius: 4px; }
+		.detail, .reference { color: #666; font-size: .85em; }
+	</style>
+</head>
+<body>
+	<main>
+		<h1>{{.Title}}</h1>
+		<p>{{.Message}}</p>
+		{{if .Detail}}<p class="detail">{{.Detail}}</p>{{end}}
+		{{if not .Success}}<p class="reference">Reference: {{.CorrelationID}}</p>{{end}}
+	</main>
+</body>
+</html>`))
+
+// RenderError tells the user that the login failed, with the status of code
+func RenderError(w http.ResponseWriter, r *http.Request, templates *tap.PagesConfig, code string, detail string) {
+	RenderErrorWithStatus(w, r, templates, StatusFor(code), code, detail, "")
+}
+
+// RenderErrorWithStatus tells the user that the login failed, detail adds to the message of code and is returned as
+// the error of JSON responses. correlationID is the one already logged for the error, the one of the request is used
+// when it is empty.
+func RenderErrorWithStatus(w http.ResponseWriter, r *http.Request, templates *tap.PagesConfig, status int, code string, detail string, correlationID string) {
+	templatePath := ""
+	if templates != nil {
+		templatePath = templates.ErrorTemplate
+	}
+	renderResult(w, r, templatePath, ResultPage{Status: status, Code: code, Detail: detail, CorrelationID: correlationID})
+}
+
+// RenderSuccess tells the user that the login is complete when there is nowhere to redirect them to
+func RenderSuccess(w http.ResponseWriter, r *http.Request, templates *tap.PagesConfig, code string) {
+	templatePath := ""
+	if templates != nil {
+		templatePath = templates.SuccessTemplate
+	}
+	renderResult(w, r, templatePath, ResultPage{Success: true, Status: http.StatusOK, Code: code})
+}
+
+func renderResult(w http.ResponseWriter, r *http.Request, templatePath string, page ResultPage) {
+	//if an external logger was set, then lets reload it to inherit those configs
+	onceReloadPagesLogger.Do(reloadPagesLogger)
+
+	page.Locale = Locale(r)
+	if page.CorrelationID == "" {
+		page.CorrelationID = CorrelationID(r)
+	}
+	msg := lookup(page.Locale, page.Code)
+	page.Title = msg.Title
+	page.Message = msg.Text
+
+	w.Header().Set(CorrelationIDHeader, page.CorrelationID)
+	if !page.Success {
+		metrics.LoginFailed(w, page.Code)
+		pagesLogger.WithFields(logrus.Fields{
+			"code":           page.Code,
+			"status":         page.Status,
+			"correlation_id": page.CorrelationID,
+		}).Warning("Login failed, showing error to the user")
+	}
+
+	if WantsHTML(r) {
+		w.Header().Set("Content-Language", page.Locale)
+		if err := render(w, page.Status, resultTemplate, templatePath, page); err != nil {
+			pagesLogger.WithError(err).Error("Failed to render result page")
+		}
+		return
+	}
+
+	result := Result{Status: "ok", Message: page.Message, Code: page.Code, CorrelationID: page.CorrelationID}
+	if !page.Success {
+		result = Result{Status: "error", Error: page.Detail, Code: page.Code, CorrelationID: page.CorrelationID}
+		if result.Error == "" {
+			result.Error = page.Message
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(page.Status)
+	json.NewEncoder(w).Encode(result) //nolint:errcheck
+}
@@ -0,0 +1,131 @@
+package pages
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func TestWantsHTML(t *testing.T) {
+	tests := map[string]bool{
+		"":                                     false,
+		"*/*":                                  false,
+		"application/json":                     false,
+		browserAccept:                          true,
+		"application/json, text/html;q=0.5":    false,
+		"application/json;q=0.5, text/html":    true,
+		"text/html;q=0, application/json;q=.1": false,
+	}
+
+	for accept, want := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", accept)
+		assert.Equal(t, want, WantsHTML(r), accept)
+	}
+	assert.False(t, WantsHTML(nil))
+}
+
+func TestLocale(t *testing.T) {
+	tests := map[string]string{
+		"":                        "en",
+		"de-DE,de;q=0.9,en;q=0.8": "de",
+		"ja, fr-CA;q=0.8":         "fr",
+		"en;q=0.5, es;q=0.9":      "es",
+		"ja":                      "en",
+	}
+
+	for header, want := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Language", header)
+		assert.Equal(t, want, Locale(r), header)
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(logger.RequestIDHeader, "req-1")
+	assert.Equal(t, "req-1", CorrelationID(r))
+
+	// the ID given by the middleware wins over the headers
+	assert.Equal(t, "corr-1", CorrelationID(r.WithContext(logger.WithCorrelationID(r.Context(), "corr-1"))))
+
+	// IDs that could forge log lines are replaced
+	r.Header.Set(CorrelationIDHeader, "abc\nlevel=error")
+	id := CorrelationID(r)
+	assert.NotContains(t, id, "level=error")
+	assert.NotEmpty(t, id)
+}
+
+func TestMessagesAreComplete(t *testing.T) {
+	for locale, msgs := range messages {
+		assert.Len(t, msgs, len(messages[DefaultLocale]), locale)
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/auth/1/openid-connect/callback", nil)
+	r.Header.Set(CorrelationIDHeader, "corr-1")
+
+	// API clients get JSON
+	w := httptest.NewRecorder()
+	RenderError(w, r, nil, CodeAccessDenied, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "corr-1", w.Header().Get(CorrelationIDHeader))
+	result := Result{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, Result{Status: "error", Error: lookup("en", CodeAccessDenied).Text, Code: CodeAccessDenied, CorrelationID: "corr-1"}, result)
+
+	// browsers get a page in their language
+	r.Header.Set("Accept", browserAccept)
+	r.Header.Set("Accept-Language", "de")
+	w = httptest.NewRecorder()
+	RenderError(w, r, nil, CodeLoginFailed, "state mismatch")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "de", w.Header().Get("Content-Language"))
+	assert.Contains(t, w.Body.String(), "<title>Anmeldung fehlgeschlagen</title>")
+	assert.Contains(t, w.Body.String(), "state mismatch")
+	assert.Contains(t, w.Body.String(), "corr-1")
+
+	// profiles can replace the pages
+	dir := t.TempDir()
+	SetTemplateDir(dir)
+	t.Cleanup(func() { SetTemplateDir("") })
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "error.html"), []byte(`{{.Locale}} {{.Code}} {{.Status}} {{.CorrelationID}}`), 0600))
+	w = httptest.NewRecorder()
+	RenderError(w, r, &tap.PagesConfig{ErrorTemplate: "error.html"}, CodeTokenFailed, "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "de token_failed 500 corr-1", w.Body.String())
+}
+
+func TestRenderSuccess(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	w := httptest.NewRecorder()
+	RenderSuccess(w, r, nil, CodeLoginComplete)
+	assert.Equal(t, http.StatusOK, w.Code)
+	result := Result{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "ok", result.Status)
+	assert.Equal(t, CodeLoginComplete, result.Code)
+	assert.NotEmpty(t, result.CorrelationID)
+
+	dir := t.TempDir()
+	SetTemplateDir(dir)
+	t.Cleanup(func() { SetTemplateDir("") })
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "success.html"), []byte(`done: {{.Message}}`), 0600))
+	r.Header.Set("Accept", browserAccept)
+	w = httptest.NewRecorder()
+	RenderSuccess(w, r, &tap.PagesConfig{ErrorTemplate: "unused", SuccessTemplate: "success.html"}, CodeDeviceLoginComplete)
+	assert.Equal(t, "done: Login complete, you can return to your device.", w.Body.String())
+}
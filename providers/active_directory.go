@@ -6,6 +6,7 @@ extending TAP to use more providers, add them to this section
 package providers
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -13,13 +14,18 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
 	"github.com/markbates/goth"
 
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var onceReloadADLogger sync.Once
@@ -72,11 +78,13 @@ func (s *ADProvider) UseCallback() bool {
 	return false
 }
 
-func (s *ADProvider) connect() {
-	ADLogger.Debug("Connect: starting...")
+func (s *ADProvider) connect(ctx context.Context) {
+	logger := ADLogger.WithContext(ctx)
+	logger.Debug("Connect: starting...")
 	var err error
 	sName := fmt.Sprintf("%s:%s", s.config.LDAPServer, s.config.LDAPPort)
-	ADLogger.Debug("--> To: ", sName)
+	logger.Debug("--> To: ", sName)
+	_, span := tracing.Start(ctx, "ldap connect", attribute.String("server.address", sName))
 	if s.config.LDAPUseSSL {
 		tlsconfig := &tls.Config{
 			ServerName: s.config.LDAPServer,
@@ -85,15 +93,16 @@ func (s *ADProvider) connect() {
 	} else {
 		s.connection, err = ldap.Dial("tcp", sName)
 	}
+	tracing.End(span, err)
 
 	if err != nil {
-		ADLogger.WithFields(logrus.Fields{
+		logger.WithFields(logrus.Fields{
 			"path":  sName,
 			"error": err,
 		}).Error("Failed to dial")
 		return
 	}
-	ADLogger.Debug("Connect: finished...")
+	logger.Debug("Connect: finished...")
 }
 
 // Init initialises the handler with it's IdentityHandler (the interface handling actual account SSO on the target)
@@ -120,7 +129,14 @@ func (s *ADProvider) Init(handler tap.IdentityHandler, profile tap.Profile, conf
 }
 
 func (s *ADProvider) provideErrorRedirect(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, s.config.FailureRedirect, 301)
+	if handleLoginFailure(w, r) {
+		return
+	}
+	if s.config.FailureRedirect == "" {
+		pages.RenderError(w, r, s.profile.Pages, pages.CodeLoginFailed, "")
+		return
+	}
+	http.Redirect(w, r, s.config.FailureRedirect, tap.RedirectStatus(r))
 	return
 }
 
@@ -150,8 +166,9 @@ func (s *ADProvider) generateUsername(username string) string {
 	return uname
 }
 
-func (s *ADProvider) getUserData(username string, password string) (goth.User, error) {
-	ADLogger.Info("Search: starting...")
+func (s *ADProvider) getUserData(ctx context.Context, username string, password string) (goth.User, error) {
+	logger := ADLogger.WithContext(ctx)
+	logger.Info("Search: starting...")
 	uname := username
 	if s.config.SlugifyUserName {
 		uname = Slug(username)
@@ -172,7 +189,7 @@ func (s *ADProvider) getUserData(username string, password string) (goth.User, e
 		DN = s.prepDN(username)
 	}
 
-	ADLogger.WithFields(logrus.Fields{
+	logger.WithFields(logrus.Fields{
 		"DN":     DN,
 		"Filter": s.prepFilter(username),
 	}).Info("Running LDAP search")
@@ -190,9 +207,13 @@ func (s *ADProvider) getUserData(username string, password string) (goth.User, e
 		s.config.LDAPAttributes,
 		nil)
 
+	start := time.Now()
+	_, span := tracing.Start(ctx, "ldap search", attribute.String("ldap.base_dn", DN))
 	sr, err := s.connection.Search(search_request)
+	tracing.End(span, err)
+	metrics.ObserveLDAP(s.profile.ID, "search", start)
 	if err != nil {
-		ADLogger.WithFields(logrus.Fields{
+		logger.WithFields(logrus.Fields{
 			"error": err,
 		}).Error("Failure in search")
 		return thisUser, err
@@ -221,15 +242,15 @@ func (s *ADProvider) getUserData(username string, password string) (goth.User, e
 	}
 
 	if s.config.LDAPAdminUser != "" {
-		bindErr := s.connection.Bind(entry.DN, password)
+		bindErr := s.bind(ctx, entry.DN, password)
 		if bindErr != nil {
-			ADLogger.WithFields(logrus.Fields{
+			logger.WithFields(logrus.Fields{
 				"username": username,
 				"error":    bindErr,
 			}).Error("Bind failed for user")
 			return thisUser, errors.New("Password not matched")
 		}
-		ADLogger.WithField("username", username).Info("User bind successful")
+		logger.WithField("username", username).Info("User bind successful")
 	}
 
 	emailFound := false
@@ -256,7 +277,7 @@ func (s *ADProvider) getUserData(username string, password string) (goth.User, e
 	}
 
 	if !emailFound {
-		ADLogger.Warning("User email not found, generating from username")
+		logger.Warning("User email not found, generating from username")
 		if strings.Contains(username, "@") {
 			thisUser.Email = username
 		} else {
@@ -267,10 +288,21 @@ func (s *ADProvider) getUserData(username string, password string) (goth.User, e
 	return thisUser, nil
 }
 
+// bind binds the connection as a user and records how long the bind took
+func (s *ADProvider) bind(ctx context.Context, username string, password string) (err error) {
+	_, span := tracing.Start(ctx, "ldap bind")
+	defer func(start time.Time) {
+		metrics.ObserveLDAP(s.profile.ID, "bind", start)
+		tracing.End(span, err)
+	}(time.Now())
+	return s.connection.Bind(username, password)
+}
+
 // Handle is a delegate for the Http Handler used by the generic inbound handler, it will extract the username
 // and password from the request and atempt to bind tot he AD host.
 func (s *ADProvider) Handle(w http.ResponseWriter, r *http.Request, pathParams map[string]string, profile tap.Profile) {
-	s.connect()
+	logger := ADLogger.WithContext(r.Context())
+	s.connect(r.Context())
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
@@ -280,29 +312,29 @@ func (s *ADProvider) Handle(w http.ResponseWriter, r *http.Request, pathParams m
 	}
 
 	if username == "" || password == "" {
-		ADLogger.Error("Login attempt with empty username or password")
+		logger.Error("Login attempt with empty username or password")
 		s.provideErrorRedirect(w, r)
 		return
 	}
 
-	ADLogger.Debug("DN: ", s.prepDN(username))
+	logger.Debug("DN: ", s.prepDN(username))
 
 	var bindErr error
 
 	if s.config.LDAPAdminUser != "" {
-		bindErr = s.connection.Bind(s.config.LDAPAdminUser, s.config.LDAPAdminPassword)
+		bindErr = s.bind(r.Context(), s.config.LDAPAdminUser, s.config.LDAPAdminPassword)
 	} else {
-		bindErr = s.connection.Bind(s.prepDN(username), password)
+		bindErr = s.bind(r.Context(), s.prepDN(username), password)
 	}
 
 	if bindErr != nil {
 		if s.config.LDAPAdminUser != "" {
-			ADLogger.WithFields(logrus.Fields{
+			logger.WithFields(logrus.Fields{
 				"username": s.config.LDAPAdminUser,
 				"error":    bindErr,
 			}).Error("Bind failed for user")
 		} else {
-			ADLogger.WithFields(logrus.Fields{
+			logger.WithFields(logrus.Fields{
 				"username": username,
 				"error":    bindErr,
 			}).Error("Bind failed for user")
@@ -312,12 +344,12 @@ func (s *ADProvider) Handle(w http.ResponseWriter, r *http.Request, pathParams m
 	}
 
 	if s.config.LDAPAdminUser != "" {
-		ADLogger.WithField("username", username).Info("User bind successful")
+		logger.WithField("username", username).Info("User bind successful")
 	}
 
-	user, uErr := s.getUserData(username, password)
+	user, uErr := s.getUserData(r.Context(), username, password)
 	if uErr != nil {
-		ADLogger.WithFields(logrus.Fields{
+		logger.WithFields(logrus.Fields{
 			"username": username,
 			"error":    uErr,
 		}).Error("Lookup failed for user")
@@ -327,14 +359,14 @@ func (s *ADProvider) Handle(w http.ResponseWriter, r *http.Request, pathParams m
 
 	constraintErr := s.checkConstraints(user)
 	if constraintErr != nil {
-		ADLogger.Error("Constraint failed: ", constraintErr)
+		logger.Error("Constraint failed: ", constraintErr)
 		s.provideErrorRedirect(w, r)
 		return
 	}
 
 	s.handler.CompleteIdentityAction(w, r, user, s.profile)
 
-	ADLogger.Debug("Closing connection")
+	logger.Debug("Closing connection")
 	s.connection.Close()
 }
 
@@ -346,7 +378,7 @@ func (s *ADProvider) checkConstraints(user interface{}) error {
 // HandleCallback is not used
 func (s *ADProvider) HandleCallback(w http.ResponseWriter, r *http.Request, onError func(tag string, errorMsg string, rawErr error, code int, w http.ResponseWriter, r *http.Request), profile tap.Profile) {
 
-	ADLogger.Warning("Callback not implemented for provider")
+	ADLogger.WithContext(r.Context()).Warning("Callback not implemented for provider")
 
 }
 
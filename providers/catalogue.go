@@ -0,0 +1,65 @@
+package providers
+
+import (
+	"sort"
+
+	"github.com/TykTechnologies/tyk-identity-broker/constants"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// CatalogueEntry describes a profile to the login pages of front ends, it only holds data that is safe to show
+// to anyone
+type CatalogueEntry struct {
+	ID           string
+	Name         string
+	ProviderName string
+	Type         tap.ProviderType
+	// Providers are the social sub-providers of the profile, each with its own login URL
+	Providers []CatalogueProvider `json:",omitempty"`
+	LoginURL  string
+}
+
+// CatalogueProvider is a social sub-provider of a profile, e.g. openid-connect
+type CatalogueProvider struct {
+	Name     string
+	LoginURL string
+}
+
+// Catalogue lists the profiles users can log in with, orgID limits the list to one organisation when it is set.
+// Profiles whose login URL can't be worked out are left out.
+func Catalogue(AuthConfigStore tap.AuthRegisterBackend, orgID string) []CatalogueEntry {
+	entries := []CatalogueEntry{}
+	for _, p := range AuthConfigStore.GetAll("") {
+		profile, ok := p.(tap.Profile)
+		if !ok || (orgID != "" && profile.OrgID != orgID) {
+			continue
+		}
+
+		loginURL, err := LoginPath(profile)
+		if err != nil {
+			log.WithField("prefix", constants.HandlerLogTag).WithField("profile", profile.ID).WithError(err).
+				Debug("Leaving profile out of the catalogue")
+			continue
+		}
+
+		entry := CatalogueEntry{
+			ID:           profile.ID,
+			Name:         profile.Name,
+			ProviderName: profile.ProviderName,
+			Type:         profile.Type,
+			LoginURL:     loginURL,
+		}
+		if profile.ProviderName == constants.SocialProvider {
+			names, _ := socialProviderNames(profile)
+			for _, name := range names {
+				entry.Providers = append(entry.Providers, CatalogueProvider{Name: name, LoginURL: "/auth/" + profile.ID + "/" + name})
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
@@ -0,0 +1,58 @@
+package providers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"github.com/TykTechnologies/tyk-identity-broker/backends"
+	"github.com/TykTechnologies/tyk-identity-broker/constants"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+func TestCatalogue(t *testing.T) {
+	is := is.New(t)
+
+	store := &backends.InMemoryBackend{}
+	is.NoErr(store.Init(nil))
+	for _, profile := range []tap.Profile{
+		{ID: "social", Name: "Acme SSO", OrgID: "org-1", ProviderName: constants.SocialProvider, Type: tap.REDIRECT_PROVIDER,
+			ProviderConfig: map[string]interface{}{"UseProviders": []interface{}{
+				map[string]interface{}{"Name": "gplus", "Key": "key", "Secret": "top-secret"},
+				map[string]interface{}{"Name": "openid-connect", "Key": "key", "Secret": "top-secret"},
+			}}},
+		{ID: "ldap", Name: "Acme LDAP", OrgID: "org-1", ProviderName: constants.ADProvider, Type: tap.PASSTHROUGH_PROVIDER,
+			ProviderConfig: map[string]interface{}{"LDAPAdminPassword": "top-secret"}},
+		{ID: "saml", Name: "Globex", OrgID: "org-2", ProviderName: constants.SAMLProvider, Type: tap.REDIRECT_PROVIDER},
+		{ID: "broken", OrgID: "org-1", ProviderName: "NoSuchProvider"},
+	} {
+		is.NoErr(store.SetKey(profile.ID, "", profile))
+	}
+
+	all := Catalogue(store, "")
+	is.Equal(len(all), 3)
+	is.Equal(all[0], CatalogueEntry{ID: "ldap", Name: "Acme LDAP", ProviderName: constants.ADProvider,
+		Type: tap.PASSTHROUGH_PROVIDER, LoginURL: "/auth/ldap/login"})
+	is.Equal(all[1].ID, "saml")
+	is.Equal(all[1].LoginURL, "/auth/saml/saml")
+	is.Equal(all[2].LoginURL, "/auth/social/gplus")
+	is.Equal(all[2].Providers, []CatalogueProvider{
+		{Name: "gplus", LoginURL: "/auth/social/gplus"},
+		{Name: "openid-connect", LoginURL: "/auth/social/openid-connect"},
+	})
+
+	asJSON, err := json.Marshal(all)
+	is.NoErr(err)
+	is.True(!strings.Contains(string(asJSON), "top-secret"))
+	// the org IDs of tenants aren't public either
+	is.True(!strings.Contains(string(asJSON), "org-1"))
+
+	org := Catalogue(store, "org-1")
+	is.Equal(len(org), 2)
+	is.Equal(org[0].ID, "ldap")
+	is.Equal(org[1].ID, "social")
+
+	is.Equal(len(Catalogue(store, "org-3")), 0)
+}
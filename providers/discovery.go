@@ -0,0 +1,113 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/TykTechnologies/tyk-identity-broker/constants"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// ErrNoProfileDiscovered is returned when no profile lists the domain of an email or the host of a request
+var ErrNoProfileDiscovered = errors.New("no profile matches the email domain or host")
+
+// DiscoverProfile picks the profile a user logs in with (home-realm discovery). Profiles that list the domain of
+// email in DiscoveryDomains win over profiles that list host in Hosts, and a profile that lists both wins over
+// either, ties go to the lowest profile ID.
+func DiscoverProfile(AuthConfigStore tap.AuthRegisterBackend, email string, host string) (tap.Profile, error) {
+	domain := ""
+	if at := strings.LastIndex(email, "@"); at != -1 {
+		domain = strings.ToLower(strings.TrimSpace(email[at+1:]))
+	}
+	host = normaliseHost(host)
+
+	candidates := []tap.Profile{}
+	for _, p := range AuthConfigStore.GetAll("") {
+		if profile, ok := p.(tap.Profile); ok {
+			candidates = append(candidates, profile)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+
+	best := tap.Profile{}
+	bestScore := 0
+	for _, profile := range candidates {
+		score := 0
+		if domain != "" && matchesDomain(profile.DiscoveryDomains, domain) {
+			score += 2
+		}
+		if host != "" && matchesDomain(profile.Hosts, host) {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = profile, score
+		}
+	}
+
+	if bestScore == 0 {
+		return best, ErrNoProfileDiscovered
+	}
+	return best, nil
+}
+
+// LoginPath returns the path that starts the login of a profile, e.g. /auth/{id}/openid-connect
+func LoginPath(profile tap.Profile) (string, error) {
+	switch profile.ProviderName {
+	case constants.SocialProvider:
+		names, err := socialProviderNames(profile)
+		if err != nil {
+			return "", err
+		}
+		if len(names) == 0 {
+			return "", errors.New("profile has no social providers")
+		}
+		return "/auth/" + profile.ID + "/" + names[0], nil
+	case constants.SAMLProvider:
+		return "/auth/" + profile.ID + "/saml", nil
+	case constants.ADProvider, constants.ProxyProvider:
+		// passthrough providers start with the built-in login form
+		return "/auth/" + profile.ID + "/login", nil
+	}
+
+	return "", errors.New("invalid provider name")
+}
+
+// socialProviderNames returns the goth providers of a social profile, in the order of UseProviders
+func socialProviderNames(profile tap.Profile) ([]string, error) {
+	config := GothConfig{}
+	if err := json.Unmarshal(hackProviderConf(profile.ProviderConfig), &config); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(config.UseProviders))
+	for _, provider := range config.UseProviders {
+		names = append(names, provider.Name)
+	}
+	return names, nil
+}
+
+// matchesDomain reports whether name is one of domains, an entry such as *.example.com matches any subdomain
+func matchesDomain(domains []string, name string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == name {
+			return true
+		}
+		if strings.HasPrefix(d, "*.") && strings.HasSuffix(name, d[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func normaliseHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,77 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+
+	"github.com/TykTechnologies/tyk-identity-broker/backends"
+	"github.com/TykTechnologies/tyk-identity-broker/constants"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+func TestDiscoverProfile(t *testing.T) {
+	is := is.New(t)
+
+	store := &backends.InMemoryBackend{}
+	is.NoErr(store.Init(nil))
+	for _, profile := range []tap.Profile{
+		{ID: "acme-okta", DiscoveryDomains: []string{"acme.com", "*.acme.io"}},
+		{ID: "acme-ldap", DiscoveryDomains: []string{"acme.com"}, Hosts: []string{"login.acme.com"}},
+		{ID: "globex", DiscoveryDomains: []string{"globex.com"}, Hosts: []string{"login.globex.com"}},
+		{ID: "no-discovery"},
+	} {
+		is.NoErr(store.SetKey(profile.ID, "", profile))
+	}
+
+	tests := []struct {
+		email string
+		host  string
+		want  string
+	}{
+		{"jane@globex.com", "tib.example.com", "globex"},
+		{"Jane@GLOBEX.com", "", "globex"},
+		{"jane@eu.acme.io", "", "acme-okta"},
+		// the host breaks the tie between the two acme.com profiles
+		{"jane@acme.com", "login.acme.com:443", "acme-ldap"},
+		// ties go to the lowest profile ID
+		{"jane@acme.com", "tib.example.com", "acme-ldap"},
+		// the email domain wins over the host
+		{"jane@globex.com", "login.acme.com", "globex"},
+		{"", "LOGIN.globex.com", "globex"},
+		{"jane@initech.com", "login.globex.com", "globex"},
+	}
+
+	for _, tt := range tests {
+		profile, err := DiscoverProfile(store, tt.email, tt.host)
+		is.NoErr(err)
+		is.Equal(profile.ID, tt.want) // tt.email, tt.host
+	}
+
+	_, err := DiscoverProfile(store, "jane@initech.com", "tib.example.com")
+	is.Equal(err, ErrNoProfileDiscovered)
+	_, err = DiscoverProfile(store, "", "")
+	is.Equal(err, ErrNoProfileDiscovered)
+}
+
+func TestLoginPath(t *testing.T) {
+	is := is.New(t)
+
+	social := tap.Profile{ID: "1", ProviderName: constants.SocialProvider, ProviderConfig: map[string]interface{}{
+		"UseProviders": []interface{}{map[string]interface{}{"Name": "openid-connect"}},
+	}}
+	path, err := LoginPath(social)
+	is.NoErr(err)
+	is.Equal(path, "/auth/1/openid-connect")
+
+	path, err = LoginPath(tap.Profile{ID: "2", ProviderName: constants.SAMLProvider})
+	is.NoErr(err)
+	is.Equal(path, "/auth/2/saml")
+
+	path, err = LoginPath(tap.Profile{ID: "3", ProviderName: constants.ADProvider})
+	is.NoErr(err)
+	is.Equal(path, "/auth/3/login")
+
+	_, err = LoginPath(tap.Profile{ID: "4", ProviderName: constants.SocialProvider, ProviderConfig: map[string]interface{}{}})
+	is.True(err != nil)
+}
@@ -0,0 +1,28 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+)
+
+type loginFailureKey struct{}
+
+// LoginFailureHandler responds to a failed login of a passthrough provider
+type LoginFailureHandler func(w http.ResponseWriter, r *http.Request)
+
+// WithLoginFailureHandler returns a request whose login failures are handled by onFailure instead of the provider's
+// usual response, it is used by the built-in login form to show the form again with an error
+func WithLoginFailureHandler(r *http.Request, onFailure LoginFailureHandler) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loginFailureKey{}, onFailure))
+}
+
+// handleLoginFailure calls the login failure handler of the request, it returns false when there is none
+func handleLoginFailure(w http.ResponseWriter, r *http.Request) bool {
+	onFailure, ok := r.Context().Value(loginFailureKey{}).(LoginFailureHandler)
+	if !ok {
+		return false
+	}
+
+	onFailure(w, r)
+	return true
+}
@@ -3,7 +3,6 @@ package providers
 import (
 	b64 "encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -12,13 +11,18 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Jeffail/gabs"
 	"github.com/markbates/goth"
 	"github.com/sirupsen/logrus"
 
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var onceReloadProxyLogger sync.Once
@@ -75,17 +79,20 @@ func (p *ProxyProvider) UseCallback() bool {
 }
 
 func (p *ProxyProvider) respondFailure(rw http.ResponseWriter, r *http.Request) {
-	rw.WriteHeader(401)
-	fmt.Fprintf(rw, "Authentication Failed")
+	if handleLoginFailure(rw, r) {
+		return
+	}
+	pages.RenderError(rw, r, p.profile.Pages, pages.CodeAuthenticationFailed, "")
 }
 
 func (p *ProxyProvider) Handle(rw http.ResponseWriter, r *http.Request, pathParams map[string]string,
 	profile tap.Profile) {
+	logger := proxyLogger.WithContext(r.Context())
 	// copy the request to a target
 
 	target, tErr := url.Parse(p.config.TargetHost)
 	if tErr != nil {
-		proxyLogger.WithFields(logrus.Fields{
+		logger.WithFields(logrus.Fields{
 			"error": tErr,
 		}).Error("Failed to parse target URL")
 		p.respondFailure(rw, r)
@@ -96,17 +103,22 @@ func (p *ProxyProvider) Handle(rw http.ResponseWriter, r *http.Request, pathPara
 	recorder := httptest.NewRecorder()
 	r.URL.Path = ""
 	r.Host = target.Host
-	thisProxy.ServeHTTP(recorder, r)
+	start := time.Now()
+	proxyCtx, span := tracing.Start(r.Context(), "proxy request", attribute.String("server.address", target.Host))
+	tracing.Inject(proxyCtx, r.Header)
+	thisProxy.ServeHTTP(recorder, r.WithContext(proxyCtx))
+	tracing.EndRequest(span, recorder.Code, nil)
+	metrics.ObserveIdP(profile.ID, profile.ProviderName, start)
 
 	if recorder.Code >= 400 {
-		proxyLogger.Error("Code was: ", recorder.Code)
+		logger.Error("Code was: ", recorder.Code)
 		p.respondFailure(rw, r)
 		return
 	}
 	// check against passing signal
 	if p.config.OKCode != 0 {
 		if recorder.Code != p.config.OKCode {
-			proxyLogger.Error("Code was: ", recorder.Code, " expected: ", p.config.OKCode)
+			logger.Error("Code was: ", recorder.Code, " expected: ", p.config.OKCode)
 			p.respondFailure(rw, r)
 			return
 		}
@@ -116,7 +128,7 @@ func (p *ProxyProvider) Handle(rw http.ResponseWriter, r *http.Request, pathPara
 	if p.config.OKResponse != "" {
 		sEnc := b64.StdEncoding.EncodeToString(thisBody)
 		if err != nil {
-			proxyLogger.Error("Could not read body.")
+			logger.Error("Could not read body.")
 			p.respondFailure(rw, r)
 			return
 		}
@@ -126,7 +138,7 @@ func (p *ProxyProvider) Handle(rw http.ResponseWriter, r *http.Request, pathPara
 			if len(sEnc) > 21 {
 				shortStr = sEnc[:20] + "..."
 			}
-			proxyLogger.Error("Response was: '", shortStr, "' expected: '", p.config.OKResponse, "'")
+			logger.Error("Response was: '", shortStr, "' expected: '", p.config.OKResponse, "'")
 			p.respondFailure(rw, r)
 			return
 		}
@@ -135,7 +147,7 @@ func (p *ProxyProvider) Handle(rw http.ResponseWriter, r *http.Request, pathPara
 	if p.config.OKRegex != "" {
 		thisRegex, rErr := regexp.Compile(p.config.OKRegex)
 		if rErr != nil {
-			proxyLogger.WithField("error", err).Error("Regex failure")
+			logger.WithField("error", err).Error("Regex failure")
 			p.respondFailure(rw, r)
 			return
 		}
@@ -143,7 +155,7 @@ func (p *ProxyProvider) Handle(rw http.ResponseWriter, r *http.Request, pathPara
 		found := thisRegex.MatchString(string(thisBody))
 
 		if !found {
-			proxyLogger.Error("Regex not found")
+			logger.Error("Regex not found")
 			p.respondFailure(rw, r)
 			return
 		}
@@ -161,7 +173,7 @@ func (p *ProxyProvider) Handle(rw http.ResponseWriter, r *http.Request, pathPara
 	if p.config.ResponseIsJson {
 		parsed, pErr := gabs.ParseJSON(thisBody)
 		if pErr != nil {
-			proxyLogger.Warning("Parsing for access token field failed")
+			logger.Warning("Parsing for access token field failed")
 		} else {
 			if p.config.AccessTokenField != "" {
 				tok, fT := parsed.Path(p.config.AccessTokenField).Data().(string)
@@ -191,8 +203,7 @@ func (p *ProxyProvider) Handle(rw http.ResponseWriter, r *http.Request, pathPara
 		thisUser.Email = uName + "@soSession.com"
 	}
 
-	proxyLogger.Info("Username: ", thisUser.UserID)
-	proxyLogger.Info("Access token: ", thisUser.AccessToken)
+	logger.Debug("Username: ", thisUser.UserID)
 
 	// Complete the identity action
 	p.handler.CompleteIdentityAction(rw, r, thisUser, p.profile)
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/matryer/is"
@@ -52,7 +53,7 @@ const proxyConfig_REGEX = `
 	}
 `
 
-const BODYFAILURE_STR = "Authentication Failed"
+const BODYFAILURE_CODE = `"Code":"authentication_failed"`
 
 func getProfile(t *testing.T, profileConfig string) tap.Profile {
 	t.Helper()
@@ -98,7 +99,7 @@ func TestProxyProvider_BadCode(t *testing.T) {
 		t.Fatalf("Expected 401 response code, got '%d'", recorder.Code)
 	}
 
-	if string(thisBody) != BODYFAILURE_STR {
+	if !strings.Contains(string(thisBody), BODYFAILURE_CODE) {
 		t.Fatalf("Body string '%s' is incorrect", thisBody)
 	}
 }
@@ -126,7 +127,7 @@ func TestProxyProvider_BadBody(t *testing.T) {
 		t.Fatalf("Expected 401 response code, got '%d'", recorder.Code)
 	}
 
-	if string(thisBody) != BODYFAILURE_STR {
+	if !strings.Contains(string(thisBody), BODYFAILURE_CODE) {
 		t.Fatalf("Body string '%s' is incorrect", thisBody)
 	}
 }
@@ -152,3 +153,34 @@ func TestProxyProvider_GoodRegex(t *testing.T) {
 		t.Fatalf("Expected 200 response code, got '%v'", recorder.Code)
 	}
 }
+
+func TestProxyProvider_LoginFailureHandler(t *testing.T) {
+	is := is.New(t)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer target.Close()
+
+	thisConf := `{"TargetHost": "` + target.URL + `"}`
+	thisProfile := getProfile(t, thisConf)
+	thisProvider := ProxyProvider{}
+
+	is.NoErr(thisProvider.Init(identityHandlers.DummyIdentityHandler{}, thisProfile, []byte(thisConf)))
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := false
+	req = WithLoginFailureHandler(req, func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+		w.WriteHeader(http.StatusTeapot)
+	})
+	thisProvider.Handle(recorder, req, nil, thisProfile)
+
+	is.True(handled)
+	is.Equal(recorder.Code, http.StatusTeapot)
+}
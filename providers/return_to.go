@@ -0,0 +1,22 @@
+package providers
+
+import (
+	"net/http"
+
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// WithReturnTo checks a return_to against the AllowedReturnURLs of the profile and returns a request whose login
+// returns to it. When it is rejected the user gets an error page and ok is false.
+func WithReturnTo(w http.ResponseWriter, r *http.Request, profile tap.Profile, returnTo string) (req *http.Request, ok bool) {
+	if returnTo == "" {
+		return r, true
+	}
+
+	if err := tap.CheckReturnTo(profile, returnTo, r); err != nil {
+		pages.RenderError(w, r, profile.Pages, pages.CodeInvalidRequest, err.Error())
+		return r, false
+	}
+	return tap.WithReturnURL(r, returnTo), true
+}
@@ -22,7 +22,10 @@ import (
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
 	"github.com/sirupsen/logrus"
 
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var onceReloadSAMLLogger sync.Once
@@ -45,6 +48,8 @@ type SAMLProvider struct {
 	config  SAMLConfig
 	profile tap.Profile
 	m       *samlsp.Middleware
+	// ctx traces fetching the IDP metadata as part of the request the provider is initialised for
+	ctx context.Context
 }
 
 type SAMLConfig struct {
@@ -107,7 +112,6 @@ func (s *SAMLProvider) initialiseSAMLMiddleware() {
 		}
 
 		keyPair := certs[0]
-		log.Debugf("KeyPair: %+v", keyPair)
 		idpMetadataURL, err := url.Parse(s.config.IDPMetadataURL)
 		if err != nil {
 			SAMLLogger.Errorf("Error parsing IDP metadata URL: %v", err)
@@ -125,7 +129,9 @@ func (s *SAMLProvider) initialiseSAMLMiddleware() {
 
 		httpClient := http.DefaultClient
 
-		metadata, err := samlsp.FetchMetadata(context.TODO(), httpClient, *idpMetadataURL)
+		fetchCtx, span := tracing.Start(s.ctx, "saml fetch metadata", attribute.String("url.full", idpMetadataURL.String()))
+		metadata, err := samlsp.FetchMetadata(context.WithoutCancel(fetchCtx), httpClient, *idpMetadataURL)
+		tracing.End(span, err)
 		if err != nil {
 			SAMLLogger.Errorf("Error retrieving IDP Metadata: %v", err)
 		} else {
@@ -187,29 +193,30 @@ func (s *SAMLProvider) initialiseSAMLMiddleware() {
 }
 
 func (s *SAMLProvider) Handle(w http.ResponseWriter, r *http.Request, pathParams map[string]string, profile tap.Profile) {
-	SAMLLogger.Debugf("Handling SAML request: %+v", r)
+	logger := SAMLLogger.WithContext(r.Context())
+	logger.Debugf("Handling SAML request: %s %s", r.Method, r.URL.Path)
 	if s.m == nil {
-		SAMLLogger.Error("cannot process request, middleware not loaded")
+		logger.Error("cannot process request, middleware not loaded")
 		return
 	} else {
-		SAMLLogger.Debug("Using saml middleware already initialized")
+		logger.Debug("Using saml middleware already initialized")
 	}
 
 	// If we try to redirect when the original request is the ACS URL we'll
 	// end up in a loop so just fail and error instead
 	if r.URL.Path == s.m.ServiceProvider.AcsURL.Path {
-		SAMLLogger.Debugf("request path is the same as SP ACSUrl, then redirecting to failing state. Url: %v", r.URL.Path)
+		logger.Debugf("request path is the same as SP ACSUrl, then redirecting to failing state. Url: %v", r.URL.Path)
 		s.provideErrorRedirect(w, r)
 		return
 	}
 
 	var binding, bindingLocation string
 	if s.m.Binding != "" {
-		SAMLLogger.Debugf("Middleware binding is not empty: %v ", s.m.Binding)
+		logger.Debugf("Middleware binding is not empty: %v ", s.m.Binding)
 		binding = s.m.Binding
 		bindingLocation = s.m.ServiceProvider.GetSSOBindingLocation(binding)
 	} else {
-		SAMLLogger.Debug("Middleware binding is empty, then initializing")
+		logger.Debug("Middleware binding is empty, then initializing")
 		binding = saml.HTTPRedirectBinding
 		bindingLocation = s.m.ServiceProvider.GetSSOBindingLocation(binding)
 		if bindingLocation == "" {
@@ -218,44 +225,44 @@ func (s *SAMLProvider) Handle(w http.ResponseWriter, r *http.Request, pathParams
 		}
 	}
 
-	SAMLLogger.Debugf("BindingLocation: %v", bindingLocation)
-	SAMLLogger.Debugf("Performing Authentication request to: %v", binding)
-	SAMLLogger.Debugf("Service Provider details: %+v", s.m.ServiceProvider)
+	logger.Debugf("BindingLocation: %v", bindingLocation)
+	logger.Debugf("Performing Authentication request to: %v", binding)
+	logger.Debugf("Service Provider: %v", s.m.ServiceProvider.EntityID)
 	authReq, err := s.m.ServiceProvider.MakeAuthenticationRequest(bindingLocation, binding, saml.HTTPPostBinding)
 
 	if err != nil {
-		SAMLLogger.Errorf("Making authentication request: %+v", err.Error())
+		logger.Errorf("Making authentication request: %+v", err.Error())
 		s.provideErrorRedirect(w, r)
 		return
 	}
 
-	SAMLLogger.Debugf("Auth Request: %+v", authReq)
+	logger.Debugf("Auth Request: %+v", authReq)
 	// relayState is limited to 80 bytes but also must be integrity protected.
 	// this means that we cannot use a JWT because it is way to long. Instead
 	// we set a signed cookie that encodes the original URL which we'll check
 	// against the SAML response when we get it.
 	relayState, err := s.m.RequestTracker.TrackRequest(w, r, authReq.ID)
 	if err != nil {
-		SAMLLogger.Errorf("Tracking request: %+v", err.Error())
+		logger.Errorf("Tracking request: %+v", err.Error())
 		s.provideErrorRedirect(w, r)
 		return
 	}
-	SAMLLogger.Debugf("Relay State: %+v", relayState)
+	logger.Debugf("Relay State: %+v", relayState)
 
 	if binding == saml.HTTPRedirectBinding {
 		redirectURL, err := authReq.Redirect(relayState, &s.m.ServiceProvider)
 		if err != nil {
-			SAMLLogger.Errorf("Redirecting auth request: %+v", err.Error())
+			logger.Errorf("Redirecting auth request: %+v", err.Error())
 			s.provideErrorRedirect(w, r)
 			return
 		}
-		SAMLLogger.Debugf("Binding is redirect, then redirecting to %v", redirectURL.String())
+		logger.Debugf("Binding is redirect, then redirecting to %v", redirectURL.String())
 		w.Header().Add("Location", redirectURL.String())
 		w.WriteHeader(http.StatusFound)
 		return
 	}
 	if binding == saml.HTTPPostBinding {
-		SAMLLogger.Debug("binding is a POST binding.")
+		logger.Debug("binding is a POST binding.")
 		w.Header().Add("Content-Security-Policy", ""+
 			"default-src; "+
 			"script-src 'sha256-AjPdJSbZmeWHnEc5ykvJFay8FTWeTeRbs9dutfZ0HqE='; "+
@@ -269,48 +276,62 @@ func (s *SAMLProvider) Handle(w http.ResponseWriter, r *http.Request, pathParams
 }
 
 func (s *SAMLProvider) HandleCallback(w http.ResponseWriter, r *http.Request, onError func(tag string, errorMsg string, rawErr error, code int, w http.ResponseWriter, r *http.Request), profile tap.Profile) {
+	logger := SAMLLogger.WithContext(r.Context())
 	err := r.ParseForm()
 	if err != nil {
-		SAMLLogger.Errorf("Error parsing form: %v", err)
+		logger.Errorf("Error parsing form: %v", err)
 	}
-	SAMLLogger.Debugf("HandleCallback called, req details: %+v", r)
+	logger.Debugf("HandleCallback called: %s %s", r.Method, r.URL.Path)
 
 	var possibleRequestIDs = make([]string, 0)
 
 	if s.m.ServiceProvider.AllowIDPInitiated {
-		SAMLLogger.Debug("allowing IDP initiated ID")
+		logger.Debug("allowing IDP initiated ID")
 		possibleRequestIDs = append(possibleRequestIDs, "")
-		SAMLLogger.Debugf("Possible Requests Ids: %+v", possibleRequestIDs)
+		logger.Debugf("Possible Requests Ids: %+v", possibleRequestIDs)
 	} else {
-		SAMLLogger.Debug("IDP Initiated flow not allowed")
+		logger.Debug("IDP Initiated flow not allowed")
 	}
 
 	trackedRequests := s.m.RequestTracker.GetTrackedRequests(r)
-	SAMLLogger.Debugf("Tracked Requests: %+v", trackedRequests)
+	logger.Debugf("Tracked Requests: %+v", trackedRequests)
 	for _, tr := range trackedRequests {
 		possibleRequestIDs = append(possibleRequestIDs, tr.SAMLRequestID)
 	}
-	SAMLLogger.Debugf("Possible requests IDs: %+v", possibleRequestIDs)
+	logger.Debugf("Possible requests IDs: %+v", possibleRequestIDs)
 
 	assertion, err := s.m.ServiceProvider.ParseResponse(r, possibleRequestIDs)
 	if err != nil {
 		PrintErrorStruct(err)
-		SAMLLogger.Error(err)
+		logger.Error(err)
 		s.provideErrorRedirect(w, r)
 		return
 	} else {
-		SAMLLogger.Debugf("Assertion: %+v", assertion)
+		logger.Debugf("Assertion: %v", assertion.ID)
+	}
+
+	// the return_to of the login is in the URL of the tracked request, which is kept in a signed cookie
+	if relayState := r.Form.Get("RelayState"); relayState != "" {
+		if tracked, tErr := s.m.RequestTracker.GetTrackedRequest(r, relayState); tErr == nil {
+			if trackedURL, uErr := url.Parse(tracked.URI); uErr == nil {
+				var ok bool
+				r, ok = WithReturnTo(w, r, s.profile, trackedURL.Query().Get(tap.ReturnToParam))
+				if !ok {
+					return
+				}
+			}
+		}
 	}
 	rawData := make(map[string]interface{}, 0)
 	var str strings.Builder
 
 	for _, v := range assertion.AttributeStatements {
 		for _, att := range v.Attributes {
-			SAMLLogger.Debugf("attribute name: %v\n", att.Name)
+			logger.Debugf("attribute name: %v\n", att.Name)
 			rawData[att.Name] = ""
 			for _, vals := range att.Values {
 				str.WriteString(vals.Value + " ")
-				SAMLLogger.Debugf("vals.value: %v\n ", vals.Value)
+				logger.Debugf("vals.value: %v\n ", vals.Value)
 			}
 			rawData[att.Name] = strings.TrimSuffix(str.String(), " ")
 			str.Reset()
@@ -323,7 +344,7 @@ func (s *SAMLProvider) HandleCallback(w http.ResponseWriter, r *http.Request, on
 	if forename == "" && surname == "" {
 		// defaults to show the email
 		name = email
-		SAMLLogger.Debug("Forename and Surname are not present in claims. You might need to map them or/and ensure that the IDP is sending them.")
+		logger.Debug("Forename and Surname are not present in claims. You might need to map them or/and ensure that the IDP is sending them.")
 	}
 
 	thisUser := goth.User{
@@ -334,12 +355,12 @@ func (s *SAMLProvider) HandleCallback(w http.ResponseWriter, r *http.Request, on
 		FirstName: forename,
 		LastName:  surname,
 	}
-	SAMLLogger.Debugf("User: %+v", thisUser)
+	logger.Debugf("User: %+v", thisUser)
 	s.handler.CompleteIdentityAction(w, r, thisUser, s.profile)
 }
 
 func (s *SAMLProvider) HandleMetadata(w http.ResponseWriter, r *http.Request) {
-	SAMLLogger.Debug("HandleMetadata Called...")
+	SAMLLogger.WithContext(r.Context()).Debug("HandleMetadata Called...")
 	buf, _ := xml.MarshalIndent(s.m.ServiceProvider.Metadata(), "", "  ")
 	w.Header().Set("Content-Type", "application/samlmetadata+xml")
 	w.Write(buf)
@@ -347,8 +368,12 @@ func (s *SAMLProvider) HandleMetadata(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *SAMLProvider) provideErrorRedirect(w http.ResponseWriter, r *http.Request) {
-	SAMLLogger.Debugf("provideErrorRedirect called... req details:\n%+v\n", r)
-	http.Redirect(w, r, s.config.FailureRedirect, 301)
+	SAMLLogger.WithContext(r.Context()).Debugf("provideErrorRedirect called: %s %s", r.Method, r.URL.Path)
+	if s.config.FailureRedirect == "" {
+		pages.RenderError(w, r, s.profile.Pages, pages.CodeLoginFailed, "")
+		return
+	}
+	http.Redirect(w, r, s.config.FailureRedirect, tap.RedirectStatus(r))
 	return
 }
 
@@ -361,6 +386,11 @@ func PrintErrorStruct(err error) {
 
 	for i := 0; i < e.NumField(); i++ {
 		f := e.Field(i)
+		// the Response of an invalid response error is the whole SAMLResponse sent by the IDP
+		if typeOfT.Field(i).Name == "Response" {
+			SAMLLogger.Debugf("%d: %s %s = %v\n", i, typeOfT.Field(i).Name, f.Type(), logger.Redacted)
+			continue
+		}
 		SAMLLogger.Debugf("%d: %s %s = %v\n", i, typeOfT.Field(i).Name, f.Type(), f.Interface())
 	}
 }
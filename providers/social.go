@@ -6,9 +6,9 @@ extending TAP to use more providers, add them to this section
 package providers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"sync"
 
 	"github.com/TykTechnologies/tyk-identity-broker/internal/jwe"
@@ -16,6 +16,7 @@ import (
 
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/providers/bitbucket"
@@ -29,10 +30,14 @@ import (
 	"github.com/markbates/goth/providers/twitter"
 	"golang.org/x/oauth2"
 
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
 	"github.com/TykTechnologies/tyk-identity-broker/toth"
 	"github.com/TykTechnologies/tyk-identity-broker/tothic"
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
 )
@@ -51,6 +56,8 @@ type Social struct {
 	config  GothConfig
 	toth    toth.TothInstance
 	profile tap.Profile
+	// ctx traces the OpenID Connect discovery as part of the request the provider is initialised for
+	ctx context.Context
 }
 
 // GothProviderConfig the configurations required for the individual goth providers
@@ -147,7 +154,9 @@ func (s *Social) Init(handler tap.IdentityHandler, profile tap.Profile, config [
 
 		case "openid-connect":
 
+			_, span := tracing.Start(s.ctx, "oidc discovery", attribute.String("url.full", provider.DiscoverURL))
 			gProv, err := openidConnect.New(provider.Key, provider.Secret, s.getCallBackURL(provider.Name), provider.DiscoverURL, provider.Scopes...)
+			tracing.End(span, err)
 			if err != nil {
 				socialLogger.Error(err)
 				return err
@@ -160,7 +169,12 @@ func (s *Social) Init(handler tap.IdentityHandler, profile tap.Profile, config [
 				oauth2.RegisterBrokenAuthHeaderProvider(provider.DisableAuthHeaderProviderDomain)
 			}
 
-			gothProviders = append(gothProviders, gProv)
+			pkceProv, err := tothic.NewOpenIDConnectProvider(gProv, provider.DiscoverURL)
+			if err != nil {
+				socialLogger.Error(err)
+				return err
+			}
+			gothProviders = append(gothProviders, pkceProv)
 		}
 	}
 
@@ -192,9 +206,24 @@ func (s *Social) checkConstraints(user interface{}) error {
 
 // HandleCallback handles the callback from the OAuth provider
 func (s *Social) HandleCallback(w http.ResponseWriter, r *http.Request, onError func(tag string, errorMsg string, rawErr error, code int, w http.ResponseWriter, r *http.Request), profile tap.Profile) {
-	user, err := tothic.CompleteUserAuth(w, r, &s.toth, profile, &s.config.JWE)
+	start := time.Now()
+	idpCtx, span := tracing.Start(r.Context(), "idp complete auth", attribute.String("tib.profile", profile.ID))
+	user, loginState, err := tothic.CompleteUserAuth(w, r.WithContext(idpCtx), &s.toth, profile, &s.config.JWE)
+	tracing.End(span, err)
+	metrics.ObserveIdP(profile.ID, profile.ProviderName, start)
+	if err == tothic.ErrInvalidState || err == tothic.ErrInvalidNonce {
+		tap.LogSecurityEvent("state_rejected", r, logrus.Fields{"profile": s.profile.ID, "error": err})
+		pages.RenderError(w, r, s.profile.Pages, pages.CodeInvalidRequest, "")
+		return
+	}
 	if err != nil {
-		fmt.Fprintln(w, err)
+		socialLogger.WithContext(r.Context()).WithError(err).Error("Could not complete login")
+		pages.RenderError(w, r, s.profile.Pages, pages.CodeLoginFailed, "")
+		return
+	}
+
+	r, ok := WithReturnTo(w, r, s.profile, loginState.ReturnTo)
+	if !ok {
 		return
 	}
 
@@ -205,7 +234,7 @@ func (s *Social) HandleCallback(w http.ResponseWriter, r *http.Request, onError
 			return
 		}
 
-		http.Redirect(w, r, s.config.FailureRedirect, 301)
+		http.Redirect(w, r, s.config.FailureRedirect, tap.RedirectStatus(r))
 		return
 	}
 
@@ -1,29 +1,35 @@
 package providers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 
 	"github.com/TykTechnologies/tyk-identity-broker/constants"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
 	identityHandlers "github.com/TykTechnologies/tyk-identity-broker/tap/identity-handlers"
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
 	"github.com/TykTechnologies/tyk-identity-broker/tyk-api"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// return a provider based on the name of the provider type, add new providers here
-func GetTAProvider(conf tap.Profile, handler tyk.TykAPI, identityKeyStore tap.AuthRegisterBackend) (tap.TAProvider, error) {
+// return a provider based on the name of the provider type, add new providers here. Initialising the provider is
+// traced as part of ctx.
+func GetTAProvider(ctx context.Context, conf tap.Profile, handler tyk.TykAPI, identityKeyStore tap.AuthRegisterBackend) (_ tap.TAProvider, err error) {
+	initCtx, span := tracing.Start(ctx, "provider init", attribute.String("tib.profile", conf.ID), attribute.String("tib.provider", conf.ProviderName))
+	defer func() { tracing.End(span, err) }()
 
 	var thisProvider tap.TAProvider
 	switch conf.ProviderName {
 	case constants.SocialProvider:
-		thisProvider = &Social{}
+		thisProvider = &Social{ctx: initCtx}
 	case constants.ADProvider:
 		thisProvider = &ADProvider{}
 	case constants.ProxyProvider:
 		thisProvider = &ProxyProvider{}
 	case constants.SAMLProvider:
-		thisProvider = &SAMLProvider{}
+		thisProvider = &SAMLProvider{ctx: initCtx}
 	default:
 		return nil, errors.New("invalid provider name")
 	}
@@ -32,7 +38,7 @@ func GetTAProvider(conf tap.Profile, handler tyk.TykAPI, identityKeyStore tap.Au
 	log.Debugf("Initializing Identity Handler with config: %+v", conf)
 	thisIdentityHandler.Init(conf)
 	log.Debug("Initializing Provider")
-	err := thisProvider.Init(thisIdentityHandler, conf, hackProviderConf(conf.ProviderConfig))
+	err = thisProvider.Init(thisIdentityHandler, conf, hackProviderConf(conf.ProviderConfig))
 
 	return thisProvider, err
 }
@@ -42,7 +48,8 @@ func getIdentityHandler(name tap.Action, handler tyk.TykAPI, identityKeyStore ta
 	var thisIdentityHandler tap.IdentityHandler
 
 	switch name {
-	case tap.GenerateOrLoginDeveloperProfile, tap.GenerateOrLoginUserProfile, tap.GenerateOAuthTokenForClient, tap.GenerateTemporaryAuthToken:
+	case tap.GenerateOrLoginDeveloperProfile, tap.GenerateOrLoginUserProfile, tap.GenerateOAuthTokenForClient, tap.GenerateTemporaryAuthToken,
+		tap.GenerateOrLoginEnterprisePortalUser:
 		thisIdentityHandler = &identityHandlers.TykIdentityHandler{
 			API:   &handler,
 			Store: identityKeyStore}
@@ -51,22 +58,35 @@ func getIdentityHandler(name tap.Action, handler tyk.TykAPI, identityKeyStore ta
 	return thisIdentityHandler
 }
 
-func GetTapProfile(AuthConfigStore, identityKeyStore tap.AuthRegisterBackend, id string, tykHandler tyk.TykAPI) (tap.TAProvider, tap.Profile, *tap.HttpError) {
-
+func lookupProfile(AuthConfigStore tap.AuthRegisterBackend, id string) (tap.Profile, *tap.HttpError) {
 	thisProfile := tap.Profile{}
 	log.WithField("prefix", constants.HandlerLogTag).Debug("--> Looking up profile ID: ", id)
 	foundProfileErr := AuthConfigStore.GetKey(id, thisProfile.OrgID, &thisProfile)
 
 	if foundProfileErr != nil {
 		errorMsg := "Profile " + id + " not found"
-		return nil, thisProfile, &tap.HttpError{
+		return thisProfile, &tap.HttpError{
 			Message: errorMsg,
 			Code:    404,
 			Error:   foundProfileErr,
 		}
 	}
 
-	thisIdentityProvider, providerErr := GetTAProvider(thisProfile, tykHandler, identityKeyStore)
+	return thisProfile, nil
+}
+
+// GetTapProfile returns the profile id and its initialised provider, the calls they make to the backends and to Tyk
+// are traced as part of ctx
+func GetTapProfile(ctx context.Context, AuthConfigStore, identityKeyStore tap.AuthRegisterBackend, id string, tykHandler tyk.TykAPI) (tap.TAProvider, tap.Profile, *tap.HttpError) {
+	AuthConfigStore, identityKeyStore = tap.WithContext(ctx, AuthConfigStore), tap.WithContext(ctx, identityKeyStore)
+	tykHandler = tykHandler.WithContext(ctx)
+
+	thisProfile, profileErr := lookupProfile(AuthConfigStore, id)
+	if profileErr != nil {
+		return nil, thisProfile, profileErr
+	}
+
+	thisIdentityProvider, providerErr := GetTAProvider(ctx, thisProfile, tykHandler, identityKeyStore)
 	if providerErr != nil {
 		log.WithError(providerErr).Error("Getting Tap Provider")
 		return nil, thisProfile, &tap.HttpError{
@@ -79,6 +99,37 @@ func GetTapProfile(AuthConfigStore, identityKeyStore tap.AuthRegisterBackend, id
 	return thisIdentityProvider, thisProfile, nil
 }
 
+// GetTykIdentityHandler returns the Tyk identity handler of a profile without initialising its provider, it is used
+// by endpoints that act on identities the profile has already issued (e.g. refreshing a token)
+func GetTykIdentityHandler(ctx context.Context, AuthConfigStore, identityKeyStore tap.AuthRegisterBackend, id string, tykHandler tyk.TykAPI) (*identityHandlers.TykIdentityHandler, tap.Profile, *tap.HttpError) {
+	AuthConfigStore, identityKeyStore = tap.WithContext(ctx, AuthConfigStore), tap.WithContext(ctx, identityKeyStore)
+	tykHandler = tykHandler.WithContext(ctx)
+
+	thisProfile, profileErr := lookupProfile(AuthConfigStore, id)
+	if profileErr != nil {
+		return nil, thisProfile, profileErr
+	}
+
+	thisIdentityHandler, ok := getIdentityHandler(thisProfile.ActionType, tykHandler, identityKeyStore).(*identityHandlers.TykIdentityHandler)
+	if !ok {
+		return nil, thisProfile, &tap.HttpError{
+			Message: "Profile action is not handled by Tyk",
+			Code:    400,
+			Error:   errors.New("invalid action type"),
+		}
+	}
+
+	if initErr := thisIdentityHandler.Init(thisProfile); initErr != nil {
+		return nil, thisProfile, &tap.HttpError{
+			Message: "Could not initialise identity handler",
+			Code:    400,
+			Error:   initErr,
+		}
+	}
+
+	return thisIdentityHandler, thisProfile, nil
+}
+
 // A hack to marshal a provider conf from map[string]interface{} into a type without type checking, ugly, but effective
 func hackProviderConf(conf interface{}) []byte {
 	thisConf, err := json.Marshal(conf)
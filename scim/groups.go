@@ -0,0 +1,332 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+const (
+	scimGroupPrefix  = "scim-group-"
+	scimGroupsPrefix = "scim-groups-"
+)
+
+// memberFilter matches the path used to remove a single member, e.g. members[value eq "id"]
+var memberFilter = regexp.MustCompile(`(?i)^members\[\s*value\s+eq\s+"([^"]*)"\s*\]$`)
+
+// groups are not a Tyk resource, TIB keeps them in the identity store and applies their memberships to the users
+func (s *Server) groupKey(profileID, id string) string {
+	return scimGroupPrefix + profileID + "-" + id
+}
+
+// groupIDs returns the index of the groups of a profile, a set shared by every TIB instance
+func (s *Server) groupIDs(profileID string) []string {
+	return tap.Members(s.IdentityKeyStore, scimGroupsPrefix+profileID, "")
+}
+
+func (s *Server) loadGroup(profileID, id string) (Group, error) {
+	group := Group{}
+	if err := s.IdentityKeyStore.GetKey(s.groupKey(profileID, id), "", &group); err != nil || group.ID == "" {
+		return Group{}, errNotFound
+	}
+	return group, nil
+}
+
+func (s *Server) groups(profileID string) []Group {
+	groups := []Group{}
+	for _, id := range s.groupIDs(profileID) {
+		if group, err := s.loadGroup(profileID, id); err == nil {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func (s *Server) saveGroup(profileID string, group Group) error {
+	group.Schemas = []string{GroupSchema}
+	group.Meta = &Meta{ResourceType: "Group"}
+	if err := s.IdentityKeyStore.SetKey(s.groupKey(profileID, group.ID), "", group); err != nil {
+		return err
+	}
+	return tap.AddMember(s.IdentityKeyStore, scimGroupsPrefix+profileID, "", group.ID, 0)
+}
+
+func (s *Server) removeGroup(profileID, id string) {
+	s.IdentityKeyStore.DeleteKey(s.groupKey(profileID, id), "")
+	if err := tap.RemoveMember(s.IdentityKeyStore, scimGroupsPrefix+profileID, "", id); err != nil {
+		scimLogger.WithField("group", id).WithError(err).Error("Failed to update the group index")
+	}
+}
+
+// removeMember drops a deleted user from every group of the profile
+func (s *Server) removeMember(profileID, userID string) {
+	for _, group := range s.groups(profileID) {
+		members := withoutMember(group.Members, userID)
+		if len(members) != len(group.Members) {
+			group.Members = members
+			s.saveGroup(profileID, group)
+		}
+	}
+}
+
+// userGroupFor resolves the Dashboard user group of a user from the groups they are a member of, the first group
+// (by ID) found in the UserGroupMapping wins, users without a mapped group get the DefaultUserGroupID
+func (s *Server) userGroupFor(profile tap.Profile, userID string) string {
+	groups := s.groups(profile.ID)
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+
+	for _, group := range groups {
+		userGroupID, mapped := profile.UserGroupMapping[group.DisplayName]
+		if !mapped {
+			continue
+		}
+		for _, member := range group.Members {
+			if member.Value == userID {
+				return userGroupID
+			}
+		}
+	}
+	return profile.DefaultUserGroupID
+}
+
+// syncMemberships updates the user group of the users whose memberships changed
+func (s *Server) syncMemberships(req request, changed ...[]Member) {
+	seen := map[string]bool{}
+	for _, members := range changed {
+		for _, member := range members {
+			if seen[member.Value] {
+				continue
+			}
+			seen[member.Value] = true
+
+			err := req.users.setGroup(member.Value, s.userGroupFor(req.profile, member.Value))
+			if err == errGroupsNotSupported {
+				return
+			}
+			if err != nil {
+				scimLogger.WithField("user_id", member.Value).WithError(err).Error("Failed to update user group")
+			}
+		}
+	}
+}
+
+func (s *Server) listGroups(w http.ResponseWriter, r *http.Request, req request) {
+	attribute, value, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil || (attribute != "" && !strings.EqualFold(attribute, "displayName")) {
+		writeError(w, http.StatusBadRequest, "invalidFilter", "Only displayName eq filters are supported")
+		return
+	}
+
+	resources := []interface{}{}
+	for _, group := range s.groups(req.profile.ID) {
+		if attribute == "" || group.DisplayName == value {
+			resources = append(resources, group)
+		}
+	}
+
+	writeList(w, r, resources)
+}
+
+func (s *Server) getGroup(w http.ResponseWriter, r *http.Request, req request) {
+	group, err := s.loadGroup(req.profile.ID, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, group)
+}
+
+func (s *Server) createGroup(w http.ResponseWriter, r *http.Request, req request) {
+	group := Group{}
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil || group.DisplayName == "" {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", "A group needs a displayName")
+		return
+	}
+
+	for _, existing := range s.groups(req.profile.ID) {
+		if existing.DisplayName == group.DisplayName {
+			writeError(w, http.StatusConflict, "uniqueness", "Group already exists")
+			return
+		}
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", "Failed to create group")
+		return
+	}
+	group.ID = id.String()
+	if group.Members == nil {
+		group.Members = []Member{}
+	}
+
+	if err := s.saveGroup(req.profile.ID, group); err != nil {
+		scimLogger.WithContext(r.Context()).WithError(err).Error("Failed to store group")
+		writeError(w, http.StatusInternalServerError, "", "Failed to create group")
+		return
+	}
+	s.syncMemberships(req, group.Members)
+
+	group, _ = s.loadGroup(req.profile.ID, group.ID)
+	writeJSON(w, http.StatusCreated, group)
+}
+
+func (s *Server) replaceGroup(w http.ResponseWriter, r *http.Request, req request) {
+	current, err := s.loadGroup(req.profile.ID, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	group := Group{}
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil || group.DisplayName == "" {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", "A group needs a displayName")
+		return
+	}
+	group.ID = current.ID
+	if group.Members == nil {
+		group.Members = []Member{}
+	}
+
+	s.updateGroup(w, current, group, req)
+}
+
+func (s *Server) patchGroup(w http.ResponseWriter, r *http.Request, req request) {
+	current, err := s.loadGroup(req.profile.ID, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	patch := PatchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", "Invalid patch request")
+		return
+	}
+
+	group := current
+	group.Members = append([]Member{}, current.Members...)
+	for _, op := range patch.Operations {
+		if err := applyGroupOperation(&group, op); err != nil {
+			writeError(w, http.StatusBadRequest, "invalidValue", fmt.Sprintf("Invalid %s operation on %q", op.Op, op.Path))
+			return
+		}
+	}
+
+	s.updateGroup(w, current, group, req)
+}
+
+func (s *Server) updateGroup(w http.ResponseWriter, current, group Group, req request) {
+	if err := s.saveGroup(req.profile.ID, group); err != nil {
+		scimLogger.WithError(err).Error("Failed to store group")
+		writeError(w, http.StatusInternalServerError, "", "Failed to update group")
+		return
+	}
+
+	// a rename can change the mapping of every member, so old and new members are all synced
+	s.syncMemberships(req, current.Members, group.Members)
+
+	group, _ = s.loadGroup(req.profile.ID, group.ID)
+	writeJSON(w, http.StatusOK, group)
+}
+
+func (s *Server) deleteGroup(w http.ResponseWriter, r *http.Request, req request) {
+	group, err := s.loadGroup(req.profile.ID, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	s.removeGroup(req.profile.ID, group.ID)
+	s.syncMemberships(req, group.Members)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyGroupOperation applies a PATCH operation to the display name or the members of a group
+func applyGroupOperation(group *Group, op PatchOperation) error {
+	opType := strings.ToLower(op.Op)
+	path := strings.ToLower(op.Path)
+
+	if match := memberFilter.FindStringSubmatch(op.Path); match != nil && opType == "remove" {
+		group.Members = withoutMember(group.Members, match[1])
+		return nil
+	}
+
+	switch {
+	case path == "" && (opType == "replace" || opType == "add"):
+		attributes := struct {
+			DisplayName *string  `json:"displayName"`
+			Members     []Member `json:"members"`
+		}{}
+		if err := json.Unmarshal(op.Value, &attributes); err != nil {
+			return err
+		}
+		if attributes.DisplayName != nil {
+			group.DisplayName = *attributes.DisplayName
+		}
+		if attributes.Members != nil {
+			return applyGroupOperation(group, PatchOperation{Op: op.Op, Path: "members", Value: mustMarshal(attributes.Members)})
+		}
+	case path == "displayname" && (opType == "replace" || opType == "add"):
+		name, err := parseString(op.Value)
+		if err != nil {
+			return err
+		}
+		group.DisplayName = name
+	case path == "members":
+		members := []Member{}
+		if len(op.Value) > 0 {
+			if err := json.Unmarshal(op.Value, &members); err != nil {
+				return err
+			}
+		}
+
+		switch opType {
+		case "add":
+			for _, member := range members {
+				group.Members = append(withoutMember(group.Members, member.Value), member)
+			}
+		case "replace":
+			group.Members = members
+		case "remove":
+			// removing the members path without a value removes every member
+			if len(members) == 0 {
+				group.Members = []Member{}
+			}
+			for _, member := range members {
+				group.Members = withoutMember(group.Members, member.Value)
+			}
+		default:
+			return errInvalidValue
+		}
+	default:
+		return errInvalidValue
+	}
+
+	return nil
+}
+
+func withoutMember(members []Member, userID string) []Member {
+	remaining := []Member{}
+	for _, member := range members {
+		if member.Value != userID {
+			remaining = append(remaining, member)
+		}
+	}
+	return remaining
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	raw, _ := json.Marshal(v)
+	return raw
+}
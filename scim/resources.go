@@ -0,0 +1,134 @@
+package scim
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+const (
+	UserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ListResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchOpSchema      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	contentType = "application/scim+json"
+)
+
+// User is a SCIM user resource, it is mapped to a Dashboard user or a portal developer depending on the action of
+// the profile
+type User struct {
+	Schemas    []string `json:"schemas"`
+	ID         string   `json:"id,omitempty"`
+	ExternalID string   `json:"externalId,omitempty"`
+	UserName   string   `json:"userName"`
+	Name       Name     `json:"name"`
+	Emails     []Email  `json:"emails,omitempty"`
+	// Active is a pointer as a missing value means the user is active
+	Active *bool `json:"active,omitempty"`
+	Meta   *Meta `json:"meta,omitempty"`
+}
+
+type Name struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type Meta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+}
+
+// Group is a SCIM group resource, its display name is looked up in the UserGroupMapping of the profile
+type Group struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	DisplayName string   `json:"displayName"`
+	Members     []Member `json:"members"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+type Member struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Email returns the primary email of the user, falling back to the first email and then the user name
+func (u User) Email() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return u.UserName
+}
+
+// IsActive returns whether the user is active, users are active unless set otherwise
+func (u User) IsActive() bool {
+	return u.Active == nil || *u.Active
+}
+
+func (u *User) setEmail(email string) {
+	u.UserName = email
+	u.Emails = []Email{{Value: email, Type: "work", Primary: true}}
+}
+
+// parseBool reads a boolean patch value, some identity providers send booleans as strings
+func parseBool(raw json.RawMessage) (bool, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return false, err
+	}
+
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(strings.ToLower(v))
+	}
+	return false, errInvalidValue
+}
+
+func parseString(raw json.RawMessage) (string, error) {
+	value := ""
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", errInvalidValue
+	}
+	return value, nil
+}
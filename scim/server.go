@@ -0,0 +1,372 @@
+// Package scim implements the SCIM 2.0 endpoints through which identity providers push the lifecycle of the users
+// and groups of a profile into Tyk
+package scim
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	identityHandlers "github.com/TykTechnologies/tyk-identity-broker/tap/identity-handlers"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+var log = logger.Get()
+var scimLogTag = "SCIM"
+var scimLogger = log.WithField("prefix", scimLogTag)
+
+var (
+	errNotFound           = errors.New("resource not found")
+	errInvalidValue       = errors.New("invalid value")
+	errUnsupportedAction  = errors.New("SCIM is only supported for Dashboard user and portal developer profiles")
+	errGroupsNotSupported = errors.New("user groups are only supported for Dashboard users")
+)
+
+// filterExpression matches the equality filters identity providers use to look up a resource, e.g. userName eq "x"
+var filterExpression = regexp.MustCompile(`(?i)^\s*(\w+)\s+eq\s+"([^"]*)"\s*$`)
+
+func reloadSCIMLogger() {
+	log = logger.Get()
+	scimLogger = &logrus.Entry{Logger: log}
+	scimLogger = scimLogger.Logger.WithField("prefix", scimLogTag)
+}
+
+// Server serves the SCIM endpoints of every profile that has SCIM enabled
+type Server struct {
+	API              *tyk.TykAPI
+	AuthConfigStore  tap.AuthRegisterBackend
+	IdentityKeyStore tap.AuthRegisterBackend
+}
+
+// request is the context of an authenticated SCIM request
+type request struct {
+	profile tap.Profile
+	users   userBackend
+}
+
+type scimHandler func(w http.ResponseWriter, r *http.Request, req request)
+
+// Register adds the SCIM routes to a router
+func (s *Server) Register(router *mux.Router) {
+	reloadSCIMLogger()
+
+	router.Handle("/scim/v2/{profileId}/Users", s.authenticated(s.listUsers)).Methods("GET")
+	router.Handle("/scim/v2/{profileId}/Users", s.authenticated(s.createUser)).Methods("POST")
+	router.Handle("/scim/v2/{profileId}/Users/{id}", s.authenticated(s.getUser)).Methods("GET")
+	router.Handle("/scim/v2/{profileId}/Users/{id}", s.authenticated(s.replaceUser)).Methods("PUT")
+	router.Handle("/scim/v2/{profileId}/Users/{id}", s.authenticated(s.patchUser)).Methods("PATCH")
+	router.Handle("/scim/v2/{profileId}/Users/{id}", s.authenticated(s.deleteUser)).Methods("DELETE")
+
+	router.Handle("/scim/v2/{profileId}/Groups", s.authenticated(s.listGroups)).Methods("GET")
+	router.Handle("/scim/v2/{profileId}/Groups", s.authenticated(s.createGroup)).Methods("POST")
+	router.Handle("/scim/v2/{profileId}/Groups/{id}", s.authenticated(s.getGroup)).Methods("GET")
+	router.Handle("/scim/v2/{profileId}/Groups/{id}", s.authenticated(s.replaceGroup)).Methods("PUT")
+	router.Handle("/scim/v2/{profileId}/Groups/{id}", s.authenticated(s.patchGroup)).Methods("PATCH")
+	router.Handle("/scim/v2/{profileId}/Groups/{id}", s.authenticated(s.deleteGroup)).Methods("DELETE")
+}
+
+// authenticated checks the bearer token of the request against the SCIM token of the profile
+func (s *Server) authenticated(h scimHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		profile := tap.Profile{}
+		if err := s.AuthConfigStore.GetKey(mux.Vars(r)["profileId"], "", &profile); err != nil {
+			writeError(w, http.StatusNotFound, "", "Profile not found")
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if profile.SCIM == nil || !profile.SCIM.Enabled || profile.SCIM.Token == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(profile.SCIM.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "", "Authorization failed")
+			return
+		}
+
+		users, err := newUserBackend(s.API, s.IdentityKeyStore, profile)
+		if err != nil {
+			writeError(w, http.StatusNotImplemented, "", err.Error())
+			return
+		}
+
+		h(w, r, request{profile: profile, users: users})
+	})
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request, req request) {
+	users, err := req.users.list()
+	if err != nil {
+		scimLogger.WithContext(r.Context()).WithError(err).Error("Failed to list users")
+		writeError(w, http.StatusInternalServerError, "", "Failed to list users")
+		return
+	}
+
+	attribute, value, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil || (attribute != "" && !strings.EqualFold(attribute, "userName")) {
+		writeError(w, http.StatusBadRequest, "invalidFilter", "Only userName eq filters are supported")
+		return
+	}
+
+	resources := []interface{}{}
+	for _, user := range users {
+		if attribute == "" || strings.EqualFold(user.UserName, value) {
+			resources = append(resources, user)
+		}
+	}
+
+	writeList(w, r, resources)
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request, req request) {
+	user, err := req.users.get(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request, req request) {
+	logger := scimLogger.WithContext(r.Context())
+	user := User{}
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil || user.Email() == "" {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", "A user needs a userName or an email")
+		return
+	}
+
+	users, err := req.users.list()
+	if err != nil {
+		logger.WithError(err).Error("Failed to list users")
+		writeError(w, http.StatusInternalServerError, "", "Failed to create user")
+		return
+	}
+	for _, existing := range users {
+		if strings.EqualFold(existing.Email(), user.Email()) {
+			writeError(w, http.StatusConflict, "uniqueness", "User already exists")
+			return
+		}
+	}
+
+	created, err := req.users.create(user)
+	if err != nil {
+		logger.WithError(err).WithField("user", user.Email()).Error("Failed to create user")
+		writeError(w, http.StatusInternalServerError, "", "Failed to create user")
+		return
+	}
+
+	logger.WithField("profile", req.profile.ID).WithField("user", created.Email()).Info("User provisioned")
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) replaceUser(w http.ResponseWriter, r *http.Request, req request) {
+	user := User{}
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil || user.Email() == "" {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", "A user needs a userName or an email")
+		return
+	}
+
+	s.updateUser(w, mux.Vars(r)["id"], user, req)
+}
+
+func (s *Server) patchUser(w http.ResponseWriter, r *http.Request, req request) {
+	patch := PatchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidSyntax", "Invalid patch request")
+		return
+	}
+
+	user, err := req.users.get(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	for _, op := range patch.Operations {
+		if err := applyUserOperation(&user, op); err != nil {
+			writeError(w, http.StatusBadRequest, "invalidValue", fmt.Sprintf("Invalid %s operation on %q", op.Op, op.Path))
+			return
+		}
+	}
+
+	s.updateUser(w, user.ID, user, req)
+}
+
+// updateUser writes a user back to Tyk and revokes the tokens of users that have been deactivated
+func (s *Server) updateUser(w http.ResponseWriter, id string, user User, req request) {
+	current, err := req.users.get(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	if err := req.users.update(id, user); err != nil {
+		scimLogger.WithError(err).WithField("user", current.Email()).Error("Failed to update user")
+		writeError(w, http.StatusInternalServerError, "", "Failed to update user")
+		return
+	}
+
+	if current.IsActive() && !user.IsActive() {
+		s.revokeTokens(req.profile, current.Email())
+		scimLogger.WithField("profile", req.profile.ID).WithField("user", current.Email()).Info("User deactivated")
+	}
+
+	updated, err := req.users.get(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request, req request) {
+	logger := scimLogger.WithContext(r.Context())
+	id := mux.Vars(r)["id"]
+	user, err := req.users.get(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	if err := req.users.delete(id); err != nil {
+		logger.WithError(err).WithField("user", user.Email()).Error("Failed to delete user")
+		writeError(w, http.StatusInternalServerError, "", "Failed to delete user")
+		return
+	}
+
+	s.revokeTokens(req.profile, user.Email())
+	s.removeMember(req.profile.ID, id)
+	identityHandlers.ForgetSSOUser(s.IdentityKeyStore, req.profile.ID, user.Email())
+
+	logger.WithField("profile", req.profile.ID).WithField("user", user.Email()).Info("User deprovisioned")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeTokens revokes the tokens of a user in the token profiles listed by the SCIM config, failures are logged as
+// the user has already been removed from Tyk
+func (s *Server) revokeTokens(profile tap.Profile, email string) {
+	for _, profileID := range profile.SCIM.RevokeTokenProfiles {
+		revoked, err := identityHandlers.RevokeUserTokensInProfile(s.API, s.AuthConfigStore, s.IdentityKeyStore, profileID, email)
+		if err != nil {
+			scimLogger.WithField("user", email).WithField("token_profile", profileID).WithError(err).Error("Failed to revoke tokens")
+			continue
+		}
+		scimLogger.WithField("user", email).WithField("token_profile", profileID).WithField("revoked", revoked).Debug("Tokens revoked")
+	}
+}
+
+// applyUserOperation applies a PATCH operation, only the attributes TIB maps to Tyk can be changed
+func applyUserOperation(user *User, op PatchOperation) error {
+	if !strings.EqualFold(op.Op, "replace") && !strings.EqualFold(op.Op, "add") {
+		return errInvalidValue
+	}
+
+	// without a path the value holds the attributes to replace
+	if op.Path == "" {
+		attributes := map[string]json.RawMessage{}
+		if err := json.Unmarshal(op.Value, &attributes); err != nil {
+			return err
+		}
+		for path, value := range attributes {
+			if err := applyUserOperation(user, PatchOperation{Op: op.Op, Path: path, Value: value}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	path := strings.ToLower(op.Path)
+	switch {
+	case path == "active":
+		active, err := parseBool(op.Value)
+		if err != nil {
+			return err
+		}
+		user.Active = &active
+	case path == "username" || strings.HasPrefix(path, "emails"):
+		email, err := parseString(op.Value)
+		if err != nil {
+			// emails can also be replaced as a list
+			emails := []Email{}
+			if json.Unmarshal(op.Value, &emails) != nil || len(emails) == 0 {
+				return errInvalidValue
+			}
+			email = User{Emails: emails}.Email()
+		}
+		user.setEmail(email)
+	case path == "name":
+		return json.Unmarshal(op.Value, &user.Name)
+	case path == "name.givenname":
+		value, err := parseString(op.Value)
+		user.Name.GivenName = value
+		return err
+	case path == "name.familyname":
+		value, err := parseString(op.Value)
+		user.Name.FamilyName = value
+		return err
+	}
+
+	// attributes TIB doesn't map are ignored rather than refused, so that providers can push their full schema
+	return nil
+}
+
+func parseFilter(filter string) (string, string, error) {
+	if filter == "" {
+		return "", "", nil
+	}
+
+	match := filterExpression.FindStringSubmatch(filter)
+	if match == nil {
+		return "", "", errInvalidValue
+	}
+	return match[1], match[2], nil
+}
+
+// writeList writes a page of resources, startIndex and count are applied to the full result set
+func writeList(w http.ResponseWriter, r *http.Request, resources []interface{}) {
+	total := len(resources)
+
+	startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	if startIndex > total+1 {
+		startIndex = total + 1
+	}
+	resources = resources[startIndex-1:]
+
+	if count, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && count >= 0 && count < len(resources) {
+		resources = resources[:count]
+	}
+
+	writeJSON(w, http.StatusOK, ListResponse{
+		Schemas:      []string{ListResponseSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data) //nolint:errcheck
+}
+
+func writeError(w http.ResponseWriter, code int, scimType string, detail string) {
+	writeJSON(w, code, Error{
+		Schemas:  []string{ErrorSchema},
+		Status:   strconv.Itoa(code),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
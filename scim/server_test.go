@@ -0,0 +1,354 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/storage/persistent/model"
+
+	"github.com/TykTechnologies/tyk-identity-broker/backends"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	identityHandlers "github.com/TykTechnologies/tyk-identity-broker/tap/identity-handlers"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+const scimToken = "scim-token"
+
+// mockDashboard serves the user, portal developer and key endpoints of the Dashboard API
+type mockDashboard struct {
+	users       map[string]*tyk.DashboardUser
+	developers  map[string]*tyk.PortalDeveloper
+	created     int
+	invalidated []string
+	issued      int
+}
+
+func (d *mockDashboard) dispatch(target tyk.Endpoint, method string, _ string, body io.Reader) ([]byte, int, error) {
+	path := strings.Split(string(target), "?")[0]
+	userID := strings.TrimPrefix(path, string(tyk.DASH_USERS)+"/")
+
+	switch {
+	case target == tyk.STANDARD_TOKENS:
+		d.issued++
+		return []byte(fmt.Sprintf(`{"key_id":"key-%d"}`, d.issued)), http.StatusOK, nil
+	case method == http.MethodDelete && strings.Contains(path, "/keys/"):
+		d.invalidated = append(d.invalidated, path[strings.LastIndex(path, "/")+1:])
+		return []byte(`{}`), http.StatusOK, nil
+	case path == string(tyk.DASH_USERS) && method == http.MethodPost:
+		user := &tyk.DashboardUser{}
+		json.NewDecoder(body).Decode(user)
+		d.created++
+		user.ID = fmt.Sprintf("u-%d", d.created)
+		d.users[user.ID] = user
+		raw, _ := json.Marshal(map[string]interface{}{"Status": "OK", "Meta": user})
+		return raw, http.StatusOK, nil
+	case strings.HasPrefix(path, string(tyk.PORTAL_DEV)):
+		return d.dispatchDeveloper(path, method, body)
+	case path == string(tyk.DASH_USERS):
+		users := []tyk.DashboardUser{}
+		for _, user := range d.users {
+			users = append(users, *user)
+		}
+		raw, _ := json.Marshal(map[string]interface{}{"users": users})
+		return raw, http.StatusOK, nil
+	}
+
+	user, found := d.users[userID]
+	if !found {
+		return []byte(`{"Status":"Error"}`), http.StatusNotFound, fmt.Errorf("user %s not found", userID)
+	}
+
+	switch method {
+	case http.MethodGet:
+		raw, _ := json.Marshal(user)
+		return raw, http.StatusOK, nil
+	case http.MethodPut:
+		json.NewDecoder(body).Decode(user)
+	case http.MethodDelete:
+		delete(d.users, userID)
+	}
+
+	return []byte(`{}`), http.StatusOK, nil
+}
+
+func (d *mockDashboard) dispatchDeveloper(path, method string, body io.Reader) ([]byte, int, error) {
+	switch {
+	case path == string(tyk.PORTAL_DEV) && method == http.MethodPost:
+		dev := &tyk.PortalDeveloper{}
+		json.NewDecoder(body).Decode(dev)
+		dev.Id = model.NewObjectID()
+		d.developers[dev.Id.Hex()] = dev
+		return []byte(`{"Status":"OK"}`), http.StatusOK, nil
+	case path == string(tyk.PORTAL_DEV):
+		devs := []tyk.PortalDeveloper{}
+		for _, dev := range d.developers {
+			devs = append(devs, *dev)
+		}
+		raw, _ := json.Marshal(map[string]interface{}{"Data": devs, "Pages": 1})
+		return raw, http.StatusOK, nil
+	case strings.HasPrefix(path, string(tyk.PORTAL_DEVS)+"/"):
+		email, _ := url.QueryUnescape(strings.TrimPrefix(path, string(tyk.PORTAL_DEVS)+"/"))
+		for _, dev := range d.developers {
+			if dev.Email == email {
+				raw, _ := json.Marshal(dev)
+				return raw, http.StatusOK, nil
+			}
+		}
+		return []byte(`{"Status":"Error"}`), http.StatusNotFound, fmt.Errorf("developer not found")
+	}
+
+	id := strings.TrimPrefix(path, string(tyk.PORTAL_DEV)+"/")
+	dev, found := d.developers[id]
+	if !found {
+		return []byte(`{"Status":"Error"}`), http.StatusNotFound, fmt.Errorf("developer %s not found", id)
+	}
+
+	switch method {
+	case http.MethodGet:
+		raw, _ := json.Marshal(dev)
+		return raw, http.StatusOK, nil
+	case http.MethodPut:
+		json.NewDecoder(body).Decode(dev)
+	case http.MethodDelete:
+		delete(d.developers, id)
+	}
+	return []byte(`{"Status":"OK"}`), http.StatusOK, nil
+}
+
+func setupServer(t *testing.T) (*mux.Router, *mockDashboard, *Server) {
+	profiles := &backends.InMemoryBackend{}
+	profiles.Init(nil)
+	identities := &backends.InMemoryBackend{}
+	identities.Init(nil)
+
+	dash := &mockDashboard{users: map[string]*tyk.DashboardUser{}, developers: map[string]*tyk.PortalDeveloper{}}
+	api := &tyk.TykAPI{CustomDispatcher: dash.dispatch}
+
+	dashboardProfile := tap.Profile{
+		ID:                    "dashboard",
+		OrgID:                 "org-1",
+		ActionType:            tap.GenerateOrLoginUserProfile,
+		IdentityHandlerConfig: map[string]interface{}{"DashboardCredential": "cred"},
+		DefaultUserGroupID:    "readers",
+		UserGroupMapping:      map[string]string{"Tyk Admins": "admins"},
+		SCIM:                  &tap.SCIMServerConfig{Enabled: true, Token: scimToken, RevokeTokenProfiles: []string{"tokens"}},
+	}
+	tokenProfile := tap.Profile{
+		ID:         "tokens",
+		ActionType: tap.GenerateTemporaryAuthToken,
+		IdentityHandlerConfig: map[string]interface{}{
+			"DashboardCredential": "cred",
+			"TokenAuth":           map[string]interface{}{"BaseAPIID": "api-1"},
+		},
+	}
+	disabledProfile := dashboardProfile
+	disabledProfile.ID = "disabled"
+	disabledProfile.SCIM = nil
+	portalProfile := dashboardProfile
+	portalProfile.ID = "portal"
+	portalProfile.ActionType = tap.GenerateOrLoginDeveloperProfile
+	for _, profile := range []tap.Profile{dashboardProfile, tokenProfile, disabledProfile, portalProfile} {
+		profiles.SetKey(profile.ID, "", profile)
+	}
+
+	server := &Server{API: api, AuthConfigStore: profiles, IdentityKeyStore: identities}
+	router := mux.NewRouter()
+	server.Register(router)
+
+	return router, dash, server
+}
+
+func scimRequest(router *mux.Router, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+scimToken)
+	req.Header.Set("Content-Type", contentType)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthentication(t *testing.T) {
+	router, _, _ := setupServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/scim/v2/dashboard/Users", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, scimRequest(router, http.MethodGet, "/scim/v2/disabled/Users", "").Code)
+	assert.Equal(t, http.StatusNotFound, scimRequest(router, http.MethodGet, "/scim/v2/unknown/Users", "").Code)
+
+	w = scimRequest(router, http.MethodGet, "/scim/v2/dashboard/Users", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, contentType, w.Header().Get("Content-Type"))
+}
+
+func TestUserLifecycle(t *testing.T) {
+	router, dash, server := setupServer(t)
+
+	w := scimRequest(router, http.MethodPost, "/scim/v2/dashboard/Users", `{
+		"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName":"Alice@tyk.io","name":{"givenName":"Alice","familyName":"Smith"},"active":true}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := User{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	assert.Equal(t, "u-1", created.ID)
+	assert.Equal(t, tyk.DashboardUser{
+		ID: "u-1", FirstName: "Alice", LastName: "Smith", EmailAddress: "alice@tyk.io",
+		OrgID: "org-1", GroupID: "readers", Active: true,
+	}, *dash.users["u-1"])
+
+	w = scimRequest(router, http.MethodPost, "/scim/v2/dashboard/Users", `{"userName":"alice@tyk.io"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = scimRequest(router, http.MethodGet, `/scim/v2/dashboard/Users?filter=userName+eq+%22ALICE@tyk.io%22`, "")
+	list := ListResponse{}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Equal(t, 1, list.TotalResults)
+
+	// alice holds a token of the token profile, which is revoked when she is deactivated
+	tokenProfile := tap.Profile{}
+	server.AuthConfigStore.GetKey("tokens", "", &tokenProfile)
+	tokenHandler := &identityHandlers.TykIdentityHandler{API: server.API, Store: server.IdentityKeyStore}
+	assert.NoError(t, tokenHandler.Init(tokenProfile))
+	tokenHandler.CompleteIdentityActionForTokenAuth(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil),
+		goth.User{UserID: "alice", Email: "alice@tyk.io"}, tokenProfile)
+
+	w = scimRequest(router, http.MethodPatch, "/scim/v2/dashboard/Users/u-1", `{
+		"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations":[{"op":"Replace","path":"name.givenName","value":"Ally"},{"op":"Replace","path":"active","value":"False"}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, dash.users["u-1"].Active)
+	assert.Equal(t, "Ally", dash.users["u-1"].FirstName)
+	assert.Equal(t, []string{"key-1"}, dash.invalidated)
+
+	w = scimRequest(router, http.MethodPut, "/scim/v2/dashboard/Users/u-1", `{"userName":"alice@tyk.io","active":true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, dash.users["u-1"].Active)
+
+	assert.Equal(t, http.StatusNoContent, scimRequest(router, http.MethodDelete, "/scim/v2/dashboard/Users/u-1", "").Code)
+	assert.Empty(t, dash.users)
+	assert.Equal(t, http.StatusNotFound, scimRequest(router, http.MethodGet, "/scim/v2/dashboard/Users/u-1", "").Code)
+}
+
+func TestUsersOfOtherProfiles(t *testing.T) {
+	router, dash, server := setupServer(t)
+	// an admin of the organisation that the profile neither created nor logged in
+	dash.users["admin"] = &tyk.DashboardUser{ID: "admin", EmailAddress: "admin@tyk.io", OrgID: "org-1", GroupID: "owners", Active: true}
+	// a user the profile logged in, of another organisation
+	dash.users["other"] = &tyk.DashboardUser{ID: "other", EmailAddress: "other@tyk.io", OrgID: "org-2", Active: true}
+	identityHandlers.RecordSSOUser(server.IdentityKeyStore, "dashboard", "other@tyk.io")
+
+	w := scimRequest(router, http.MethodGet, "/scim/v2/dashboard/Users", "")
+	list := ListResponse{}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Equal(t, 0, list.TotalResults)
+
+	for _, id := range []string{"admin", "other"} {
+		assert.Equal(t, http.StatusNotFound, scimRequest(router, http.MethodGet, "/scim/v2/dashboard/Users/"+id, "").Code)
+		assert.Equal(t, http.StatusNotFound, scimRequest(router, http.MethodPut, "/scim/v2/dashboard/Users/"+id, `{"userName":"`+id+`@tyk.io","active":false}`).Code)
+		assert.Equal(t, http.StatusNotFound, scimRequest(router, http.MethodDelete, "/scim/v2/dashboard/Users/"+id, "").Code)
+	}
+	assert.True(t, dash.users["admin"].Active)
+	assert.Len(t, dash.users, 2)
+
+	scimRequest(router, http.MethodPost, "/scim/v2/dashboard/Groups", `{"displayName":"Tyk Admins","members":[{"value":"admin"}]}`)
+	assert.Equal(t, "owners", dash.users["admin"].GroupID)
+}
+
+func TestDevelopersOfOtherProfiles(t *testing.T) {
+	router, dash, server := setupServer(t)
+	// a developer an admin created in the portal, and one of another organisation the profile logged in
+	dash.developers["admin-dev"] = &tyk.PortalDeveloper{Id: "admin-dev", Email: "dev@tyk.io", OrgId: "org-1"}
+	dash.developers["other-dev"] = &tyk.PortalDeveloper{Id: "other-dev", Email: "other@tyk.io", OrgId: "org-2"}
+	identityHandlers.RecordPortalDeveloper(server.IdentityKeyStore, "portal", "other@tyk.io")
+
+	w := scimRequest(router, http.MethodPost, "/scim/v2/portal/Users", `{"userName":"Carol@tyk.io","name":{"givenName":"Carol"},"active":true}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := User{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	w = scimRequest(router, http.MethodGet, "/scim/v2/portal/Users", "")
+	list := ListResponse{}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Equal(t, 1, list.TotalResults)
+	assert.Equal(t, http.StatusOK, scimRequest(router, http.MethodGet, "/scim/v2/portal/Users/"+created.ID, "").Code)
+
+	for _, id := range []string{"admin-dev", "other-dev"} {
+		assert.Equal(t, http.StatusNotFound, scimRequest(router, http.MethodGet, "/scim/v2/portal/Users/"+id, "").Code)
+		assert.Equal(t, http.StatusNotFound, scimRequest(router, http.MethodPut, "/scim/v2/portal/Users/"+id, `{"userName":"x@tyk.io","active":false}`).Code)
+		assert.Equal(t, http.StatusNotFound, scimRequest(router, http.MethodDelete, "/scim/v2/portal/Users/"+id, "").Code)
+	}
+	assert.Equal(t, "dev@tyk.io", dash.developers["admin-dev"].Email)
+	assert.False(t, dash.developers["admin-dev"].InActive)
+
+	assert.Equal(t, http.StatusNoContent, scimRequest(router, http.MethodDelete, "/scim/v2/portal/Users/"+created.ID, "").Code)
+	assert.Len(t, dash.developers, 2)
+	assert.Equal(t, []string{"other@tyk.io"}, identityHandlers.PortalDevelopers(server.IdentityKeyStore, "portal"))
+}
+
+func TestGroupMemberships(t *testing.T) {
+	router, dash, server := setupServer(t)
+	dash.users["u-1"] = &tyk.DashboardUser{ID: "u-1", EmailAddress: "alice@tyk.io", OrgID: "org-1", GroupID: "readers", Active: true}
+	dash.users["u-2"] = &tyk.DashboardUser{ID: "u-2", EmailAddress: "bob@tyk.io", OrgID: "org-1", GroupID: "readers", Active: true}
+	identityHandlers.RecordSSOUser(server.IdentityKeyStore, "dashboard", "alice@tyk.io")
+	identityHandlers.RecordSSOUser(server.IdentityKeyStore, "dashboard", "Bob@tyk.io")
+
+	w := scimRequest(router, http.MethodPost, "/scim/v2/dashboard/Groups",
+		`{"displayName":"Tyk Admins","members":[{"value":"u-1"}]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	group := Group{}
+	json.Unmarshal(w.Body.Bytes(), &group)
+	assert.NotEmpty(t, group.ID)
+	assert.Equal(t, "admins", dash.users["u-1"].GroupID)
+	assert.Equal(t, "readers", dash.users["u-2"].GroupID)
+
+	w = scimRequest(router, http.MethodPatch, "/scim/v2/dashboard/Groups/"+group.ID, `{"Operations":[
+		{"op":"add","path":"members","value":[{"value":"u-2"}]},
+		{"op":"remove","path":"members[value eq \"u-1\"]"}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "readers", dash.users["u-1"].GroupID)
+	assert.Equal(t, "admins", dash.users["u-2"].GroupID)
+
+	// groups that are not in the UserGroupMapping don't change the user group
+	w = scimRequest(router, http.MethodPost, "/scim/v2/dashboard/Groups",
+		`{"displayName":"Everyone","members":[{"value":"u-1"},{"value":"u-2"}]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "readers", dash.users["u-1"].GroupID)
+	assert.Equal(t, "admins", dash.users["u-2"].GroupID)
+
+	w = scimRequest(router, http.MethodGet, `/scim/v2/dashboard/Groups?filter=displayName+eq+%22Tyk+Admins%22`, "")
+	list := ListResponse{}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Equal(t, 1, list.TotalResults)
+
+	assert.Equal(t, http.StatusNoContent, scimRequest(router, http.MethodDelete, "/scim/v2/dashboard/Groups/"+group.ID, "").Code)
+	assert.Equal(t, "readers", dash.users["u-2"].GroupID)
+	assert.Equal(t, http.StatusNotFound, scimRequest(router, http.MethodGet, "/scim/v2/dashboard/Groups/"+group.ID, "").Code)
+	assert.Len(t, tap.Members(server.IdentityKeyStore, scimGroupsPrefix+"dashboard", ""), 1)
+}
+
+func TestApplyUserOperation(t *testing.T) {
+	user := User{UserName: "alice@tyk.io"}
+
+	assert.NoError(t, applyUserOperation(&user, PatchOperation{Op: "replace",
+		Value: json.RawMessage(`{"active":false,"name.familyName":"Smith","emails":[{"value":"a.smith@tyk.io","primary":true}]}`)}))
+	assert.False(t, user.IsActive())
+	assert.Equal(t, "Smith", user.Name.FamilyName)
+	assert.Equal(t, "a.smith@tyk.io", user.Email())
+
+	assert.Error(t, applyUserOperation(&user, PatchOperation{Op: "replace", Path: "active", Value: json.RawMessage(`"maybe"`)}))
+	assert.Error(t, applyUserOperation(&user, PatchOperation{Op: "remove", Path: "active"}))
+}
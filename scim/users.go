@@ -0,0 +1,287 @@
+package scim
+
+import (
+	"strings"
+
+	"github.com/TykTechnologies/storage/persistent/model"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	identityHandlers "github.com/TykTechnologies/tyk-identity-broker/tap/identity-handlers"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+// userBackend stores the SCIM users of a profile in Tyk
+type userBackend interface {
+	list() ([]User, error)
+	get(id string) (User, error)
+	create(user User) (User, error)
+	update(id string, user User) error
+	delete(id string) error
+	// setGroup sets the Dashboard user group of a user, it is not supported by every backend
+	setGroup(id string, groupID string) error
+}
+
+// newUserBackend returns the backend matching the action of the profile, store holds the users the profile manages
+func newUserBackend(api *tyk.TykAPI, store tap.AuthRegisterBackend, profile tap.Profile) (userBackend, error) {
+	cred, _ := profile.IdentityHandlerConfig["DashboardCredential"].(string)
+
+	switch profile.ActionType {
+	case tap.GenerateOrLoginUserProfile:
+		return &dashboardUsers{api: api, cred: cred, profile: profile, store: store}, nil
+	case tap.GenerateOrLoginDeveloperProfile:
+		return &portalDevelopers{api: api, cred: cred, profile: profile, store: store}, nil
+	}
+
+	return nil, errUnsupportedAction
+}
+
+func activePtr(active bool) *bool {
+	return &active
+}
+
+// dashboardUsers maps SCIM users to Dashboard users. Only the users the profile created or logged in, kept in its SSO
+// users, can be seen and changed, so that the SCIM token can't reach admins and other users of the organisation.
+type dashboardUsers struct {
+	api     *tyk.TykAPI
+	cred    string
+	profile tap.Profile
+	store   tap.AuthRegisterBackend
+}
+
+// managed reports whether a Dashboard user belongs to the profile
+func (d *dashboardUsers) managed(user tyk.DashboardUser) bool {
+	if user.ID == "" || (d.profile.OrgID != "" && user.OrgID != d.profile.OrgID) {
+		return false
+	}
+	for _, email := range identityHandlers.SSOUsers(d.store, d.profile.ID) {
+		if strings.EqualFold(email, user.EmailAddress) {
+			return true
+		}
+	}
+	return false
+}
+
+// dashboardUser returns a Dashboard user of the profile
+func (d *dashboardUsers) dashboardUser(id string) (tyk.DashboardUser, error) {
+	user, err := d.api.GetDashboardUser(d.cred, id)
+	if err != nil || !d.managed(user) {
+		return tyk.DashboardUser{}, errNotFound
+	}
+	return user, nil
+}
+
+func (d *dashboardUsers) toSCIM(user tyk.DashboardUser) User {
+	u := User{
+		Schemas: []string{UserSchema},
+		ID:      user.ID,
+		Name:    Name{GivenName: user.FirstName, FamilyName: user.LastName},
+		Active:  activePtr(user.Active),
+	}
+	u.setEmail(user.EmailAddress)
+	return u
+}
+
+func (d *dashboardUsers) list() ([]User, error) {
+	dashUsers, err := d.api.GetDashboardUsers(d.cred)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(dashUsers))
+	for _, user := range dashUsers {
+		if d.managed(user) {
+			users = append(users, d.toSCIM(user))
+		}
+	}
+	return users, nil
+}
+
+func (d *dashboardUsers) get(id string) (User, error) {
+	user, err := d.dashboardUser(id)
+	if err != nil {
+		return User{}, err
+	}
+	return d.toSCIM(user), nil
+}
+
+func (d *dashboardUsers) create(user User) (User, error) {
+	created, err := d.api.CreateDashboardUser(d.cred, tyk.DashboardUser{
+		FirstName:    user.Name.GivenName,
+		LastName:     user.Name.FamilyName,
+		EmailAddress: strings.ToLower(user.Email()),
+		OrgID:        d.profile.OrgID,
+		GroupID:      d.profile.DefaultUserGroupID,
+		Active:       user.IsActive(),
+	})
+	if err != nil {
+		return User{}, err
+	}
+	identityHandlers.RecordSSOUser(d.store, d.profile.ID, created.EmailAddress)
+	return d.toSCIM(created), nil
+}
+
+func (d *dashboardUsers) update(id string, user User) error {
+	existing, err := d.dashboardUser(id)
+	if err != nil {
+		return err
+	}
+
+	email := strings.ToLower(user.Email())
+	if err := d.api.UpdateDashboardUser(d.cred, id, map[string]interface{}{
+		"first_name":    user.Name.GivenName,
+		"last_name":     user.Name.FamilyName,
+		"email_address": email,
+		"active":        user.IsActive(),
+	}); err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(existing.EmailAddress, email) {
+		identityHandlers.RecordSSOUser(d.store, d.profile.ID, email)
+		identityHandlers.ForgetSSOUser(d.store, d.profile.ID, existing.EmailAddress)
+	}
+	return nil
+}
+
+func (d *dashboardUsers) delete(id string) error {
+	if _, err := d.dashboardUser(id); err != nil {
+		return err
+	}
+	return d.api.DeleteDashboardUser(d.cred, id)
+}
+
+func (d *dashboardUsers) setGroup(id string, groupID string) error {
+	if _, err := d.dashboardUser(id); err != nil {
+		return err
+	}
+	return d.api.UpdateDashboardUser(d.cred, id, map[string]interface{}{"group_id": groupID})
+}
+
+// portalDevelopers maps SCIM users to portal developers, the name of the user is kept in the developer fields. Like
+// dashboardUsers, only the developers the profile created or logged in can be seen and changed.
+type portalDevelopers struct {
+	api     *tyk.TykAPI
+	cred    string
+	profile tap.Profile
+	store   tap.AuthRegisterBackend
+}
+
+// managed reports whether a portal developer belongs to the profile
+func (p *portalDevelopers) managed(dev tyk.PortalDeveloper) bool {
+	if dev.Id == "" || (p.profile.OrgID != "" && dev.OrgId != p.profile.OrgID) {
+		return false
+	}
+	for _, email := range identityHandlers.PortalDevelopers(p.store, p.profile.ID) {
+		if strings.EqualFold(email, dev.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// developer returns a portal developer of the profile
+func (p *portalDevelopers) developer(id string) (tyk.PortalDeveloper, error) {
+	dev, err := p.api.GetDeveloperByID(p.cred, id)
+	if err != nil || !p.managed(dev) {
+		return tyk.PortalDeveloper{}, errNotFound
+	}
+	return dev, nil
+}
+
+func (p *portalDevelopers) toSCIM(dev tyk.PortalDeveloper) User {
+	u := User{
+		Schemas: []string{UserSchema},
+		ID:      dev.Id.Hex(),
+		Name:    Name{GivenName: dev.Fields["Name"], FamilyName: dev.Fields["Surname"]},
+		Active:  activePtr(!dev.InActive),
+	}
+	u.setEmail(dev.Email)
+	return u
+}
+
+func (p *portalDevelopers) list() ([]User, error) {
+	devs, err := p.api.GetDevelopers(p.cred)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(devs))
+	for _, dev := range devs {
+		if p.managed(dev) {
+			users = append(users, p.toSCIM(dev))
+		}
+	}
+	return users, nil
+}
+
+func (p *portalDevelopers) get(id string) (User, error) {
+	dev, err := p.developer(id)
+	if err != nil {
+		return User{}, err
+	}
+	return p.toSCIM(dev), nil
+}
+
+func (p *portalDevelopers) create(user User) (User, error) {
+	email := strings.ToLower(user.Email())
+	dev := tyk.PortalDeveloper{
+		Email:    email,
+		OrgId:    p.profile.OrgID,
+		InActive: !user.IsActive(),
+		Fields:   map[string]string{"Name": user.Name.GivenName, "Surname": user.Name.FamilyName},
+	}
+	if err := p.api.CreateDeveloper(p.cred, dev); err != nil {
+		return User{}, err
+	}
+	identityHandlers.RecordPortalDeveloper(p.store, p.profile.ID, email)
+
+	// the portal API doesn't return the new developer, so it is read back for its ID
+	created, err := p.api.GetDeveloper(p.cred, email)
+	if err != nil {
+		return User{}, err
+	}
+	return p.toSCIM(created), nil
+}
+
+func (p *portalDevelopers) update(id string, user User) error {
+	dev, err := p.developer(id)
+	if err != nil {
+		return err
+	}
+
+	previous := dev.Email
+	dev.Id = model.ObjectIDHex(id)
+	dev.Email = strings.ToLower(user.Email())
+	dev.InActive = !user.IsActive()
+	if dev.Fields == nil {
+		dev.Fields = map[string]string{}
+	}
+	dev.Fields["Name"] = user.Name.GivenName
+	dev.Fields["Surname"] = user.Name.FamilyName
+
+	if err := p.api.UpdateDeveloper(p.cred, dev); err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(previous, dev.Email) {
+		identityHandlers.RecordPortalDeveloper(p.store, p.profile.ID, dev.Email)
+		identityHandlers.ForgetPortalDeveloper(p.store, p.profile.ID, previous)
+	}
+	return nil
+}
+
+func (p *portalDevelopers) delete(id string) error {
+	dev, err := p.developer(id)
+	if err != nil {
+		return err
+	}
+	if err := p.api.DeleteDeveloper(p.cred, id); err != nil {
+		return err
+	}
+	identityHandlers.ForgetPortalDeveloper(p.store, p.profile.ID, dev.Email)
+	return nil
+}
+
+func (p *portalDevelopers) setGroup(string, string) error {
+	return errGroupsNotSupported
+}
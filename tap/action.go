@@ -18,4 +18,7 @@ const (
 	// Direct or redirect
 	GenerateTemporaryAuthToken    Action = "GenerateTemporaryAuthToken"  // Tyk Access Token
 	GenerateOAuthTokenForPassword Action = "GenerateOAuthTokenForClient" // OAuth PW flow
+
+	// Tyk Enterprise Developer Portal
+	GenerateOrLoginEnterprisePortalUser Action = "GenerateOrLoginEnterprisePortalUser"
 )
@@ -6,6 +6,10 @@ proxy
 package tap
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/TykTechnologies/storage/persistent/model"
 )
 
@@ -18,6 +22,200 @@ type AuthRegisterBackend interface {
 	DeleteKey(key string, orgId string) error
 }
 
+// ExpiringBackend is implemented by backends that can expire keys on their own, such as Redis
+type ExpiringBackend interface {
+	SetKeyWithTTL(key string, orgId string, val interface{}, ttl time.Duration) error
+}
+
+// SetKeyWithTTL sets a key that expires after ttl when the backend supports it, other backends keep the key until
+// it is deleted, so values stored this way must carry their own expiry as well
+func SetKeyWithTTL(store AuthRegisterBackend, key string, orgId string, val interface{}, ttl time.Duration) error {
+	if expiring, ok := store.(ExpiringBackend); ok {
+		return expiring.SetKeyWithTTL(key, orgId, val, ttl)
+	}
+	return store.SetKey(key, orgId, val)
+}
+
+// AtomicBackend is implemented by backends whose keys can be claimed and consumed atomically by one of several TIB
+// instances, such as Redis
+type AtomicBackend interface {
+	// SetKeyIfNotExist sets a key that expires after ttl unless it is already set, and reports whether it was set
+	SetKeyIfNotExist(key string, orgId string, val interface{}, ttl time.Duration) (bool, error)
+	// ConsumeKey gets a key and deletes it, when a key is consumed concurrently only one caller gets its value
+	ConsumeKey(key string, orgId string, val interface{}) error
+}
+
+// atomicLock makes SetKeyIfNotExist and ConsumeKey atomic within this instance for backends that are not atomic
+var atomicLock sync.Mutex
+
+// SetKeyIfNotExist sets a key that expires after ttl unless it is already set, and reports whether it was set. Only
+// backends that implement AtomicBackend make this atomic across TIB instances.
+func SetKeyIfNotExist(store AuthRegisterBackend, key string, orgId string, val interface{}, ttl time.Duration) (bool, error) {
+	if atomic, ok := store.(AtomicBackend); ok {
+		return atomic.SetKeyIfNotExist(key, orgId, val, ttl)
+	}
+
+	atomicLock.Lock()
+	defer atomicLock.Unlock()
+	var existing interface{}
+	if store.GetKey(key, orgId, &existing) == nil {
+		return false, nil
+	}
+	return true, SetKeyWithTTL(store, key, orgId, val, ttl)
+}
+
+// ConsumeKey gets a key into val and deletes it, so that a value such as a one time code is used once. Only backends
+// that implement AtomicBackend make this atomic across TIB instances.
+func ConsumeKey(store AuthRegisterBackend, key string, orgId string, val interface{}) error {
+	if atomic, ok := store.(AtomicBackend); ok {
+		return atomic.ConsumeKey(key, orgId, val)
+	}
+
+	atomicLock.Lock()
+	defer atomicLock.Unlock()
+	if err := store.GetKey(key, orgId, val); err != nil {
+		return err
+	}
+	return store.DeleteKey(key, orgId)
+}
+
+// SetBackend is implemented by backends that hold sets shared by every TIB instance, such as Redis, so that members
+// are added and removed without rewriting the whole set
+type SetBackend interface {
+	// AddMember adds member to the set at key, and makes the set expire after ttl unless ttl is 0
+	AddMember(key string, orgId string, member string, ttl time.Duration) error
+	Members(key string, orgId string) ([]string, error)
+	RemoveMember(key string, orgId string, member string) error
+}
+
+// setLock guards the read-modify-write of sets kept as lists by backends that do not implement SetBackend
+var setLock sync.Mutex
+
+// AddMember adds member to the set at key, which expires after ttl when the backend supports it. Other backends keep
+// the set as a list, whose changes are only atomic within this instance.
+func AddMember(store AuthRegisterBackend, key string, orgId string, member string, ttl time.Duration) error {
+	if sets, ok := store.(SetBackend); ok {
+		return sets.AddMember(key, orgId, member, ttl)
+	}
+
+	setLock.Lock()
+	defer setLock.Unlock()
+	members := []string{}
+	store.GetKey(key, orgId, &members)
+	for _, existing := range members {
+		if existing == member {
+			return nil
+		}
+	}
+	return SetKeyWithTTL(store, key, orgId, append(members, member), ttl)
+}
+
+// Members returns the members of the set at key, a set that does not exist has no members
+func Members(store AuthRegisterBackend, key string, orgId string) []string {
+	if sets, ok := store.(SetBackend); ok {
+		members, err := sets.Members(key, orgId)
+		if err != nil {
+			return []string{}
+		}
+		return members
+	}
+
+	setLock.Lock()
+	defer setLock.Unlock()
+	members := []string{}
+	store.GetKey(key, orgId, &members)
+	return members
+}
+
+// RemoveMember removes member from the set at key
+func RemoveMember(store AuthRegisterBackend, key string, orgId string, member string) error {
+	if sets, ok := store.(SetBackend); ok {
+		return sets.RemoveMember(key, orgId, member)
+	}
+
+	setLock.Lock()
+	defer setLock.Unlock()
+	members := []string{}
+	store.GetKey(key, orgId, &members)
+	remaining := make([]string, 0, len(members))
+	for _, existing := range members {
+		if existing != member {
+			remaining = append(remaining, existing)
+		}
+	}
+	if len(remaining) == 0 {
+		return store.DeleteKey(key, orgId)
+	}
+	return store.SetKey(key, orgId, remaining)
+}
+
+// ListBackend is implemented by backends that keep lists shared by every TIB instance, such as Redis
+type ListBackend interface {
+	// PushCapped adds value to the head of the list at key and drops the values past the first size
+	PushCapped(key string, orgId string, value []byte, size int64) error
+	Range(key string, orgId string) ([]string, error)
+}
+
+// listLock guards the read-modify-write of lists kept in a key by backends that do not implement ListBackend
+var listLock sync.Mutex
+
+// PushCapped adds value to the head of the list at key, which keeps its first size values only. Other backends keep
+// the list in a key, whose changes are only atomic within this instance.
+func PushCapped(store AuthRegisterBackend, key string, orgId string, value []byte, size int) error {
+	if lists, ok := store.(ListBackend); ok {
+		return lists.PushCapped(key, orgId, value, int64(size))
+	}
+
+	listLock.Lock()
+	defer listLock.Unlock()
+	values := []string{}
+	store.GetKey(key, orgId, &values)
+	values = append([]string{string(value)}, values...)
+	if len(values) > size {
+		values = values[:size]
+	}
+	return store.SetKey(key, orgId, values)
+}
+
+// Range returns the values of the list at key, head first, a list that does not exist has no values
+func Range(store AuthRegisterBackend, key string, orgId string) []string {
+	if lists, ok := store.(ListBackend); ok {
+		values, err := lists.Range(key, orgId)
+		if err != nil {
+			return []string{}
+		}
+		return values
+	}
+
+	listLock.Lock()
+	defer listLock.Unlock()
+	values := []string{}
+	store.GetKey(key, orgId, &values)
+	return values
+}
+
+// ScheduleBackend is implemented by backends that hold schedules shared by every TIB instance, such as Redis. Claim
+// hands the members that are due to one instance and reschedules them at the end of lease, a member stays in its
+// schedule until it is unscheduled, so it is claimed again if the instance that claimed it stops.
+type ScheduleBackend interface {
+	Schedule(schedule string, member string, at time.Time) error
+	Claim(schedule string, now time.Time, count int64, lease time.Duration) ([]string, error)
+	Unschedule(schedule string, member string) error
+}
+
+// ContextBackend is implemented by backends that trace their operations, such as Redis
+type ContextBackend interface {
+	WithContext(ctx context.Context) AuthRegisterBackend
+}
+
+// WithContext binds store to ctx when it traces its operations, so that they are traced as part of the request of ctx
+func WithContext(ctx context.Context, store AuthRegisterBackend) AuthRegisterBackend {
+	if traced, ok := store.(ContextBackend); ok {
+		return traced.WithContext(ctx)
+	}
+	return store
+}
+
 type DBObject interface {
 	SetDBID(id model.ObjectID)
 }
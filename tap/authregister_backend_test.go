@@ -0,0 +1,49 @@
+package tap
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// keyValueStore only stores keys, so the helpers fall back to keeping sets as lists
+type keyValueStore map[string][]byte
+
+func (m keyValueStore) Init(interface{}) error { return nil }
+
+func (m keyValueStore) SetKey(key string, _ string, val interface{}) error {
+	m[key], _ = json.Marshal(val)
+	return nil
+}
+
+func (m keyValueStore) GetKey(key string, _ string, val interface{}) error {
+	v, ok := m[key]
+	if !ok {
+		return errors.New("not found")
+	}
+	return json.Unmarshal(v, val)
+}
+
+func (m keyValueStore) GetAll(string) []interface{} { return nil }
+
+func (m keyValueStore) DeleteKey(key string, _ string) error {
+	delete(m, key)
+	return nil
+}
+
+func TestSetFallback(t *testing.T) {
+	store := keyValueStore{}
+	assert.Empty(t, Members(store, "set", ""))
+
+	assert.NoError(t, AddMember(store, "set", "", "first", 0))
+	assert.NoError(t, AddMember(store, "set", "", "second", 0))
+	assert.NoError(t, AddMember(store, "set", "", "first", 0))
+	assert.Equal(t, []string{"first", "second"}, Members(store, "set", ""))
+
+	assert.NoError(t, RemoveMember(store, "set", "", "first"))
+	assert.Equal(t, []string{"second"}, Members(store, "set", ""))
+	assert.NoError(t, RemoveMember(store, "set", "", "second"))
+	assert.NotContains(t, store, "set")
+}
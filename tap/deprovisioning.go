@@ -0,0 +1,45 @@
+package tap
+
+const (
+	DirectoryLDAP = "ldap"
+	DirectorySCIM = "scim"
+
+	DeprovisionDisable = "disable"
+	DeprovisionDelete  = "delete"
+)
+
+// DeprovisioningConfig configures the sync that removes Dashboard users who were logged in through a profile, and
+// are no longer part of the directory of the identity provider
+type DeprovisioningConfig struct {
+	Enabled bool   `bson:"Enabled" json:"Enabled"`
+	Source  string `bson:"Source" json:"Source"`
+	// Interval in seconds between scheduled syncs, when 0 the sync only runs when triggered through the API
+	Interval int64 `bson:"Interval" json:"Interval"`
+	// Action is either "disable" (default) or "delete"
+	Action string `bson:"Action" json:"Action"`
+	// DryRun only reports the users that would be deprovisioned
+	DryRun bool                `bson:"DryRun" json:"DryRun"`
+	LDAP   LDAPDirectoryConfig `bson:"LDAP" json:"LDAP"`
+	SCIM   SCIMDirectoryConfig `bson:"SCIM" json:"SCIM"`
+	// RevokeTokenProfiles lists the token profiles whose tokens are revoked for deprovisioned users
+	RevokeTokenProfiles []string `bson:"RevokeTokenProfiles" json:"RevokeTokenProfiles"`
+}
+
+// LDAPDirectoryConfig is the scope of an LDAP directory, the users found by Filter under BaseDN are the ones that
+// keep their access
+type LDAPDirectoryConfig struct {
+	Server         string `bson:"Server" json:"Server"`
+	Port           string `bson:"Port" json:"Port"`
+	UseSSL         bool   `bson:"UseSSL" json:"UseSSL"`
+	BindDN         string `bson:"BindDN" json:"BindDN"`
+	BindPassword   string `bson:"BindPassword" json:"BindPassword"`
+	BaseDN         string `bson:"BaseDN" json:"BaseDN"`
+	Filter         string `bson:"Filter" json:"Filter"`
+	EmailAttribute string `bson:"EmailAttribute" json:"EmailAttribute"`
+}
+
+// SCIMDirectoryConfig is a SCIM 2.0 service provider, URL is its base, e.g. https://idp.example.com/scim/v2
+type SCIMDirectoryConfig struct {
+	URL   string `bson:"URL" json:"URL"`
+	Token string `bson:"Token" json:"Token"`
+}
@@ -0,0 +1,32 @@
+package identityHandlers
+
+import (
+	"net/http"
+
+	"github.com/markbates/goth"
+
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
+)
+
+// loginSucceeded marks the login of w as completed and records it in the audit log
+func (t *TykIdentityHandler) loginSucceeded(w http.ResponseWriter, r *http.Request, i interface{}) {
+	metrics.LoginSucceeded(w)
+
+	user, _ := i.(goth.User)
+	audit.Log(r, audit.Event{
+		Type:      audit.LoginSuccess,
+		OrgID:     t.profile.OrgID,
+		ProfileID: t.profile.ID,
+		Provider:  t.profile.ProviderName,
+		User:      auditUser(user),
+	})
+}
+
+// auditUser identifies a user in the audit log by email, falling back to the ID given by the identity provider
+func auditUser(user goth.User) string {
+	if user.Email != "" {
+		return user.Email
+	}
+	return user.UserID
+}
@@ -0,0 +1,100 @@
+package identityHandlers
+
+import (
+	"errors"
+
+	"github.com/markbates/goth"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+const (
+	permissionDeny  = "deny"
+	permissionRead  = "read"
+	permissionWrite = "write"
+)
+
+var (
+	ErrOrgNotMapped         = errors.New("user organisation is not mapped to a Tyk organisation")
+	ErrPermissionsNotMapped = errors.New("none of the user groups is mapped to Dashboard permissions")
+)
+
+// permissionRank orders permission values so that the broadest one granted by any group wins
+var permissionRank = map[string]int{
+	permissionDeny:  1,
+	permissionRead:  2,
+	permissionWrite: 3,
+}
+
+// GetOrgID returns the Tyk organisation of a user. When customOrgIDField is set the organisation is read from that
+// claim and mapped through orgIDMapping, a user whose claim has no mapping gets ErrOrgNotMapped. Otherwise the
+// organisation of the profile is used.
+func GetOrgID(gUser goth.User, customOrgIDField string, orgIDMapping map[string]string, defaultOrgID string) (string, error) {
+	if customOrgIDField == "" {
+		return defaultOrgID, nil
+	}
+
+	rawOrg, exists := gUser.RawData[customOrgIDField]
+	if !exists || rawOrg == nil {
+		return "", ErrOrgNotMapped
+	}
+
+	// the claim may hold several values, e.g. every tenant the user belongs to, the first mapped one is used
+	for _, org := range claimValues(rawOrg) {
+		if orgID, ok := orgIDMapping[org]; ok {
+			return orgID, nil
+		}
+	}
+
+	return "", ErrOrgNotMapped
+}
+
+// claimValues returns the values of a claim that holds one value or a list of them. Unlike groupsStringer it never
+// splits a string, an organisation such as "Acme Corp" is a single value, and numbers are read as their text.
+func claimValues(raw interface{}) []string {
+	switch v := raw.(type) {
+	case nil:
+		return nil
+	case []string:
+		return v
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, elem := range v {
+			if elem != nil {
+				values = append(values, claimString(elem))
+			}
+		}
+		return values
+	default:
+		return []string{claimString(v)}
+	}
+}
+
+// GetPermissions merges the Dashboard permissions mapped to every group of the user, when groups disagree on an
+// object write takes precedence over read, and read over deny. It returns nil when there is no mapping configured,
+// and ErrPermissionsNotMapped when none of the user's groups has permissions.
+func GetPermissions(gUser goth.User, CustomUserGroupField string, permissionsMapping map[string]tap.Permissions, userGroupSeparator string) (tap.Permissions, error) {
+	if len(permissionsMapping) == 0 {
+		return nil, nil
+	}
+
+	permissions := tap.Permissions{}
+	if CustomUserGroupField != "" {
+		rawGroups, exists := gUser.RawData[CustomUserGroupField]
+		if exists && rawGroups != nil {
+			for _, group := range groupsStringer(rawGroups, userGroupSeparator) {
+				for object, permission := range permissionsMapping[group] {
+					if permissionRank[permission] > permissionRank[permissions[object]] {
+						permissions[object] = permission
+					}
+				}
+			}
+		}
+	}
+
+	if len(permissions) == 0 {
+		return nil, ErrPermissionsNotMapped
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,189 @@
+package identityHandlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+func TestGetOrgID(t *testing.T) {
+	orgIDMapping := map[string]string{
+		"acme":      "org-acme",
+		"globex":    "org-globex",
+		"Acme Corp": "org-acme-corp",
+		"42":        "org-42",
+	}
+
+	cases := []struct {
+		TestName         string
+		CustomOrgIDField string
+		user             goth.User
+		ExpectedOrgID    string
+		ExpectedErr      error
+	}{
+		{
+			TestName:      "No org field uses profile org",
+			user:          goth.User{},
+			ExpectedOrgID: "org-default",
+		},
+		{
+			TestName:         "Mapped org",
+			CustomOrgIDField: "tenant",
+			user:             goth.User{RawData: map[string]interface{}{"tenant": "globex"}},
+			ExpectedOrgID:    "org-globex",
+		},
+		{
+			TestName:         "First mapped value of a list",
+			CustomOrgIDField: "tenant",
+			user:             goth.User{RawData: map[string]interface{}{"tenant": []interface{}{"initech", "acme"}}},
+			ExpectedOrgID:    "org-acme",
+		},
+		{
+			TestName:         "Org with spaces is one value",
+			CustomOrgIDField: "tenant",
+			user:             goth.User{RawData: map[string]interface{}{"tenant": "Acme Corp"}},
+			ExpectedOrgID:    "org-acme-corp",
+		},
+		{
+			TestName:         "Org with spaces is not split",
+			CustomOrgIDField: "tenant",
+			user:             goth.User{RawData: map[string]interface{}{"tenant": "initech acme"}},
+			ExpectedErr:      ErrOrgNotMapped,
+		},
+		{
+			TestName:         "Numeric org",
+			CustomOrgIDField: "tenant",
+			user:             goth.User{RawData: map[string]interface{}{"tenant": float64(42)}},
+			ExpectedOrgID:    "org-42",
+		},
+		{
+			TestName:         "List of orgs with a number",
+			CustomOrgIDField: "tenant",
+			user:             goth.User{RawData: map[string]interface{}{"tenant": []interface{}{float64(7), "Acme Corp"}}},
+			ExpectedOrgID:    "org-acme-corp",
+		},
+		{
+			TestName:         "Unmapped org",
+			CustomOrgIDField: "tenant",
+			user:             goth.User{RawData: map[string]interface{}{"tenant": "initech"}},
+			ExpectedErr:      ErrOrgNotMapped,
+		},
+		{
+			TestName:         "Missing claim",
+			CustomOrgIDField: "tenant",
+			user:             goth.User{RawData: map[string]interface{}{}},
+			ExpectedErr:      ErrOrgNotMapped,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			orgID, err := GetOrgID(tc.user, tc.CustomOrgIDField, orgIDMapping, "org-default")
+			assert.Equal(t, tc.ExpectedErr, err)
+			assert.Equal(t, tc.ExpectedOrgID, orgID)
+		})
+	}
+}
+
+func TestGetPermissions(t *testing.T) {
+	permissionsMapping := map[string]tap.Permissions{
+		"devs":    {"apis": "read", "keys": "write"},
+		"admins":  {"apis": "write", "users": "write"},
+		"readers": {"apis": "deny", "keys": "read"},
+	}
+
+	cases := []struct {
+		TestName            string
+		PermissionsMapping  map[string]tap.Permissions
+		user                goth.User
+		ExpectedPermissions tap.Permissions
+		ExpectedErr         error
+	}{
+		{
+			TestName:            "No mapping",
+			user:                goth.User{RawData: map[string]interface{}{"groups": "devs"}},
+			ExpectedPermissions: nil,
+		},
+		{
+			TestName:            "Single group",
+			PermissionsMapping:  permissionsMapping,
+			user:                goth.User{RawData: map[string]interface{}{"groups": "devs"}},
+			ExpectedPermissions: tap.Permissions{"apis": "read", "keys": "write"},
+		},
+		{
+			TestName:            "Write takes precedence over read and deny",
+			PermissionsMapping:  permissionsMapping,
+			user:                goth.User{RawData: map[string]interface{}{"groups": []interface{}{"readers", "devs", "admins"}}},
+			ExpectedPermissions: tap.Permissions{"apis": "write", "keys": "write", "users": "write"},
+		},
+		{
+			TestName:            "Read takes precedence over deny",
+			PermissionsMapping:  permissionsMapping,
+			user:                goth.User{RawData: map[string]interface{}{"groups": []interface{}{"readers", "devs"}}},
+			ExpectedPermissions: tap.Permissions{"apis": "read", "keys": "write"},
+		},
+		{
+			TestName:           "Unmapped groups",
+			PermissionsMapping: permissionsMapping,
+			user:               goth.User{RawData: map[string]interface{}{"groups": "guests"}},
+			ExpectedErr:        ErrPermissionsNotMapped,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			permissions, err := GetPermissions(tc.user, "groups", tc.PermissionsMapping, "")
+			assert.Equal(t, tc.ExpectedErr, err)
+			assert.Equal(t, tc.ExpectedPermissions, permissions)
+		})
+	}
+}
+
+func TestCreateIdentityOrgAndPermissions(t *testing.T) {
+	newDashboardHandler := func(dash *mockDashboard) *TykIdentityHandler {
+		handler := &TykIdentityHandler{API: &tyk.TykAPI{CustomDispatcher: dash.dispatch}, Store: newMemoryStore()}
+		assert.NoError(t, handler.Init(tap.Profile{
+			ID:                   "profile-1",
+			OrgID:                "org-default",
+			ActionType:           tap.GenerateOrLoginUserProfile,
+			CustomUserGroupField: "groups",
+			CustomOrgIDField:     "tenant",
+			OrgIDMapping:         map[string]string{"acme": "org-acme"},
+			PermissionsMapping:   map[string]tap.Permissions{"admins": {"apis": "write"}},
+		}))
+		return handler
+	}
+
+	t.Run("mapped user", func(t *testing.T) {
+		dash := &mockDashboard{}
+		nonce, err := newDashboardHandler(dash).CreateIdentity(goth.User{
+			Email:   TestEmail,
+			RawData: map[string]interface{}{"tenant": "acme", "groups": "admins"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "nonce-1", nonce)
+
+		sent := SSOAccessData{}
+		assert.NoError(t, json.Unmarshal([]byte(dash.bodies["POST "+string(tyk.SSO_REGULAR)]), &sent))
+		assert.Equal(t, "org-acme", sent.OrgID)
+		assert.Equal(t, tap.Permissions{"apis": "write"}, sent.Permissions)
+	})
+
+	t.Run("unmapped users are rejected before the SSO call", func(t *testing.T) {
+		dash := &mockDashboard{}
+		handler := newDashboardHandler(dash)
+
+		_, err := handler.CreateIdentity(goth.User{RawData: map[string]interface{}{"tenant": "initech", "groups": "admins"}})
+		assert.Equal(t, ErrOrgNotMapped, err)
+
+		_, err = handler.CreateIdentity(goth.User{RawData: map[string]interface{}{"tenant": "acme", "groups": "guests"}})
+		assert.Equal(t, ErrPermissionsNotMapped, err)
+
+		assert.Empty(t, dash.requests)
+	})
+}
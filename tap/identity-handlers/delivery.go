@@ -0,0 +1,171 @@
+package identityHandlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+const (
+	// DeliveryQuery appends the nonce to the query of the ReturnURL (or the token to its fragment), it is the default
+	DeliveryQuery = "query"
+	// DeliveryFormPost POSTs the nonce or token to the ReturnURL with an auto-submitting form
+	DeliveryFormPost = "form_post"
+	// DeliveryCookie sets the nonce or token as cookies on CookieDomain before redirecting to the ReturnURL
+	DeliveryCookie = "cookie"
+	// DeliveryCode sends a one-time code to the ReturnURL, the target exchanges it server-to-server
+	DeliveryCode = "code"
+
+	DefaultDeliveryExpires      = 60
+	DefaultDeliveryCookiePrefix = "tib_"
+
+	deliveryCodePrefix = "delivery-code-"
+)
+
+var ErrInvalidDeliveryCode = errors.New("code is invalid, expired or has already been used")
+
+// DeliverySettings determine how nonces and tokens are handed to the ReturnURL of a profile, so that they can be kept
+// out of browser history, proxy logs and Referer headers
+type DeliverySettings struct {
+	Mode string
+	// CookieDomain is the domain of the cookies set by DeliveryCookie, e.g. .example.com
+	CookieDomain string
+	CookiePrefix string
+	// Expires is the lifetime in seconds of the cookies and codes
+	Expires int64
+	// ExchangeSecret authenticates the target when it exchanges a code
+	ExchangeSecret string
+}
+
+// deliveryCode is kept in the identity store until the code is exchanged
+type deliveryCode struct {
+	ProfileID string
+	Fields    []pages.FormField
+	ExpiresAt int64
+}
+
+func (d DeliverySettings) validate() error {
+	switch d.Mode {
+	case DeliveryQuery, DeliveryFormPost:
+	case DeliveryCookie:
+		if d.CookieDomain == "" {
+			return errors.New("cookie delivery needs a CookieDomain")
+		}
+	case DeliveryCode:
+		if d.ExchangeSecret == "" {
+			return errors.New("code delivery needs an ExchangeSecret")
+		}
+	default:
+		return errors.New("unknown delivery mode " + d.Mode)
+	}
+	return nil
+}
+
+// deliver hands fields (e.g. the nonce) to returnURL with the delivery mode of the profile, inFragment puts them in
+// the fragment instead of the query in DeliveryQuery mode
+func (t *TykIdentityHandler) deliver(w http.ResponseWriter, r *http.Request, returnURL string, fields []pages.FormField, inFragment bool) {
+	logger := tykHandlerLogger.WithContext(r.Context())
+	switch t.delivery.Mode {
+	case DeliveryFormPost:
+		logger.Debug("--> Posting to URL: ", returnURL)
+		if err := pages.RenderFormPost(w, returnURL, fields); err != nil {
+			logger.WithField("error", err).Error("Failed to render form post")
+		}
+		return
+
+	case DeliveryCookie:
+		for _, field := range fields {
+			http.SetCookie(w, &http.Cookie{
+				Name:     t.delivery.CookiePrefix + field.Name,
+				Value:    field.Value,
+				Domain:   t.delivery.CookieDomain,
+				Path:     "/",
+				MaxAge:   int(t.delivery.Expires),
+				Secure:   strings.HasPrefix(returnURL, "https://"),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+	case DeliveryCode:
+		code, err := t.newDeliveryCode(fields)
+		if err != nil {
+			logger.WithField("error", err).Error("Failed to store delivery code")
+			pages.RenderError(w, r, t.profile.Pages, pages.CodeServerError, "")
+			return
+		}
+		returnURL = withQueryParam(returnURL, "code", code)
+
+	default:
+		if inFragment {
+			encoded := make([]string, 0, len(fields))
+			for _, field := range fields {
+				encoded = append(encoded, url.QueryEscape(field.Name)+"="+url.QueryEscape(field.Value))
+			}
+			returnURL += "#" + strings.Join(encoded, "&")
+		} else {
+			for _, field := range fields {
+				returnURL = withQueryParam(returnURL, field.Name, field.Value)
+			}
+		}
+	}
+
+	logger.Debug("--> Redirecting to URL: ", returnURL)
+	http.Redirect(w, r, returnURL, tap.RedirectStatus(r))
+}
+
+func (t *TykIdentityHandler) newDeliveryCode(fields []pages.FormField) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(raw)
+
+	ttl := time.Duration(t.delivery.Expires) * time.Second
+	pending := deliveryCode{ProfileID: t.profile.ID, Fields: fields, ExpiresAt: time.Now().Add(ttl).Unix()}
+	return code, tap.SetKeyWithTTL(t.Store, t.deliveryCodeKey(code), "", pending, ttl)
+}
+
+// deliveryCodeKey is the key of a code in the identity store, it holds the profile so that the exchange of another
+// profile can't consume the code
+func (t *TykIdentityHandler) deliveryCodeKey(code string) string {
+	return deliveryCodePrefix + t.profile.ID + "-" + code
+}
+
+// ValidExchangeSecret checks the secret a target sent to exchange a code
+func (t *TykIdentityHandler) ValidExchangeSecret(secret string) bool {
+	if t.delivery.Mode != DeliveryCode || t.delivery.ExchangeSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(t.delivery.ExchangeSecret)) == 1
+}
+
+// ExchangeDeliveryCode returns the nonce or token a code was issued for, codes can only be exchanged once. The code is
+// read and deleted in one operation of the store, so that two instances can't both exchange it.
+func (t *TykIdentityHandler) ExchangeDeliveryCode(code string) (map[string]string, error) {
+	pending := deliveryCode{}
+	if code == "" || tap.ConsumeKey(t.Store, t.deliveryCodeKey(code), "", &pending) != nil {
+		return nil, ErrInvalidDeliveryCode
+	}
+	if pending.ProfileID != t.profile.ID {
+		return nil, ErrInvalidDeliveryCode
+	}
+
+	if time.Now().Unix() >= pending.ExpiresAt {
+		return nil, ErrInvalidDeliveryCode
+	}
+
+	values := map[string]string{}
+	for _, field := range pending.Fields {
+		values[field.Name] = field.Value
+	}
+	return values, nil
+}
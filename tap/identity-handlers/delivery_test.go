@@ -0,0 +1,163 @@
+package identityHandlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+func newDeliveryHandler(t *testing.T, store tap.AuthRegisterBackend, delivery map[string]interface{}) *TykIdentityHandler {
+	t.Helper()
+
+	handler := &TykIdentityHandler{Store: store}
+	err := handler.Init(tap.Profile{
+		ID:         "profile-1",
+		OrgID:      "org-1",
+		ActionType: tap.GenerateOrLoginUserProfile,
+		IdentityHandlerConfig: map[string]interface{}{
+			"DashboardCredential": "dash-cred",
+			"Delivery":            delivery,
+		},
+	})
+	assert.NoError(t, err)
+	return handler
+}
+
+func TestDeliver(t *testing.T) {
+	nonce := []pages.FormField{{Name: "nonce", Value: "nonce-1"}}
+
+	t.Run("query by default", func(t *testing.T) {
+		handler := newDeliveryHandler(t, newMemoryStore(), nil)
+		assert.Equal(t, DeliveryQuery, handler.delivery.Mode)
+
+		w := httptest.NewRecorder()
+		handler.deliver(w, httptest.NewRequest(http.MethodGet, "/auth/profile-1/callback", nil), "https://dash.example.com/tap", nonce, false)
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "https://dash.example.com/tap?nonce=nonce-1", w.Header().Get("Location"))
+
+		w = httptest.NewRecorder()
+		handler.deliver(w, httptest.NewRequest(http.MethodPost, "/auth/profile-1/saml", nil), "https://app.example.com/", []pages.FormField{{Name: "token", Value: "key-1"}}, true)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "https://app.example.com/#token=key-1", w.Header().Get("Location"))
+	})
+
+	t.Run("form post", func(t *testing.T) {
+		handler := newDeliveryHandler(t, newMemoryStore(), map[string]interface{}{"Mode": DeliveryFormPost})
+
+		w := httptest.NewRecorder()
+		handler.deliver(w, httptest.NewRequest(http.MethodGet, "/", nil), "https://dash.example.com/tap", nonce, false)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Location"))
+		assert.Contains(t, w.Body.String(), `name="nonce" value="nonce-1"`)
+		assert.Contains(t, w.Header().Get("Content-Security-Policy"), "form-action https://dash.example.com")
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		handler := newDeliveryHandler(t, newMemoryStore(), map[string]interface{}{"Mode": DeliveryCookie, "CookieDomain": ".example.com", "Expires": float64(30)})
+
+		w := httptest.NewRecorder()
+		handler.deliver(w, httptest.NewRequest(http.MethodGet, "/", nil), "https://dash.example.com/tap", nonce, false)
+		assert.Equal(t, "https://dash.example.com/tap", w.Header().Get("Location"))
+
+		cookies := w.Result().Cookies()
+		if assert.Len(t, cookies, 1) {
+			assert.Equal(t, "tib_nonce", cookies[0].Name)
+			assert.Equal(t, "nonce-1", cookies[0].Value)
+			assert.Equal(t, "example.com", cookies[0].Domain)
+			assert.Equal(t, 30, cookies[0].MaxAge)
+			assert.True(t, cookies[0].Secure)
+			assert.True(t, cookies[0].HttpOnly)
+		}
+	})
+
+	t.Run("code", func(t *testing.T) {
+		store := newMemoryStore()
+		handler := newDeliveryHandler(t, store, map[string]interface{}{"Mode": DeliveryCode, "ExchangeSecret": "secret-1"})
+
+		w := httptest.NewRecorder()
+		handler.deliver(w, httptest.NewRequest(http.MethodGet, "/", nil), "https://dash.example.com/tap", nonce, false)
+		location, err := url.Parse(w.Header().Get("Location"))
+		assert.NoError(t, err)
+		assert.Empty(t, location.Query().Get("nonce"))
+		code := location.Query().Get("code")
+		assert.NotEmpty(t, code)
+
+		assert.True(t, handler.ValidExchangeSecret("secret-1"))
+		assert.False(t, handler.ValidExchangeSecret("secret-2"))
+
+		other := newDeliveryHandler(t, store, map[string]interface{}{"Mode": DeliveryCode, "ExchangeSecret": "secret-1"})
+		other.profile.ID = "profile-2"
+		_, err = other.ExchangeDeliveryCode(code)
+		assert.Equal(t, ErrInvalidDeliveryCode, err)
+
+		values, err := handler.ExchangeDeliveryCode(code)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"nonce": "nonce-1"}, values)
+
+		_, err = handler.ExchangeDeliveryCode(code)
+		assert.Equal(t, ErrInvalidDeliveryCode, err)
+
+		// concurrent exchanges of the same code, only one gets the nonce
+		code, err = handler.newDeliveryCode(nonce)
+		assert.NoError(t, err)
+		var exchanged int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := handler.ExchangeDeliveryCode(code); err == nil {
+					atomic.AddInt32(&exchanged, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), exchanged)
+
+		handler.delivery.Expires = -10
+		expired, err := handler.newDeliveryCode(nonce)
+		assert.NoError(t, err)
+		_, err = handler.ExchangeDeliveryCode(expired)
+		assert.Equal(t, ErrInvalidDeliveryCode, err)
+	})
+
+	t.Run("exchange is disabled in other modes", func(t *testing.T) {
+		handler := newDeliveryHandler(t, newMemoryStore(), map[string]interface{}{"ExchangeSecret": "secret-1"})
+		assert.False(t, handler.ValidExchangeSecret("secret-1"))
+	})
+}
+
+func TestDeliverySettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery map[string]interface{}
+		err      string
+	}{
+		{"cookie without domain", map[string]interface{}{"Mode": DeliveryCookie}, "CookieDomain"},
+		{"code without secret", map[string]interface{}{"Mode": DeliveryCode}, "ExchangeSecret"},
+		{"unknown mode", map[string]interface{}{"Mode": "fragment"}, "unknown delivery mode"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := &TykIdentityHandler{Store: newMemoryStore()}
+			err := handler.Init(tap.Profile{
+				ID:                    "profile-1",
+				ActionType:            tap.GenerateOrLoginUserProfile,
+				IdentityHandlerConfig: map[string]interface{}{"Delivery": tc.delivery},
+			})
+			if assert.Error(t, err) {
+				assert.True(t, strings.Contains(err.Error(), tc.err), err.Error())
+			}
+		})
+	}
+}
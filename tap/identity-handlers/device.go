@@ -0,0 +1,347 @@
+package identityHandlers
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/markbates/goth"
+
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+const (
+	deviceCodePrefix     = "device-code-"
+	deviceUserCodePrefix = "device-user-code-"
+	// devicePollPrefix keeps the polling state of a device apart from its authorization, so that polls never
+	// overwrite the token stored when the login completes
+	devicePollPrefix = "device-poll-"
+
+	// DeviceCodeGrantType is the grant_type of the device access token request
+	DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// DeviceCookieName carries the user code through the browser leg of the device flow
+	DeviceCookieName = "tib-device-code"
+
+	DefaultDeviceCodeExpires  = 600
+	DefaultDevicePollInterval = 5
+
+	// deviceSlowDownStep is added to the polling interval of a client that polls too fast
+	deviceSlowDownStep = 5
+	// userCodeAlphabet leaves out vowels and look-alike characters, as recommended by RFC 8628
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// DeviceError is an error of the device access token request, Code is the RFC 8628 error code
+type DeviceError struct {
+	Code string
+}
+
+func (e *DeviceError) Error() string {
+	return e.Code
+}
+
+var (
+	ErrDeviceNotEnabled     = errors.New("device authorization is not enabled for this profile")
+	ErrInvalidUserCode      = errors.New("user code is invalid or has expired")
+	ErrAuthorizationPending = &DeviceError{Code: "authorization_pending"}
+	ErrSlowDown             = &DeviceError{Code: "slow_down"}
+	ErrExpiredToken         = &DeviceError{Code: "expired_token"}
+	ErrInvalidDeviceCode    = &DeviceError{Code: "invalid_grant"}
+)
+
+// DeviceSettings enable the device authorization grant (RFC 8628) for the tap.GenerateTemporaryAuthToken and
+// tap.GenerateOAuthTokenForClient actions
+type DeviceSettings struct {
+	Enabled bool
+	// ProviderPath is the {provider} segment of /auth/{id}/{provider} that the verification page sends browsers to
+	ProviderPath string
+	// ExpiresIn is the lifetime of device and user codes in seconds
+	ExpiresIn int64
+	// Interval is the minimum number of seconds between two polls of the token endpoint
+	Interval int64
+}
+
+// DeviceAuthorization is kept in the identity store while a device code is pending
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	ProfileID  string
+	ExpiresAt  int64
+	Interval   int64
+	Token      *DeviceTokenResponse
+}
+
+// DisplayUserCode returns the user code as it is shown on the device
+func (d *DeviceAuthorization) DisplayUserCode() string {
+	return formatUserCode(d.UserCode)
+}
+
+// devicePoll is the polling state of a device
+type devicePoll struct {
+	LastPolledAt int64
+	Interval     int64
+}
+
+// DeviceAuthorizationResponse is returned to the device when a login starts
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceTokenResponse is returned to the device once the user has logged in through the browser
+type DeviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// DeviceProviderPath returns the provider path the browser leg of the device flow starts
+func (t *TykIdentityHandler) DeviceProviderPath() string {
+	return t.device.ProviderPath
+}
+
+func (t *TykIdentityHandler) deviceEnabled() bool {
+	return t.device.Enabled &&
+		(t.profile.ActionType == tap.GenerateTemporaryAuthToken || t.profile.ActionType == tap.GenerateOAuthTokenForClient)
+}
+
+// StartDeviceAuthorization issues a device code and a user code, the user enters the user code on verificationURI
+func (t *TykIdentityHandler) StartDeviceAuthorization(verificationURI string) (*DeviceAuthorizationResponse, error) {
+	if !t.deviceEnabled() {
+		return nil, ErrDeviceNotEnabled
+	}
+
+	userCode, err := newUserCode()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := DeviceAuthorization{
+		DeviceCode: newUUID(),
+		UserCode:   userCode,
+		ProfileID:  t.profile.ID,
+		ExpiresAt:  time.Now().Add(time.Duration(t.device.ExpiresIn) * time.Second).Unix(),
+		Interval:   t.device.Interval,
+	}
+	if err := t.saveDeviceAuthorization(pending); err != nil {
+		return nil, err
+	}
+	if err := tap.SetKeyWithTTL(t.Store, deviceUserCodePrefix+userCode, "", pending.DeviceCode, time.Duration(t.device.ExpiresIn)*time.Second); err != nil {
+		return nil, err
+	}
+
+	displayCode := formatUserCode(userCode)
+	return &DeviceAuthorizationResponse{
+		DeviceCode:              pending.DeviceCode,
+		UserCode:                displayCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + displayCode,
+		ExpiresIn:               t.device.ExpiresIn,
+		Interval:                t.device.Interval,
+	}, nil
+}
+
+// VerifyDeviceUserCode checks that a user code entered in the browser belongs to a pending login of the profile
+func (t *TykIdentityHandler) VerifyDeviceUserCode(userCode string) (*DeviceAuthorization, error) {
+	if !t.deviceEnabled() {
+		return nil, ErrDeviceNotEnabled
+	}
+
+	deviceCode := ""
+	if err := t.Store.GetKey(deviceUserCodePrefix+normaliseUserCode(userCode), "", &deviceCode); err != nil {
+		return nil, ErrInvalidUserCode
+	}
+
+	pending, err := t.loadDeviceAuthorization(deviceCode)
+	if err != nil || pending.Token != nil || time.Now().Unix() >= pending.ExpiresAt {
+		return nil, ErrInvalidUserCode
+	}
+	return pending, nil
+}
+
+// PollDeviceToken is called by the device until the user has logged in, it returns an error with the RFC 8628 code
+// while the login is pending
+func (t *TykIdentityHandler) PollDeviceToken(deviceCode string) (*DeviceTokenResponse, error) {
+	if !t.deviceEnabled() {
+		return nil, ErrDeviceNotEnabled
+	}
+
+	pending, err := t.loadDeviceAuthorization(deviceCode)
+	if err != nil {
+		return nil, ErrInvalidDeviceCode
+	}
+
+	now := time.Now().Unix()
+	if now >= pending.ExpiresAt {
+		t.deleteDeviceAuthorization(pending)
+		return nil, ErrExpiredToken
+	}
+
+	if pending.Token != nil {
+		// device codes are single use, when the device polls concurrently only one poll gets the token
+		if err := tap.ConsumeKey(t.Store, deviceCodePrefix+deviceCode, "", pending); err != nil {
+			return nil, ErrInvalidDeviceCode
+		}
+		t.deleteDeviceAuthorization(pending)
+		return pending.Token, nil
+	}
+
+	poll := devicePoll{Interval: pending.Interval}
+	t.Store.GetKey(devicePollPrefix+deviceCode, "", &poll)
+	tooFast := poll.LastPolledAt != 0 && now < poll.LastPolledAt+poll.Interval
+	poll.LastPolledAt = now
+	if tooFast {
+		poll.Interval += deviceSlowDownStep
+	}
+	if err := tap.SetKeyWithTTL(t.Store, devicePollPrefix+deviceCode, "", poll, time.Until(time.Unix(pending.ExpiresAt, 0))+time.Second); err != nil {
+		return nil, err
+	}
+
+	if tooFast {
+		return nil, ErrSlowDown
+	}
+	return nil, ErrAuthorizationPending
+}
+
+// SetDeviceCookie keeps the user code in the browser while it goes through the provider flow of the profile
+func SetDeviceCookie(w http.ResponseWriter, r *http.Request, pending *DeviceAuthorization) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     DeviceCookieName,
+		Value:    pending.UserCode,
+		Path:     "/auth/" + pending.ProfileID,
+		MaxAge:   int(pending.ExpiresAt - time.Now().Unix()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearDeviceCookie(w http.ResponseWriter, profileID string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     DeviceCookieName,
+		Value:    "",
+		Path:     "/auth/" + profileID,
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// deviceUserCode returns the user code of a browser that is completing a device login
+func (t *TykIdentityHandler) deviceUserCode(r *http.Request) string {
+	if r == nil || !t.deviceEnabled() {
+		return ""
+	}
+	cookie, err := r.Cookie(DeviceCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// CompleteIdentityActionForDevice issues the token of the profile for a pending device login, the token is handed
+// to the device on its next poll rather than to the browser
+func (t *TykIdentityHandler) CompleteIdentityActionForDevice(w http.ResponseWriter, r *http.Request, i interface{}, userCode string) {
+	logger := tykHandlerLogger.WithContext(r.Context())
+	logger.Info("Completing device login...")
+	clearDeviceCookie(w, t.profile.ID)
+
+	pending, err := t.VerifyDeviceUserCode(userCode)
+	if err != nil {
+		logger.WithField("error", err).Warning("Device login failed")
+		pages.RenderError(w, r, t.profile.Pages, pages.CodeInvalidDeviceCode, "")
+		return
+	}
+
+	token := &DeviceTokenResponse{TokenType: "bearer"}
+	if t.profile.ActionType == tap.GenerateOAuthTokenForClient {
+		resp, failure := t.issueOAuthToken(i)
+		if failure != "" {
+			pages.RenderError(w, r, t.profile.Pages, failure, "")
+			return
+		}
+		token.AccessToken = resp.AccessToken
+		token.ExpiresIn = resp.ExpiresIn
+		if resp.TokenType != "" {
+			token.TokenType = resp.TokenType
+		}
+	} else {
+		resp, failure := t.issueTokenAuth(i)
+		if failure != "" {
+			pages.RenderError(w, r, t.profile.Pages, failure, "")
+			return
+		}
+		token.AccessToken = resp.KeyID
+		token.ExpiresIn = t.token.Expires
+		token.RefreshToken = resp.RefreshToken
+	}
+
+	pending.Token = token
+	if err := t.saveDeviceAuthorization(*pending); err != nil {
+		logger.WithField("error", err).Error("Failed to store device token")
+		pages.RenderError(w, r, t.profile.Pages, pages.CodeServerError, "")
+		return
+	}
+
+	logger.WithField("user", i.(goth.User).UserID).Info("Device login approved")
+	t.loginSucceeded(w, r, i)
+	pages.RenderSuccess(w, r, t.profile.Pages, pages.CodeDeviceLoginComplete)
+}
+
+func (t *TykIdentityHandler) loadDeviceAuthorization(deviceCode string) (*DeviceAuthorization, error) {
+	pending := DeviceAuthorization{}
+	if err := t.Store.GetKey(deviceCodePrefix+deviceCode, "", &pending); err != nil {
+		return nil, err
+	}
+	if pending.ProfileID != t.profile.ID {
+		return nil, ErrInvalidDeviceCode
+	}
+	return &pending, nil
+}
+
+func (t *TykIdentityHandler) saveDeviceAuthorization(pending DeviceAuthorization) error {
+	ttl := time.Until(time.Unix(pending.ExpiresAt, 0))
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return tap.SetKeyWithTTL(t.Store, deviceCodePrefix+pending.DeviceCode, "", pending, ttl)
+}
+
+func (t *TykIdentityHandler) deleteDeviceAuthorization(pending *DeviceAuthorization) {
+	t.Store.DeleteKey(deviceCodePrefix+pending.DeviceCode, "")
+	t.Store.DeleteKey(deviceUserCodePrefix+pending.UserCode, "")
+	t.Store.DeleteKey(devicePollPrefix+pending.DeviceCode, "")
+}
+
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// formatUserCode splits a user code in two halves to make it easier to type, e.g. BDFG-HJKL
+func formatUserCode(code string) string {
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// normaliseUserCode accepts user codes typed in lower case and with or without the separator
+func normaliseUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
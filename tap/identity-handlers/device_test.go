@@ -0,0 +1,127 @@
+package identityHandlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+func newDeviceHandler(t *testing.T, store tap.AuthRegisterBackend, dash *mockDashboard) *TykIdentityHandler {
+	t.Helper()
+
+	handler := newTokenHandler(t, store, dash)
+	handler.device = DeviceSettings{Enabled: true, ProviderPath: "openid-connect", ExpiresIn: 600, Interval: 5}
+	return handler
+}
+
+// completeBrowserLeg logs the user in with the device cookie set by the verification page
+func completeBrowserLeg(handler *TykIdentityHandler, userCode string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/auth/profile-1/openid-connect/callback", nil)
+	r.AddCookie(&http.Cookie{Name: DeviceCookieName, Value: userCode})
+	w := httptest.NewRecorder()
+	handler.CompleteIdentityAction(w, r, goth.User{UserID: TestId, Email: TestEmail}, handler.profile)
+	return w
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+	store := newMemoryStore()
+	dash := &mockDashboard{}
+	handler := newDeviceHandler(t, store, dash)
+
+	resp, err := handler.StartDeviceAuthorization("https://tib.example.com/auth/profile-1/device/verify")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`, resp.UserCode)
+	assert.Equal(t, "https://tib.example.com/auth/profile-1/device/verify?user_code="+resp.UserCode, resp.VerificationURIComplete)
+	assert.Equal(t, int64(600), resp.ExpiresIn)
+	assert.Equal(t, int64(5), resp.Interval)
+
+	_, err = handler.PollDeviceToken(resp.DeviceCode)
+	assert.Equal(t, ErrAuthorizationPending, err)
+
+	// polling again straight away is too fast
+	_, err = handler.PollDeviceToken(resp.DeviceCode)
+	assert.Equal(t, ErrSlowDown, err)
+	poll := devicePoll{}
+	assert.NoError(t, store.GetKey(devicePollPrefix+resp.DeviceCode, "", &poll))
+	assert.Equal(t, int64(10), poll.Interval)
+
+	// polls keep their state apart, so they can't overwrite the token stored when the login completes
+	pending, _ := handler.loadDeviceAuthorization(resp.DeviceCode)
+	assert.Equal(t, int64(5), pending.Interval)
+
+	// user codes are accepted in lower case and without the separator
+	pending, err = handler.VerifyDeviceUserCode(normaliseUserCode(resp.UserCode)[:4] + " " + normaliseUserCode(resp.UserCode)[4:])
+	assert.NoError(t, err)
+	_, err = handler.VerifyDeviceUserCode("BCDF-GHJK-WRONG")
+	assert.Equal(t, ErrInvalidUserCode, err)
+
+	w := completeBrowserLeg(handler, pending.UserCode)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "return to your device")
+	assert.Contains(t, w.Header().Get("Set-Cookie"), DeviceCookieName+"=;")
+	assert.Empty(t, w.Header().Get("Location"))
+
+	// the token goes to the device, once
+	token, err := handler.PollDeviceToken(resp.DeviceCode)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-1", token.AccessToken)
+	assert.Equal(t, "bearer", token.TokenType)
+	assert.NotEmpty(t, token.RefreshToken)
+	assert.Equal(t, handler.token.Expires, token.ExpiresIn)
+
+	_, err = handler.PollDeviceToken(resp.DeviceCode)
+	assert.Equal(t, ErrInvalidDeviceCode, err)
+	_, err = handler.VerifyDeviceUserCode(resp.UserCode)
+	assert.Equal(t, ErrInvalidUserCode, err)
+}
+
+func TestDeviceAuthorizationExpiry(t *testing.T) {
+	store := newMemoryStore()
+	handler := newDeviceHandler(t, store, &mockDashboard{})
+
+	resp, err := handler.StartDeviceAuthorization("https://tib.example.com/auth/profile-1/device/verify")
+	assert.NoError(t, err)
+
+	pending, _ := handler.loadDeviceAuthorization(resp.DeviceCode)
+	pending.ExpiresAt = 1
+	store.SetKey(deviceCodePrefix+pending.DeviceCode, "", pending)
+
+	_, err = handler.VerifyDeviceUserCode(resp.UserCode)
+	assert.Equal(t, ErrInvalidUserCode, err)
+
+	w := completeBrowserLeg(handler, pending.UserCode)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	_, err = handler.PollDeviceToken(resp.DeviceCode)
+	assert.Equal(t, ErrExpiredToken, err)
+}
+
+func TestDeviceAuthorizationSettings(t *testing.T) {
+	profile := tap.Profile{
+		ID:         "profile-1",
+		ActionType: tap.GenerateTemporaryAuthToken,
+		IdentityHandlerConfig: map[string]interface{}{
+			"TokenAuth":           map[string]interface{}{"BaseAPIID": "api-1"},
+			"DeviceAuthorization": map[string]interface{}{"Enabled": true, "ProviderPath": "saml", "Interval": float64(10)},
+		},
+	}
+
+	handler := &TykIdentityHandler{Store: newMemoryStore()}
+	assert.NoError(t, handler.Init(profile))
+	assert.Equal(t, DeviceSettings{Enabled: true, ProviderPath: "saml", ExpiresIn: DefaultDeviceCodeExpires, Interval: 10}, handler.device)
+
+	delete(profile.IdentityHandlerConfig["DeviceAuthorization"].(map[string]interface{}), "ProviderPath")
+	assert.Error(t, handler.Init(profile))
+
+	// the device flow only issues tokens
+	profile.ActionType = tap.GenerateOrLoginUserProfile
+	profile.IdentityHandlerConfig["DeviceAuthorization"] = map[string]interface{}{"Enabled": true, "ProviderPath": "saml"}
+	assert.NoError(t, handler.Init(profile))
+	_, err := handler.StartDeviceAuthorization("https://tib.example.com/auth/profile-1/device/verify")
+	assert.Equal(t, ErrDeviceNotEnabled, err)
+}
@@ -6,11 +6,11 @@ these handlers create accounts and sso tokens
 package identityHandlers
 
 import (
-	"fmt"
 	"net/http"
 	"sync"
 
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
 	"github.com/sirupsen/logrus"
 )
@@ -49,17 +49,18 @@ func (d DummyIdentityHandler) LoginIdentity(user string, pass string) (string, e
 // CompleteIdentityAction is called when an authenticated callback event is triggered, it should speak to
 // the target system and generate / login the user. In this case it redirects the user to the ReturnURL.
 func (d DummyIdentityHandler) CompleteIdentityAction(w http.ResponseWriter, r *http.Request, i interface{}, profile tap.Profile) {
+	logger := dummyLogger.WithContext(r.Context())
 	d.CreateIdentity(i)
 	nonce, _ := d.LoginIdentity("DUMMY", "DUMMY")
 
 	// After login, we need to redirect this user
-	dummyLogger.Debug("--> Running redirect...")
-	if profile.ReturnURL != "" {
-		newURL := profile.ReturnURL + "?nonce=" + nonce
-		http.Redirect(w, r, newURL, 301)
+	logger.Debug("--> Running redirect...")
+	if returnURL := tap.ReturnURL(r, profile); returnURL != "" {
+		newURL := withQueryParam(returnURL, "nonce", nonce)
+		http.Redirect(w, r, newURL, tap.RedirectStatus(r))
 		return
 	}
 
-	dummyLogger.Warning("No return URL found, redirect failed.")
-	fmt.Fprintf(w, "Success! (Have you set a return URL?)")
+	logger.Warning("No return URL found, redirect failed.")
+	pages.RenderSuccess(w, r, profile.Pages, pages.CodeLoginComplete)
 }
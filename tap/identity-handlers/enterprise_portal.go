@@ -0,0 +1,150 @@
+package identityHandlers
+
+import (
+	"net/http"
+
+	"github.com/markbates/goth"
+
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+// EnterprisePortalSettings determine how users are provisioned in the Tyk Enterprise Developer Portal for the
+// tap.GenerateOrLoginEnterprisePortalUser action
+type EnterprisePortalSettings struct {
+	// Role is given to users created by TIB
+	Role string
+	// DefaultOrganisationID is used when the value of OrganisationClaim has no OrganisationMapping
+	DefaultOrganisationID int
+	OrganisationClaim     string
+	OrganisationMapping   map[string]int
+	// DefaultTeamID is used when none of the groups read from CustomUserGroupField has a TeamMapping
+	DefaultTeamID int
+	TeamMapping   map[string]int
+}
+
+// enterprisePortalOrganisation returns the portal organisation of a user, or the default one when the claim has no
+// mapping
+func (t *TykIdentityHandler) enterprisePortalOrganisation(user goth.User) int {
+	if t.enterprisePortal.OrganisationClaim != "" {
+		if rawOrg, ok := user.RawData[t.enterprisePortal.OrganisationClaim]; ok && rawOrg != nil {
+			for _, org := range claimValues(rawOrg) {
+				if organisationID, ok := t.enterprisePortal.OrganisationMapping[org]; ok {
+					return organisationID
+				}
+			}
+		}
+	}
+
+	return t.enterprisePortal.DefaultOrganisationID
+}
+
+// enterprisePortalTeams returns the portal teams mapped to the user's groups, or the default team
+func (t *TykIdentityHandler) enterprisePortalTeams(user goth.User) []int {
+	teams := []int{}
+	if t.profile.CustomUserGroupField != "" {
+		if rawGroups, ok := user.RawData[t.profile.CustomUserGroupField]; ok && rawGroups != nil {
+			seen := map[int]bool{}
+			for _, group := range groupsStringer(rawGroups, t.profile.UserGroupSeparator) {
+				if teamID, ok := t.enterprisePortal.TeamMapping[group]; ok && !seen[teamID] {
+					seen[teamID] = true
+					teams = append(teams, teamID)
+				}
+			}
+		}
+	}
+
+	if len(teams) == 0 && t.enterprisePortal.DefaultTeamID != 0 {
+		teams = append(teams, t.enterprisePortal.DefaultTeamID)
+	}
+
+	return teams
+}
+
+// syncEnterprisePortalUser sets the organisation and teams of a portal user from the identity of user, names are only
+// filled in when they are blank
+func (t *TykIdentityHandler) syncEnterprisePortalUser(portalUser *tyk.EnterprisePortalUser, user goth.User, email string) {
+	portalUser.Email = email
+	if portalUser.First == "" {
+		portalUser.First = user.FirstName
+	}
+	if portalUser.Last == "" {
+		portalUser.Last = user.LastName
+	}
+	if portalUser.Role == "" {
+		portalUser.Role = t.enterprisePortal.Role
+	}
+
+	if organisationID := t.enterprisePortalOrganisation(user); organisationID != 0 {
+		portalUser.OrganisationID = organisationID
+	}
+
+	if teams := t.enterprisePortalTeams(user); len(teams) > 0 {
+		portalUser.Teams = teams
+	}
+	if portalUser.Teams == nil {
+		portalUser.Teams = []int{}
+	}
+}
+
+// CompleteIdentityActionForEnterprisePortal creates or updates the user in the Enterprise Developer Portal and logs
+// them in with a one-time nonce
+func (t *TykIdentityHandler) CompleteIdentityActionForEnterprisePortal(w http.ResponseWriter, r *http.Request, i interface{}, profile tap.Profile) {
+	logger := tykHandlerLogger.WithContext(r.Context())
+	user := i.(goth.User)
+	email := GetEmail(user, t.profile.CustomEmailField)
+
+	portalUser, found, err := t.API.GetEnterprisePortalUser(email)
+	if err != nil {
+		logger.WithField("error", err).Error("Failed to look up enterprise portal user")
+		pages.RenderError(w, r, profile.Pages, pages.CodeServerError, "")
+		return
+	}
+
+	if !found && t.profile.SSOOnlyForRegisteredUsers {
+		logger.WithField("email", email).Warning("User is not registered in the enterprise portal")
+		pages.RenderError(w, r, profile.Pages, pages.CodeAccessDenied, "")
+		return
+	}
+
+	t.syncEnterprisePortalUser(&portalUser, user, email)
+
+	if found {
+		if err := t.API.UpdateEnterprisePortalUser(portalUser); err != nil {
+			logger.WithField("error", err).Error("Failed to update enterprise portal user")
+			pages.RenderError(w, r, profile.Pages, pages.CodeServerError, "")
+			return
+		}
+	} else {
+		logger.WithField("email", email).Info("Creating enterprise portal user")
+		portalUser.Provider = "tib"
+		portalUser.Active = true
+		if _, err := t.API.CreateEnterprisePortalUser(portalUser); err != nil {
+			logger.WithField("error", err).Error("Failed to create enterprise portal user")
+			pages.RenderError(w, r, profile.Pages, pages.CodeServerError, "")
+			return
+		}
+	}
+
+	nonce, nErr := t.CreateIdentity(i)
+	if nErr != nil {
+		logger.WithField("error", nErr).Error("Nonce creation failed")
+		code := pages.CodeLoginFailed
+		if nErr == ErrOrgNotMapped || nErr == ErrPermissionsNotMapped {
+			code = pages.CodeAccessDenied
+		}
+		pages.RenderError(w, r, profile.Pages, code, "")
+		return
+	}
+
+	// After login, we need to redirect this user
+	t.loginSucceeded(w, r, i)
+	if returnURL := tap.ReturnURL(r, profile); returnURL != "" {
+		t.deliver(w, r, returnURL, []pages.FormField{{Name: "nonce", Value: nonce}}, false)
+		return
+	}
+
+	logger.Warning("No return URL found, redirect failed.")
+	pages.RenderSuccess(w, r, profile.Pages, pages.CodeLoginComplete)
+}
@@ -0,0 +1,188 @@
+package identityHandlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+// mockEnterprisePortal is a local Enterprise Developer Portal that implements the user and SSO APIs used by TIB
+type mockEnterprisePortal struct {
+	*httptest.Server
+	users  map[string]tyk.EnterprisePortalUser
+	sso    []SSOAccessData
+	nextID int
+	lock   sync.Mutex
+}
+
+func newMockEnterprisePortal(t *testing.T) *mockEnterprisePortal {
+	portal := &mockEnterprisePortal{users: map[string]tyk.EnterprisePortalUser{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(string(tyk.EP_USERS), func(w http.ResponseWriter, r *http.Request) {
+		portal.lock.Lock()
+		defer portal.lock.Unlock()
+
+		switch r.Method {
+		case http.MethodGet:
+			found := []tyk.EnterprisePortalUser{}
+			if user, ok := portal.users[r.URL.Query().Get("email")]; ok {
+				found = append(found, user)
+			}
+			json.NewEncoder(w).Encode(found)
+		case http.MethodPost:
+			user := tyk.EnterprisePortalUser{}
+			json.NewDecoder(r.Body).Decode(&user)
+			portal.nextID++
+			user.ID = portal.nextID
+			portal.users[user.Email] = user
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(user)
+		}
+	})
+	mux.HandleFunc(string(tyk.EP_USERS)+"/", func(w http.ResponseWriter, r *http.Request) {
+		portal.lock.Lock()
+		defer portal.lock.Unlock()
+
+		user := tyk.EnterprisePortalUser{}
+		json.NewDecoder(r.Body).Decode(&user)
+		portal.users[user.Email] = user
+		json.NewEncoder(w).Encode(user)
+	})
+	mux.HandleFunc(string(tyk.EP_SSO), func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "portal-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		portal.lock.Lock()
+		defer portal.lock.Unlock()
+
+		data := SSOAccessData{}
+		json.NewDecoder(r.Body).Decode(&data)
+		portal.sso = append(portal.sso, data)
+		w.Write([]byte(`{"Status":"ok","Message":"SSO Nonce created","Meta":"portal-nonce"}`))
+	})
+
+	portal.Server = httptest.NewServer(mux)
+	t.Cleanup(portal.Close)
+	return portal
+}
+
+func (p *mockEnterprisePortal) config() tyk.EndpointConfig {
+	u, _ := url.Parse(p.URL)
+	return tyk.EndpointConfig{
+		Endpoint:    u.Scheme + "://" + u.Hostname(),
+		Port:        u.Port(),
+		AdminSecret: "portal-secret",
+	}
+}
+
+func TestEnterprisePortal(t *testing.T) {
+	portal := newMockEnterprisePortal(t)
+
+	newHandler := func(registeredOnly bool) *TykIdentityHandler {
+		handler := &TykIdentityHandler{API: &tyk.TykAPI{EnterprisePortalConfig: portal.config()}, Store: newMemoryStore()}
+		assert.NoError(t, handler.Init(tap.Profile{
+			ID:                        "profile-1",
+			OrgID:                     "org-1",
+			ActionType:                tap.GenerateOrLoginEnterprisePortalUser,
+			ReturnURL:                 "http://portal.tyk.io/sso",
+			CustomUserGroupField:      "groups",
+			SSOOnlyForRegisteredUsers: registeredOnly,
+			IdentityHandlerConfig: map[string]interface{}{
+				"EnterprisePortal": map[string]interface{}{
+					"Role":                  "consumer-team-member",
+					"DefaultOrganisationID": float64(1),
+					"OrganisationClaim":     "company",
+					"OrganisationMapping":   map[string]interface{}{"acme": float64(2)},
+					"DefaultTeamID":         float64(10),
+					"TeamMapping":           map[string]interface{}{"devs": float64(11), "ops": float64(12)},
+				},
+			},
+		}))
+		return handler
+	}
+
+	login := func(handler *TykIdentityHandler, user goth.User) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.CompleteIdentityAction(w, httptest.NewRequest("GET", "/auth/profile-1/callback", nil), user, handler.profile)
+		return w
+	}
+
+	t.Run("new user is created with mapped organisation and teams", func(t *testing.T) {
+		w := login(newHandler(false), goth.User{
+			Email:     TestEmail,
+			FirstName: "Test",
+			LastName:  "User",
+			RawData:   map[string]interface{}{"company": "acme", "groups": []interface{}{"devs", "ops", "guests"}},
+		})
+		assert.Equal(t, http.StatusFound, w.Code)
+		assert.Equal(t, "http://portal.tyk.io/sso?nonce=portal-nonce", w.Header().Get("Location"))
+
+		user := portal.users[TestEmail]
+		assert.Equal(t, "Test", user.First)
+		assert.Equal(t, 2, user.OrganisationID)
+		assert.Equal(t, []int{11, 12}, user.Teams)
+		assert.Equal(t, "consumer-team-member", user.Role)
+		assert.True(t, user.Active)
+
+		assert.Equal(t, SSOForEnterprisePortal, portal.sso[len(portal.sso)-1].ForSection)
+		assert.Equal(t, TestEmail, portal.sso[len(portal.sso)-1].EmailAddress)
+	})
+
+	t.Run("existing user is updated", func(t *testing.T) {
+		w := login(newHandler(false), goth.User{
+			Email:   TestEmail,
+			RawData: map[string]interface{}{"company": "initech"},
+		})
+		assert.Equal(t, http.StatusFound, w.Code)
+
+		user := portal.users[TestEmail]
+		assert.Equal(t, 1, user.ID)
+		assert.Equal(t, "Test", user.First)
+		assert.Equal(t, 1, user.OrganisationID)
+		assert.Equal(t, []int{10}, user.Teams)
+	})
+
+	t.Run("unregistered users are refused", func(t *testing.T) {
+		w := login(newHandler(true), goth.User{Email: "new@tyk.io"})
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.NotContains(t, portal.users, "new@tyk.io")
+		assert.False(t, strings.Contains(w.Header().Get("Location"), "nonce"))
+	})
+}
+
+func TestEnterprisePortalOrganisation(t *testing.T) {
+	handler := &TykIdentityHandler{enterprisePortal: EnterprisePortalSettings{
+		DefaultOrganisationID: 1,
+		OrganisationClaim:     "company",
+		OrganisationMapping:   map[string]int{"Acme Corp": 2, "42": 3},
+	}}
+
+	cases := map[string]struct {
+		claim    interface{}
+		expected int
+	}{
+		"multi-word organisation": {"Acme Corp", 2},
+		"words are not split":     {"Initech Acme", 1},
+		"numeric organisation":    {float64(42), 3},
+		"list of organisations":   {[]interface{}{"Initech", float64(42)}, 3},
+		"object claim":            {map[string]interface{}{"name": "Acme Corp"}, 1},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			user := goth.User{RawData: map[string]interface{}{"company": tc.claim}}
+			assert.Equal(t, tc.expected, handler.enterprisePortalOrganisation(user))
+		})
+	}
+}
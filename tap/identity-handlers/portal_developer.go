@@ -0,0 +1,41 @@
+package identityHandlers
+
+import (
+	"github.com/markbates/goth"
+
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+// syncDeveloper copies the mapped claims of user into the developer fields, and sets whether the developer is
+// inactive when the profile reads it from a claim. It is applied when developers are created and on every login.
+func (t *TykIdentityHandler) syncDeveloper(dev *tyk.PortalDeveloper, user goth.User) {
+	if dev.Fields == nil {
+		dev.Fields = map[string]string{}
+	}
+
+	for field, claim := range t.portalDeveloper.FieldMapping {
+		rawValue, ok := user.RawData[claim]
+		if !ok {
+			continue
+		}
+
+		value := claimString(rawValue)
+		if value == "" || (dev.Fields[field] != "" && !t.portalDeveloper.OverwriteFields) {
+			continue
+		}
+		dev.Fields[field] = value
+	}
+
+	if t.portalDeveloper.InActiveClaim == "" {
+		return
+	}
+
+	dev.InActive = false
+	value := claimString(user.RawData[t.portalDeveloper.InActiveClaim])
+	for _, inActiveValue := range t.portalDeveloper.InActiveValues {
+		if value == inActiveValue {
+			dev.InActive = true
+			return
+		}
+	}
+}
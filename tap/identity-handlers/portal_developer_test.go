@@ -0,0 +1,118 @@
+package identityHandlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+// mockPortal keeps a single developer and records what was created or updated
+type mockPortal struct {
+	developer *tyk.PortalDeveloper
+	saved     []tyk.PortalDeveloper
+}
+
+func (p *mockPortal) dispatch(target tyk.Endpoint, method string, _ string, body io.Reader) ([]byte, int, error) {
+	switch {
+	case target == tyk.SSO_REGULAR:
+		return []byte(`{"Meta":"nonce-1"}`), http.StatusOK, nil
+	case method == http.MethodGet && strings.HasPrefix(string(target), string(tyk.PORTAL_DEVS_SSO)):
+		if p.developer == nil {
+			return []byte(`{}`), http.StatusNotFound, io.EOF
+		}
+		raw, _ := json.Marshal(p.developer)
+		return raw, http.StatusOK, nil
+	case method == http.MethodPost || method == http.MethodPut:
+		dev := tyk.PortalDeveloper{}
+		raw, _ := io.ReadAll(body)
+		json.Unmarshal(raw, &dev)
+		p.saved = append(p.saved, dev)
+	}
+	return []byte(`{}`), http.StatusOK, nil
+}
+
+func TestPortalDeveloperSync(t *testing.T) {
+	newPortalHandler := func(portal *mockPortal, overwrite bool) *TykIdentityHandler {
+		handler := &TykIdentityHandler{API: &tyk.TykAPI{CustomDispatcher: portal.dispatch}, Store: newMemoryStore()}
+		assert.NoError(t, handler.Init(tap.Profile{
+			ID:         "profile-1",
+			OrgID:      "org-1",
+			ActionType: tap.GenerateOrLoginDeveloperProfile,
+			ReturnURL:  "http://portal.tyk.io/sso",
+			IdentityHandlerConfig: map[string]interface{}{
+				"PortalDeveloper": map[string]interface{}{
+					"FieldMapping": map[string]interface{}{
+						"company": "organization",
+						"phone":   "phone_number",
+					},
+					"OverwriteFields": overwrite,
+					"InActiveClaim":   "status",
+					"InActiveValues":  []interface{}{"suspended", "left"},
+				},
+			},
+		}))
+		return handler
+	}
+
+	user := goth.User{
+		UserID: TestId,
+		Email:  TestEmail,
+		RawData: map[string]interface{}{
+			"organization": "Tyk",
+			"phone_number": "+44 20 0000 0000",
+			"status":       "active",
+		},
+	}
+
+	login := func(handler *TykIdentityHandler, user goth.User) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.CompleteIdentityActionForPortal(w, httptest.NewRequest("GET", "/auth/profile-1/callback", nil), user, handler.profile)
+		return w
+	}
+
+	t.Run("create", func(t *testing.T) {
+		portal := &mockPortal{}
+		handler := newPortalHandler(portal, false)
+		w := login(handler, user)
+		assert.Equal(t, http.StatusFound, w.Code)
+		// the developer can be managed through the SCIM server of the profile
+		assert.Equal(t, []string{strings.ToLower(TestEmail)}, PortalDevelopers(handler.Store, "profile-1"))
+
+		assert.Len(t, portal.saved, 1)
+		assert.Equal(t, map[string]string{"company": "Tyk", "phone": "+44 20 0000 0000"}, portal.saved[0].Fields)
+		assert.False(t, portal.saved[0].InActive)
+	})
+
+	t.Run("update fills blanks only", func(t *testing.T) {
+		portal := &mockPortal{developer: &tyk.PortalDeveloper{Email: TestEmail, Fields: map[string]string{"company": "Old Co"}}}
+		login(newPortalHandler(portal, false), user)
+
+		assert.Equal(t, map[string]string{"company": "Old Co", "phone": "+44 20 0000 0000"}, portal.saved[0].Fields)
+	})
+
+	t.Run("update overwrites", func(t *testing.T) {
+		portal := &mockPortal{developer: &tyk.PortalDeveloper{Email: TestEmail, Fields: map[string]string{"company": "Old Co"}}}
+		login(newPortalHandler(portal, true), user)
+
+		assert.Equal(t, "Tyk", portal.saved[0].Fields["company"])
+	})
+
+	t.Run("inactive developer", func(t *testing.T) {
+		portal := &mockPortal{developer: &tyk.PortalDeveloper{Email: TestEmail}}
+		suspended := user
+		suspended.RawData = map[string]interface{}{"status": "suspended"}
+
+		w := login(newPortalHandler(portal, false), suspended)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.True(t, portal.saved[0].InActive)
+	})
+}
@@ -0,0 +1,38 @@
+package identityHandlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// withQueryParam adds a query parameter to a return URL that may already have a query
+func withQueryParam(returnURL string, key string, value string) string {
+	separator := "?"
+	if strings.Contains(returnURL, "?") {
+		separator = "&"
+	}
+	return returnURL + separator + url.QueryEscape(key) + "=" + url.QueryEscape(value)
+}
+
+// allowedOAuthRedirect checks the redirect returned by the gateway for an OAuth token, it must go to the RedirectURI
+// of the profile or match its AllowedReturnURLs
+func (t *TykIdentityHandler) allowedOAuthRedirect(r *http.Request, redirectTo string) bool {
+	target := redirectTo
+	if i := strings.IndexAny(target, "?#"); i != -1 {
+		target = target[:i]
+	}
+	if target == t.oauth.RedirectURI || tap.MatchesReturnURL(t.profile.AllowedReturnURLs, redirectTo) {
+		return true
+	}
+
+	tap.LogSecurityEvent("redirect_rejected", r, logrus.Fields{
+		"profile":     t.profile.ID,
+		"redirect_to": redirectTo,
+	})
+	return false
+}
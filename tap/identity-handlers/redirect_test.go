@@ -0,0 +1,47 @@
+package identityHandlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+func TestWithQueryParam(t *testing.T) {
+	assert.Equal(t, "https://app.example.com/sso?nonce=a%2Bb", withQueryParam("https://app.example.com/sso", "nonce", "a+b"))
+	assert.Equal(t, "https://app.example.com/sso?tenant=1&nonce=n", withQueryParam("https://app.example.com/sso?tenant=1", "nonce", "n"))
+}
+
+func TestReturnTo(t *testing.T) {
+	handler := newTokenHandler(t, newMemoryStore(), &mockDashboard{})
+	handler.profile.ReturnURL = "https://app.example.com/default"
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/profile-1/openid-connect/callback", nil)
+	w := httptest.NewRecorder()
+	handler.CompleteIdentityActionForTokenAuth(w, r, goth.User{UserID: TestId, Email: TestEmail}, handler.profile)
+	assert.Contains(t, w.Header().Get("Location"), "https://app.example.com/default#token=key-1")
+	assert.NotContains(t, w.Header().Get("Location"), "refresh_token")
+
+	r = tap.WithReturnURL(r, "https://app.example.com/reports")
+	w = httptest.NewRecorder()
+	handler.CompleteIdentityActionForTokenAuth(w, r, goth.User{UserID: TestId, Email: TestEmail}, handler.profile)
+	assert.Contains(t, w.Header().Get("Location"), "https://app.example.com/reports#token=key-2")
+}
+
+func TestAllowedOAuthRedirect(t *testing.T) {
+	handler := &TykIdentityHandler{
+		profile: tap.Profile{ID: "profile-1", AllowedReturnURLs: []string{"https://*.example.com/oauth/*"}},
+		oauth:   OAuthSettings{RedirectURI: "https://app.example.com/callback"},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	assert.True(t, handler.allowedOAuthRedirect(r, "https://app.example.com/callback?code=123"))
+	assert.True(t, handler.allowedOAuthRedirect(r, "https://app.example.com/callback#access_token=123"))
+	assert.True(t, handler.allowedOAuthRedirect(r, "https://eu.example.com/oauth/cb?code=123"))
+	assert.False(t, handler.allowedOAuthRedirect(r, "https://evil.com/callback?code=123"))
+	assert.False(t, handler.allowedOAuthRedirect(r, "https://app.example.com/callback.evil.com?code=123"))
+}
@@ -0,0 +1,219 @@
+package identityHandlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/markbates/goth"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+const (
+	// DefaultRefreshTokenExpires is used when a TokenAuth profile enables refresh tokens without an expiry
+	DefaultRefreshTokenExpires int64 = 86400
+
+	refreshTokenPrefix  = "refresh-token-"
+	refreshFamilyPrefix = "refresh-family-"
+	// refreshUsedPrefix marks a rotated refresh token until it expires, so that its re-use can be detected
+	refreshUsedPrefix = "refresh-used-"
+)
+
+var (
+	ErrRefreshTokenDisabled = errors.New("refresh tokens are not enabled for this profile")
+	ErrInvalidRefreshToken  = errors.New("invalid refresh token")
+	ErrRefreshTokenReused   = errors.New("refresh token reuse detected, token family revoked")
+)
+
+// RefreshTokenRecord is what is kept in the identity store for every refresh token, it binds the token to
+// the profile and user it was issued for and to the Tyk key it can renew. All tokens that descend from the
+// same login share a FamilyID, so that re-use of a rotated token can revoke the whole chain.
+type RefreshTokenRecord struct {
+	ProfileID string
+	FamilyID  string
+	KeyID     string
+	User      goth.User
+	Expires   int64
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// issueRefreshToken creates and stores a new refresh token for keyID as the newest token of familyID
+func (t *TykIdentityHandler) issueRefreshToken(familyID, keyID string, user goth.User) (string, error) {
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	record := RefreshTokenRecord{
+		ProfileID: t.profile.ID,
+		FamilyID:  familyID,
+		KeyID:     keyID,
+		User:      t.refreshTokenUser(user),
+		Expires:   time.Now().Add(time.Duration(t.token.RefreshTokenExpires) * time.Second).Unix(),
+	}
+
+	ttl := time.Duration(t.token.RefreshTokenExpires) * time.Second
+	if err := tap.SetKeyWithTTL(t.Store, refreshTokenPrefix+refreshToken, "", record, ttl); err != nil {
+		return "", err
+	}
+
+	if err := tap.SetKeyWithTTL(t.Store, refreshFamilyPrefix+familyID, "", refreshToken, ttl); err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// sessionTemplateClaims finds the claims a session template reads, as .Claims.name or index .Claims "name"
+var sessionTemplateClaims = regexp.MustCompile(`\.Claims\.(\w+)|index\s+\.Claims\s+"([^"]+)"`)
+
+// refreshTokenUser keeps only what is needed to mint the next key of a refresh token. The tokens of the identity
+// provider and the claims the profile doesn't use are dropped, they would otherwise be kept in the identity
+// store for the life of the refresh token.
+func (t *TykIdentityHandler) refreshTokenUser(user goth.User) goth.User {
+	claims := append([]string{t.profile.CustomUserIDField, t.profile.CustomEmailField, t.profile.CustomUserGroupField},
+		t.profile.MetaDataClaims...)
+
+	if st := t.profile.SessionTemplate; st != nil {
+		templates := append([]string{}, st.Tags...)
+		for _, value := range st.MetaData {
+			templates = append(templates, value)
+		}
+		for _, text := range templates {
+			for _, match := range sessionTemplateClaims.FindAllStringSubmatch(text, -1) {
+				claims = append(claims, match[1], match[2])
+			}
+		}
+	}
+
+	rawData := map[string]interface{}{}
+	for _, claim := range claims {
+		if value, ok := user.RawData[claim]; ok && claim != "" {
+			rawData[claim] = value
+		}
+	}
+
+	return goth.User{
+		UserID:    user.UserID,
+		Provider:  user.Provider,
+		Email:     user.Email,
+		Name:      user.Name,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		NickName:  user.NickName,
+		RawData:   rawData,
+	}
+}
+
+// revokeRefreshFamily invalidates the Tyk key held by the newest token of a family and removes the token
+func (t *TykIdentityHandler) revokeRefreshFamily(familyID string) {
+	current := ""
+	if err := t.Store.GetKey(refreshFamilyPrefix+familyID, "", &current); err != nil {
+		tykHandlerLogger.WithField("error", err).Debug("Refresh token family not found")
+		return
+	}
+
+	record := RefreshTokenRecord{}
+	if err := t.Store.GetKey(refreshTokenPrefix+current, "", &record); err == nil {
+		iErr, _ := t.API.InvalidateToken(t.dashboardUserAPICred, t.token.BaseAPIID, record.KeyID)
+		if iErr != nil {
+			tykHandlerLogger.WithField("error", iErr).Error("Failed to invalidate token of revoked refresh token family")
+		}
+		t.untrackToken(record.KeyID, revokedReuse)
+	}
+
+	t.Store.DeleteKey(refreshTokenPrefix+current, "")
+	t.Store.DeleteKey(refreshFamilyPrefix+familyID, "")
+}
+
+// refreshTokenReused revokes the family of a refresh token that was presented after it had been rotated
+func (t *TykIdentityHandler) refreshTokenReused(familyID string) error {
+	tykHandlerLogger.WithField("family", familyID).Warning("Refresh token re-used, revoking token family")
+	t.revokeRefreshFamily(familyID)
+	return ErrRefreshTokenReused
+}
+
+// RefreshTokenAuth exchanges a refresh token for a new Tyk key. The key the refresh token was bound to is
+// invalidated and a new refresh token is returned with the key, the presented one can not be used again.
+func (t *TykIdentityHandler) RefreshTokenAuth(refreshToken string) (*tyk.TokenResponse, error) {
+	if !t.token.EnableRefreshToken {
+		return nil, ErrRefreshTokenDisabled
+	}
+
+	record := RefreshTokenRecord{}
+	if err := t.Store.GetKey(refreshTokenPrefix+refreshToken, "", &record); err != nil {
+		// a rotated token is only kept as a marker of its use, presenting it again means it has leaked
+		if t.Store.GetKey(refreshUsedPrefix+refreshToken, "", &record) == nil && record.ProfileID == t.profile.ID {
+			return nil, t.refreshTokenReused(record.FamilyID)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if record.ProfileID != t.profile.ID {
+		tykHandlerLogger.Warning("Refresh token presented to a profile it was not issued by")
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if time.Now().Unix() > record.Expires {
+		t.Store.DeleteKey(refreshTokenPrefix+refreshToken, "")
+		return nil, ErrInvalidRefreshToken
+	}
+
+	session, sErr := t.sessionState(record.User, t.token.BaseAPIID)
+	if sErr != nil {
+		return nil, sErr
+	}
+
+	// marking the token as used claims it, when it is presented concurrently only one request gets to rotate it
+	ttl := time.Until(time.Unix(record.Expires, 0)) + time.Second
+	claimed, err := tap.SetKeyIfNotExist(t.Store, refreshUsedPrefix+refreshToken, "", record, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, t.refreshTokenReused(record.FamilyID)
+	}
+	t.Store.DeleteKey(refreshTokenPrefix+refreshToken, "")
+
+	iErr, isAuthorized := t.API.InvalidateToken(t.dashboardUserAPICred, t.token.BaseAPIID, record.KeyID)
+	if iErr != nil {
+		tykHandlerLogger.WithField("isAuthorized", isAuthorized).WithField("returned-error", iErr).Error("----> Token Invalidation failed.")
+		if !isAuthorized {
+			return nil, iErr
+		}
+	}
+	t.untrackToken(record.KeyID, revokedRefreshed)
+
+	resp, tErr := t.API.RequestStandardToken(session,
+		t.dashboardUserAPICred,
+		t.token.Expires)
+	if tErr != nil {
+		return nil, tErr
+	}
+
+	if resp == nil || resp.KeyID == "" {
+		return nil, errors.New("no key returned")
+	}
+
+	t.Store.SetKey(t.profile.ID+"-"+tap.GenerateSSOKey(record.User), "", resp.KeyID)
+
+	rotated, rErr := t.issueRefreshToken(record.FamilyID, resp.KeyID, record.User)
+	if rErr != nil {
+		return nil, rErr
+	}
+	resp.RefreshToken = rotated
+	t.trackToken(resp.KeyID, record.User, record.FamilyID)
+
+	return resp, nil
+}
@@ -0,0 +1,264 @@
+package identityHandlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+// memoryStore is a minimal tap.AuthRegisterBackend used as identity store in tests
+type memoryStore struct {
+	kv   map[string][]byte
+	lock sync.RWMutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{kv: map[string][]byte{}}
+}
+
+func (m *memoryStore) Init(interface{}) error { return nil }
+
+func (m *memoryStore) SetKey(key string, _ string, val interface{}) error {
+	asByte, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.kv[key] = asByte
+	m.lock.Unlock()
+	return nil
+}
+
+func (m *memoryStore) GetKey(key string, _ string, val interface{}) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	v, ok := m.kv[key]
+	if !ok {
+		return errors.New("not found")
+	}
+	return json.Unmarshal(v, val)
+}
+
+func (m *memoryStore) GetAll(string) []interface{} { return nil }
+
+func (m *memoryStore) DeleteKey(key string, _ string) error {
+	m.lock.Lock()
+	delete(m.kv, key)
+	m.lock.Unlock()
+	return nil
+}
+
+// mockDashboard records calls made through the custom dispatcher and issues sequential keys
+type mockDashboard struct {
+	issued      int
+	invalidated []string
+	requests    []string
+	bodies      map[string]string
+}
+
+func (d *mockDashboard) dispatch(target tyk.Endpoint, method string, _ string, body io.Reader) ([]byte, int, error) {
+	d.requests = append(d.requests, method+" "+string(target))
+	if body != nil {
+		raw, _ := io.ReadAll(body)
+		if d.bodies == nil {
+			d.bodies = map[string]string{}
+		}
+		d.bodies[method+" "+string(target)] = string(raw)
+	}
+
+	switch {
+	case method == http.MethodPost && target == tyk.SSO_REGULAR:
+		return []byte(`{"Status":"ok","Message":"SSO Nonce created","Meta":"nonce-1"}`), http.StatusOK, nil
+	case method == http.MethodPost && target == tyk.STANDARD_TOKENS:
+		d.issued++
+		return []byte(fmt.Sprintf(`{"key_id":"key-%d"}`, d.issued)), http.StatusOK, nil
+	case method == http.MethodDelete && strings.Contains(string(target), "/keys/"):
+		parts := strings.Split(string(target), "/")
+		d.invalidated = append(d.invalidated, parts[len(parts)-1])
+		return []byte(`{}`), http.StatusOK, nil
+	}
+
+	return []byte(`{}`), http.StatusOK, nil
+}
+
+func (d *mockDashboard) lastKey() string {
+	return fmt.Sprintf("key-%d", d.issued)
+}
+
+func newTokenHandler(t *testing.T, store tap.AuthRegisterBackend, dash *mockDashboard) *TykIdentityHandler {
+	t.Helper()
+
+	api := &tyk.TykAPI{CustomDispatcher: dash.dispatch}
+	handler := &TykIdentityHandler{API: api, Store: store}
+	err := handler.Init(tap.Profile{
+		ID:              "profile-1",
+		OrgID:           "org-1",
+		ActionType:      tap.GenerateTemporaryAuthToken,
+		MatchedPolicyID: "policy-1",
+		IdentityHandlerConfig: map[string]interface{}{
+			"DashboardCredential": "dash-cred",
+			"TokenAuth": map[string]interface{}{
+				"BaseAPIID":          "api-1",
+				"EnableRefreshToken": true,
+			},
+		},
+	})
+	assert.NoError(t, err)
+	return handler
+}
+
+func TestRefreshTokenAuth(t *testing.T) {
+	store := newMemoryStore()
+	dash := &mockDashboard{}
+	handler := newTokenHandler(t, store, dash)
+	user := goth.User{UserID: TestId, Email: TestEmail, Provider: "ADProvider"}
+
+	assert.Equal(t, DefaultRefreshTokenExpires, handler.token.RefreshTokenExpires)
+
+	first, err := handler.issueRefreshToken("family-0", "key-0", user)
+	assert.NoError(t, err)
+
+	resp, err := handler.RefreshTokenAuth(first)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-1", resp.KeyID)
+	assert.NotEmpty(t, resp.RefreshToken)
+	assert.NotEqual(t, first, resp.RefreshToken)
+	assert.Equal(t, []string{"key-0"}, dash.invalidated)
+
+	stored := ""
+	assert.NoError(t, store.GetKey("profile-1-"+tap.GenerateSSOKey(user), "", &stored))
+	assert.Equal(t, "key-1", stored)
+
+	second, err := handler.RefreshTokenAuth(resp.RefreshToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "key-2", second.KeyID)
+
+	t.Run("reuse of a rotated token revokes the family", func(t *testing.T) {
+		_, err := handler.RefreshTokenAuth(first)
+		assert.Equal(t, ErrRefreshTokenReused, err)
+		assert.Contains(t, dash.invalidated, "key-2")
+
+		_, err = handler.RefreshTokenAuth(second.RefreshToken)
+		assert.Equal(t, ErrInvalidRefreshToken, err)
+	})
+
+	t.Run("used marker expires with the token", func(t *testing.T) {
+		used := RefreshTokenRecord{}
+		assert.NoError(t, store.GetKey(refreshUsedPrefix+first, "", &used))
+		assert.Equal(t, "family-0", used.FamilyID)
+		assert.Error(t, store.GetKey(refreshTokenPrefix+first, "", &used))
+	})
+
+	t.Run("concurrent rotations of the same token", func(t *testing.T) {
+		token, err := handler.issueRefreshToken("family-z", "key-z", user)
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		rotated := 0
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := handler.RefreshTokenAuth(token); err == nil {
+					lock.Lock()
+					rotated++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 1, rotated)
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		_, err := handler.RefreshTokenAuth("does-not-exist")
+		assert.Equal(t, ErrInvalidRefreshToken, err)
+	})
+
+	t.Run("token from another profile", func(t *testing.T) {
+		other, err := handler.issueRefreshToken("family-x", "key-x", user)
+		assert.NoError(t, err)
+
+		otherHandler := newTokenHandler(t, store, dash)
+		otherHandler.profile.ID = "profile-2"
+		_, err = otherHandler.RefreshTokenAuth(other)
+		assert.Equal(t, ErrInvalidRefreshToken, err)
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		handler.token.RefreshTokenExpires = -10
+		expired, err := handler.issueRefreshToken("family-y", "key-y", user)
+		assert.NoError(t, err)
+		handler.token.RefreshTokenExpires = DefaultRefreshTokenExpires
+
+		_, err = handler.RefreshTokenAuth(expired)
+		assert.Equal(t, ErrInvalidRefreshToken, err)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		handler.token.EnableRefreshToken = false
+		_, err := handler.RefreshTokenAuth(first)
+		assert.Equal(t, ErrRefreshTokenDisabled, err)
+	})
+}
+
+func TestRefreshTokenRecordUser(t *testing.T) {
+	store := newMemoryStore()
+	handler := newTokenHandler(t, store, &mockDashboard{})
+	handler.profile.CustomUserGroupField = "groups"
+	handler.profile.MetaDataClaims = []string{"tenant"}
+	handler.profile.SessionTemplate = &tap.SessionTemplate{
+		Tags:     []string{"dept-{{.Claims.department}}"},
+		MetaData: map[string]string{"region": `{{index .Claims "region"}}`},
+	}
+
+	user := goth.User{
+		UserID:            TestId,
+		Email:             TestEmail,
+		Name:              "Jane Doe",
+		Provider:          "ADProvider",
+		AccessToken:       "upstream-access",
+		AccessTokenSecret: "upstream-secret",
+		RefreshToken:      "upstream-refresh",
+		IDToken:           "upstream-id",
+		RawData: map[string]interface{}{
+			"groups":     []interface{}{"admins"},
+			"tenant":     "acme",
+			"department": "sales",
+			"region":     "eu",
+			"id_token":   "upstream-id",
+			"address":    "1 Main Street",
+		},
+	}
+
+	token, err := handler.issueRefreshToken("family-0", "key-0", user)
+	assert.NoError(t, err)
+
+	record := RefreshTokenRecord{}
+	assert.NoError(t, store.GetKey(refreshTokenPrefix+token, "", &record))
+	assert.Equal(t, TestId, record.User.UserID)
+	assert.Equal(t, TestEmail, record.User.Email)
+	assert.Equal(t, "Jane Doe", record.User.Name)
+	assert.Empty(t, record.User.AccessToken)
+	assert.Empty(t, record.User.AccessTokenSecret)
+	assert.Empty(t, record.User.RefreshToken)
+	assert.Empty(t, record.User.IDToken)
+	assert.Equal(t, map[string]interface{}{
+		"groups":     []interface{}{"admins"},
+		"tenant":     "acme",
+		"department": "sales",
+		"region":     "eu",
+	}, record.User.RawData)
+}
@@ -0,0 +1,217 @@
+package identityHandlers
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/markbates/goth"
+
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+const (
+	issuedTokenPrefix   = "issued-token-"
+	profileTokensPrefix = "profile-tokens-"
+)
+
+var ErrTokenNotFound = errors.New("token was not issued by this profile")
+
+// Reasons a token stopped being valid, recorded in the audit log
+const (
+	revokedReplaced  = "replaced"
+	revokedByRequest = "revoked"
+	revokedRefreshed = "refreshed"
+	revokedReuse     = "refresh_token_reuse"
+)
+
+// IssuedToken is kept in the identity store for every Tyk key or OAuth token created by a profile, so that the
+// token can be revoked by its owner, or in bulk by user or profile through the API.
+type IssuedToken struct {
+	Token           string
+	ProfileID       string
+	UserID          string
+	Email           string
+	SSOKey          string
+	BaseAPIID       string
+	RefreshFamilyID string
+}
+
+// baseAPIID returns the API that tokens of this handler are created for
+func (t *TykIdentityHandler) baseAPIID() string {
+	if t.profile.ActionType == tap.GenerateOAuthTokenForClient {
+		return t.oauth.BaseAPIID
+	}
+	return t.token.BaseAPIID
+}
+
+// tokenTTL returns how long tokens of this handler are valid for, 0 when their expiry is not known to TIB
+func (t *TykIdentityHandler) tokenTTL() time.Duration {
+	if t.profile.ActionType == tap.GenerateTemporaryAuthToken && t.token.Expires > 0 {
+		return time.Duration(t.token.Expires) * time.Second
+	}
+	return 0
+}
+
+// profileTokens returns the tokens of the profile index, tokens whose record has expired are pruned from it
+func (t *TykIdentityHandler) profileTokens() []string {
+	tokens := []string{}
+	for _, token := range tap.Members(t.Store, profileTokensPrefix+t.profile.ID, "") {
+		issued := IssuedToken{}
+		if t.Store.GetKey(issuedTokenPrefix+token, "", &issued) != nil {
+			tap.RemoveMember(t.Store, profileTokensPrefix+t.profile.ID, "", token)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// trackToken records a newly issued token against the profile index
+func (t *TykIdentityHandler) trackToken(token string, user goth.User, refreshFamilyID string) {
+	issued := IssuedToken{
+		Token:           token,
+		ProfileID:       t.profile.ID,
+		UserID:          user.UserID,
+		Email:           user.Email,
+		SSOKey:          tap.GenerateSSOKey(user),
+		BaseAPIID:       t.baseAPIID(),
+		RefreshFamilyID: refreshFamilyID,
+	}
+
+	ttl := t.tokenTTL()
+	if err := tap.SetKeyWithTTL(t.Store, issuedTokenPrefix+token, "", issued, ttl); err != nil {
+		tykHandlerLogger.WithField("error", err).Error("Failed to record issued token")
+		return
+	}
+	audit.Log(nil, audit.Event{
+		Type:      audit.TokenIssued,
+		OrgID:     t.profile.OrgID,
+		ProfileID: t.profile.ID,
+		Provider:  t.profile.ProviderName,
+		User:      auditUser(user),
+		Token:     token,
+		Details:   map[string]interface{}{"base_api_id": issued.BaseAPIID, "refreshable": refreshFamilyID != ""},
+	})
+
+	// the index lives as long as the newest token it holds
+	if err := tap.AddMember(t.Store, profileTokensPrefix+t.profile.ID, "", token, ttl); err != nil {
+		tykHandlerLogger.WithField("error", err).Error("Failed to update profile token index")
+	}
+}
+
+// untrackToken removes every store entry that refers to a token that has been invalidated for reason, it does not
+// invalidate the token
+func (t *TykIdentityHandler) untrackToken(token string, reason string) {
+	issued := IssuedToken{}
+	// tokens that were never issued, or have already been revoked or expired, are not logged as revoked
+	if err := t.Store.GetKey(issuedTokenPrefix+token, "", &issued); err == nil {
+		audit.Log(nil, audit.Event{
+			Type:      audit.TokenRevoked,
+			OrgID:     t.profile.OrgID,
+			ProfileID: t.profile.ID,
+			Provider:  t.profile.ProviderName,
+			User:      auditUser(goth.User{UserID: issued.UserID, Email: issued.Email}),
+			Token:     token,
+			Reason:    reason,
+		})
+
+		current := ""
+		idWithProfile := issued.ProfileID + "-" + issued.SSOKey
+		if t.Store.GetKey(idWithProfile, "", &current) == nil && current == token {
+			t.Store.DeleteKey(idWithProfile, "")
+		}
+	}
+	t.Store.DeleteKey(issuedTokenPrefix+token, "")
+
+	if err := tap.RemoveMember(t.Store, profileTokensPrefix+t.profile.ID, "", token); err != nil {
+		tykHandlerLogger.WithField("error", err).Error("Failed to update profile token index")
+	}
+}
+
+// retireToken removes the store entries of a token that has been invalidated, together with the refresh token
+// that could have renewed it
+func (t *TykIdentityHandler) retireToken(token string, reason string) {
+	issued := IssuedToken{}
+	if t.Store.GetKey(issuedTokenPrefix+token, "", &issued) == nil && issued.RefreshFamilyID != "" {
+		current := ""
+		if t.Store.GetKey(refreshFamilyPrefix+issued.RefreshFamilyID, "", &current) == nil {
+			t.Store.DeleteKey(refreshTokenPrefix+current, "")
+		}
+		t.Store.DeleteKey(refreshFamilyPrefix+issued.RefreshFamilyID, "")
+	}
+
+	t.untrackToken(token, reason)
+}
+
+// RevokeToken invalidates a token issued by this profile and cleans up its store entries, including any refresh
+// token that could renew it
+func (t *TykIdentityHandler) RevokeToken(token string) error {
+	issued := IssuedToken{}
+	if err := t.Store.GetKey(issuedTokenPrefix+token, "", &issued); err != nil || issued.ProfileID != t.profile.ID {
+		return ErrTokenNotFound
+	}
+
+	iErr, isAuthorized := t.API.InvalidateToken(t.dashboardUserAPICred, issued.BaseAPIID, token)
+	if iErr != nil {
+		tykHandlerLogger.WithField("isAuthorized", isAuthorized).WithField("returned-error", iErr).Error("----> Token Invalidation failed.")
+		if !isAuthorized {
+			return iErr
+		}
+	}
+
+	t.retireToken(token, revokedByRequest)
+	tykHandlerLogger.WithField("profile", t.profile.ID).WithField("user", issued.UserID).Info("Token revoked")
+	return nil
+}
+
+// RevokeUserTokens revokes every token the profile issued to a user, matched by user ID or email address, and
+// returns how many were revoked. Email addresses are matched regardless of case, the identity provider may not use
+// the same case as the caller.
+func (t *TykIdentityHandler) RevokeUserTokens(userID string) (int, error) {
+	return t.revokeMatching(func(issued IssuedToken) bool {
+		return issued.UserID == userID || (issued.Email != "" && strings.EqualFold(issued.Email, userID))
+	})
+}
+
+// RevokeUserTokensInProfile loads a token profile and revokes every token it issued to a user, it is used to cut
+// off the API access of users removed from their identity provider
+func RevokeUserTokensInProfile(api *tyk.TykAPI, profiles, identities tap.AuthRegisterBackend, profileID, userID string) (int, error) {
+	tokenProfile := tap.Profile{}
+	if err := profiles.GetKey(profileID, "", &tokenProfile); err != nil {
+		return 0, err
+	}
+
+	handler := &TykIdentityHandler{API: api, Store: identities}
+	if err := handler.Init(tokenProfile); err != nil {
+		return 0, err
+	}
+
+	return handler.RevokeUserTokens(userID)
+}
+
+// RevokeProfileTokens revokes every token issued by the profile and returns how many were revoked
+func (t *TykIdentityHandler) RevokeProfileTokens() (int, error) {
+	return t.revokeMatching(func(IssuedToken) bool {
+		return true
+	})
+}
+
+func (t *TykIdentityHandler) revokeMatching(match func(IssuedToken) bool) (int, error) {
+	revoked := 0
+	for _, token := range t.profileTokens() {
+		issued := IssuedToken{}
+		if err := t.Store.GetKey(issuedTokenPrefix+token, "", &issued); err != nil || !match(issued) {
+			continue
+		}
+
+		if err := t.RevokeToken(token); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+
+	return revoked, nil
+}
@@ -0,0 +1,153 @@
+package identityHandlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+func TestRevokeTokens(t *testing.T) {
+	store := newMemoryStore()
+	dash := &mockDashboard{}
+	handler := newTokenHandler(t, store, dash)
+
+	alice := goth.User{UserID: "alice", Email: "alice@tyk.io", Provider: "ADProvider"}
+	bob := goth.User{UserID: "bob", Email: "bob@tyk.io", Provider: "ADProvider"}
+
+	login := func(user goth.User) string {
+		w := httptest.NewRecorder()
+		handler.CompleteIdentityActionForTokenAuth(w, httptest.NewRequest("POST", "/auth/profile-1/ADProvider", nil), user, handler.profile)
+		assert.Equal(t, 200, w.Code)
+		return dash.lastKey()
+	}
+
+	aliceKey := login(alice)
+	bobKey := login(bob)
+	assert.ElementsMatch(t, []string{aliceKey, bobKey}, handler.profileTokens())
+
+	t.Run("a new login replaces the previous token", func(t *testing.T) {
+		replaced := aliceKey
+		aliceKey = login(alice)
+		assert.Contains(t, dash.invalidated, replaced)
+		assert.ElementsMatch(t, []string{aliceKey, bobKey}, handler.profileTokens())
+	})
+
+	t.Run("revoke single token", func(t *testing.T) {
+		assert.NoError(t, handler.RevokeToken(bobKey))
+		assert.Contains(t, dash.invalidated, bobKey)
+		assert.Equal(t, []string{aliceKey}, handler.profileTokens())
+
+		current := ""
+		assert.Error(t, store.GetKey("profile-1-"+tap.GenerateSSOKey(bob), "", &current))
+		assert.Equal(t, ErrTokenNotFound, handler.RevokeToken(bobKey))
+	})
+
+	t.Run("token of another profile", func(t *testing.T) {
+		otherHandler := newTokenHandler(t, store, dash)
+		otherHandler.profile.ID = "profile-2"
+		assert.Equal(t, ErrTokenNotFound, otherHandler.RevokeToken(aliceKey))
+	})
+
+	t.Run("revoke by user also drops refresh tokens", func(t *testing.T) {
+		issued := IssuedToken{}
+		assert.NoError(t, store.GetKey(issuedTokenPrefix+aliceKey, "", &issued))
+		assert.NotEmpty(t, issued.RefreshFamilyID)
+
+		revoked, err := handler.RevokeUserTokens("alice@tyk.io")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, revoked)
+
+		current := ""
+		assert.Error(t, store.GetKey(refreshFamilyPrefix+issued.RefreshFamilyID, "", &current))
+	})
+
+	t.Run("revoke by user matches emails regardless of case", func(t *testing.T) {
+		jane := goth.User{UserID: "jane", Email: "Jane.Doe@corp.com", Provider: "ADProvider"}
+		janeKey := login(jane)
+
+		revoked, err := handler.RevokeUserTokens("jane.doe@corp.com")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, revoked)
+		assert.Contains(t, dash.invalidated, janeKey)
+		assert.NotContains(t, handler.profileTokens(), janeKey)
+	})
+
+	t.Run("expired tokens are pruned from the index", func(t *testing.T) {
+		expired := login(bob)
+		assert.Contains(t, handler.profileTokens(), expired)
+
+		// the backend expired the record of the token
+		store.DeleteKey(issuedTokenPrefix+expired, "")
+		assert.NotContains(t, handler.profileTokens(), expired)
+		assert.NotContains(t, tap.Members(store, profileTokensPrefix+handler.profile.ID, ""), expired)
+	})
+
+	t.Run("revoke whole profile", func(t *testing.T) {
+		login(alice)
+		login(bob)
+
+		revoked, err := handler.RevokeProfileTokens()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, revoked)
+		assert.Empty(t, handler.profileTokens())
+	})
+}
+
+type auditSink struct {
+	events []audit.Event
+}
+
+func (a *auditSink) Write(line []byte) error {
+	event := audit.Event{}
+	err := json.Unmarshal(line, &event)
+	a.events = append(a.events, event)
+	return err
+}
+
+func (a *auditSink) Close() error {
+	return nil
+}
+
+func TestTokenAudit(t *testing.T) {
+	sink := &auditSink{}
+	audit.SetSink(sink)
+	defer audit.Close()
+
+	dash := &mockDashboard{}
+	handler := newTokenHandler(t, newMemoryStore(), dash)
+	alice := goth.User{UserID: "alice", Email: "alice@tyk.io", Provider: "ADProvider"}
+	r := httptest.NewRequest("POST", "/auth/profile-1/ADProvider", nil)
+
+	handler.CompleteIdentityActionForTokenAuth(httptest.NewRecorder(), r, alice, handler.profile)
+	first := dash.lastKey()
+	handler.CompleteIdentityActionForTokenAuth(httptest.NewRecorder(), r, alice, handler.profile)
+	second := dash.lastKey()
+	assert.NoError(t, handler.RevokeToken(second))
+
+	types, reasons := []string{}, []string{}
+	for _, event := range sink.events {
+		types = append(types, event.Type)
+		reasons = append(reasons, event.Reason)
+		assert.Equal(t, "profile-1", event.ProfileID)
+		assert.Equal(t, "alice@tyk.io", event.User)
+	}
+	assert.Equal(t, []string{
+		audit.TokenIssued, audit.LoginSuccess,
+		audit.TokenRevoked, audit.TokenIssued, audit.LoginSuccess,
+		audit.TokenRevoked,
+	}, types)
+	assert.Equal(t, []string{"", "", revokedReplaced, "", "", revokedByRequest}, reasons)
+	assert.Equal(t, audit.Fingerprint(first), sink.events[2].Token)
+	assert.Equal(t, audit.Fingerprint(second), sink.events[5].Token)
+
+	// tokens that aren't known, e.g. already revoked, are not logged again
+	handler.untrackToken(second, revokedByRequest)
+	handler.untrackToken("unknown-key", revokedByRequest)
+	assert.Len(t, sink.events, 6)
+}
@@ -0,0 +1,268 @@
+package identityHandlers
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/markbates/goth"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+const defaultAPIVersion = "Default"
+
+// sessionTemplateData is what tags and meta data templates of a session template are rendered with, e.g.
+// {{.Email}}, {{join .Groups ","}} or {{.Claims.department}}
+type sessionTemplateData struct {
+	UserID    string
+	Email     string
+	FirstName string
+	LastName  string
+	NickName  string
+	Provider  string
+	Groups    []string
+	Claims    map[string]string
+}
+
+var sessionTemplateFuncs = template.FuncMap{
+	"join": func(elems []string, sep string) string {
+		return strings.Join(elems, sep)
+	},
+}
+
+func parseSessionTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(sessionTemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// validateSessionTemplate checks that every tag and meta data value of a session template can be parsed, so that
+// a broken profile is rejected when it is loaded rather than when a user logs in
+func validateSessionTemplate(st *tap.SessionTemplate) error {
+	if st == nil {
+		return nil
+	}
+
+	for i, tag := range st.Tags {
+		if _, err := parseSessionTemplate(fmt.Sprintf("Tags[%d]", i), tag); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range st.MetaData {
+		if _, err := parseSessionTemplate("MetaData."+key, value); err != nil {
+			return err
+		}
+	}
+
+	for _, right := range st.AccessRights {
+		if right.APIID == "" {
+			return fmt.Errorf("session template access rights require an APIID")
+		}
+	}
+
+	return nil
+}
+
+func renderSessionTemplate(name, text string, data sessionTemplateData) (string, error) {
+	tpl, err := parseSessionTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// newSessionTemplateData exposes the identity of the user to session templates, claims are flattened to strings
+// so that missing ones render as empty values
+func (t *TykIdentityHandler) newSessionTemplateData(user goth.User) sessionTemplateData {
+	data := sessionTemplateData{
+		UserID:    GetUserID(user, t.profile.CustomUserIDField),
+		Email:     GetEmail(user, t.profile.CustomEmailField),
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		NickName:  user.NickName,
+		Provider:  user.Provider,
+		Groups:    []string{},
+		Claims:    map[string]string{},
+	}
+
+	if t.profile.CustomUserGroupField != "" {
+		if rawGroups, ok := user.RawData[t.profile.CustomUserGroupField]; ok && rawGroups != nil {
+			data.Groups = groupsStringer(rawGroups, t.profile.UserGroupSeparator)
+		}
+	}
+
+	for claim, value := range user.RawData {
+		data.Claims[claim] = claimString(value)
+	}
+
+	return data
+}
+
+// newTagTemplateData is the data tags are rendered with. Rendered tags are split on commas, so commas are removed
+// from the values of the user, otherwise a claim such as "x,admin" would add tags of its choosing. List claims keep
+// a comma between their elements, so that they still produce one tag each.
+func (t *TykIdentityHandler) newTagTemplateData(user goth.User) sessionTemplateData {
+	data := t.newSessionTemplateData(user)
+	data.UserID = stripCommas(data.UserID)
+	data.Email = stripCommas(data.Email)
+	data.FirstName = stripCommas(data.FirstName)
+	data.LastName = stripCommas(data.LastName)
+	data.NickName = stripCommas(data.NickName)
+	data.Provider = stripCommas(data.Provider)
+
+	for i, group := range data.Groups {
+		data.Groups[i] = stripCommas(group)
+	}
+
+	for claim, value := range user.RawData {
+		data.Claims[claim] = tagClaimString(value)
+	}
+
+	return data
+}
+
+func stripCommas(value string) string {
+	return strings.ReplaceAll(value, ",", "")
+}
+
+func tagClaimString(value interface{}) string {
+	switch v := value.(type) {
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, elem := range v {
+			parts = append(parts, stripCommas(claimString(elem)))
+		}
+		return strings.Join(parts, ",")
+	case []string:
+		parts := make([]string, 0, len(v))
+		for _, elem := range v {
+			parts = append(parts, stripCommas(elem))
+		}
+		return strings.Join(parts, ",")
+	default:
+		return stripCommas(claimString(value))
+	}
+}
+
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, elem := range v {
+			parts = append(parts, claimString(elem))
+		}
+		return strings.Join(parts, ",")
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// sessionState builds the Tyk session for a token generated for user, using the session template of the profile
+// when there is one. Without a template the token gets access to the base API only.
+func (t *TykIdentityHandler) sessionState(user goth.User, baseAPIID string) (tyk.SessionState, error) {
+	session := tyk.GenerateBasicTykSession(baseAPIID, defaultAPIVersion, t.policyIDs(user), t.profile.OrgID)
+
+	t.setIdentityMetaData(&session, user)
+
+	st := t.profile.SessionTemplate
+	if st == nil {
+		return session, nil
+	}
+
+	if len(st.AccessRights) > 0 {
+		session.AccessRights = map[string]tyk.AccessDefinition{}
+		for _, right := range st.AccessRights {
+			versions := right.Versions
+			if len(versions) == 0 {
+				versions = []string{defaultAPIVersion}
+			}
+			session.AccessRights[right.APIID] = tyk.AccessDefinition{
+				APIName:  right.APIName,
+				APIID:    right.APIID,
+				Versions: versions,
+			}
+		}
+	}
+
+	if st.Rate > 0 {
+		session.Rate = st.Rate
+		session.Allowance = st.Rate
+		if st.Per > 0 {
+			session.Per = st.Per
+		}
+	}
+
+	if st.QuotaMax != 0 {
+		session.QuotaMax = st.QuotaMax
+		session.QuotaRemaining = st.QuotaMax
+		session.QuotaRenewalRate = st.QuotaRenewalRate
+		session.QuotaRenews = time.Now().Add(time.Duration(st.QuotaRenewalRate) * time.Second).Unix()
+	}
+
+	data := t.newSessionTemplateData(user)
+	tagData := t.newTagTemplateData(user)
+
+	for i, tag := range st.Tags {
+		rendered, err := renderSessionTemplate(fmt.Sprintf("Tags[%d]", i), tag, tagData)
+		if err != nil {
+			return session, err
+		}
+		// a single template can produce several tags, e.g. one per group
+		for _, renderedTag := range strings.Split(rendered, ",") {
+			if renderedTag = strings.TrimSpace(renderedTag); renderedTag != "" {
+				session.Tags = append(session.Tags, renderedTag)
+			}
+		}
+	}
+
+	metaData := session.MetaData.(map[string]interface{})
+	for key, value := range st.MetaData {
+		rendered, err := renderSessionTemplate("MetaData."+key, value, data)
+		if err != nil {
+			return session, err
+		}
+		metaData[key] = rendered
+	}
+
+	return session, nil
+}
+
+// setIdentityMetaData adds the identity of the user to the session meta data, so that it can be read by the
+// gateway, e.g. in Global header settings:
+//
+//	X-Origin-Tyk: $tyk_meta.Origin
+//	X-Tyk-TAP-AccessToken: $tyk_meta.AccessToken
+//	X-Tyk-TAP-ID: $tyk_meta.AuthProviderUserID
+//	X-Tyk-TAP-Provider: $tyk_meta.AuthProviderSource
+func (t *TykIdentityHandler) setIdentityMetaData(session *tyk.SessionState, user goth.User) {
+	metaData := session.MetaData.(map[string]interface{})
+
+	metaData["AuthProviderUserID"] = user.UserID
+	metaData["AuthProviderSource"] = user.Provider
+
+	if !t.profile.OmitUpstreamTokens {
+		metaData["AccessToken"] = user.AccessToken
+		metaData["AccessTokenSecret"] = user.AccessTokenSecret
+	}
+
+	for _, claim := range t.profile.MetaDataClaims {
+		if value, ok := user.RawData[claim]; ok {
+			metaData[claim] = value
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package identityHandlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+func TestSessionState(t *testing.T) {
+	user := goth.User{
+		UserID:   TestId,
+		Email:    TestEmail,
+		Provider: "ADProvider",
+		RawData: map[string]interface{}{
+			"memberOf":   []interface{}{"devs", "admins"},
+			"department": "engineering",
+		},
+	}
+
+	t.Run("no template", func(t *testing.T) {
+		handler := newTokenHandler(t, newMemoryStore(), &mockDashboard{})
+		session, err := handler.sessionState(user, "api-1")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"api-1"}, accessRightIDs(session))
+		assert.Equal(t, []string{"policy-1"}, session.ApplyPolicies)
+		assert.Equal(t, []string{"TykOrigin-TAP"}, session.Tags)
+		assert.Equal(t, float64(1), session.Rate)
+	})
+
+	t.Run("template", func(t *testing.T) {
+		handler := newTokenHandler(t, newMemoryStore(), &mockDashboard{})
+		handler.profile.CustomUserGroupField = "memberOf"
+		handler.profile.SessionTemplate = &tap.SessionTemplate{
+			AccessRights: []tap.SessionAccessRight{
+				{APIID: "api-1", APIName: "Orders", Versions: []string{"v1", "v2"}},
+				{APIID: "api-2"},
+			},
+			Rate:             100,
+			Per:              60,
+			QuotaMax:         1000,
+			QuotaRenewalRate: 3600,
+			Tags:             []string{"sso", "{{join .Groups \",\"}}", "{{.Claims.missing}}"},
+			MetaData: map[string]string{
+				"email":      "{{.Email}}",
+				"department": "{{.Claims.department}}",
+			},
+		}
+
+		session, err := handler.sessionState(user, "api-1")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"api-1", "api-2"}, accessRightIDs(session))
+		assert.Equal(t, []string{"v1", "v2"}, session.AccessRights["api-1"].Versions)
+		assert.Equal(t, []string{"Default"}, session.AccessRights["api-2"].Versions)
+		assert.Equal(t, float64(100), session.Rate)
+		assert.Equal(t, float64(60), session.Per)
+		assert.Equal(t, int64(1000), session.QuotaMax)
+		assert.Equal(t, int64(1000), session.QuotaRemaining)
+		assert.Equal(t, []string{"TykOrigin-TAP", "sso", "devs", "admins"}, session.Tags)
+
+		metaData := session.MetaData.(map[string]interface{})
+		assert.Equal(t, TestEmail, metaData["email"])
+		assert.Equal(t, "engineering", metaData["department"])
+		assert.Equal(t, "TAP", metaData["Origin"])
+	})
+
+	t.Run("claim values can't add tags", func(t *testing.T) {
+		handler := newTokenHandler(t, newMemoryStore(), &mockDashboard{})
+		handler.profile.CustomUserGroupField = "memberOf"
+		handler.profile.SessionTemplate = &tap.SessionTemplate{
+			Tags:     []string{"name-{{.Claims.name}}", "team-{{.Claims.team}}", "{{join .Groups \",\"}}", "{{.Claims.roles}}"},
+			MetaData: map[string]string{"name": "{{.Claims.name}}"},
+		}
+
+		session, err := handler.sessionState(goth.User{
+			UserID: TestId,
+			RawData: map[string]interface{}{
+				"name":     "Doe, Jane",
+				"team":     "x,admin",
+				"memberOf": []interface{}{"devs", "ops,admin"},
+				"roles":    []interface{}{"reader", "writer"},
+			},
+		}, "api-1")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"TykOrigin-TAP", "name-Doe Jane", "team-xadmin", "devs", "opsadmin", "reader", "writer"}, session.Tags)
+		// meta data is a single value, it keeps the claim as it is
+		assert.Equal(t, "Doe, Jane", session.MetaData.(map[string]interface{})["name"])
+	})
+
+	t.Run("is sent with the token request", func(t *testing.T) {
+		dash := &mockDashboard{}
+		handler := newTokenHandler(t, newMemoryStore(), dash)
+		handler.profile.SessionTemplate = &tap.SessionTemplate{
+			AccessRights: []tap.SessionAccessRight{{APIID: "api-3"}},
+			MetaData:     map[string]string{"user": "{{.UserID}}"},
+		}
+
+		w := httptest.NewRecorder()
+		handler.CompleteIdentityActionForTokenAuth(w, httptest.NewRequest("POST", "/auth/profile-1/ADProvider", nil), user, handler.profile)
+		assert.Equal(t, 200, w.Code)
+
+		sent := tyk.SessionState{}
+		assert.NoError(t, json.Unmarshal([]byte(dash.bodies["POST "+string(tyk.STANDARD_TOKENS)]), &sent))
+		assert.Equal(t, []string{"api-3"}, accessRightIDs(sent))
+		assert.Equal(t, TestId, sent.MetaData.(map[string]interface{})["user"])
+		assert.Equal(t, TestId, sent.MetaData.(map[string]interface{})["AuthProviderUserID"])
+	})
+
+	t.Run("invalid template is rejected on init", func(t *testing.T) {
+		handler := &TykIdentityHandler{API: &tyk.TykAPI{}, Store: newMemoryStore()}
+		err := handler.Init(tap.Profile{
+			ID:              "profile-1",
+			SessionTemplate: &tap.SessionTemplate{Tags: []string{"{{.Email"}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestSetIdentityMetaData(t *testing.T) {
+	user := goth.User{
+		UserID:            TestId,
+		Provider:          "ADProvider",
+		AccessToken:       "upstream-token",
+		AccessTokenSecret: "upstream-secret",
+		RawData: map[string]interface{}{
+			"email":  TestEmail,
+			"groups": []interface{}{"devs"},
+		},
+	}
+
+	t.Run("default", func(t *testing.T) {
+		handler := newTokenHandler(t, newMemoryStore(), &mockDashboard{})
+		session, err := handler.sessionState(user, "api-1")
+		assert.NoError(t, err)
+
+		metaData := session.MetaData.(map[string]interface{})
+		assert.Equal(t, TestId, metaData["AuthProviderUserID"])
+		assert.Equal(t, "ADProvider", metaData["AuthProviderSource"])
+		assert.Equal(t, "upstream-token", metaData["AccessToken"])
+		assert.Equal(t, "upstream-secret", metaData["AccessTokenSecret"])
+		assert.NotContains(t, metaData, "email")
+	})
+
+	t.Run("claims and no upstream tokens", func(t *testing.T) {
+		handler := newTokenHandler(t, newMemoryStore(), &mockDashboard{})
+		handler.profile.MetaDataClaims = []string{"email", "groups", "tenant"}
+		handler.profile.OmitUpstreamTokens = true
+
+		session, err := handler.sessionState(user, "api-1")
+		assert.NoError(t, err)
+
+		metaData := session.MetaData.(map[string]interface{})
+		assert.Equal(t, TestId, metaData["AuthProviderUserID"])
+		assert.Equal(t, TestEmail, metaData["email"])
+		assert.Equal(t, []interface{}{"devs"}, metaData["groups"])
+		assert.NotContains(t, metaData, "tenant")
+		assert.NotContains(t, metaData, "AccessToken")
+		assert.NotContains(t, metaData, "AccessTokenSecret")
+	})
+}
+
+func accessRightIDs(session tyk.SessionState) []string {
+	ids := []string{}
+	for id := range session.AccessRights {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,65 @@
+package identityHandlers
+
+import (
+	"strings"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+const (
+	ssoUsersPrefix         = "sso-users-"
+	portalDevelopersPrefix = "portal-developers-"
+)
+
+// SSOUsers returns the email addresses of the users a profile has logged into the Dashboard, only these users are
+// considered by the deprovisioning sync
+func SSOUsers(store tap.AuthRegisterBackend, profileID string) []string {
+	return tap.Members(store, ssoUsersPrefix+profileID, "")
+}
+
+// ForgetSSOUser removes a user from the profile's SSO users once they have been deprovisioned
+func ForgetSSOUser(store tap.AuthRegisterBackend, profileID, email string) {
+	if err := tap.RemoveMember(store, ssoUsersPrefix+profileID, "", strings.ToLower(email)); err != nil {
+		tykHandlerLogger.WithField("error", err).Error("Failed to update SSO users")
+	}
+}
+
+// RecordSSOUser adds a user to the profile's SSO users, e.g. when they are provisioned through SCIM
+func RecordSSOUser(store tap.AuthRegisterBackend, profileID, email string) {
+	if store == nil || email == "" || email == DefaultSSOEmail {
+		return
+	}
+
+	if err := tap.AddMember(store, ssoUsersPrefix+profileID, "", strings.ToLower(email), 0); err != nil {
+		tykHandlerLogger.WithField("error", err).Error("Failed to record SSO user")
+	}
+}
+
+// trackSSOUser records a user logged into the Dashboard through the profile
+func (t *TykIdentityHandler) trackSSOUser(email string) {
+	RecordSSOUser(t.Store, t.profile.ID, email)
+}
+
+// PortalDevelopers returns the email addresses of the portal developers a profile has logged in or provisioned, only
+// these developers can be managed through the SCIM server of the profile
+func PortalDevelopers(store tap.AuthRegisterBackend, profileID string) []string {
+	return tap.Members(store, portalDevelopersPrefix+profileID, "")
+}
+
+// RecordPortalDeveloper adds a developer to the profile's portal developers
+func RecordPortalDeveloper(store tap.AuthRegisterBackend, profileID, email string) {
+	if store == nil || email == "" {
+		return
+	}
+
+	if err := tap.AddMember(store, portalDevelopersPrefix+profileID, "", strings.ToLower(email), 0); err != nil {
+		tykHandlerLogger.WithField("error", err).Error("Failed to record portal developer")
+	}
+}
+
+// ForgetPortalDeveloper removes a developer from the profile's portal developers once they have been deleted
+func ForgetPortalDeveloper(store tap.AuthRegisterBackend, profileID, email string) {
+	if err := tap.RemoveMember(store, portalDevelopersPrefix+profileID, "", strings.ToLower(email)); err != nil {
+		tykHandlerLogger.WithField("error", err).Error("Failed to update portal developers")
+	}
+}
@@ -8,7 +8,6 @@ package identityHandlers
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"strings"
 	"sync"
@@ -17,6 +16,7 @@ import (
 	"github.com/markbates/goth"
 
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/pages"
 	"github.com/TykTechnologies/tyk-identity-broker/tap"
 	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
 	"github.com/sirupsen/logrus"
@@ -30,10 +30,11 @@ type ModuleName string // To separate out target modules of the dashboard
 
 const (
 	// Enums to identify which target it being used, dashbaord or portal, they are distinct.
-	SSOForDashboard ModuleName = "dashboard"
-	SSOForPortal    ModuleName = "portal"
-	InvalidModule   ModuleName = ""
-	DefaultSSOEmail string     = "ssoSession@ssoSession.com"
+	SSOForDashboard        ModuleName = "dashboard"
+	SSOForPortal           ModuleName = "portal"
+	SSOForEnterprisePortal ModuleName = "enterprise-portal"
+	InvalidModule          ModuleName = ""
+	DefaultSSOEmail        string     = "ssoSession@ssoSession.com"
 )
 
 // SSOAccessData is the data type used for speaking to the SSO endpoint in the advanced API
@@ -45,6 +46,7 @@ type SSOAccessData struct {
 	GroupID                   string
 	GroupsIDs                 []string
 	SSOOnlyForRegisteredUsers bool
+	Permissions               tap.Permissions `json:",omitempty"`
 }
 
 // TykIdentityHandler provides an interface for generating SSO identities on a tyk node
@@ -55,6 +57,10 @@ type TykIdentityHandler struct {
 	dashboardUserAPICred  string
 	oauth                 OAuthSettings
 	token                 TokenSettings
+	portalDeveloper       PortalDeveloperSettings
+	enterprisePortal      EnterprisePortalSettings
+	device                DeviceSettings
+	delivery              DeliverySettings
 	disableOneTokenPerAPI bool
 }
 
@@ -70,8 +76,22 @@ type OAuthSettings struct {
 }
 
 type TokenSettings struct {
-	BaseAPIID string
-	Expires   int64
+	BaseAPIID           string
+	Expires             int64
+	EnableRefreshToken  bool
+	RefreshTokenExpires int64
+}
+
+// PortalDeveloperSettings determine how the portal developer of a user is kept in sync with the identity provider
+// for the tap.GenerateOrLoginDeveloperProfile action
+type PortalDeveloperSettings struct {
+	// FieldMapping maps developer Fields (e.g. "company") to the claim they are read from
+	FieldMapping map[string]string
+	// OverwriteFields replaces fields that already have a value, by default only blank fields are filled in
+	OverwriteFields bool
+	// InActiveClaim and InActiveValues deactivate the developer when the claim has one of the values
+	InActiveClaim  string
+	InActiveValues []string
 }
 
 func mapActionToModule(action tap.Action) (ModuleName, error) {
@@ -80,6 +100,8 @@ func mapActionToModule(action tap.Action) (ModuleName, error) {
 		return SSOForDashboard, nil
 	case tap.GenerateOrLoginDeveloperProfile:
 		return SSOForPortal, nil
+	case tap.GenerateOrLoginEnterprisePortalUser:
+		return SSOForEnterprisePortal, nil
 	}
 
 	tykHandlerLogger.Error("invalid action: ", action)
@@ -99,6 +121,7 @@ func (t *TykIdentityHandler) Init(conf interface{}) error {
 	})
 
 	t.profile = conf.(tap.Profile)
+	t.delivery = DeliverySettings{Mode: DeliveryQuery, CookiePrefix: DefaultDeliveryCookiePrefix, Expires: DefaultDeliveryExpires}
 	if conf.(tap.Profile).IdentityHandlerConfig != nil {
 		theseConfs := conf.(tap.Profile).IdentityHandlerConfig
 		if theseConfs["DashboardCredential"] != nil {
@@ -137,9 +160,121 @@ func (t *TykIdentityHandler) Init(conf interface{}) error {
 				t.token.Expires = int64(tokenSettings.(map[string]interface{})["Expires"].(float64))
 			}
 
+			if tokenSettings.(map[string]interface{})["EnableRefreshToken"] != nil {
+				t.token.EnableRefreshToken = tokenSettings.(map[string]interface{})["EnableRefreshToken"].(bool)
+			}
+
+			if tokenSettings.(map[string]interface{})["RefreshTokenExpires"] == nil {
+				t.token.RefreshTokenExpires = DefaultRefreshTokenExpires
+			} else {
+				t.token.RefreshTokenExpires = int64(tokenSettings.(map[string]interface{})["RefreshTokenExpires"].(float64))
+			}
+
+		}
+
+		deviceSettings, deviceOk := theseConfs["DeviceAuthorization"]
+		if deviceOk {
+			tykHandlerLogger.Debug("Found device authorization configuration, loading...")
+			t.device = DeviceSettings{ExpiresIn: DefaultDeviceCodeExpires, Interval: DefaultDevicePollInterval}
+			if deviceSettings.(map[string]interface{})["Enabled"] != nil {
+				t.device.Enabled = deviceSettings.(map[string]interface{})["Enabled"].(bool)
+			}
+			if deviceSettings.(map[string]interface{})["ProviderPath"] != nil {
+				t.device.ProviderPath = deviceSettings.(map[string]interface{})["ProviderPath"].(string)
+			}
+			if deviceSettings.(map[string]interface{})["ExpiresIn"] != nil {
+				t.device.ExpiresIn = int64(deviceSettings.(map[string]interface{})["ExpiresIn"].(float64))
+			}
+			if deviceSettings.(map[string]interface{})["Interval"] != nil {
+				t.device.Interval = int64(deviceSettings.(map[string]interface{})["Interval"].(float64))
+			}
+			if t.device.Enabled && t.device.ProviderPath == "" {
+				return errors.New("device authorization needs a ProviderPath")
+			}
+		}
+
+		deliverySettings, deliveryOk := theseConfs["Delivery"]
+		if deliveryOk {
+			tykHandlerLogger.Debug("Found delivery configuration, loading...")
+			if deliverySettings.(map[string]interface{})["Mode"] != nil {
+				t.delivery.Mode = deliverySettings.(map[string]interface{})["Mode"].(string)
+			}
+			if deliverySettings.(map[string]interface{})["CookieDomain"] != nil {
+				t.delivery.CookieDomain = deliverySettings.(map[string]interface{})["CookieDomain"].(string)
+			}
+			if deliverySettings.(map[string]interface{})["CookiePrefix"] != nil {
+				t.delivery.CookiePrefix = deliverySettings.(map[string]interface{})["CookiePrefix"].(string)
+			}
+			if deliverySettings.(map[string]interface{})["Expires"] != nil {
+				t.delivery.Expires = int64(deliverySettings.(map[string]interface{})["Expires"].(float64))
+			}
+			if deliverySettings.(map[string]interface{})["ExchangeSecret"] != nil {
+				t.delivery.ExchangeSecret = deliverySettings.(map[string]interface{})["ExchangeSecret"].(string)
+			}
+			if err := t.delivery.validate(); err != nil {
+				return err
+			}
+		}
+
+		enterprisePortalSettings, enterprisePortalOk := theseConfs["EnterprisePortal"]
+		if enterprisePortalOk {
+			tykHandlerLogger.Debug("Found enterprise portal configuration, loading...")
+			t.enterprisePortal = EnterprisePortalSettings{
+				OrganisationMapping: map[string]int{},
+				TeamMapping:         map[string]int{},
+			}
+			if enterprisePortalSettings.(map[string]interface{})["Role"] != nil {
+				t.enterprisePortal.Role = enterprisePortalSettings.(map[string]interface{})["Role"].(string)
+			}
+			if enterprisePortalSettings.(map[string]interface{})["DefaultOrganisationID"] != nil {
+				t.enterprisePortal.DefaultOrganisationID = int(enterprisePortalSettings.(map[string]interface{})["DefaultOrganisationID"].(float64))
+			}
+			if enterprisePortalSettings.(map[string]interface{})["OrganisationClaim"] != nil {
+				t.enterprisePortal.OrganisationClaim = enterprisePortalSettings.(map[string]interface{})["OrganisationClaim"].(string)
+			}
+			if organisationMapping, ok := enterprisePortalSettings.(map[string]interface{})["OrganisationMapping"].(map[string]interface{}); ok {
+				for claim, organisationID := range organisationMapping {
+					t.enterprisePortal.OrganisationMapping[claim] = int(organisationID.(float64))
+				}
+			}
+			if enterprisePortalSettings.(map[string]interface{})["DefaultTeamID"] != nil {
+				t.enterprisePortal.DefaultTeamID = int(enterprisePortalSettings.(map[string]interface{})["DefaultTeamID"].(float64))
+			}
+			if teamMapping, ok := enterprisePortalSettings.(map[string]interface{})["TeamMapping"].(map[string]interface{}); ok {
+				for group, teamID := range teamMapping {
+					t.enterprisePortal.TeamMapping[group] = int(teamID.(float64))
+				}
+			}
+		}
+
+		portalSettings, portalOk := theseConfs["PortalDeveloper"]
+		if portalOk {
+			tykHandlerLogger.Debug("Found portal developer configuration, loading...")
+			t.portalDeveloper = PortalDeveloperSettings{FieldMapping: map[string]string{}}
+			if fieldMapping, ok := portalSettings.(map[string]interface{})["FieldMapping"].(map[string]interface{}); ok {
+				for field, claim := range fieldMapping {
+					t.portalDeveloper.FieldMapping[field] = claim.(string)
+				}
+			}
+			if portalSettings.(map[string]interface{})["OverwriteFields"] != nil {
+				t.portalDeveloper.OverwriteFields = portalSettings.(map[string]interface{})["OverwriteFields"].(bool)
+			}
+			if portalSettings.(map[string]interface{})["InActiveClaim"] != nil {
+				t.portalDeveloper.InActiveClaim = portalSettings.(map[string]interface{})["InActiveClaim"].(string)
+			}
+			if inActiveValues, ok := portalSettings.(map[string]interface{})["InActiveValues"].([]interface{}); ok {
+				for _, value := range inActiveValues {
+					t.portalDeveloper.InActiveValues = append(t.portalDeveloper.InActiveValues, value.(string))
+				}
+			}
 		}
 	}
 
+	if err := validateSessionTemplate(t.profile.SessionTemplate); err != nil {
+		tykHandlerLogger.WithField("error", err).Error("Invalid session template")
+		return err
+	}
+
 	return nil
 }
 
@@ -160,7 +295,22 @@ func (t *TykIdentityHandler) CreateIdentity(i interface{}) (string, error) {
 	displayName := ""
 	var groupsIDs []string
 	var groupID string
+	var permissions tap.Permissions
+	orgID := t.profile.OrgID
 	if ok {
+		var err error
+		orgID, err = GetOrgID(gUser, t.profile.CustomOrgIDField, t.profile.OrgIDMapping, t.profile.OrgID)
+		if err != nil {
+			tykHandlerLogger.WithField("user", gUser.UserID).Warning("Rejecting SSO: ", err)
+			return "", err
+		}
+
+		permissions, err = GetPermissions(gUser, t.profile.CustomUserGroupField, t.profile.PermissionsMapping, t.profile.UserGroupSeparator)
+		if err != nil {
+			tykHandlerLogger.WithField("user", gUser.UserID).Warning("Rejecting SSO: ", err)
+			return "", err
+		}
+
 		email = GetEmail(gUser, t.profile.CustomEmailField)
 
 		if gUser.FirstName != "" {
@@ -184,21 +334,33 @@ func (t *TykIdentityHandler) CreateIdentity(i interface{}) (string, error) {
 	tykHandlerLogger.Debugf("The GroupIDs %s used for SSO: ", groupsIDs)
 	accessRequest := SSOAccessData{
 		ForSection:                thisModule,
-		OrgID:                     t.profile.OrgID,
+		OrgID:                     orgID,
 		EmailAddress:              email,
 		DisplayName:               displayName,
 		GroupsIDs:                 groupsIDs,
 		GroupID:                   groupID,
 		SSOOnlyForRegisteredUsers: t.profile.SSOOnlyForRegisteredUsers,
+		Permissions:               permissions,
 	}
 
-	returnVal, ssoEndpoint, retErr := t.API.CreateSSONonce(t.dashboardUserAPICred, accessRequest)
+	var returnVal interface{}
+	var ssoEndpoint tyk.Endpoint
+	var retErr error
+	if thisModule == SSOForEnterprisePortal {
+		returnVal, ssoEndpoint, retErr = t.API.CreateEnterprisePortalSSONonce(accessRequest)
+	} else {
+		returnVal, ssoEndpoint, retErr = t.API.CreateSSONonce(t.dashboardUserAPICred, accessRequest)
+	}
 	tykHandlerLogger.WithField("return_value", returnVal).Debugf("Returned from %s endpoint", ssoEndpoint)
 	if retErr != nil {
 		tykHandlerLogger.WithField("return_value", returnVal).Error("API Response error: ", retErr)
 		return "", retErr
 	}
 
+	if thisModule == SSOForDashboard {
+		t.trackSSOUser(email)
+	}
+
 	asMapString := returnVal.(map[string]interface{})
 
 	return asMapString["Meta"].(string), nil
@@ -233,37 +395,46 @@ func groupsStringer(i interface{}, separator string) []string {
 
 // CompleteIdentityActionForDashboard handles a dashboard identity. No ise is created, only an SSO login session
 func (t *TykIdentityHandler) CompleteIdentityActionForDashboard(w http.ResponseWriter, r *http.Request, i interface{}, profile tap.Profile) {
+	logger := tykHandlerLogger.WithContext(r.Context())
 	nonce, nErr := t.CreateIdentity(i)
 
 	if nErr != nil {
-		tykHandlerLogger.WithField("error", nErr).Error("Nonce creation failed")
-		fmt.Fprintf(w, "Login failed")
+		logger.WithField("error", nErr).Error("Nonce creation failed")
+		code := pages.CodeLoginFailed
+		if nErr == ErrOrgNotMapped || nErr == ErrPermissionsNotMapped {
+			code = pages.CodeAccessDenied
+		}
+		pages.RenderError(w, r, profile.Pages, code, "")
 		return
 	}
 
 	// After login, we need to redirect this user
-	tykHandlerLogger.Debug("--> Running redirect...")
-	if profile.ReturnURL != "" {
-		newURL := profile.ReturnURL + "?nonce=" + nonce
-		tykHandlerLogger.Debugln("--> redirecting to URL: " + newURL)
-		http.Redirect(w, r, newURL, 301)
+	logger.Debug("--> Running redirect...")
+	if returnURL := tap.ReturnURL(r, profile); returnURL != "" {
+		t.loginSucceeded(w, r, i)
+		t.deliver(w, r, returnURL, []pages.FormField{{Name: "nonce", Value: nonce}}, false)
 		return
 	}
 
-	tykHandlerLogger.Error("No return URL found, cannot redirect. (Check why no URL redirect on the profile) ")
-	fmt.Fprintf(w, "Check with your admin why there's no URI defined")
+	logger.Error("No return URL found, cannot redirect. (Check why no URL redirect on the profile) ")
+	pages.RenderError(w, r, profile.Pages, pages.CodeNoReturnURL, "")
 }
 
 // CompleteIdentityActionForPortal will generate an identity for a portal user based, so it will AddOrUpdate that
 // user depnding on if they exist or not and validate the login using a one-time nonce.
 func (t *TykIdentityHandler) CompleteIdentityActionForPortal(w http.ResponseWriter, r *http.Request, i interface{}, profile tap.Profile) {
+	logger := tykHandlerLogger.WithContext(r.Context())
 	// Create a nonce
-	tykHandlerLogger.Info("Creating nonce")
+	logger.Info("Creating nonce")
 	nonce, nErr := t.CreateIdentity(i)
 
 	if nErr != nil {
-		tykHandlerLogger.Error("Nonce creation failed: ", nErr)
-		fmt.Fprintf(w, "Login failed")
+		logger.Error("Nonce creation failed: ", nErr)
+		code := pages.CodeLoginFailed
+		if nErr == ErrOrgNotMapped || nErr == ErrPermissionsNotMapped {
+			code = pages.CodeAccessDenied
+		}
+		pages.RenderError(w, r, profile.Pages, code, "")
 		return
 	}
 
@@ -272,20 +443,22 @@ func (t *TykIdentityHandler) CompleteIdentityActionForPortal(w http.ResponseWrit
 
 	// Check if user exists
 	sso_key := tap.GenerateSSOKey(user)
-	tykHandlerLogger.Debug("sso_key = ", sso_key)
+	logger.Debug("sso_key = ", sso_key)
 
+	inActive := false
+	email := user.Email
 	thisUser, retErr, isAuthorised := t.API.GetDeveloperBySSOKey(t.dashboardUserAPICred, sso_key)
 	if !isAuthorised {
-		tykHandlerLogger.WithField("returned_error", retErr).Error("User is unauthorized.")
-		fmt.Fprintf(w, "Login failed")
+		logger.WithField("returned_error", retErr).Error("User is unauthorized.")
+		pages.RenderError(w, r, profile.Pages, pages.CodeServerError, "")
 		return
 	}
 	if retErr != nil {
-		tykHandlerLogger.WithField("returned_error", retErr).Info("User not found, creating new record.")
+		logger.WithField("returned_error", retErr).Info("User not found, creating new record.")
 
 		// If not, create user
-		tykHandlerLogger.Info("Creating user")
-		tykHandlerLogger.WithField("user_name", user.Email).Debug()
+		logger.Info("Creating user")
+		logger.WithField("user_name", user.Email).Debug()
 
 		newUser := tyk.PortalDeveloper{
 			Email:         user.Email,
@@ -298,14 +471,17 @@ func (t *TykIdentityHandler) CompleteIdentityActionForPortal(w http.ResponseWrit
 			Nonce:         nonce,
 			SSOKey:        sso_key,
 		}
+		t.syncDeveloper(&newUser, user)
+		inActive = newUser.InActive
+
 		createErr := t.API.CreateDeveloper(t.dashboardUserAPICred, newUser)
 		if createErr != nil {
-			tykHandlerLogger.WithField("error", createErr).Error("failed to create user!")
-			fmt.Fprintf(w, "Login failed")
+			logger.WithField("error", createErr).Error("failed to create user!")
+			pages.RenderError(w, r, profile.Pages, pages.CodeServerError, "")
 			return
 		}
 	} else {
-		tykHandlerLogger.Debug("Returned: ", thisUser)
+		logger.Debug("Returned: ", thisUser)
 
 		if thisUser.Email == "" {
 			thisUser.Email = user.Email
@@ -315,31 +491,79 @@ func (t *TykIdentityHandler) CompleteIdentityActionForPortal(w http.ResponseWrit
 		if thisUser.Password == "" {
 			thisUser.Password = newUUID()
 		}
+		t.syncDeveloper(&thisUser, user)
+		inActive = thisUser.InActive
 
 		updateErr := t.API.UpdateDeveloper(t.dashboardUserAPICred, thisUser)
 		if updateErr != nil {
-			tykHandlerLogger.WithField("error", updateErr).Error("Failed to update user!")
-			fmt.Fprintf(w, "Login failed")
+			logger.WithField("error", updateErr).Error("Failed to update user!")
+			pages.RenderError(w, r, profile.Pages, pages.CodeServerError, "")
 			return
 		}
+		email = thisUser.Email
+	}
+	RecordPortalDeveloper(t.Store, t.profile.ID, email)
+
+	if inActive {
+		logger.WithField("user", user.UserID).Warning("Developer is inactive, login refused")
+		pages.RenderError(w, r, profile.Pages, pages.CodeAccessDenied, "")
+		return
 	}
 
 	// After login, we need to redirect this user
-	tykHandlerLogger.Info("--> Running redirect...")
-	if profile.ReturnURL != "" {
-		newURL := profile.ReturnURL + "?nonce=" + nonce
-		tykHandlerLogger.Info("--> URL With NONCE is: ", newURL)
-		http.Redirect(w, r, newURL, 301)
+	logger.Info("--> Running redirect...")
+	if returnURL := tap.ReturnURL(r, profile); returnURL != "" {
+		t.loginSucceeded(w, r, i)
+		t.deliver(w, r, returnURL, []pages.FormField{{Name: "nonce", Value: nonce}}, false)
 		return
 	}
 
-	tykHandlerLogger.Warning("No return URL found, redirect failed.")
-	fmt.Fprintf(w, "Success! (Have you set a return URL?)")
+	logger.Warning("No return URL found, redirect failed.")
+	t.loginSucceeded(w, r, i)
+	pages.RenderSuccess(w, r, profile.Pages, pages.CodeLoginComplete)
 }
 
 func (t *TykIdentityHandler) CompleteIdentityActionForOAuth(w http.ResponseWriter, r *http.Request, i interface{}, _ tap.Profile) {
-	tykHandlerLogger.Info("Starting OAuth Flow...")
+	logger := tykHandlerLogger.WithContext(r.Context())
+	logger.Info("Starting OAuth Flow...")
+
+	resp, failure := t.issueOAuthToken(i)
+	if failure != "" {
+		pages.RenderError(w, r, t.profile.Pages, failure, "")
+		return
+	}
+
+	if t.oauth.NoRedirect {
+		t.loginSucceeded(w, r, i)
+		asJson, jErr := json.Marshal(resp)
+		if jErr != nil {
+			logger.WithField("error", jErr).Error("--> Marshalling failure")
+			w.Write([]byte("Data Failure")) //nolint:errcheck
+		}
+
+		logger.Info("--> No redirect, returning token...")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(asJson) //nolint:errcheck
+		return
+	}
 
+	// After login, we need to redirect this user
+	logger.Info("--> Running oauth redirect...")
+	if resp.RedirectTo != "" {
+		if !t.allowedOAuthRedirect(r, resp.RedirectTo) {
+			pages.RenderError(w, r, t.profile.Pages, pages.CodeInvalidRequest, "")
+			return
+		}
+		logger.Debug("--> URL is: ", resp.RedirectTo)
+		t.loginSucceeded(w, r, i)
+		http.Redirect(w, r, resp.RedirectTo, tap.RedirectStatus(r))
+		return
+	}
+}
+
+// issueOAuthToken generates an OAuth token for a user, replacing the one they already hold for the API, the returned
+// string is the pages code shown to the user when it fails
+func (t *TykIdentityHandler) issueOAuthToken(i interface{}) (*tyk.OAuthResponse, string) {
 	// Generate identity key match ID
 	sso_key := tap.GenerateSSOKey(i.(goth.User))
 	id_with_profile := t.profile.ID + "-" + sso_key
@@ -349,6 +573,12 @@ func (t *TykIdentityHandler) CompleteIdentityActionForOAuth(w http.ResponseWrite
 	tykHandlerLogger.Debug("Store is: ", t.Store)
 	tykHandlerLogger.Debug("ID IS: ", id_with_profile)
 
+	session, sErr := t.sessionState(i.(goth.User), t.oauth.BaseAPIID)
+	if sErr != nil {
+		tykHandlerLogger.WithField("error", sErr).Error("Failed to render session template")
+		return nil, pages.CodeTokenFailed
+	}
+
 	if !t.disableOneTokenPerAPI {
 		fErr := t.Store.GetKey(id_with_profile, "", &value)
 		if fErr == nil {
@@ -363,6 +593,8 @@ func (t *TykIdentityHandler) CompleteIdentityActionForOAuth(w http.ResponseWrite
 				if !isAuthorized {
 					tykHandlerLogger.Error("Unauthorized user. Should exit.")
 				}
+			} else {
+				t.retireToken(value, revokedReplaced)
 			}
 		}
 	}
@@ -372,54 +604,67 @@ func (t *TykIdentityHandler) CompleteIdentityActionForOAuth(w http.ResponseWrite
 		t.oauth.ResponseType,
 		t.oauth.ClientId,
 		t.oauth.Secret,
-		t.profile.OrgID,
-		t.profile.MatchedPolicyID,
-		t.oauth.BaseAPIID,
-		i)
+		session)
 
 	// Redirect request
 	if oErr != nil {
 		tykHandlerLogger.WithField("error", oErr).Error("Failed to generate OAuth token")
-		fmt.Fprintf(w, "OAuth token generation failed")
-		return
+		return nil, pages.CodeTokenFailed
 	}
 
 	if resp == nil {
 		tykHandlerLogger.Error("--> Login failure. Request not allowed")
-		fmt.Fprintf(w, "Login failed")
-		return
+		return nil, pages.CodeAccessDenied
 	}
 
 	if resp.AccessToken != "" {
 		tykHandlerLogger.Warning("--> Storing token reference")
 		t.Store.SetKey(id_with_profile, "", resp.AccessToken)
+		t.trackToken(resp.AccessToken, i.(goth.User), "")
 	}
 
-	if t.oauth.NoRedirect {
-		asJson, jErr := json.Marshal(resp)
-		if jErr != nil {
-			tykHandlerLogger.WithField("error", jErr).Error("--> Marshalling failure")
-			w.Write([]byte("Data Failure")) //nolint:errcheck
-		}
+	return resp, ""
+}
 
-		tykHandlerLogger.Info("--> No redirect, returning token...")
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(asJson) //nolint:errcheck
+func (t *TykIdentityHandler) CompleteIdentityActionForTokenAuth(w http.ResponseWriter, r *http.Request, i interface{}, _ tap.Profile) {
+	logger := tykHandlerLogger.WithContext(r.Context())
+	logger.Info("Starting Token Flow...")
+
+	resp, failure := t.issueTokenAuth(i)
+	if failure != "" {
+		pages.RenderError(w, r, t.profile.Pages, failure, "")
 		return
 	}
 
 	// After login, we need to redirect this user
-	tykHandlerLogger.Info("--> Running oauth redirect...")
-	if resp.RedirectTo != "" {
-		tykHandlerLogger.Debug("--> URL is: ", resp.RedirectTo)
-		http.Redirect(w, r, resp.RedirectTo, 301)
+	if returnURL := tap.ReturnURL(r, t.profile); returnURL != "" {
+		logger.Info("--> Running auth redirect...")
+		t.loginSucceeded(w, r, i)
+		fields := []pages.FormField{{Name: "token", Value: resp.KeyID}}
+		// refresh tokens are long lived, so they are only handed over server to server in the JSON of a code exchange
+		if resp.RefreshToken != "" && t.delivery.Mode == DeliveryCode {
+			fields = append(fields, pages.FormField{Name: "refresh_token", Value: resp.RefreshToken})
+		}
+		t.deliver(w, r, returnURL, fields, true)
 		return
 	}
-}
 
-func (t *TykIdentityHandler) CompleteIdentityActionForTokenAuth(w http.ResponseWriter, r *http.Request, i interface{}, _ tap.Profile) {
-	tykHandlerLogger.Info("Starting Token Flow...")
+	asJson, jErr := json.Marshal(resp)
+	if jErr != nil {
+		logger.WithField("error", jErr).Error("--> Marshalling failure")
+		w.Write([]byte("Data Failure")) //nolint:errcheck
+	}
+
+	logger.Info("--> No redirect, returning token...")
+	t.loginSucceeded(w, r, i)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(asJson) //nolint:errcheck
+	return
+}
 
+// issueTokenAuth generates a Tyk key for a user, replacing the one they already hold for the API, the returned string
+// is the pages code shown to the user when it fails
+func (t *TykIdentityHandler) issueTokenAuth(i interface{}) (*tyk.TokenResponse, string) {
 	// Generate identity key match ID
 	sso_key := tap.GenerateSSOKey(i.(goth.User))
 	id_with_profile := t.profile.ID + "-" + sso_key
@@ -429,6 +674,12 @@ func (t *TykIdentityHandler) CompleteIdentityActionForTokenAuth(w http.ResponseW
 	tykHandlerLogger.Debug("Store is: ", t.Store)
 	tykHandlerLogger.Debug("ID IS: ", id_with_profile)
 
+	session, sErr := t.sessionState(i.(goth.User), t.token.BaseAPIID)
+	if sErr != nil {
+		tykHandlerLogger.WithField("error", sErr).Error("Failed to render session template")
+		return nil, pages.CodeTokenFailed
+	}
+
 	if !t.disableOneTokenPerAPI {
 		fErr := t.Store.GetKey(id_with_profile, "", &value)
 		if fErr == nil {
@@ -442,62 +693,58 @@ func (t *TykIdentityHandler) CompleteIdentityActionForTokenAuth(w http.ResponseW
 				//TODO: The other action to auth token is calling the gateway. why they are not the same?
 				if !isAuthorized {
 					tykHandlerLogger.Error("Unauthorized user. Should exit.")
-					fmt.Fprintf(w, "Auth token generation failed due to invalid user credentials.")
-					return
+					return nil, pages.CodeTokenFailed
 				}
+			} else {
+				t.retireToken(value, revokedReplaced)
 			}
 		}
 	}
 
 	// Generate Token
-	resp, tErr := t.API.RequestStandardToken(t.profile.OrgID,
-		t.profile.MatchedPolicyID,
-		t.token.BaseAPIID,
+	resp, tErr := t.API.RequestStandardToken(session,
 		t.dashboardUserAPICred,
-		t.token.Expires,
-		i)
+		t.token.Expires)
 
 	if tErr != nil {
 		tykHandlerLogger.WithField("error", tErr).Error("Failed to generate Auth token")
-		fmt.Fprintf(w, "Auth token generation failed")
-		return
+		return nil, pages.CodeTokenFailed
 	}
 
 	if resp == nil {
 		tykHandlerLogger.Error("--> Login failure. Request not allowed")
-		fmt.Fprintf(w, "Login failed")
-		return
+		return nil, pages.CodeAccessDenied
 	}
 
 	if resp.KeyID != "" {
 		tykHandlerLogger.Warning("--> Storing token reference")
 		t.Store.SetKey(id_with_profile, "", resp.KeyID)
-	}
-
-	// After login, we need to redirect this user
-	if t.profile.ReturnURL != "" {
-		tykHandlerLogger.Info("--> Running auth redirect...")
-		cleanURL := t.profile.ReturnURL + "#token=" + resp.KeyID
-		tykHandlerLogger.Debug("--> URL is: ", cleanURL)
-		http.Redirect(w, r, cleanURL, 301)
-		return
-	}
 
-	asJson, jErr := json.Marshal(resp)
-	if jErr != nil {
-		tykHandlerLogger.WithField("error", jErr).Error("--> Marshalling failure")
-		w.Write([]byte("Data Failure")) //nolint:errcheck
+		refreshFamilyID := ""
+		if t.token.EnableRefreshToken {
+			refreshFamilyID = newUUID()
+			refreshToken, rErr := t.issueRefreshToken(refreshFamilyID, resp.KeyID, i.(goth.User))
+			if rErr != nil {
+				tykHandlerLogger.WithField("error", rErr).Error("Failed to issue refresh token")
+				refreshFamilyID = ""
+			} else {
+				resp.RefreshToken = refreshToken
+			}
+		}
+		t.trackToken(resp.KeyID, i.(goth.User), refreshFamilyID)
 	}
 
-	tykHandlerLogger.Info("--> No redirect, returning token...")
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(asJson) //nolint:errcheck
-	return
+	return resp, ""
 }
 
 // CompleteIdentityAction will log a user into Tyk dashboard or Tyk portal
 func (t *TykIdentityHandler) CompleteIdentityAction(w http.ResponseWriter, r *http.Request, i interface{}, profile tap.Profile) {
-	tykHandlerLogger.Debug("Completing Identity Action")
+	tykHandlerLogger.WithContext(r.Context()).Debug("Completing Identity Action")
+	if userCode := t.deviceUserCode(r); userCode != "" {
+		t.CompleteIdentityActionForDevice(w, r, i, userCode)
+		return
+	}
+
 	if profile.ActionType == tap.GenerateOrLoginUserProfile {
 		t.CompleteIdentityActionForDashboard(w, r, i, profile)
 		return
@@ -510,6 +757,9 @@ func (t *TykIdentityHandler) CompleteIdentityAction(w http.ResponseWriter, r *ht
 	} else if profile.ActionType == tap.GenerateTemporaryAuthToken {
 		t.CompleteIdentityActionForTokenAuth(w, r, i, profile)
 		return
+	} else if profile.ActionType == tap.GenerateOrLoginEnterprisePortalUser {
+		t.CompleteIdentityActionForEnterprisePortal(w, r, i, profile)
+		return
 	}
 }
 
@@ -549,6 +799,38 @@ func defaultOrEmptyGroupIDs(DefaultUserGroup string) []string {
 	return []string{DefaultUserGroup}
 }
 
+// GetPolicyIDs returns the policies to apply to a token, mapped from the user's groups through policyMapping. When
+// no group has a mapping the matched policy of the profile is used.
+func GetPolicyIDs(gUser goth.User, CustomUserGroupField string, policyMapping map[string][]string, userGroupSeparator string, matchedPolicyID string) []string {
+	var policyIDs []string
+
+	if CustomUserGroupField != "" && len(policyMapping) > 0 {
+		rawGroups, exists := gUser.RawData[CustomUserGroupField]
+		if exists && rawGroups != nil {
+			seen := map[string]bool{}
+			for _, group := range groupsStringer(rawGroups, userGroupSeparator) {
+				for _, pid := range policyMapping[group] {
+					if !seen[pid] {
+						seen[pid] = true
+						policyIDs = append(policyIDs, pid)
+					}
+				}
+			}
+		}
+	}
+
+	if len(policyIDs) == 0 && matchedPolicyID != "" {
+		return []string{matchedPolicyID}
+	}
+
+	return policyIDs
+}
+
+// policyIDs returns the policies the profile applies to tokens generated for a user
+func (t *TykIdentityHandler) policyIDs(gUser goth.User) []string {
+	return GetPolicyIDs(gUser, t.profile.CustomUserGroupField, t.profile.PolicyMapping, t.profile.UserGroupSeparator, t.profile.MatchedPolicyID)
+}
+
 func GetGroupId(gUser goth.User, CustomUserGroupField, DefaultUserGroup string, userGroupMapping map[string]string, userGroupSeparator string) []string {
 	if CustomUserGroupField == "" {
 		return defaultOrEmptyGroupIDs(DefaultUserGroup)
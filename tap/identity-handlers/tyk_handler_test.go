@@ -234,6 +234,82 @@ func TestGetGroupId(t *testing.T) {
 	}
 }
 
+func TestGetPolicyIDs(t *testing.T) {
+	policyMapping := map[string][]string{
+		"devs":   {"devs-policy"},
+		"admins": {"admins-policy", "devs-policy"},
+	}
+
+	cases := []struct {
+		TestName           string
+		CustomGroupIDField string
+		PolicyMapping      map[string][]string
+		UserGroupSeparator string
+		MatchedPolicyID    string
+		user               goth.User
+		ExpectedPolicyIDs  []string
+	}{
+		{
+			TestName:          "No mapping, matched policy is used",
+			MatchedPolicyID:   "matched-policy",
+			user:              goth.User{},
+			ExpectedPolicyIDs: []string{"matched-policy"},
+		},
+		{
+			TestName:           "No mapping and no matched policy",
+			CustomGroupIDField: "memberOf",
+			user:               goth.User{RawData: map[string]interface{}{"memberOf": "devs"}},
+			ExpectedPolicyIDs:  nil,
+		},
+		{
+			TestName:           "Single group",
+			CustomGroupIDField: "memberOf",
+			PolicyMapping:      policyMapping,
+			MatchedPolicyID:    "matched-policy",
+			user:               goth.User{RawData: map[string]interface{}{"memberOf": "devs"}},
+			ExpectedPolicyIDs:  []string{"devs-policy"},
+		},
+		{
+			TestName:           "Multiple groups are merged without duplicates",
+			CustomGroupIDField: "memberOf",
+			PolicyMapping:      policyMapping,
+			user:               goth.User{RawData: map[string]interface{}{"memberOf": []interface{}{"admins", "devs"}}},
+			ExpectedPolicyIDs:  []string{"admins-policy", "devs-policy"},
+		},
+		{
+			TestName:           "Groups with separator",
+			CustomGroupIDField: "memberOf",
+			PolicyMapping:      policyMapping,
+			UserGroupSeparator: ",",
+			user:               goth.User{RawData: map[string]interface{}{"memberOf": "devs,admins"}},
+			ExpectedPolicyIDs:  []string{"devs-policy", "admins-policy"},
+		},
+		{
+			TestName:           "Unmapped groups fall back to matched policy",
+			CustomGroupIDField: "memberOf",
+			PolicyMapping:      policyMapping,
+			MatchedPolicyID:    "matched-policy",
+			user:               goth.User{RawData: map[string]interface{}{"memberOf": "guests"}},
+			ExpectedPolicyIDs:  []string{"matched-policy"},
+		},
+		{
+			TestName:           "Group field missing falls back to matched policy",
+			CustomGroupIDField: "memberOf",
+			PolicyMapping:      policyMapping,
+			MatchedPolicyID:    "matched-policy",
+			user:               goth.User{RawData: map[string]interface{}{}},
+			ExpectedPolicyIDs:  []string{"matched-policy"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.TestName, func(t *testing.T) {
+			ids := GetPolicyIDs(tc.user, tc.CustomGroupIDField, tc.PolicyMapping, tc.UserGroupSeparator, tc.MatchedPolicyID)
+			assert.Equal(t, tc.ExpectedPolicyIDs, ids)
+		})
+	}
+}
+
 func Test_defaultOrEmptyGroupIDs(t *testing.T) {
 	tests := []struct {
 		name             string
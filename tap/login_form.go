@@ -0,0 +1,10 @@
+package tap
+
+// LoginFormConfig themes the login form TIB serves for passthrough providers at /auth/{id}/login
+type LoginFormConfig struct {
+	Title         string `bson:"Title" json:"Title"`
+	LogoURL       string `bson:"LogoURL" json:"LogoURL"`
+	StylesheetURL string `bson:"StylesheetURL" json:"StylesheetURL"`
+	// Template is the path of an html/template file that replaces the built-in form
+	Template string `bson:"Template" json:"Template"`
+}
@@ -0,0 +1,49 @@
+package tap
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// PagesConfig replaces the built-in error, result and device verification pages TIB shows to browsers with
+// html/template files
+type PagesConfig struct {
+	ErrorTemplate   string `bson:"ErrorTemplate" json:"ErrorTemplate"`
+	SuccessTemplate string `bson:"SuccessTemplate" json:"SuccessTemplate"`
+	DeviceTemplate  string `bson:"DeviceTemplate" json:"DeviceTemplate"`
+}
+
+// ValidTemplatePath checks the path of a template file set on a profile. Paths are relative to the TemplateDir of
+// the configuration and can't leave it, so that whoever writes profiles can't read other files of the server.
+func ValidTemplatePath(path string) error {
+	if path == "" {
+		return nil
+	}
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") || strings.HasPrefix(path, `\`) {
+		return errors.New("template " + path + " must be relative to the template directory")
+	}
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return errors.New("template " + path + " can't leave the template directory")
+		}
+	}
+	return nil
+}
+
+// ValidateTemplates checks the paths of the template files of a profile
+func (p Profile) ValidateTemplates() error {
+	if p.LoginForm != nil {
+		if err := ValidTemplatePath(p.LoginForm.Template); err != nil {
+			return err
+		}
+	}
+	if p.Pages != nil {
+		for _, path := range []string{p.Pages.ErrorTemplate, p.Pages.SuccessTemplate, p.Pages.DeviceTemplate} {
+			if err := ValidTemplatePath(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package tap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTemplates(t *testing.T) {
+	valid := []string{"", "login.html", "acme/login.html", "./acme/login.html", "login..html"}
+	for _, path := range valid {
+		assert.NoError(t, ValidTemplatePath(path), path)
+	}
+
+	invalid := []string{"/etc/passwd", "../tib.conf", "acme/../../tib.conf", `..\tib.conf`, `\etc\passwd`}
+	for _, path := range invalid {
+		assert.Error(t, ValidTemplatePath(path), path)
+	}
+
+	assert.NoError(t, Profile{LoginForm: &LoginFormConfig{Template: "login.html"}}.ValidateTemplates())
+	assert.Error(t, Profile{LoginForm: &LoginFormConfig{Template: "/etc/passwd"}}.ValidateTemplates())
+	assert.NoError(t, Profile{Pages: &PagesConfig{ErrorTemplate: "error.html", SuccessTemplate: "success.html"}}.ValidateTemplates())
+	assert.Error(t, Profile{Pages: &PagesConfig{ErrorTemplate: "error.html", SuccessTemplate: "../success.html"}}.ValidateTemplates())
+	assert.Error(t, Profile{Pages: &PagesConfig{DeviceTemplate: "/etc/passwd"}}.ValidateTemplates())
+}
@@ -35,7 +35,22 @@ type Profile struct {
 	CustomUserGroupField      string                 `bson:"CustomUserGroupField" json:"CustomUserGroupField"`
 	UserGroupMapping          map[string]string      `bson:"UserGroupMapping" json:"UserGroupMapping"`
 	UserGroupSeparator        string                 `bson:"UserGroupSeparator" json:"UserGroupSeparator"`
+	PolicyMapping             map[string][]string    `bson:"PolicyMapping" json:"PolicyMapping"`
+	PermissionsMapping        map[string]Permissions `bson:"PermissionsMapping" json:"PermissionsMapping"`
+	CustomOrgIDField          string                 `bson:"CustomOrgIDField" json:"CustomOrgIDField"`
+	OrgIDMapping              map[string]string      `bson:"OrgIDMapping" json:"OrgIDMapping"`
 	SSOOnlyForRegisteredUsers bool                   `bson:"SSOOnlyForRegisteredUsers" json:"SSOOnlyForRegisteredUsers"`
+	LogoutURL                 string                 `bson:"LogoutURL" json:"LogoutURL"`
+	SessionTemplate           *SessionTemplate       `bson:"SessionTemplate" json:"SessionTemplate"`
+	MetaDataClaims            []string               `bson:"MetaDataClaims" json:"MetaDataClaims"`
+	OmitUpstreamTokens        bool                   `bson:"OmitUpstreamTokens" json:"OmitUpstreamTokens"`
+	Deprovisioning            *DeprovisioningConfig  `bson:"Deprovisioning" json:"Deprovisioning"`
+	SCIM                      *SCIMServerConfig      `bson:"SCIM" json:"SCIM"`
+	LoginForm                 *LoginFormConfig       `bson:"LoginForm" json:"LoginForm"`
+	Pages                     *PagesConfig           `bson:"Pages" json:"Pages"`
+	DiscoveryDomains          []string               `bson:"DiscoveryDomains" json:"DiscoveryDomains"`
+	Hosts                     []string               `bson:"Hosts" json:"Hosts"`
+	AllowedReturnURLs         []string               `bson:"AllowedReturnURLs" json:"AllowedReturnURLs"`
 }
 
 func (p Profile) SetObjectID(id model.ObjectID) {
@@ -49,6 +64,9 @@ func (p Profile) GetObjectID() model.ObjectID {
 	return ""
 }
 
+// Permissions maps Dashboard objects (e.g. "apis", "keys", "policies") to "read", "write" or "deny"
+type Permissions map[string]string
+
 // ProfileConstraint Certain providers can have constraints, this object sets out those constraints. E.g. Domain: "tyk.io" will limit
 // social logins to only those with a tyk.io domain name
 type ProfileConstraint struct {
@@ -9,6 +9,15 @@ import (
 
 var log = logger.Get()
 
+// Validate checks the settings of a profile that could be used against users or the server, it is called before a
+// profile is saved and when profiles are loaded
+func (p Profile) Validate() error {
+	if err := p.ValidateRedirects(); err != nil {
+		return err
+	}
+	return p.ValidateTemplates()
+}
+
 type HttpError struct {
 	Message string
 	Code    int
@@ -16,6 +25,14 @@ type HttpError struct {
 }
 
 func AddProfile(profile Profile, AuthConfigStore AuthRegisterBackend, flush func(backend AuthRegisterBackend) error) *HttpError {
+	if err := profile.Validate(); err != nil {
+		return &HttpError{
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+			Error:   err,
+		}
+	}
+
 	dumpProfile := Profile{}
 	keyErr := AuthConfigStore.GetKey(profile.ID, profile.OrgID, &dumpProfile)
 	if keyErr == nil && dumpProfile.ID != "" {
@@ -58,6 +75,14 @@ func UpdateProfile(key string, profile Profile, AuthConfigStore AuthRegisterBack
 		}
 	}
 
+	if err := profile.Validate(); err != nil {
+		return &HttpError{
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+			Error:   err,
+		}
+	}
+
 	dumpProfile := Profile{}
 	keyErr := AuthConfigStore.GetKey(key, profile.OrgID, &dumpProfile)
 	if keyErr != nil {
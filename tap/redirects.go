@@ -0,0 +1,210 @@
+package tap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ReturnToParam is the query parameter that asks for a login to return somewhere other than the profile's ReturnURL
+const ReturnToParam = "return_to"
+
+// SecurityLogTag prefixes security events, e.g. a rejected redirect
+const SecurityLogTag = "SECURITY"
+
+var (
+	ErrReturnURLNotAllowed = errors.New("return URL is not allowed for this profile")
+	ErrInvalidRedirectURL  = errors.New("redirect URL must be an absolute URL or a path on this host")
+)
+
+// unsafeSchemes can run code or read local data when a browser is redirected to them
+var unsafeSchemes = map[string]bool{"javascript": true, "data": true, "vbscript": true, "file": true}
+
+type returnURLKey struct{}
+
+// WithReturnURL returns a request whose login returns to returnURL instead of the profile's ReturnURL, returnURL must
+// have been checked with CheckReturnTo
+func WithReturnURL(r *http.Request, returnURL string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), returnURLKey{}, returnURL))
+}
+
+// ReturnURL returns where a completed login of the request is sent, the return_to of the login or else the
+// profile's ReturnURL
+func ReturnURL(r *http.Request, profile Profile) string {
+	if r != nil {
+		if returnURL, ok := r.Context().Value(returnURLKey{}).(string); ok && returnURL != "" {
+			return returnURL
+		}
+	}
+	return profile.ReturnURL
+}
+
+// RedirectStatus is the status of the redirects that move a login along. It is 303 after a POST (e.g. the SAML ACS
+// or the login form) so that browsers follow it with a GET, and 302 otherwise. A 301 is never used because browsers
+// cache it.
+func RedirectStatus(r *http.Request) int {
+	if r != nil && r.Method == http.MethodPost {
+		return http.StatusSeeOther
+	}
+	return http.StatusFound
+}
+
+// CheckReturnTo checks a return_to asked for by a login against the AllowedReturnURLs of the profile, a rejected
+// URL is logged as a security event
+func CheckReturnTo(profile Profile, returnTo string, r *http.Request) error {
+	if MatchesReturnURL(profile.AllowedReturnURLs, returnTo) {
+		return nil
+	}
+
+	LogSecurityEvent("redirect_rejected", r, logrus.Fields{
+		"profile":   profile.ID,
+		"return_to": returnTo,
+	})
+	return ErrReturnURLNotAllowed
+}
+
+// LogSecurityEvent logs an event that may be an attack on the broker
+func LogSecurityEvent(event string, r *http.Request, fields logrus.Fields) {
+	entry := log.WithField("prefix", SecurityLogTag).WithField("event", event).WithFields(fields)
+	if r != nil {
+		entry = entry.WithField("remote_addr", r.RemoteAddr)
+	}
+	entry.Warning("Security event")
+}
+
+// MatchesReturnURL reports whether candidate matches one of patterns. A pattern is an absolute URL whose host may
+// start with *. to match any subdomain, and whose path may end with * to match any path under it. The query and
+// fragment of candidate are not checked.
+func MatchesReturnURL(patterns []string, candidate string) bool {
+	target, err := parseRedirectURL(candidate)
+	if err != nil || hasDotSegment(target.Path) {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		allowed, err := parseRedirectURL(pattern)
+		if err != nil {
+			continue
+		}
+		if !strings.EqualFold(allowed.Scheme, target.Scheme) || !matchesHost(allowed.Host, target.Host) {
+			continue
+		}
+		if matchesPath(allowed.Path, target.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRedirects checks the redirect URLs of a profile, it is called before a profile is saved and when profiles
+// are loaded. The browser redirects of the profile may be paths on the host of TIB, the OAuth RedirectURI is
+// sent to the Gateway and has to be absolute.
+func (p Profile) ValidateRedirects() error {
+	redirects := [][2]string{
+		{"ReturnURL", p.ReturnURL},
+		{"LogoutURL", p.LogoutURL},
+	}
+	if providerConfig, ok := p.ProviderConfig.(map[string]interface{}); ok {
+		if failureRedirect, ok := providerConfig["FailureRedirect"].(string); ok {
+			redirects = append(redirects, [2]string{"ProviderConfig.FailureRedirect", failureRedirect})
+		}
+	}
+	for _, field := range redirects {
+		if field[1] == "" || isLocalPath(field[1]) {
+			continue
+		}
+		if _, err := parseRedirectURL(field[1]); err != nil {
+			return fmt.Errorf("%s: %v", field[0], ErrInvalidRedirectURL)
+		}
+	}
+
+	if oauth, ok := p.IdentityHandlerConfig["OAuth"].(map[string]interface{}); ok {
+		if redirectURI, ok := oauth["RedirectURI"].(string); ok && redirectURI != "" {
+			if _, err := parseRedirectURL(redirectURI); err != nil {
+				return fmt.Errorf("IdentityHandlerConfig.OAuth.RedirectURI: %v", ErrInvalidRedirectURL)
+			}
+		}
+	}
+
+	for _, pattern := range p.AllowedReturnURLs {
+		if err := validateReturnURLPattern(pattern); err != nil {
+			return fmt.Errorf("AllowedReturnURLs: %q %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func validateReturnURLPattern(pattern string) error {
+	allowed, err := parseRedirectURL(pattern)
+	if err != nil {
+		return err
+	}
+
+	host := strings.TrimPrefix(allowed.Host, "*.")
+	path := strings.TrimSuffix(allowed.Path, "*")
+	if strings.Contains(host, "*") || strings.Contains(path, "*") || allowed.RawQuery != "" || allowed.Fragment != "" {
+		return errors.New("may only have a * at the start of the host or the end of the path, and no query or fragment")
+	}
+	return nil
+}
+
+// isLocalPath reports whether raw is a path on the host of TIB, e.g. /portal/. Paths starting with // or /\ are
+// not, browsers read them as another host.
+func isLocalPath(raw string) bool {
+	if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") || strings.ContainsAny(raw, "\\ \t\r\n") {
+		return false
+	}
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "" && u.Host == "" && u.User == nil
+}
+
+// parseRedirectURL parses an absolute URL that is safe to redirect a browser to
+func parseRedirectURL(raw string) (*url.URL, error) {
+	if strings.ContainsAny(raw, "\\ \t\r\n") {
+		return nil, ErrInvalidRedirectURL
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "" || unsafeSchemes[scheme] || u.User != nil || u.Opaque != "" {
+		return nil, ErrInvalidRedirectURL
+	}
+	if (scheme == "http" || scheme == "https") && u.Host == "" {
+		return nil, ErrInvalidRedirectURL
+	}
+	return u, nil
+}
+
+func matchesHost(pattern string, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return pattern == host
+}
+
+func matchesPath(pattern string, path string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(pattern, "*"))
+	}
+	return strings.TrimSuffix(pattern, "/") == strings.TrimSuffix(path, "/")
+}
+
+// hasDotSegment reports whether a path has . or .. segments, which browsers resolve before following a redirect
+func hasDotSegment(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
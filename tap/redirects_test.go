@@ -0,0 +1,96 @@
+package tap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesReturnURL(t *testing.T) {
+	patterns := []string{
+		"https://app.example.com/dashboard",
+		"https://*.tenants.example.com/*",
+		"https://portal.example.com:8443/docs/*",
+		"myapp://callback",
+	}
+
+	tests := map[string]bool{
+		"https://app.example.com/dashboard":             true,
+		"https://app.example.com/dashboard/":            true,
+		"https://APP.example.com/dashboard?tab=keys":    true,
+		"https://app.example.com/dashboard/other":       false,
+		"http://app.example.com/dashboard":              false,
+		"https://acme.tenants.example.com/any/path":     true,
+		"https://tenants.example.com/any/path":          false,
+		"https://acme.tenants.example.com.evil.com/":    false,
+		"https://portal.example.com:8443/docs/api":      true,
+		"https://portal.example.com/docs/api":           false,
+		"https://portal.example.com:8443/docs/../admin": false,
+		"https://portal.example.com:8443/docs/%2e%2e/x": false,
+		"https://app.example.com@evil.com/dashboard":    false,
+		"https://app.example.com\\@evil.com/dashboard":  false,
+		"//evil.com/dashboard":                          false,
+		"/dashboard":                                    false,
+		"javascript:alert(document.cookie)":             false,
+		"myapp://callback?code=1":                       true,
+		"":                                              false,
+	}
+
+	for candidate, want := range tests {
+		assert.Equal(t, want, MatchesReturnURL(patterns, candidate), candidate)
+	}
+	assert.False(t, MatchesReturnURL(nil, "https://app.example.com/dashboard"))
+}
+
+func TestCheckReturnTo(t *testing.T) {
+	profile := Profile{ID: "1", AllowedReturnURLs: []string{"https://app.example.com/*"}}
+	r := httptest.NewRequest(http.MethodGet, "/auth/1/openid-connect", nil)
+
+	assert.NoError(t, CheckReturnTo(profile, "https://app.example.com/reports", r))
+	assert.Equal(t, ErrReturnURLNotAllowed, CheckReturnTo(profile, "https://evil.com/", r))
+
+	assert.Equal(t, "", ReturnURL(r, profile))
+	profile.ReturnURL = "https://app.example.com/"
+	assert.Equal(t, "https://app.example.com/", ReturnURL(r, profile))
+	assert.Equal(t, "https://app.example.com/reports", ReturnURL(WithReturnURL(r, "https://app.example.com/reports"), profile))
+}
+
+func TestValidateRedirects(t *testing.T) {
+	valid := Profile{
+		ReturnURL:         "http://dashboard:3000/tap",
+		LogoutURL:         "https://idp.example.com/logout",
+		AllowedReturnURLs: []string{"https://*.example.com/*", "myapp://callback"},
+		ProviderConfig:    map[string]interface{}{"FailureRedirect": "http://dashboard:3000/?fail=true"},
+		IdentityHandlerConfig: map[string]interface{}{
+			"OAuth": map[string]interface{}{"RedirectURI": "https://app.example.com/callback"},
+		},
+	}
+	assert.NoError(t, valid.ValidateRedirects())
+	assert.NoError(t, Profile{}.ValidateRedirects())
+
+	// browser redirects may stay on the host of TIB
+	relative := Profile{
+		ReturnURL:      "/portal/sso",
+		LogoutURL:      "/",
+		ProviderConfig: map[string]interface{}{"FailureRedirect": "/?fail=true"},
+	}
+	assert.NoError(t, relative.ValidateRedirects())
+
+	invalid := map[string]Profile{
+		"ReturnURL":         {ReturnURL: "portal/sso"},
+		"ReturnURL host":    {ReturnURL: "//evil.com/"},
+		"ReturnURL slash":   {ReturnURL: "/\\evil.com/"},
+		"OAuth relative":    {IdentityHandlerConfig: map[string]interface{}{"OAuth": map[string]interface{}{"RedirectURI": "/callback"}}},
+		"LogoutURL":         {LogoutURL: "javascript:alert(1)"},
+		"FailureRedirect":   {ProviderConfig: map[string]interface{}{"FailureRedirect": "https://user@evil.com"}},
+		"OAuth RedirectURI": {IdentityHandlerConfig: map[string]interface{}{"OAuth": map[string]interface{}{"RedirectURI": "//evil.com"}}},
+		"pattern host":      {AllowedReturnURLs: []string{"https://app.*.com/"}},
+		"pattern path":      {AllowedReturnURLs: []string{"https://app.example.com/*/admin"}},
+		"pattern query":     {AllowedReturnURLs: []string{"https://app.example.com/?a=*"}},
+	}
+	for name, profile := range invalid {
+		assert.Error(t, profile.ValidateRedirects(), name)
+	}
+}
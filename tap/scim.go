@@ -0,0 +1,11 @@
+package tap
+
+// SCIMServerConfig enables the SCIM 2.0 endpoints of a profile, through which an identity provider pushes the
+// users and groups of the Dashboard users or portal developers the profile logs in
+type SCIMServerConfig struct {
+	Enabled bool `bson:"Enabled" json:"Enabled"`
+	// Token is the bearer token the identity provider authenticates with
+	Token string `bson:"Token" json:"Token"`
+	// RevokeTokenProfiles lists the token profiles whose tokens are revoked for deactivated and deleted users
+	RevokeTokenProfiles []string `bson:"RevokeTokenProfiles" json:"RevokeTokenProfiles"`
+}
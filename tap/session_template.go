@@ -0,0 +1,21 @@
+package tap
+
+// SessionTemplate describes the Tyk session of the keys and OAuth tokens generated by a profile. Tags and MetaData
+// values are Go templates that are rendered with the identity of the user the token is generated for.
+type SessionTemplate struct {
+	AccessRights     []SessionAccessRight `bson:"AccessRights" json:"AccessRights"`
+	Rate             float64              `bson:"Rate" json:"Rate"`
+	Per              float64              `bson:"Per" json:"Per"`
+	QuotaMax         int64                `bson:"QuotaMax" json:"QuotaMax"`
+	QuotaRenewalRate int64                `bson:"QuotaRenewalRate" json:"QuotaRenewalRate"`
+	Tags             []string             `bson:"Tags" json:"Tags"`
+	MetaData         map[string]string    `bson:"MetaData" json:"MetaData"`
+}
+
+// SessionAccessRight grants access to the listed versions of an API, all tokens get access to "Default" when no
+// version is set
+type SessionAccessRight struct {
+	APIID    string   `bson:"APIID" json:"APIID"`
+	APIName  string   `bson:"APIName" json:"APIName"`
+	Versions []string `bson:"Versions" json:"Versions"`
+}
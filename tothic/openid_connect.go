@@ -0,0 +1,96 @@
+package tothic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/openidConnect"
+	"golang.org/x/oauth2"
+)
+
+// pkceProvider is a provider whose code exchange sends the PKCE code_verifier of the login
+type pkceProvider interface {
+	goth.Provider
+	AuthorizeWithVerifier(ctx context.Context, sess goth.Session, code string, verifier string) error
+}
+
+// OpenIDConnectProvider is a goth OpenID Connect provider whose logins use PKCE (RFC 7636). goth doesn't send a
+// code_verifier when it exchanges the code, so the exchange is done here against the token endpoint of the
+// discovery document.
+type OpenIDConnectProvider struct {
+	*openidConnect.Provider
+	config oauth2.Config
+}
+
+// NewOpenIDConnectProvider wraps a provider created with openidConnect.New from discoverURL
+func NewOpenIDConnectProvider(provider *openidConnect.Provider, discoverURL string) (*OpenIDConnectProvider, error) {
+	resp, err := provider.Client().Get(discoverURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("OpenID Connect discovery failed with " + resp.Status)
+	}
+
+	discovery := struct {
+		AuthEndpoint  string `json:"authorization_endpoint"`
+		TokenEndpoint string `json:"token_endpoint"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, err
+	}
+	if discovery.TokenEndpoint == "" {
+		return nil, errors.New("OpenID Connect discovery has no token_endpoint")
+	}
+
+	return &OpenIDConnectProvider{
+		Provider: provider,
+		config: oauth2.Config{
+			ClientID:     provider.ClientKey,
+			ClientSecret: provider.Secret,
+			RedirectURL:  provider.CallbackURL,
+			Endpoint:     oauth2.Endpoint{AuthURL: discovery.AuthEndpoint, TokenURL: discovery.TokenEndpoint},
+		},
+	}, nil
+}
+
+// AuthorizeWithVerifier exchanges the code of a login with its code_verifier and keeps the tokens in sess, like the
+// Authorize of the goth session does
+func (p *OpenIDConnectProvider) AuthorizeWithVerifier(ctx context.Context, sess goth.Session, code string, verifier string) error {
+	oidcSession, ok := sess.(*openidConnect.Session)
+	if !ok {
+		return errors.New("not an OpenID Connect session")
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.Client())
+	token, err := p.config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return err
+	}
+	if !token.Valid() {
+		return errors.New("invalid token received from provider")
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return errors.New("no id_token received from provider")
+	}
+
+	oidcSession.AccessToken = token.AccessToken
+	oidcSession.RefreshToken = token.RefreshToken
+	oidcSession.ExpiresAt = token.Expiry
+	oidcSession.IDToken = idToken
+	return nil
+}
+
+// isOpenIDConnect reports whether a provider logs users in with OpenID Connect, whose logins get a nonce
+func isOpenIDConnect(provider goth.Provider) bool {
+	switch provider.(type) {
+	case *openidConnect.Provider, *OpenIDConnectProvider:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package tothic
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+const (
+	// CookieSessionStore keeps sessions in a signed cookie, it is the default
+	CookieSessionStore = "cookie"
+	// RedisSessionStore keeps sessions in the identity backend, the cookie only holds their ID
+	RedisSessionStore = "redis"
+
+	DefaultSessionMaxAge = 3600
+
+	// sessionKeyPrefix is the prefix of the sessions kept by RedisStore
+	sessionKeyPrefix = "session-"
+)
+
+var ErrNoSessionSecret = errors.New("TYK_IB_SESSION_SECRET must be set to sign sessions")
+
+// SessionSettings configure the session that follows a login from its start to its callback
+type SessionSettings struct {
+	// Store is where sessions are kept, CookieSessionStore or RedisSessionStore
+	Store string
+	// PreviousSecrets are session secrets that have been rotated out, sessions they signed are still accepted
+	PreviousSecrets []string
+	// MaxAge is the lifetime in seconds of sessions
+	MaxAge   int
+	Domain   string
+	Secure   bool
+	SameSite string
+}
+
+// SetupSessionStore sets Store up from the settings and TYK_IB_SESSION_SECRET, backend keeps the sessions of a
+// RedisSessionStore
+func SetupSessionStore(settings SessionSettings, backend tap.AuthRegisterBackend) error {
+	key := KeyFromEnv()
+	if key == "" {
+		return ErrNoSessionSecret
+	}
+
+	// sessions are signed with the current secret, and checked against the previous ones too
+	keyPairs := [][]byte{[]byte(key), nil}
+	for _, previous := range settings.PreviousSecrets {
+		if previous != "" {
+			keyPairs = append(keyPairs, []byte(previous), nil)
+		}
+	}
+
+	if settings.MaxAge == 0 {
+		settings.MaxAge = DefaultSessionMaxAge
+	}
+	options := &sessions.Options{
+		Path:     "/",
+		Domain:   settings.Domain,
+		MaxAge:   settings.MaxAge,
+		Secure:   settings.Secure,
+		HttpOnly: true,
+		SameSite: sameSiteMode(settings.SameSite),
+	}
+
+	switch settings.Store {
+	case "", CookieSessionStore:
+		cookieStore := sessions.NewCookieStore(keyPairs...)
+		cookieStore.Options = options
+		cookieStore.MaxAge(settings.MaxAge)
+		Store = cookieStore
+	case RedisSessionStore:
+		if backend == nil {
+			return errors.New("the redis session store needs a backend")
+		}
+		redisStore := NewRedisStore(backend, keyPairs...)
+		redisStore.Options = options
+		redisStore.MaxAge(settings.MaxAge)
+		Store = redisStore
+	default:
+		return errors.New("unknown session store " + settings.Store)
+	}
+	return nil
+}
+
+func sameSiteMode(sameSite string) http.SameSite {
+	switch strings.ToLower(sameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+// RedisStore is a sessions.Store that keeps sessions server side, so that large provider sessions don't overflow
+// the cookie limits of browsers. The cookie only holds the signed ID of the session.
+type RedisStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	backend tap.AuthRegisterBackend
+}
+
+// NewRedisStore returns a RedisStore that keeps sessions in backend, see sessions.NewCookieStore for keyPairs
+func NewRedisStore(backend tap.AuthRegisterBackend, keyPairs ...[]byte) *RedisStore {
+	return &RedisStore{
+		Codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{Path: "/", MaxAge: DefaultSessionMaxAge, HttpOnly: true},
+		backend: backend,
+	}
+}
+
+// Get returns the session of the request, it is only loaded once per request
+func (s *RedisStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session of the request, it returns a new session when there is none or it has expired
+func (s *RedisStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	data := []byte{}
+	if err := tap.WithContext(r.Context(), s.backend).GetKey(sessionKeyPrefix+session.ID, "", &data); err != nil {
+		// expired sessions start over under a new ID, so that an ID known to someone else can't be revived
+		session.ID = ""
+		return session, nil
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session and sets its cookie, a session with a negative MaxAge is deleted
+func (s *RedisStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := tap.WithContext(r.Context(), s.backend).DeleteKey(sessionKeyPrefix+session.ID, ""); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		id, err := randomString()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := tap.SetKeyWithTTL(tap.WithContext(r.Context(), s.backend), sessionKeyPrefix+session.ID, "", data, ttl); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// MaxAge sets the lifetime of the sessions and of their cookies
+func (s *RedisStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package tothic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupSessionStore(t *testing.T) {
+	defer os.Unsetenv("TYK_IB_SESSION_SECRET")
+	os.Unsetenv("SESSION_SECRET")
+
+	os.Setenv("TYK_IB_SESSION_SECRET", "")
+	assert.Equal(t, ErrNoSessionSecret, SetupSessionStore(SessionSettings{}, nil))
+
+	os.Setenv("TYK_IB_SESSION_SECRET", "secret")
+	assert.NoError(t, SetupSessionStore(SessionSettings{}, nil))
+	cookieStore, ok := Store.(*sessions.CookieStore)
+	if assert.True(t, ok) {
+		assert.Equal(t, DefaultSessionMaxAge, cookieStore.Options.MaxAge)
+		assert.Equal(t, http.SameSiteLaxMode, cookieStore.Options.SameSite)
+	}
+
+	assert.Error(t, SetupSessionStore(SessionSettings{Store: RedisSessionStore}, nil))
+	assert.Error(t, SetupSessionStore(SessionSettings{Store: "file"}, nil))
+
+	settings := SessionSettings{Store: RedisSessionStore, MaxAge: 600, Domain: "example.com", Secure: true, SameSite: "Strict"}
+	assert.NoError(t, SetupSessionStore(settings, &memoryParams{kv: map[string][]byte{}}))
+	redisStore, ok := Store.(*RedisStore)
+	if assert.True(t, ok) {
+		assert.Equal(t, &sessions.Options{Path: "/", Domain: "example.com", MaxAge: 600, Secure: true, HttpOnly: true, SameSite: http.SameSiteStrictMode}, redisStore.Options)
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	backend := &memoryParams{kv: map[string][]byte{}}
+	store := NewRedisStore(backend, []byte("secret"), nil)
+
+	// save stores a value in a new session and returns its cookie
+	save := func(t *testing.T, store *RedisStore, value string) *http.Cookie {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		session, err := store.Get(req, SessionName)
+		assert.NoError(t, err)
+		assert.True(t, session.IsNew)
+		session.Values["value"] = value
+
+		w := httptest.NewRecorder()
+		assert.NoError(t, session.Save(req, w))
+		return w.Result().Cookies()[0]
+	}
+	load := func(store *RedisStore, cookie *http.Cookie) (*sessions.Session, error) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		return store.Get(req, SessionName)
+	}
+
+	cookie := save(t, store, "state-1")
+	assert.True(t, cookie.HttpOnly)
+	assert.NotContains(t, cookie.Value, "state-1")
+	assert.Len(t, backend.kv, 1)
+
+	session, err := load(store, cookie)
+	assert.NoError(t, err)
+	assert.False(t, session.IsNew)
+	assert.Equal(t, "state-1", session.Values["value"])
+
+	t.Run("tampered cookie", func(t *testing.T) {
+		tampered := *cookie
+		tampered.Value = cookie.Value[:len(cookie.Value)-2] + "xx"
+		session, err := load(store, &tampered)
+		assert.Error(t, err)
+		assert.True(t, session.IsNew)
+		assert.Empty(t, session.Values)
+	})
+
+	t.Run("rotated secret", func(t *testing.T) {
+		rotated := NewRedisStore(backend, []byte("new-secret"), nil, []byte("secret"), nil)
+		session, err := load(rotated, cookie)
+		assert.NoError(t, err)
+		assert.Equal(t, "state-1", session.Values["value"])
+
+		// sessions are only accepted with a secret that is still configured
+		other := NewRedisStore(backend, []byte("new-secret"), nil)
+		_, err = load(other, cookie)
+		assert.Error(t, err)
+	})
+
+	t.Run("expired session", func(t *testing.T) {
+		cookie := save(t, store, "state-2")
+		backend.kv = map[string][]byte{}
+		session, err := load(store, cookie)
+		assert.NoError(t, err)
+		assert.True(t, session.IsNew)
+		assert.Empty(t, session.Values)
+		assert.Empty(t, session.ID)
+
+		// saving it again issues a new ID
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		assert.NoError(t, store.Save(req, w, session))
+		var oldID, newID string
+		assert.NoError(t, securecookie.DecodeMulti(SessionName, cookie.Value, &oldID, store.Codecs...))
+		assert.NoError(t, securecookie.DecodeMulti(SessionName, w.Result().Cookies()[0].Value, &newID, store.Codecs...))
+		assert.NotEmpty(t, newID)
+		assert.NotEqual(t, oldID, newID)
+		backend.kv = map[string][]byte{}
+	})
+
+	t.Run("deleted session", func(t *testing.T) {
+		cookie := save(t, store, "state-3")
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		session, _ := store.Get(req, SessionName)
+		session.Options.MaxAge = -1
+
+		w := httptest.NewRecorder()
+		assert.NoError(t, session.Save(req, w))
+		assert.Empty(t, backend.kv)
+		assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+	})
+}
@@ -0,0 +1,186 @@
+package tothic
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/openidConnect"
+	"golang.org/x/oauth2"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+const (
+	// stateKeyPrefix is the prefix of the login states kept in the params store
+	stateKeyPrefix = "oauth-state-"
+	// stateSessionPrefix binds a login state to the browser that started the login, each state has its own key in
+	// the session so that a browser can have several logins going, e.g. in two tabs
+	stateSessionPrefix = "state-"
+)
+
+// StateTTL is how long a user has to complete a login with the provider
+var StateTTL = 10 * time.Minute
+
+var (
+	ErrInvalidState = errors.New("state is invalid, expired or has already been used")
+	ErrInvalidNonce = errors.New("id_token nonce does not match the login")
+)
+
+// LoginState is kept server side from the start of a login until its callback, the state sent to the provider is
+// the key it is stored under
+type LoginState struct {
+	ProfileID string
+	Provider  string
+	ReturnTo  string
+	// Nonce is sent to OpenID Connect providers and must come back in the id_token
+	Nonce string
+	// CodeVerifier is the PKCE verifier of OpenID Connect logins, its S256 challenge is sent with the authorization
+	// request and the verifier with the code exchange
+	CodeVerifier string
+	// Session is the goth session of the login
+	Session   string
+	ExpiresAt int64
+}
+
+// newLoginState returns a random state for a login that is starting, it is kept with saveLoginState
+func newLoginState(req *http.Request, profile tap.Profile, providerName string, withNonce bool, withPKCE bool) (string, LoginState, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", LoginState{}, err
+	}
+
+	loginState := LoginState{
+		ProfileID: profile.ID,
+		Provider:  providerName,
+		// the return_to has been checked against the profile by the caller
+		ReturnTo:  req.URL.Query().Get(tap.ReturnToParam),
+		ExpiresAt: time.Now().Add(StateTTL).Unix(),
+	}
+	if withNonce {
+		if loginState.Nonce, err = randomString(); err != nil {
+			return "", LoginState{}, err
+		}
+	}
+	if withPKCE {
+		loginState.CodeVerifier = oauth2.GenerateVerifier()
+	}
+
+	return state, loginState, nil
+}
+
+func saveLoginState(ctx context.Context, state string, profile tap.Profile, loginState LoginState) error {
+	return tap.SetKeyWithTTL(tap.WithContext(ctx, pathParams), stateKeyPrefix+state, profile.OrgID, loginState, StateTTL)
+}
+
+// bindState keeps a state in the session of the browser that starts the login, the states of logins that have
+// expired are dropped
+func bindState(session *sessions.Session, state string, loginState LoginState) {
+	now := time.Now().Unix()
+	for key, value := range session.Values {
+		name, _ := key.(string)
+		expiresAt, _ := value.(int64)
+		if strings.HasPrefix(name, stateSessionPrefix) && expiresAt <= now {
+			delete(session.Values, key)
+		}
+	}
+	session.Values[stateSessionPrefix+state] = loginState.ExpiresAt
+}
+
+// ConsumeState checks the state of a callback against the states issued to the browser when its logins started,
+// a state can only be used once. The state is read and deleted in one operation of the store, so that two instances
+// can't both consume it.
+func ConsumeState(res http.ResponseWriter, req *http.Request, profile tap.Profile) (LoginState, error) {
+	state := GetState(req)
+	if state == "" {
+		return LoginState{}, ErrInvalidState
+	}
+
+	if Store == nil {
+		return LoginState{}, ErrInvalidState
+	}
+	session, err := Store.Get(req, SessionName)
+	if err != nil {
+		return LoginState{}, ErrInvalidState
+	}
+	if _, issued := session.Values[stateSessionPrefix+state]; !issued {
+		return LoginState{}, ErrInvalidState
+	}
+	delete(session.Values, stateSessionPrefix+state)
+	if err := session.Save(req, res); err != nil {
+		log.WithError(err).Error("clearing login state")
+	}
+
+	loginState := LoginState{}
+	if err := tap.ConsumeKey(tap.WithContext(req.Context(), pathParams), stateKeyPrefix+state, profile.OrgID, &loginState); err != nil {
+		return LoginState{}, ErrInvalidState
+	}
+
+	if loginState.ProfileID != profile.ID || time.Now().Unix() >= loginState.ExpiresAt {
+		return LoginState{}, ErrInvalidState
+	}
+	return loginState, nil
+}
+
+// withLoginParams adds the nonce and PKCE challenge of a login to the authorization URL of an OpenID Connect provider
+func withLoginParams(authURL string, loginState LoginState) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	if loginState.Nonce != "" {
+		query.Set("nonce", loginState.Nonce)
+	}
+	if loginState.CodeVerifier != "" {
+		query.Set("code_challenge", oauth2.S256ChallengeFromVerifier(loginState.CodeVerifier))
+		query.Set("code_challenge_method", "S256")
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// checkNonce makes sure the id_token was issued for this login, sessions of other providers have no id_token
+func checkNonce(sess goth.Session, nonce string) error {
+	oidcSession, ok := sess.(*openidConnect.Session)
+	if !ok || nonce == "" {
+		return nil
+	}
+
+	parts := strings.Split(oidcSession.IDToken, ".")
+	if len(parts) != 3 {
+		return ErrInvalidNonce
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ErrInvalidNonce
+	}
+
+	claims := struct {
+		Nonce string `json:"nonce"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ErrInvalidNonce
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return ErrInvalidNonce
+	}
+	return nil
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -36,28 +36,9 @@ var pathParams tap.AuthRegisterBackend
 
 var TothErrorHandler func(string, string, error, int, http.ResponseWriter, *http.Request)
 
-// Store can/should be set by applications using gothic. The default is a cookie store.
+// Store can/should be set by applications using gothic, SetupSessionStore sets it from the settings of TIB.
 var Store sessions.Store
 
-type PathParam struct {
-	Id       string `json:"id"`
-	Provider string `json:"provider"`
-}
-
-func (p PathParam) UnmarshalBinary(data []byte) error {
-	// convert data to yours, let's assume its json data
-	return json.Unmarshal(data, p)
-}
-
-func (p PathParam) MarshalBinary() ([]byte, error) {
-	return json.Marshal(p)
-}
-
-func SetupSessionStore() {
-	key := KeyFromEnv()
-	Store = sessions.NewCookieStore([]byte(key))
-}
-
 func KeyFromEnv() (key string) {
 	// To handle deprecation
 	key = os.Getenv("SESSION_SECRET")
@@ -69,49 +50,12 @@ func KeyFromEnv() (key string) {
 		key = temp
 	}
 
-	if key == "" && temp == "" {
-		log.Warn("toth/tothic: no TYK_IB_SESSION_SECRET environment variable is set. The default cookie store is not available and any calls will fail. Ignore this warning if you are using a different store.")
-	}
-
 	return
 }
 
-func SetPathParams(newPathParams map[string]string, profile tap.Profile) {
-
-	val, ok := newPathParams[":provider"]
-	if ok {
-		newPathParams["provider"] = val
-		delete(newPathParams, ":provider")
-	}
-
-	jsonbody, err := json.Marshal(newPathParams)
-	if err != nil {
-		log.WithError(err).Error("saving path params")
-		return
-	}
-
-	params := PathParam{}
-	if err := json.Unmarshal(jsonbody, &params); err != nil {
-		log.WithError(err).Error("saving path params")
-		return
-	}
-
-	err = pathParams.SetKey(profile.GetPrefix(), profile.OrgID, params)
-	if err != nil {
-		log.WithError(err).Error("saving path params")
-	}
-
-}
-
-func GetParams(profile tap.Profile) PathParam {
-	params := PathParam{}
-	pathParams.GetKey(profile.GetPrefix(), profile.OrgID, &params)
-	return params
-}
-
 /*
 BeginAuthHandler is a convienence handler for starting the authentication process.
-It expects to be able to get the name of the provider from the query parameters
+It expects to be able to get the name of the provider from the path parameters
 as either "provider" or ":provider".
 
 BeginAuthHandler will redirect the user to the appropriate authentication end-point
@@ -121,9 +65,13 @@ See https://github.com/markbates/goth/examples/main.go to see this in action.
 */
 func BeginAuthHandler(res http.ResponseWriter, req *http.Request, toth *toth.TothInstance, pathParams map[string]string, profile tap.Profile) {
 
-	SetPathParams(pathParams, profile)
+	providerName, err := GetProviderName(pathParams)
+	if err != nil {
+		TothErrorHandler("[TOTHIC]", err.Error(), err, http.StatusBadRequest, res, req)
+		return
+	}
 
-	url, err := GetAuthURL(res, req, toth, profile)
+	url, err := GetAuthURL(res, req, toth, profile, providerName)
 	if err != nil {
 		//res.WriteHeader(http.StatusBadRequest)
 		//fmt.Fprintln(res, err)
@@ -131,7 +79,7 @@ func BeginAuthHandler(res http.ResponseWriter, req *http.Request, toth *toth.Tot
 		return
 	}
 
-	http.Redirect(res, req, url, http.StatusTemporaryRedirect)
+	http.Redirect(res, req, url, tap.RedirectStatus(req))
 }
 
 // GetState gets the state returned by the provider during the callback.
@@ -146,11 +94,6 @@ var GetState = func(req *http.Request) string {
 		state = req.FormValue("state")
 	}
 
-	if state == "" {
-		// no "state" found, returning the default value
-		state = "state"
-	}
-
 	return state
 }
 
@@ -158,24 +101,27 @@ var GetState = func(req *http.Request) string {
 GetAuthURL starts the authentication process with the requested provided.
 It will return a URL that should be used to send users to.
 
-It expects to be able to get the name of the provider from the query parameters
-as either "provider" or ":provider".
+The provider, and everything else the callback needs, is kept with the state of the login
+so that concurrent logins on the same profile don't share anything.
 
 I would recommend using the BeginAuthHandler instead of doing all of these steps
 yourself, but that's entirely up to you.
 */
-func GetAuthURL(res http.ResponseWriter, req *http.Request, toth *toth.TothInstance, profile tap.Profile) (string, error) {
-
-	providerName, err := GetProviderName(profile)
+func GetAuthURL(res http.ResponseWriter, req *http.Request, toth *toth.TothInstance, profile tap.Profile, providerName string) (string, error) {
+	if Store == nil {
+		return "", ErrNoSessionSecret
+	}
+	provider, err := toth.GetProvider(providerName)
 	if err != nil {
 		return "", err
 	}
-
-	provider, err := toth.GetProvider(providerName)
+	_, withPKCE := provider.(pkceProvider)
+	state, loginState, err := newLoginState(req, profile, providerName, isOpenIDConnect(provider), withPKCE)
 	if err != nil {
 		return "", err
 	}
-	sess, err := provider.BeginAuth(GetState(req))
+
+	sess, err := provider.BeginAuth(state)
 	if err != nil {
 		return "", err
 	}
@@ -184,9 +130,19 @@ func GetAuthURL(res http.ResponseWriter, req *http.Request, toth *toth.TothInsta
 	if err != nil {
 		return "", err
 	}
+	if loginState.Nonce != "" || loginState.CodeVerifier != "" {
+		if url, err = withLoginParams(url, loginState); err != nil {
+			return "", err
+		}
+	}
+
+	loginState.Session = sess.Marshal()
+	if err := saveLoginState(req.Context(), state, profile, loginState); err != nil {
+		return "", err
+	}
 
 	session, _ := Store.Get(req, SessionName)
-	session.Values[SessionName] = sess.Marshal()
+	bindState(session, state, loginState)
 	err = session.Save(req, res)
 	if err != nil {
 		return "", err
@@ -199,47 +155,46 @@ func GetAuthURL(res http.ResponseWriter, req *http.Request, toth *toth.TothInsta
 CompleteUserAuth does what it says on the tin. It completes the authentication
 process and fetches all of the basic information about the user from the provider.
 
-It expects to be able to get the name of the provider from the query parameters
-as either "provider" or ":provider".
+The state of the callback is checked and consumed first, and returned so that the login can continue with it.
 
 See https://github.com/markbates/goth/examples/main.go to see this in action.
 */
-var CompleteUserAuth = func(res http.ResponseWriter, req *http.Request, toth *toth.TothInstance, profile tap.Profile, jweHandler *jwe.Handler) (goth.User, error) {
-	providerName, err := GetProviderName(profile)
+var CompleteUserAuth = func(res http.ResponseWriter, req *http.Request, toth *toth.TothInstance, profile tap.Profile, jweHandler *jwe.Handler) (goth.User, LoginState, error) {
+	loginState, err := ConsumeState(res, req, profile)
 	if err != nil {
-		return goth.User{}, err
+		return goth.User{}, LoginState{}, err
 	}
 
-	provider, err := toth.GetProvider(providerName)
+	provider, err := toth.GetProvider(loginState.Provider)
 	if err != nil {
-		return goth.User{}, err
+		return goth.User{}, loginState, err
 	}
 
-	session, err := Store.Get(req, SessionName)
+	sess, err := provider.UnmarshalSession(loginState.Session)
 	if err != nil {
-		return goth.User{}, errors.New("cannot get session store")
+		return goth.User{}, loginState, err
 	}
 
-	if session.Values[SessionName] == nil {
-		return goth.User{}, errors.New("could not find a matching session for this request")
+	if pkce, ok := provider.(pkceProvider); ok && loginState.CodeVerifier != "" {
+		err = pkce.AuthorizeWithVerifier(req.Context(), sess, req.URL.Query().Get("code"), loginState.CodeVerifier)
+	} else {
+		_, err = sess.Authorize(provider, req.URL.Query())
 	}
-
-	sess, err := provider.UnmarshalSession(session.Values[SessionName].(string))
 	if err != nil {
-		return goth.User{}, err
+		return goth.User{}, loginState, err
 	}
 
-	_, err = sess.Authorize(provider, req.URL.Query())
+	JWTSession, err := prepareJWTSession(sess, jweHandler)
 	if err != nil {
-		return goth.User{}, err
+		return goth.User{}, loginState, err
 	}
 
-	JWTSession, err := prepareJWTSession(sess, jweHandler)
-	if err != nil {
-		return goth.User{}, err
+	if err := checkNonce(JWTSession, loginState.Nonce); err != nil {
+		return goth.User{}, loginState, err
 	}
 
-	return provider.FetchUser(JWTSession)
+	user, err := provider.FetchUser(JWTSession)
+	return user, loginState, err
 }
 
 func prepareJWTSession(sess goth.Session, jweHandler *jwe.Handler) (goth.Session, error) {
@@ -263,17 +218,17 @@ func prepareJWTSession(sess goth.Session, jweHandler *jwe.Handler) (goth.Session
 	return JWTSession, nil
 }
 
-// GetProviderName is a function used to get the name of a provider
-// for a given request. By default, this provider is fetched from
-// the URL query string. If you provide it in a different way,
-// assign your own function to this variable that returns the provider
-// name for your request.
+// GetProviderName is a function used to get the name of the provider a login
+// starts with. By default, this provider is fetched from the path parameters of
+// the request. If you provide it in a different way, assign your own function
+// to this variable that returns the provider name for your request.
 var GetProviderName = getProviderName
 
-func getProviderName(profile tap.Profile) (string, error) {
-	params := GetParams(profile)
-
-	provider := params.Provider
+func getProviderName(pathParams map[string]string) (string, error) {
+	provider := pathParams["provider"]
+	if provider == "" {
+		provider = pathParams[":provider"]
+	}
 	if provider == "" {
 		return provider, errors.New("you must select a provider")
 	}
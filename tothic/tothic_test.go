@@ -2,17 +2,29 @@ package tothic
 
 import (
 	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/TykTechnologies/tyk-identity-broker/internal/jwe"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+	"github.com/TykTechnologies/tyk-identity-broker/toth"
+	"github.com/gorilla/sessions"
 	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/faux"
 	"github.com/markbates/goth/providers/openidConnect"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
 )
 
 func TestKeyFromEnv(t *testing.T) {
@@ -116,13 +128,13 @@ func assertDeepEqual(t *testing.T, expected interface{}, actual interface{}) {
 
 func TestGetState(t *testing.T) {
 	req, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
-	assert.Equal(t, "state", GetState(req))
+	assert.Equal(t, "", GetState(req))
 
 	req, _ = http.NewRequest(http.MethodGet, "http://localhost?state=FooBar", nil)
 	assert.Equal(t, "FooBar", GetState(req))
 
 	req, _ = http.NewRequest(http.MethodPost, "http://localhost", nil)
-	assert.Equal(t, "state", GetState(req))
+	assert.Equal(t, "", GetState(req))
 
 	req, _ = http.NewRequest(http.MethodPost, "http://localhost?state=FooBar", nil)
 	assert.Equal(t, "FooBar", GetState(req))
@@ -142,3 +154,315 @@ func TestGetState(t *testing.T) {
 
 	assert.Equal(t, "FooBar", GetState(req))
 }
+
+// memoryParams is a minimal params store, the backends package can't be imported here
+type memoryParams struct {
+	kv   map[string][]byte
+	lock sync.Mutex
+}
+
+func (m *memoryParams) Init(interface{}) error { return nil }
+
+func (m *memoryParams) SetKey(key string, _ string, val interface{}) error {
+	asByte, err := json.Marshal(val)
+	m.lock.Lock()
+	m.kv[key] = asByte
+	m.lock.Unlock()
+	return err
+}
+
+func (m *memoryParams) GetKey(key string, _ string, val interface{}) error {
+	m.lock.Lock()
+	v, ok := m.kv[key]
+	m.lock.Unlock()
+	if !ok {
+		return errors.New("not found")
+	}
+	return json.Unmarshal(v, val)
+}
+
+func (m *memoryParams) GetAll(string) []interface{} { return nil }
+
+func (m *memoryParams) DeleteKey(key string, _ string) error {
+	m.lock.Lock()
+	delete(m.kv, key)
+	m.lock.Unlock()
+	return nil
+}
+
+func TestLoginState(t *testing.T) {
+	SetParamsStoreHandler(&memoryParams{kv: map[string][]byte{}})
+	Store = sessions.NewCookieStore([]byte("secret"))
+	profile := tap.Profile{ID: "1", OrgID: "org-1"}
+
+	// start issues a state to a browser and returns the session cookie of that browser
+	start := func(t *testing.T, returnTo string) (string, *http.Cookie) {
+		req := httptest.NewRequest(http.MethodGet, "/auth/1/openid-connect?"+tap.ReturnToParam+"="+url.QueryEscape(returnTo), nil)
+		state, loginState, err := newLoginState(req, profile, "openid-connect", true, true)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, loginState.Nonce)
+		assert.NotEmpty(t, loginState.CodeVerifier)
+		assert.NoError(t, saveLoginState(req.Context(), state, profile, loginState))
+
+		w := httptest.NewRecorder()
+		session, _ := Store.Get(req, SessionName)
+		bindState(session, state, loginState)
+		assert.NoError(t, session.Save(req, w))
+		return state, w.Result().Cookies()[0]
+	}
+	// startAgain starts another login in the browser of cookie, e.g. in another tab
+	startAgain := func(t *testing.T, cookie *http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest(http.MethodGet, "/auth/1/openid-connect", nil)
+		req.AddCookie(cookie)
+		state, loginState, err := newLoginState(req, profile, "openid-connect", true, true)
+		assert.NoError(t, err)
+		assert.NoError(t, saveLoginState(req.Context(), state, profile, loginState))
+
+		w := httptest.NewRecorder()
+		session, _ := Store.Get(req, SessionName)
+		bindState(session, state, loginState)
+		assert.NoError(t, session.Save(req, w))
+		return state, w.Result().Cookies()[0]
+	}
+	callback := func(state string, cookie *http.Cookie) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/auth/1/openid-connect/callback?state="+url.QueryEscape(state), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	state, cookie := start(t, "https://app.example.com/reports")
+	loginState, err := ConsumeState(httptest.NewRecorder(), callback(state, cookie), profile)
+	assert.NoError(t, err)
+	assert.Equal(t, "openid-connect", loginState.Provider)
+	assert.Equal(t, "https://app.example.com/reports", loginState.ReturnTo)
+
+	t.Run("replayed state", func(t *testing.T) {
+		_, err := ConsumeState(httptest.NewRecorder(), callback(state, cookie), profile)
+		assert.Equal(t, ErrInvalidState, err)
+	})
+
+	t.Run("state issued to another browser", func(t *testing.T) {
+		state, _ := start(t, "")
+		_, otherCookie := start(t, "")
+		_, err := ConsumeState(httptest.NewRecorder(), callback(state, otherCookie), profile)
+		assert.Equal(t, ErrInvalidState, err)
+
+		_, err = ConsumeState(httptest.NewRecorder(), callback(state, nil), profile)
+		assert.Equal(t, ErrInvalidState, err)
+	})
+
+	t.Run("missing or forged state", func(t *testing.T) {
+		_, cookie := start(t, "")
+		_, err := ConsumeState(httptest.NewRecorder(), callback("", cookie), profile)
+		assert.Equal(t, ErrInvalidState, err)
+
+		_, err = ConsumeState(httptest.NewRecorder(), callback("state", cookie), profile)
+		assert.Equal(t, ErrInvalidState, err)
+	})
+
+	t.Run("logins in two tabs", func(t *testing.T) {
+		first, cookie := start(t, "")
+		second, cookie := startAgain(t, cookie)
+
+		_, err := ConsumeState(httptest.NewRecorder(), callback(second, cookie), profile)
+		assert.NoError(t, err)
+		_, err = ConsumeState(httptest.NewRecorder(), callback(first, cookie), profile)
+		assert.NoError(t, err)
+	})
+
+	t.Run("concurrent callbacks", func(t *testing.T) {
+		state, cookie := start(t, "")
+		var consumed int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := ConsumeState(httptest.NewRecorder(), callback(state, cookie), profile); err == nil {
+					atomic.AddInt32(&consumed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), consumed)
+	})
+
+	t.Run("state of another profile", func(t *testing.T) {
+		state, cookie := start(t, "")
+		_, err := ConsumeState(httptest.NewRecorder(), callback(state, cookie), tap.Profile{ID: "2", OrgID: "org-1"})
+		assert.Equal(t, ErrInvalidState, err)
+	})
+
+	t.Run("expired state", func(t *testing.T) {
+		StateTTL = -time.Minute
+		defer func() { StateTTL = 10 * time.Minute }()
+
+		state, cookie := start(t, "")
+		_, err := ConsumeState(httptest.NewRecorder(), callback(state, cookie), profile)
+		assert.Equal(t, ErrInvalidState, err)
+	})
+}
+
+// namedProvider is a faux provider that can be registered under any name
+type namedProvider struct {
+	faux.Provider
+	name string
+}
+
+func (p *namedProvider) Name() string { return p.name }
+
+func (p *namedProvider) FetchUser(session goth.Session) (goth.User, error) {
+	user, err := p.Provider.FetchUser(session)
+	user.Provider = p.name
+	return user, err
+}
+
+func TestConcurrentLogins(t *testing.T) {
+	SetParamsStoreHandler(&memoryParams{kv: map[string][]byte{}})
+	Store = sessions.NewCookieStore([]byte("secret"))
+	profile := tap.Profile{ID: "1", OrgID: "org-1"}
+
+	instance := &toth.TothInstance{}
+	instance.Init()
+	instance.UseProviders(&namedProvider{name: "github"}, &namedProvider{name: "openid-connect"})
+
+	// begin starts the login of one browser with a provider, the provider's callback comes back later
+	begin := func(provider string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/auth/1/"+provider, nil)
+		w := httptest.NewRecorder()
+		BeginAuthHandler(w, req, instance, map[string]string{"id": "1", "provider": provider}, profile)
+		assert.Equal(t, http.StatusFound, w.Code)
+
+		authURL, err := url.Parse(w.Header().Get("Location"))
+		assert.NoError(t, err)
+		callback := httptest.NewRequest(http.MethodGet, "/auth/1/"+provider+"/callback?code=abc&state="+url.QueryEscape(authURL.Query().Get("state")), nil)
+		for _, cookie := range w.Result().Cookies() {
+			callback.AddCookie(cookie)
+		}
+		return callback
+	}
+	complete := func(callback *http.Request) (goth.User, error) {
+		user, _, err := CompleteUserAuth(httptest.NewRecorder(), callback, instance, profile, &jwe.Handler{})
+		return user, err
+	}
+
+	// both users pick a provider before either of them comes back
+	github := begin("github")
+	oidc := begin("openid-connect")
+
+	user, err := complete(github)
+	assert.NoError(t, err)
+	assert.Equal(t, "github", user.Provider)
+
+	user, err = complete(oidc)
+	assert.NoError(t, err)
+	assert.Equal(t, "openid-connect", user.Provider)
+
+	t.Run("in parallel", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			provider := []string{"github", "openid-connect"}[i%2]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				user, err := complete(begin(provider))
+				assert.NoError(t, err)
+				assert.Equal(t, provider, user.Provider)
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestNonce(t *testing.T) {
+	authURL, err := withLoginParams("https://idp.example.com/authorize?state=abc", LoginState{Nonce: "nonce-1"})
+	assert.NoError(t, err)
+	assert.Contains(t, authURL, "nonce=nonce-1")
+	assert.Contains(t, authURL, "state=abc")
+	assert.NotContains(t, authURL, "code_challenge")
+
+	idToken := func(claims string) *openidConnect.Session {
+		return &openidConnect.Session{IDToken: "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"}
+	}
+
+	assert.NoError(t, checkNonce(idToken(`{"nonce":"nonce-1"}`), "nonce-1"))
+	assert.Equal(t, ErrInvalidNonce, checkNonce(idToken(`{"nonce":"nonce-2"}`), "nonce-1"))
+	assert.Equal(t, ErrInvalidNonce, checkNonce(idToken(`{}`), "nonce-1"))
+	assert.Equal(t, ErrInvalidNonce, checkNonce(&openidConnect.Session{IDToken: "not-a-jwt"}, "nonce-1"))
+	// logins with other providers have no nonce
+	assert.NoError(t, checkNonce(&openidConnect.Session{}, ""))
+}
+
+func TestPKCE(t *testing.T) {
+	SetParamsStoreHandler(&memoryParams{kv: map[string][]byte{}})
+	Store = sessions.NewCookieStore([]byte("secret"))
+	profile := tap.Profile{ID: "1", OrgID: "org-1"}
+
+	// the IdP remembers the challenge of the authorization request and checks the verifier of the code exchange
+	var challenge string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{ //nolint:errcheck
+				"issuer":                 srv.URL,
+				"authorization_endpoint": srv.URL + "/authorize",
+				"token_endpoint":         srv.URL + "/token",
+			})
+		case "/token":
+			r.ParseForm() //nolint:errcheck
+			if oauth2.S256ChallengeFromVerifier(r.PostForm.Get("code_verifier")) != challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant"}`)) //nolint:errcheck
+				return
+			}
+			w.Write([]byte(`{"access_token":"access-1","token_type":"Bearer","expires_in":3600,"id_token":"id-1"}`)) //nolint:errcheck
+		}
+	}))
+	defer srv.Close()
+
+	gProv, err := openidConnect.New("key", "secret", "https://tib.example.com/auth/1/openid-connect/callback", srv.URL+"/.well-known/openid-configuration")
+	assert.NoError(t, err)
+	provider, err := NewOpenIDConnectProvider(gProv, srv.URL+"/.well-known/openid-configuration")
+	assert.NoError(t, err)
+	instance := &toth.TothInstance{}
+	instance.Init()
+	instance.UseProviders(provider)
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/1/openid-connect", nil)
+	w := httptest.NewRecorder()
+	authURL, err := GetAuthURL(w, req, instance, profile, "openid-connect")
+	assert.NoError(t, err)
+	authQuery := mustParseQuery(t, authURL)
+	assert.Equal(t, "S256", authQuery.Get("code_challenge_method"))
+	assert.NotEmpty(t, authQuery.Get("nonce"))
+	challenge = authQuery.Get("code_challenge")
+	assert.NotEmpty(t, challenge)
+
+	callback := httptest.NewRequest(http.MethodGet, "/auth/1/openid-connect/callback?code=abc&state="+url.QueryEscape(authQuery.Get("state")), nil)
+	for _, cookie := range w.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	loginState, err := ConsumeState(httptest.NewRecorder(), callback, profile)
+	assert.NoError(t, err)
+	assert.Equal(t, challenge, oauth2.S256ChallengeFromVerifier(loginState.CodeVerifier))
+
+	sess, err := provider.UnmarshalSession(loginState.Session)
+	assert.NoError(t, err)
+	assert.NoError(t, provider.AuthorizeWithVerifier(callback.Context(), sess, "abc", loginState.CodeVerifier))
+	assert.Equal(t, "access-1", sess.(*openidConnect.Session).AccessToken)
+	assert.Equal(t, "id-1", sess.(*openidConnect.Session).IDToken)
+
+	// a code intercepted on its way back can't be exchanged without the verifier of the login
+	assert.Error(t, provider.AuthorizeWithVerifier(callback.Context(), sess, "abc", oauth2.GenerateVerifier()))
+}
+
+func mustParseQuery(t *testing.T, raw string) url.Values {
+	t.Helper()
+	u, err := url.Parse(raw)
+	assert.NoError(t, err)
+	return u.Query()
+}
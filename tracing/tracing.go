@@ -0,0 +1,87 @@
+/*
+Package tracing traces the requests TIB serves and the calls it makes while logging users in with OpenTelemetry,
+spans are exported over OTLP.
+*/
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/TykTechnologies/opentelemetry/config"
+	tyktrace "github.com/TykTechnologies/opentelemetry/trace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+)
+
+// Name is the name of the tracer and the default name of the resource spans are reported for
+const Name = "tyk-identity-broker"
+
+var log = logger.Get()
+var tracingLogTag = "TRACING"
+var tracingLogger = log.WithField("prefix", tracingLogTag)
+
+var provider tyktrace.Provider
+
+// Init sets up the exporter from cfg, until it is called with tracing enabled spans are not recorded
+func Init(cfg *config.OpenTelemetry, version string) error {
+	if cfg.ResourceName == "" {
+		cfg.ResourceName = Name
+	}
+
+	var err error
+	provider, err = tyktrace.NewProvider(
+		tyktrace.WithContext(context.Background()),
+		tyktrace.WithConfig(cfg),
+		tyktrace.WithLogger(tracingLogger),
+		tyktrace.WithServiceVersion(version),
+	)
+	return err
+}
+
+// Shutdown flushes the spans that have not been exported yet
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// Handler starts a span for each request handler serves, it continues the trace of the caller when the request
+// carries one
+func Handler(handler http.Handler) http.Handler {
+	return tyktrace.NewHTTPHandler(Name, handler, provider)
+}
+
+// Start starts a span as a child of the span in ctx, a nil ctx starts a new trace
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return otel.Tracer(Name).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End ends span, marking it as failed when err is set
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// EndRequest ends the span of a call to an HTTP API with the status code of the response
+func EndRequest(span trace.Span, code int, err error) {
+	span.SetAttributes(attribute.Int("http.response.status_code", code))
+	End(span, err)
+}
+
+// Inject adds the trace context of ctx to the headers of an outbound request
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -0,0 +1,115 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	otelconfig "github.com/TykTechnologies/opentelemetry/config"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
+	tyk "github.com/TykTechnologies/tyk-identity-broker/tyk-api"
+)
+
+// record exports the spans of the test to memory
+func record(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	return exporter
+}
+
+func TestHandler(t *testing.T) {
+	exporter := record(t)
+
+	var received http.Header
+	dashboard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Write([]byte("{}"))
+	}))
+	defer dashboard.Close()
+	dashboardURL, _ := url.Parse(dashboard.URL)
+	api := tyk.TykAPI{DashboardConfig: tyk.EndpointConfig{Endpoint: "http://" + dashboardURL.Hostname(), Port: dashboardURL.Port()}}
+
+	handler := tracing.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bound := api.WithContext(r.Context())
+		_, _, err := bound.DispatchDashboard("/api/users", http.MethodGet, "user-secret", nil)
+		assert.NoError(t, err)
+	}))
+
+	t.Run("new trace", func(t *testing.T) {
+		exporter.Reset()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/auth/1/ADProvider", nil))
+
+		spans := exporter.GetSpans()
+		if !assert.Len(t, spans, 2) {
+			return
+		}
+		call, request := spans[0], spans[1]
+		assert.Equal(t, "GET /auth/1/ADProvider", request.Name)
+		assert.Equal(t, "dashboard GET", call.Name)
+		assert.Equal(t, request.SpanContext.SpanID(), call.Parent.SpanID())
+		assert.Equal(t, request.SpanContext.TraceID(), call.SpanContext.TraceID())
+
+		// the dashboard carries on with the trace of the call
+		assert.Equal(t, "00-"+call.SpanContext.TraceID().String()+"-"+call.SpanContext.SpanID().String()+"-01", received.Get("traceparent"))
+	})
+
+	t.Run("trace of the caller", func(t *testing.T) {
+		exporter.Reset()
+		traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		req := httptest.NewRequest(http.MethodGet, "/auth/1/ADProvider", nil)
+		req.Header.Set("traceparent", traceparent)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		spans := exporter.GetSpans()
+		if assert.Len(t, spans, 2) {
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[1].SpanContext.TraceID().String())
+			assert.Equal(t, "00f067aa0ba902b7", spans[1].Parent.SpanID().String())
+		}
+	})
+}
+
+func TestEnd(t *testing.T) {
+	exporter := record(t)
+
+	_, span := tracing.Start(context.Background(), "ok")
+	tracing.End(span, nil)
+	_, span = tracing.Start(context.Background(), "failed")
+	tracing.End(span, errors.New("connection refused"))
+	_, span = tracing.Start(context.Background(), "dashboard GET")
+	tracing.EndRequest(span, http.StatusForbidden, errors.New("Response code from dashboard was not 200!"))
+
+	spans := exporter.GetSpans()
+	if assert.Len(t, spans, 3) {
+		assert.Equal(t, codes.Unset, spans[0].Status.Code)
+		assert.False(t, spans[0].Parent.IsValid())
+		assert.Equal(t, codes.Error, spans[1].Status.Code)
+		assert.Equal(t, "connection refused", spans[1].Status.Description)
+		assert.Len(t, spans[1].Events, 1)
+		assert.Equal(t, codes.Error, spans[2].Status.Code)
+		assert.Contains(t, spans[2].Attributes, attribute.Int("http.response.status_code", http.StatusForbidden))
+	}
+}
+
+func TestInit(t *testing.T) {
+	cfg := otelconfig.OpenTelemetry{}
+	assert.NoError(t, tracing.Init(&cfg, "v1.0.0"))
+	assert.Equal(t, tracing.Name, cfg.ResourceName)
+	assert.NoError(t, tracing.Shutdown(context.Background()))
+}
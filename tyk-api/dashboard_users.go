@@ -0,0 +1,102 @@
+package tyk
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+const DASH_USERS Endpoint = "/api/users"
+
+// DashboardUser is a user of the Tyk Dashboard
+type DashboardUser struct {
+	ID           string `json:"id"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	EmailAddress string `json:"email_address"`
+	OrgID        string `json:"org_id"`
+	GroupID      string `json:"group_id,omitempty"`
+	Active       bool   `json:"active"`
+}
+
+type dashboardUserCreated struct {
+	Meta DashboardUser `json:"Meta"`
+}
+
+type dashboardUserList struct {
+	Users []DashboardUser `json:"users"`
+	Pages int             `json:"pages"`
+}
+
+// GetDashboardUsers lists all the users of the organisation of the dashboard credential
+func (t *TykAPI) GetDashboardUsers(UserCred string) ([]DashboardUser, error) {
+	list := dashboardUserList{}
+	target := string(DASH_USERS) + "?p=-1"
+	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "GET", DASH, &list, UserCred, nil, "")
+
+	return list.Users, dErr
+}
+
+// GetDashboardUser retrieves a Dashboard user by ID
+func (t *TykAPI) GetDashboardUser(UserCred string, userID string) (DashboardUser, error) {
+	target := strings.Join([]string{string(DASH_USERS), url.PathEscape(userID)}, "/")
+
+	user := DashboardUser{}
+	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "GET", DASH, &user, UserCred, nil, "")
+
+	return user, dErr
+}
+
+// CreateDashboardUser creates a Dashboard user and returns it as stored by the Dashboard
+func (t *TykAPI) CreateDashboardUser(UserCred string, user DashboardUser) (DashboardUser, error) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return user, err
+	}
+
+	created := dashboardUserCreated{}
+	dErr, _, _ := t.DispatchAndDecode(DASH_USERS, "POST", DASH, &created, UserCred, bytes.NewBuffer(data), "")
+
+	return created.Meta, dErr
+}
+
+// UpdateDashboardUser sets fields of a Dashboard user, the rest of the user object is left untouched
+func (t *TykAPI) UpdateDashboardUser(UserCred string, userID string, fields map[string]interface{}) error {
+	target := strings.Join([]string{string(DASH_USERS), url.PathEscape(userID)}, "/")
+
+	// the user is read and written back as a map so that fields this wrapper doesn't know about are not lost
+	user := map[string]interface{}{}
+	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "GET", DASH, &user, UserCred, nil, "")
+	if dErr != nil {
+		return dErr
+	}
+
+	for field, value := range fields {
+		user[field] = value
+	}
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	retData := map[string]interface{}{}
+	dErr, _, _ = t.DispatchAndDecode(Endpoint(target), "PUT", DASH, &retData, UserCred, bytes.NewBuffer(data), "")
+
+	return dErr
+}
+
+// DisableDashboardUser sets a Dashboard user as inactive
+func (t *TykAPI) DisableDashboardUser(UserCred string, userID string) error {
+	return t.UpdateDashboardUser(UserCred, userID, map[string]interface{}{"active": false})
+}
+
+// DeleteDashboardUser deletes a Dashboard user
+func (t *TykAPI) DeleteDashboardUser(UserCred string, userID string) error {
+	target := strings.Join([]string{string(DASH_USERS), url.PathEscape(userID)}, "/")
+
+	retData := map[string]interface{}{}
+	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "DELETE", DASH, &retData, UserCred, nil, "")
+
+	return dErr
+}
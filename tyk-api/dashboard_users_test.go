@@ -0,0 +1,28 @@
+package tyk
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashboardUserPaths(t *testing.T) {
+	targets := []string{}
+	api := TykAPI{CustomDispatcher: func(target Endpoint, method string, _ string, _ io.Reader) ([]byte, int, error) {
+		targets = append(targets, method+" "+string(target))
+		return []byte(`{}`), http.StatusOK, nil
+	}}
+
+	api.GetDashboardUser("cred", "../keys/admin")
+	api.UpdateDashboardUser("cred", "a/b", map[string]interface{}{"active": false})
+	api.DeleteDashboardUser("cred", "u?1")
+
+	assert.Equal(t, []string{
+		"GET /api/users/..%2Fkeys%2Fadmin",
+		"GET /api/users/a%2Fb",
+		"PUT /api/users/a%2Fb",
+		"DELETE /api/users/u%3F1",
+	}, targets)
+}
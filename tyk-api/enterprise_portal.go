@@ -0,0 +1,140 @@
+package tyk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
+)
+
+const (
+	// Enterprise Developer Portal endpoints
+	EP_USERS Endpoint = "/portal-api/users"
+	EP_SSO   Endpoint = "/api/sso"
+
+	ENTERPRISE_PORTAL TykAPIName = "enterprise_portal"
+)
+
+// EnterprisePortalUser is a user of the Tyk Enterprise Developer Portal
+type EnterprisePortalUser struct {
+	ID             int    `json:"id,omitempty"`
+	Email          string `json:"email"`
+	First          string `json:"first"`
+	Last           string `json:"last"`
+	Role           string `json:"role,omitempty"`
+	OrganisationID int    `json:"organisation_id,omitempty"`
+	Teams          []int  `json:"teams"`
+	Provider       string `json:"provider,omitempty"`
+	Active         bool   `json:"active"`
+}
+
+// DispatchEnterprisePortal dispatches a request to the admin API of the Enterprise Developer Portal
+func (t *TykAPI) DispatchEnterprisePortal(target Endpoint, method string, body io.Reader) (_ []byte, code int, err error) {
+	start := time.Now()
+	spanCtx, span := t.startSpan("portal", method)
+	defer func() {
+		metrics.ObserveTykAPI("portal", method, code, start)
+		tracing.EndRequest(span, code, err)
+	}()
+
+	preparedEndpoint := t.EnterprisePortalConfig.Endpoint + ":" + t.EnterprisePortalConfig.Port + string(target)
+
+	t.log().Debug("Calling: ", preparedEndpoint)
+	newRequest, err := http.NewRequest(method, preparedEndpoint, body)
+	if err != nil {
+		t.log().WithField("error", err).Error("Failed to create request")
+		return []byte{}, http.StatusInternalServerError, err
+	}
+
+	tracing.Inject(spanCtx, newRequest.Header)
+	t.forwardCorrelationID(newRequest.Header)
+	newRequest.Header.Add("authorization", t.EnterprisePortalConfig.AdminSecret)
+	newRequest.Header.Add("content-type", "application/json")
+	response, reqErr := httpClient.Do(newRequest)
+
+	if reqErr != nil {
+		return []byte{}, http.StatusInternalServerError, reqErr
+	}
+
+	retBody, bErr := t.readBody(response)
+	if bErr != nil {
+		return []byte{}, response.StatusCode, bErr
+	}
+
+	if response.StatusCode > 201 {
+		t.log().WithField("reponse_code", response.StatusCode).Warning("Got:", string(retBody))
+		return retBody, response.StatusCode, errors.New("Response code from the enterprise portal was not 200!")
+	}
+
+	return retBody, response.StatusCode, nil
+}
+
+// GetEnterprisePortalUser retrieves a portal user by email address, the bool is false when there is no such user
+func (t *TykAPI) GetEnterprisePortalUser(email string) (EnterprisePortalUser, bool, error) {
+	target := string(EP_USERS) + "?email=" + url.QueryEscape(email)
+
+	users := []EnterprisePortalUser{}
+	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "GET", ENTERPRISE_PORTAL, &users, "", nil, "")
+	if dErr != nil {
+		return EnterprisePortalUser{}, false, dErr
+	}
+
+	for _, user := range users {
+		if user.Email == email {
+			return user, true, nil
+		}
+	}
+
+	return EnterprisePortalUser{}, false, nil
+}
+
+// CreateEnterprisePortalUser creates a portal user and returns it as stored by the portal
+func (t *TykAPI) CreateEnterprisePortalUser(user EnterprisePortalUser) (EnterprisePortalUser, error) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return user, err
+	}
+
+	created := EnterprisePortalUser{}
+	dErr, _, _ := t.DispatchAndDecode(EP_USERS, "POST", ENTERPRISE_PORTAL, &created, "", bytes.NewBuffer(data), "")
+
+	return created, dErr
+}
+
+// UpdateEnterprisePortalUser updates an existing portal user
+func (t *TykAPI) UpdateEnterprisePortalUser(user EnterprisePortalUser) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	target := fmt.Sprintf("%s/%d", EP_USERS, user.ID)
+	retData := map[string]interface{}{}
+	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "PUT", ENTERPRISE_PORTAL, &retData, "", bytes.NewBuffer(data), "")
+
+	return dErr
+}
+
+// CreateEnterprisePortalSSONonce generates a single-use login nonce for a portal user, it is exchanged by the portal
+// on its /sso endpoint
+func (t *TykAPI) CreateEnterprisePortalSSONonce(data interface{}) (interface{}, Endpoint, error) {
+	SSODataJSON, err := json.Marshal(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var returnVal interface{}
+	dErr, _, _ := t.DispatchAndDecode(EP_SSO, "POST", ENTERPRISE_PORTAL, &returnVal, "", bytes.NewBuffer(SSODataJSON), "")
+	if dErr == nil {
+		t.log().Info("Single Sign-On nonce created successfully via Enterprise Portal API!")
+	}
+
+	return returnVal, EP_SSO, dErr
+}
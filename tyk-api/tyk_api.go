@@ -2,6 +2,7 @@ package tyk
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -15,8 +16,11 @@ import (
 	"github.com/TykTechnologies/storage/persistent/model"
 
 	logger "github.com/TykTechnologies/tyk-identity-broker/log"
-	"github.com/markbates/goth"
+	"github.com/TykTechnologies/tyk-identity-broker/metrics"
+	"github.com/TykTechnologies/tyk-identity-broker/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var onceReloadTykApiLogger sync.Once
@@ -43,15 +47,30 @@ type OAuthResponse struct {
 }
 
 type TokenResponse struct {
-	KeyID string `json:"key_id"`
+	KeyID        string `json:"key_id"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 // TykAPI is the main object (and configuration) of the Tyk API wrapper
 type TykAPI struct {
-	GatewayConfig         EndpointConfig
-	DashboardConfig       EndpointConfig
-	CustomDispatcher      func(target Endpoint, method string, usercode string, body io.Reader) ([]byte, int, error) `json:"-"`
-	CustomSuperDispatcher func(target Endpoint, method string, body io.Reader) ([]byte, int, error)                  `json:"-"`
+	GatewayConfig          EndpointConfig
+	DashboardConfig        EndpointConfig
+	EnterprisePortalConfig EndpointConfig
+	CustomDispatcher       func(target Endpoint, method string, usercode string, body io.Reader) ([]byte, int, error) `json:"-"`
+	CustomSuperDispatcher  func(target Endpoint, method string, body io.Reader) ([]byte, int, error)                  `json:"-"`
+	// ctx is the context of the request the calls are made for, they are traced as part of it
+	ctx context.Context
+}
+
+// WithContext returns a copy of the API whose calls are traced as part of ctx, and carry its trace context
+func (t TykAPI) WithContext(ctx context.Context) TykAPI {
+	t.ctx = ctx
+	return t
+}
+
+// startSpan starts the span of a call to api, the calls are not cancelled with the request they are traced for
+func (t *TykAPI) startSpan(api string, method string) (context.Context, trace.Span) {
+	return tracing.Start(t.ctx, api+" "+method, attribute.String("tyk.api", api), attribute.String("http.request.method", method))
 }
 
 // PortalDeveloper represents a portal developer
@@ -130,11 +149,12 @@ type SessionState struct {
 	JWTData struct {
 		Secret string `json:"secret"`
 	} `json:"jwt_data"`
-	HMACEnabled   bool   `json:"hmac_enabled"`
-	HmacSecret    string `json:"hmac_string"`
-	IsInactive    bool   `json:"is_inactive"`
-	ApplyPolicyID string `json:"apply_policy_id"`
-	DataExpires   int64  `json:"data_expires"`
+	HMACEnabled   bool     `json:"hmac_enabled"`
+	HmacSecret    string   `json:"hmac_string"`
+	IsInactive    bool     `json:"is_inactive"`
+	ApplyPolicyID string   `json:"apply_policy_id"`
+	ApplyPolicies []string `json:"apply_policies"`
+	DataExpires   int64    `json:"data_expires"`
 	Monitor       struct {
 		TriggerLimits []float64 `json:"trigger_limits"`
 	} `json:"monitor"`
@@ -172,28 +192,50 @@ func ReloadLogger() {
 	})
 }
 
+// log returns the logger of the API, its lines carry the correlation ID of the request the API is used for
+func (t *TykAPI) log() *logrus.Entry {
+	return tykAPILogger.WithContext(t.ctx)
+}
+
+// forwardCorrelationID passes the correlation ID of the request the API is used for on to the Tyk API, so that its
+// logs can be matched with the logs of TIB
+func (t *TykAPI) forwardCorrelationID(header http.Header) {
+	if id := logger.CorrelationID(t.ctx); id != "" {
+		header.Set(logger.RequestIDHeader, id)
+	}
+}
+
 func SetHttpClient(c *http.Client) {
 	httpClient = c
 }
 
 // DispatchDashboard dispatches a request to the dashboard API and handles the response
-func (t *TykAPI) DispatchDashboard(target Endpoint, method string, usercode string, body io.Reader) ([]byte, int, error) {
+func (t *TykAPI) DispatchDashboard(target Endpoint, method string, usercode string, body io.Reader) (_ []byte, code int, err error) {
+	start := time.Now()
+	spanCtx, span := t.startSpan("dashboard", method)
+	defer func() {
+		metrics.ObserveTykAPI("dashboard", method, code, start)
+		tracing.EndRequest(span, code, err)
+	}()
+
 	//if user set custom dispatcher then lets use it (internal tib)
 	if t.CustomDispatcher != nil {
-		tykAPILogger.Info("Using custom regular dispatcher")
+		t.log().Info("Using custom regular dispatcher")
 		return t.CustomDispatcher(target, method, usercode, body)
 	} else {
-		tykAPILogger.Info("using regular dispatcher")
+		t.log().Info("using regular dispatcher")
 	}
 
 	preparedEndpoint := t.DashboardConfig.Endpoint + ":" + t.DashboardConfig.Port + string(target)
-	tykAPILogger.Debug("Calling: ", preparedEndpoint)
+	t.log().Debug("Calling: ", preparedEndpoint)
 	newRequest, err := http.NewRequest(method, preparedEndpoint, body)
 	if err != nil {
-		tykAPILogger.WithField("error", err).Error("Failed to create request")
+		t.log().WithField("error", err).Error("Failed to create request")
 		return []byte{}, http.StatusInternalServerError, err
 	}
 
+	tracing.Inject(spanCtx, newRequest.Header)
+	t.forwardCorrelationID(newRequest.Header)
 	newRequest.Header.Add("authorization", usercode)
 	response, reqErr := httpClient.Do(newRequest)
 
@@ -206,10 +248,10 @@ func (t *TykAPI) DispatchDashboard(target Endpoint, method string, usercode stri
 		return []byte{}, response.StatusCode, bErr
 	}
 
-	tykAPILogger.Debug("GOT:", string(retBody))
+	t.log().Debug("GOT:", string(retBody))
 
 	if response.StatusCode > 201 {
-		tykAPILogger.WithField("reponse_code", response.StatusCode).Warning("Got:", string(retBody))
+		t.log().WithField("reponse_code", response.StatusCode).Warning("Got:", string(retBody))
 		return retBody, response.StatusCode, errors.New("Response code from dashboard was not 200!")
 	}
 
@@ -229,23 +271,32 @@ func (t *TykAPI) readBody(response *http.Response) ([]byte, error) {
 }
 
 // DispatchDashboardSuper will dispatch a request to the dashbaord super-user API (admin)
-func (t *TykAPI) DispatchDashboardSuper(target Endpoint, method string, body io.Reader) ([]byte, int, error) {
+func (t *TykAPI) DispatchDashboardSuper(target Endpoint, method string, body io.Reader) (_ []byte, code int, err error) {
+	start := time.Now()
+	spanCtx, span := t.startSpan("dashboard_admin", method)
+	defer func() {
+		metrics.ObserveTykAPI("dashboard_admin", method, code, start)
+		tracing.EndRequest(span, code, err)
+	}()
+
 	//if user set custom super dispatcher then lets use it (internal tib)
 	if t.CustomSuperDispatcher != nil {
-		tykAPILogger.Info("using custom super dispatcher")
+		t.log().Info("using custom super dispatcher")
 		return t.CustomSuperDispatcher(target, method, body)
 	} else {
-		tykAPILogger.Info("using super dispatcher")
+		t.log().Info("using super dispatcher")
 	}
 	preparedEndpoint := t.DashboardConfig.Endpoint + ":" + t.DashboardConfig.Port + string(target)
 
-	tykAPILogger.Debug("Calling: ", preparedEndpoint)
+	t.log().Debug("Calling: ", preparedEndpoint)
 	newRequest, err := http.NewRequest(method, preparedEndpoint, body)
 	if err != nil {
-		tykAPILogger.WithField("error", err).Error("Failed to create request")
+		t.log().WithField("error", err).Error("Failed to create request")
 		return []byte{}, http.StatusInternalServerError, err
 	}
 
+	tracing.Inject(spanCtx, newRequest.Header)
+	t.forwardCorrelationID(newRequest.Header)
 	newRequest.Header.Add("admin-auth", t.DashboardConfig.AdminSecret)
 	response, reqErr := httpClient.Do(newRequest)
 
@@ -259,8 +310,8 @@ func (t *TykAPI) DispatchDashboardSuper(target Endpoint, method string, body io.
 	}
 
 	if response.StatusCode > 201 {
-		tykAPILogger.Warning("Response code was: ", response.StatusCode)
-		tykAPILogger.Warning("Returned: ", string(retBody))
+		t.log().Warning("Response code was: ", response.StatusCode)
+		t.log().Warning("Returned: ", string(retBody))
 		return retBody, response.StatusCode, errors.New("Response code admin dashboard was not 200!")
 	}
 
@@ -268,16 +319,25 @@ func (t *TykAPI) DispatchDashboardSuper(target Endpoint, method string, body io.
 }
 
 // DispatchGateway will dispatch a request to the gateway API
-func (t *TykAPI) DispatchGateway(target Endpoint, method string, body io.Reader, ctype string) ([]byte, int, error) {
+func (t *TykAPI) DispatchGateway(target Endpoint, method string, body io.Reader, ctype string) (_ []byte, code int, err error) {
+	start := time.Now()
+	spanCtx, span := t.startSpan("gateway", method)
+	defer func() {
+		metrics.ObserveTykAPI("gateway", method, code, start)
+		tracing.EndRequest(span, code, err)
+	}()
+
 	preparedEndpoint := t.GatewayConfig.Endpoint + ":" + t.GatewayConfig.Port + string(target)
 
-	tykAPILogger.Debug("Calling: ", preparedEndpoint)
+	t.log().Debug("Calling: ", preparedEndpoint)
 	newRequest, err := http.NewRequest(method, preparedEndpoint, body)
 	if err != nil {
-		tykAPILogger.Error("Failed to create request")
-		tykAPILogger.Error(err)
+		t.log().Error("Failed to create request")
+		t.log().Error(err)
 	}
 
+	tracing.Inject(spanCtx, newRequest.Header)
+	t.forwardCorrelationID(newRequest.Header)
 	if ctype == "" {
 		ctype = "application/json"
 	}
@@ -296,11 +356,11 @@ func (t *TykAPI) DispatchGateway(target Endpoint, method string, body io.Reader,
 	}
 
 	if response.StatusCode > 201 {
-		tykAPILogger.Warning("Response code was: ", response.StatusCode)
+		t.log().Warning("Response code was: ", response.StatusCode)
 		return retBody, response.StatusCode, errors.New("Response code from the gateway was not 200!")
 	}
 
-	tykAPILogger.Debug("API Response: ", string(retBody))
+	t.log().Debug("API Response: ", string(retBody))
 
 	return retBody, response.StatusCode, nil
 }
@@ -324,12 +384,14 @@ func (t *TykAPI) DispatchAndDecode(target Endpoint, method string, APIName TykAP
 		retBytes, retCode, dispatchErr = t.DispatchDashboard(target, method, creds, body)
 	case DASH_SUPER:
 		retBytes, retCode, dispatchErr = t.DispatchDashboardSuper(target, method, body)
+	case ENTERPRISE_PORTAL:
+		retBytes, retCode, dispatchErr = t.DispatchEnterprisePortal(target, method, body)
 	default:
-		return errors.New("APIName must be one of GATEWAY, DASH or DASH_SUPER"), retCode, false
+		return errors.New("APIName must be one of GATEWAY, DASH, DASH_SUPER or ENTERPRISE_PORTAL"), retCode, false
 	}
 
 	if dispatchErr != nil {
-		tykAPILogger.WithField("retCode", retCode).WithField("dispatchErr", dispatchErr).Info("error")
+		t.log().WithField("retCode", retCode).WithField("dispatchErr", dispatchErr).Info("error")
 		if retCode == 401 {
 			return dispatchErr, retCode, false
 		}
@@ -358,12 +420,12 @@ func (t *TykAPI) CreateSSONonce(userAPICred string, data interface{}) (interface
 
 	dErr, retCode, _ := t.DispatchAndDecode(SSO_REGULAR, "POST", DASH, &returnVal, userAPICred, body, "")
 	if retCode != http.StatusOK {
-		tykAPILogger.Warn("SSO regular dashboard API failed, trying with Admin API")
+		t.log().Warn("SSO regular dashboard API failed, trying with Admin API")
 		return t.CreateAdminSSONonce(data)
 	}
 
 	if dErr == nil && retCode == http.StatusOK {
-		tykAPILogger.Info("Single Sign-On nonce created successfully via Dashboard API!")
+		t.log().Info("Single Sign-On nonce created successfully via Dashboard API!")
 	}
 
 	return returnVal, endpoint, dErr
@@ -383,9 +445,9 @@ func (t *TykAPI) CreateAdminSSONonce(data interface{}) (interface{}, Endpoint, e
 	dErr, retCode, _ := t.DispatchAndDecode(SSO_ADMIN, "POST", DASH_SUPER, &returnVal, "", body, "")
 
 	if dErr == nil && retCode == http.StatusOK {
-		tykAPILogger.Info("Single Sign-On nonce created successfully via Admin API!")
+		t.log().Info("Single Sign-On nonce created successfully via Admin API!")
 	} else {
-		tykAPILogger.Error("could not create nonce for admin api:", dErr.Error())
+		t.log().Error("could not create nonce for admin api:", dErr.Error())
 	}
 
 	return returnVal, endpoint, dErr
@@ -445,7 +507,43 @@ func (t *TykAPI) CreateDeveloper(UserCred string, dev PortalDeveloper) error {
 	}
 
 	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "POST", DASH, &retData, UserCred, body, "")
-	tykAPILogger.Debug("Returned: ", retData)
+	t.log().Debug("Returned: ", retData)
+
+	return dErr
+}
+
+type portalDeveloperList struct {
+	Data  []PortalDeveloper `json:"Data"`
+	Pages int               `json:"Pages"`
+}
+
+// GetDevelopers will list every developer of the organisation of the credential using the advanced API
+func (t *TykAPI) GetDevelopers(UserCred string) ([]PortalDeveloper, error) {
+	list := portalDeveloperList{}
+	target := string(PORTAL_DEV) + "?p=-1"
+
+	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "GET", DASH, &list, UserCred, nil, "")
+
+	return list.Data, dErr
+}
+
+// GetDeveloperByID will retrieve a developer from the Advanced API using their ID
+func (t *TykAPI) GetDeveloperByID(UserCred string, id string) (PortalDeveloper, error) {
+	target := strings.Join([]string{string(PORTAL_DEV), url.PathEscape(id)}, "/")
+
+	retUser := PortalDeveloper{}
+
+	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "GET", DASH, &retUser, UserCred, nil, "")
+
+	return retUser, dErr
+}
+
+// DeleteDeveloper will delete a developer using the advanced API
+func (t *TykAPI) DeleteDeveloper(UserCred string, id string) error {
+	target := strings.Join([]string{string(PORTAL_DEV), url.PathEscape(id)}, "/")
+
+	retData := map[string]interface{}{}
+	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "DELETE", DASH, &retData, UserCred, nil, "")
 
 	return dErr
 }
@@ -454,7 +552,9 @@ type OAuthMethod string
 
 var Access OAuthMethod = "AccessToken"
 
-func generateBasicTykSesion(baseAPIID, baseVersion, policyID, orgID string) SessionState {
+// GenerateBasicTykSession returns the session used for keys and OAuth tokens requested by TIB, with access to one
+// version of the base API and the given policies applied
+func GenerateBasicTykSession(baseAPIID, baseVersion string, policyIDs []string, orgID string) SessionState {
 	// Create a generic access token withour policy
 	basicSessionState := SessionState{
 		Allowance:        1,
@@ -467,7 +567,7 @@ func generateBasicTykSesion(baseAPIID, baseVersion, policyID, orgID string) Sess
 		QuotaRenewalRate: 1,
 		AccessRights:     map[string]AccessDefinition{},
 		OrgID:            orgID,
-		ApplyPolicyID:    policyID,
+		ApplyPolicies:    policyIDs,
 		MetaData:         map[string]interface{}{"Origin": "TAP"},
 		Tags:             []string{"TykOrigin-TAP"},
 	}
@@ -479,28 +579,16 @@ func generateBasicTykSesion(baseAPIID, baseVersion, policyID, orgID string) Sess
 	}
 	basicSessionState.AccessRights[baseAPIID] = accessEntry
 
+	// apply_policy_id is deprecated in favour of apply_policies, it is kept for older gateways
+	if len(policyIDs) > 0 {
+		basicSessionState.ApplyPolicyID = policyIDs[0]
+	}
+
 	return basicSessionState
 }
 
-func (t *TykAPI) RequestOAuthToken(APIlistenPath, redirect_uri, responseType, clientId, secret, orgID, policyID, BaseAPIID string, userInfo interface{}) (*OAuthResponse, error) {
-	// Create a generic access token withour policy
-	basicSessionState := generateBasicTykSesion(BaseAPIID, "Default", policyID, orgID)
+func (t *TykAPI) RequestOAuthToken(APIlistenPath, redirect_uri, responseType, clientId, secret string, basicSessionState SessionState) (*OAuthResponse, error) {
 	basicSessionState.OauthClientID = clientId
-	basicSessionState.MetaData.(map[string]interface{})["AuthProviderUserID"] = userInfo.(goth.User).UserID
-	basicSessionState.MetaData.(map[string]interface{})["AuthProviderSource"] = userInfo.(goth.User).Provider
-	basicSessionState.MetaData.(map[string]interface{})["AccessToken"] = userInfo.(goth.User).AccessToken
-	basicSessionState.MetaData.(map[string]interface{})["AccessTokenSecret"] = userInfo.(goth.User).AccessTokenSecret
-
-	/*
-
-		Can be extracted in Global header settings as:
-
-		X-Origin-Tyk: $tyk_meta.Origin
-		X-Tyk-TAP-AccessToken: $tyk_meta.AccessToken
-		X-Tyk-TAP-ID: $tyk_meta.AuthProviderUserID
-		X-Tyk-TAP-Provider: $tyk_meta.AuthProviderSource
-
-	*/
 
 	keyDataJSON, err := json.Marshal(basicSessionState)
 
@@ -520,12 +608,12 @@ func (t *TykAPI) RequestOAuthToken(APIlistenPath, redirect_uri, responseType, cl
 	data += "&redirect_uri=" + redirect_uri
 	data += "&key_rules=" + url.QueryEscape(string(keyDataJSON))
 
-	tykAPILogger.Debug("Request data sent: ", data)
+	t.log().Debug("Request data sent: ", data)
 
 	body := bytes.NewBuffer([]byte(data))
 	dErr, _, _ := t.DispatchAndDecode(Endpoint(target), "POST", GATEWAY, response, "", body, "application/x-www-form-urlencoded")
 
-	tykAPILogger.Debug("Returned: ", response)
+	t.log().Debug("Returned token of type: ", response.TokenType)
 
 	if dErr != nil {
 		return nil, dErr
@@ -534,26 +622,9 @@ func (t *TykAPI) RequestOAuthToken(APIlistenPath, redirect_uri, responseType, cl
 	return response, nil
 }
 
-func (t *TykAPI) RequestStandardToken(orgID, policyID, BaseAPIID, UserCred string, expires int64, userInfo interface{}) (*TokenResponse, error) {
-	// Create a generic access token withour policy
-	basicSessionState := generateBasicTykSesion(BaseAPIID, "Default", policyID, orgID)
-	basicSessionState.MetaData.(map[string]interface{})["AuthProviderUserID"] = userInfo.(goth.User).UserID
-	basicSessionState.MetaData.(map[string]interface{})["AuthProviderSource"] = userInfo.(goth.User).Provider
-	basicSessionState.MetaData.(map[string]interface{})["AccessToken"] = userInfo.(goth.User).AccessToken
-	basicSessionState.MetaData.(map[string]interface{})["AccessTokenSecret"] = userInfo.(goth.User).AccessTokenSecret
+func (t *TykAPI) RequestStandardToken(basicSessionState SessionState, UserCred string, expires int64) (*TokenResponse, error) {
 	basicSessionState.Expires = time.Now().Add(time.Duration(expires) * time.Second).Unix()
 
-	/*
-
-		Can be extracted in Global header settings as:
-
-		X-Origin-Tyk: $tyk_meta.Origin
-		X-Tyk-TAP-AccessToken: $tyk_meta.AccessToken
-		X-Tyk-TAP-ID: $tyk_meta.AuthProviderUserID
-		X-Tyk-TAP-Provider: $tyk_meta.AuthProviderSource
-
-	*/
-
 	keyDataJSON, err := json.Marshal(basicSessionState)
 
 	if err != nil {
@@ -565,15 +636,15 @@ func (t *TykAPI) RequestStandardToken(orgID, policyID, BaseAPIID, UserCred strin
 	target := strings.Join([]string{string(STANDARD_TOKENS)}, "/")
 	data := keyDataJSON
 
-	tykAPILogger.Debug("Request data sent: ", data)
+	t.log().Debug("Request data sent: ", data)
 
 	body := bytes.NewBuffer([]byte(data))
 	dErr, _, isAuthorized := t.DispatchAndDecode(Endpoint(target), "POST", DASH, response, UserCred, body, "")
 
-	tykAPILogger.WithField("is_authorized", isAuthorized).WithField("response", response).Debug("Returned from dispatch to the dashboard.")
+	t.log().WithField("is_authorized", isAuthorized).Debug("Returned from dispatch to the dashboard.")
 
 	if dErr != nil {
-		tykAPILogger.WithField("returned_error", dErr).Debug("Returned from dispatch to the dashboard.")
+		t.log().WithField("returned_error", dErr).Debug("Returned from dispatch to the dashboard.")
 		return nil, dErr
 	}
 
@@ -584,7 +655,7 @@ func (t *TykAPI) InvalidateToken(UserCred string, BaseAPI string, token string)
 	target := strings.Join([]string{string(TOKENS), token}, "/")
 	target = strings.Replace(target, "{APIID}", BaseAPI, 1)
 
-	tykAPILogger.Debug("Target is: ", target)
+	t.log().Debug("Target is: ", target)
 	var reply interface{}
 	oErr, _, isAuthorised := t.DispatchAndDecode(Endpoint(target), "DELETE", DASH, &reply, UserCred, nil, "")
 
@@ -0,0 +1,34 @@
+package tyk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+)
+
+func TestForwardCorrelationID(t *testing.T) {
+	var received http.Header
+	dashboard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Write([]byte("{}"))
+	}))
+	defer dashboard.Close()
+	dashboardURL, _ := url.Parse(dashboard.URL)
+	api := TykAPI{DashboardConfig: EndpointConfig{Endpoint: "http://" + dashboardURL.Hostname(), Port: dashboardURL.Port()}}
+
+	bound := api.WithContext(logger.WithCorrelationID(context.Background(), "abc-123"))
+	_, _, err := bound.DispatchDashboard("/api/users", http.MethodGet, "user-secret", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc-123", received.Get(logger.RequestIDHeader))
+
+	// calls made outside of a request have no correlation ID to forward
+	_, _, err = api.DispatchDashboard("/api/users", http.MethodGet, "user-secret", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, received.Get(logger.RequestIDHeader))
+}
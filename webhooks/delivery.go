@@ -0,0 +1,363 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+const (
+	scheduleKey = "schedule"
+	jobPrefix   = "job-"
+	// pollInterval is how often the schedule is checked for deliveries that are due
+	pollInterval = time.Second
+)
+
+// Headers sent with each delivery
+const (
+	EventHeader     = "X-Tib-Event"
+	DeliveryHeader  = "X-Tib-Delivery"
+	SignatureHeader = "X-Tib-Signature"
+)
+
+// Settings configure the delivery of webhooks
+type Settings struct {
+	Enabled bool
+	// MaxAttempts is how many times a delivery is tried before it is given up, 5 by default
+	MaxAttempts int
+	// RetryBackoff is the delay in seconds before the first retry, it doubles with each retry, 10 by default
+	RetryBackoff int
+	// MaxBackoff caps the delay in seconds between retries, 3600 by default
+	MaxBackoff int
+	// Timeout is the timeout in seconds of a delivery, 10 by default
+	Timeout int
+	// Concurrency is the number of deliveries an instance makes at once, 10 by default
+	Concurrency int
+	// DeliveryLogSize is the number of deliveries kept in the log of each subscription, 100 by default
+	DeliveryLogSize int
+}
+
+// Payload is the body of a delivery, its ID stays the same when the delivery is retried
+type Payload struct {
+	ID    string      `json:"id"`
+	Type  string      `json:"type"`
+	OrgID string      `json:"org_id"`
+	Time  time.Time   `json:"time"`
+	Data  audit.Event `json:"data"`
+}
+
+// Delivery is an attempt to deliver an event, as kept in the delivery log of a subscription
+type Delivery struct {
+	ID          string
+	Event       string
+	Attempt     int
+	Time        time.Time
+	StatusCode  int
+	Succeeded   bool
+	Error       string `json:",omitempty"`
+	NextAttempt time.Time
+}
+
+// job is a scheduled delivery, it is kept under its ID until it succeeds or is given up
+type job struct {
+	ID             string
+	SubscriptionID string
+	Event          string
+	Payload        json.RawMessage
+	Attempt        int
+	NextAttempt    time.Time
+}
+
+// Service manages the subscriptions and delivers their events
+type Service struct {
+	store    tap.AuthRegisterBackend
+	schedule tap.ScheduleBackend
+	settings Settings
+	client   *http.Client
+	now      func() time.Time
+
+	events chan audit.Event
+	done   chan struct{}
+	wg     sync.WaitGroup
+	// slots holds a value for each delivery in flight, inFlight waits for them
+	slots    chan struct{}
+	inFlight sync.WaitGroup
+}
+
+// New returns a service that keeps subscriptions and schedules deliveries in store, which must support schedules
+func New(store tap.AuthRegisterBackend, settings Settings) (*Service, error) {
+	schedule, ok := store.(tap.ScheduleBackend)
+	if !ok {
+		return nil, errors.New("webhooks need a backend that supports schedules, such as Redis")
+	}
+
+	if settings.MaxAttempts == 0 {
+		settings.MaxAttempts = 5
+	}
+	if settings.RetryBackoff == 0 {
+		settings.RetryBackoff = 10
+	}
+	if settings.MaxBackoff == 0 {
+		settings.MaxBackoff = 3600
+	}
+	if settings.Timeout == 0 {
+		settings.Timeout = 10
+	}
+	if settings.DeliveryLogSize == 0 {
+		settings.DeliveryLogSize = 100
+	}
+	if settings.Concurrency == 0 {
+		settings.Concurrency = 10
+	}
+
+	return &Service{
+		store:    store,
+		schedule: schedule,
+		settings: settings,
+		client:   &http.Client{Timeout: time.Duration(settings.Timeout) * time.Second},
+		now:      time.Now,
+		events:   make(chan audit.Event, 1000),
+		done:     make(chan struct{}),
+		slots:    make(chan struct{}, settings.Concurrency),
+	}, nil
+}
+
+// Start subscribes to the audit events and starts delivering the schedule
+func (s *Service) Start() {
+	audit.Subscribe(s.notify)
+
+	s.wg.Add(2)
+	go s.dispatch()
+	go s.work()
+}
+
+// Stop stops delivering once the deliveries in flight are done, the deliveries left in the schedule are sent by
+// other instances or after a restart
+func (s *Service) Stop() {
+	close(s.done)
+	s.wg.Wait()
+	s.inFlight.Wait()
+}
+
+// notify hands an event to the dispatcher without holding up the request that caused it
+func (s *Service) notify(event audit.Event) {
+	select {
+	case s.events <- event:
+	default:
+		webhooksLogger.WithField("event", event.Type).Warning("Webhook events are backing up, event dropped")
+	}
+}
+
+func (s *Service) dispatch() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case event := <-s.events:
+			s.enqueue(event)
+		}
+	}
+}
+
+// enqueue schedules a delivery of event for each subscription of its organisation that subscribes to it
+func (s *Service) enqueue(event audit.Event) {
+	if event.OrgID == "" {
+		return
+	}
+
+	name := eventName(event.Type)
+	for _, sub := range s.List(event.OrgID) {
+		if sub.Disabled || !sub.subscribes(name) {
+			continue
+		}
+
+		id := randomHex(16)
+		payload, err := json.Marshal(Payload{ID: id, Type: name, OrgID: event.OrgID, Time: event.Time, Data: event})
+		if err != nil {
+			webhooksLogger.WithError(err).Error("Failed to encode webhook payload")
+			return
+		}
+		if err := s.scheduleJob(job{ID: id, SubscriptionID: sub.ID, Event: name, Payload: payload, NextAttempt: s.now()}); err != nil {
+			webhooksLogger.WithError(err).WithField("event", name).Error("Failed to schedule webhook delivery")
+			s.store.DeleteKey(jobPrefix+id, "")
+		}
+	}
+}
+
+func (s *Service) work() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.deliverDue()
+		}
+	}
+}
+
+// lease is how long a claimed delivery is hidden from the other instances, it is claimed again after that in case
+// the instance that claimed it stopped
+func (s *Service) lease() time.Duration {
+	return 2 * time.Duration(s.settings.Timeout) * time.Second
+}
+
+// deliverDue claims as many deliveries that are due as there are free slots and delivers them in the background
+func (s *Service) deliverDue() {
+	free := cap(s.slots) - len(s.slots)
+	if free == 0 {
+		return
+	}
+
+	ids, err := s.schedule.Claim(scheduleKey, s.now(), int64(free), s.lease())
+	if err != nil {
+		webhooksLogger.WithError(err).Error("Failed to read the webhook schedule")
+		return
+	}
+
+	for _, id := range ids {
+		s.slots <- struct{}{}
+		s.inFlight.Add(1)
+		go func(id string) {
+			defer func() {
+				<-s.slots
+				s.inFlight.Done()
+			}()
+			s.deliver(id)
+		}(id)
+	}
+}
+
+func (s *Service) deliver(id string) {
+	j := job{}
+	if err := s.store.GetKey(jobPrefix+id, "", &j); err != nil {
+		webhooksLogger.WithError(err).WithField("delivery", id).Warning("Webhook delivery is gone, dropped")
+		s.finish(id)
+		return
+	}
+
+	sub, err := s.subscription(j.SubscriptionID)
+	if err != nil || sub.Disabled {
+		webhooksLogger.WithField("delivery", j.ID).Debug("Subscription is gone or disabled, delivery dropped")
+		s.finish(id)
+		return
+	}
+
+	j.Attempt++
+	delivery := Delivery{ID: j.ID, Event: j.Event, Attempt: j.Attempt, Time: s.now().UTC()}
+	delivery.StatusCode, err = s.post(sub, j)
+	if err == nil {
+		delivery.Succeeded = true
+		s.finish(id)
+	} else {
+		delivery.Error = err.Error()
+		if j.Attempt < s.settings.MaxAttempts {
+			j.NextAttempt = s.now().Add(s.backoff(j.Attempt))
+			delivery.NextAttempt = j.NextAttempt.UTC()
+			if err := s.scheduleJob(j); err != nil {
+				webhooksLogger.WithError(err).WithField("delivery", j.ID).Error("Failed to reschedule webhook delivery")
+			}
+		} else {
+			s.finish(id)
+		}
+		webhooksLogger.WithError(err).WithField("subscription", sub.ID).WithField("attempt", j.Attempt).Warning("Webhook delivery failed")
+	}
+	s.record(sub, delivery)
+}
+
+func (s *Service) post(sub Subscription, j job) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(j.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, j.Event)
+	req.Header.Set(DeliveryHeader, j.ID)
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, s.now().Unix(), j.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("webhook responded " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// scheduleJob saves a job and schedules it at its NextAttempt
+func (s *Service) scheduleJob(j job) error {
+	if err := s.store.SetKey(jobPrefix+j.ID, "", j); err != nil {
+		return err
+	}
+	return s.schedule.Schedule(scheduleKey, j.ID, j.NextAttempt)
+}
+
+// finish removes a delivery that succeeded or was given up, the delivery is sent again if it stays in the schedule
+func (s *Service) finish(id string) {
+	if err := s.schedule.Unschedule(scheduleKey, id); err != nil {
+		webhooksLogger.WithError(err).WithField("delivery", id).Error("Failed to unschedule webhook delivery")
+		return
+	}
+	s.store.DeleteKey(jobPrefix+id, "")
+}
+
+// backoff returns the delay before the retry that follows attempt
+func (s *Service) backoff(attempt int) time.Duration {
+	delay := time.Duration(s.settings.RetryBackoff) * time.Second
+	max := time.Duration(s.settings.MaxBackoff) * time.Second
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// record adds a delivery to the log of its subscription, newest first
+func (s *Service) record(sub Subscription, delivery Delivery) {
+	encoded, _ := json.Marshal(delivery)
+	if err := tap.PushCapped(s.store, deliveriesPrefix+sub.ID, sub.OrgID, encoded, s.settings.DeliveryLogSize); err != nil {
+		webhooksLogger.WithError(err).Error("Failed to update the webhook delivery log")
+	}
+}
+
+// Deliveries returns the delivery log of a subscription of an organisation, newest first
+func (s *Service) Deliveries(orgID, id string) ([]Delivery, error) {
+	if _, err := s.Get(orgID, id); err != nil {
+		return nil, err
+	}
+	deliveries := []Delivery{}
+	for _, value := range tap.Range(s.store, deliveriesPrefix+id, orgID) {
+		delivery := Delivery{}
+		if err := json.Unmarshal([]byte(value), &delivery); err == nil {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+// Sign returns the signature header of a delivery: the time it was sent and the HMAC-SHA256, keyed with the secret
+// of the subscription, of that time and the body joined by a dot. Receivers should reject old timestamps.
+func Sign(secret string, timestamp int64, body []byte) string {
+	t := strconv.FormatInt(timestamp, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,179 @@
+/*
+Package webhooks notifies the subscriptions of an organisation of the logins, tokens and profile changes of its
+profiles. Events are scheduled in Redis and delivered by every TIB instance, signed with the secret of the
+subscription and retried with backoff until they are accepted.
+*/
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
+	logger "github.com/TykTechnologies/tyk-identity-broker/log"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+// Events subscriptions can subscribe to
+const (
+	LoginSuccess   = audit.LoginSuccess
+	LoginFailure   = audit.LoginFailure
+	TokenIssued    = audit.TokenIssued
+	TokenRevoked   = audit.TokenRevoked
+	ProfileChanged = "profile.changed"
+)
+
+// Events lists every event subscriptions can subscribe to
+var Events = []string{LoginSuccess, LoginFailure, TokenIssued, TokenRevoked, ProfileChanged}
+
+const (
+	subscriptionPrefix = "subscription-"
+	orgPrefix          = "org-"
+	deliveriesPrefix   = "deliveries-"
+)
+
+var ErrSubscriptionNotFound = errors.New("webhook subscription not found")
+
+var log = logger.Get()
+var webhooksLogTag = "WEBHOOKS"
+var webhooksLogger = log.WithField("prefix", webhooksLogTag)
+
+// Subscription sends the events of an organisation to URL. Secret signs the deliveries, it is generated when a
+// subscription is created without one.
+type Subscription struct {
+	ID       string
+	OrgID    string
+	URL      string
+	Secret   string
+	Events   []string
+	Disabled bool
+	Created  time.Time
+}
+
+func (sub Subscription) subscribes(event string) bool {
+	for _, e := range sub.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (sub Subscription) validate() error {
+	target, err := url.Parse(sub.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errors.New("the URL of a webhook must be an absolute http or https URL")
+	}
+	if len(sub.Events) == 0 {
+		return errors.New("a webhook must subscribe to at least one of " + strings.Join(Events, ", "))
+	}
+	for _, event := range sub.Events {
+		known := false
+		for _, e := range Events {
+			known = known || e == event
+		}
+		if !known {
+			return errors.New("unknown webhook event " + event)
+		}
+	}
+	return nil
+}
+
+// eventName returns the event subscriptions subscribe to for an audit event, changes to profiles share one event
+func eventName(auditType string) string {
+	switch auditType {
+	case audit.ProfileCreated, audit.ProfileUpdated, audit.ProfileDeleted:
+		return ProfileChanged
+	}
+	return auditType
+}
+
+// Add creates a subscription for an organisation and returns it with its ID and secret
+func (s *Service) Add(sub Subscription) (Subscription, error) {
+	if sub.OrgID == "" {
+		return sub, errors.New("a webhook needs an organisation")
+	}
+	if err := sub.validate(); err != nil {
+		return sub, err
+	}
+
+	sub.ID = randomHex(16)
+	sub.Created = s.now().UTC()
+	if sub.Secret == "" {
+		sub.Secret = randomHex(32)
+	}
+	if err := s.store.SetKey(subscriptionPrefix+sub.ID, sub.OrgID, sub); err != nil {
+		return sub, err
+	}
+	return sub, tap.AddMember(s.store, orgPrefix+sub.OrgID, sub.OrgID, sub.ID, 0)
+}
+
+// Update replaces the URL, events and state of a subscription, and its secret when a new one is given
+func (s *Service) Update(sub Subscription) (Subscription, error) {
+	existing, err := s.Get(sub.OrgID, sub.ID)
+	if err != nil {
+		return sub, err
+	}
+	if err := sub.validate(); err != nil {
+		return sub, err
+	}
+
+	sub.Created = existing.Created
+	if sub.Secret == "" {
+		sub.Secret = existing.Secret
+	}
+	return sub, s.store.SetKey(subscriptionPrefix+sub.ID, sub.OrgID, sub)
+}
+
+// Get returns a subscription of an organisation
+func (s *Service) Get(orgID, id string) (Subscription, error) {
+	sub, err := s.subscription(id)
+	if err != nil || sub.OrgID != orgID {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+// List returns the subscriptions of an organisation, oldest first
+func (s *Service) List(orgID string) []Subscription {
+	subscriptions := []Subscription{}
+	for _, id := range tap.Members(s.store, orgPrefix+orgID, orgID) {
+		if sub, err := s.Get(orgID, id); err == nil {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].Created.Equal(subscriptions[j].Created) {
+			return subscriptions[i].ID < subscriptions[j].ID
+		}
+		return subscriptions[i].Created.Before(subscriptions[j].Created)
+	})
+	return subscriptions
+}
+
+// Delete removes a subscription of an organisation and its delivery log, deliveries still queued for it are dropped
+func (s *Service) Delete(orgID, id string) error {
+	if _, err := s.Get(orgID, id); err != nil {
+		return err
+	}
+	s.store.DeleteKey(subscriptionPrefix+id, orgID)
+	s.store.DeleteKey(deliveriesPrefix+id, orgID)
+	return tap.RemoveMember(s.store, orgPrefix+orgID, orgID, id)
+}
+
+func (s *Service) subscription(id string) (Subscription, error) {
+	sub := Subscription{}
+	err := s.store.GetKey(subscriptionPrefix+id, "", &sub)
+	return sub, err
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,430 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/TykTechnologies/tyk-identity-broker/audit"
+	"github.com/TykTechnologies/tyk-identity-broker/tap"
+)
+
+type memoryStore struct {
+	lock      sync.Mutex
+	kv        map[string][]byte
+	sets      map[string]map[string]bool
+	lists     map[string][]string
+	schedules map[string]map[string]time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		kv:        map[string][]byte{},
+		sets:      map[string]map[string]bool{},
+		lists:     map[string][]string{},
+		schedules: map[string]map[string]time.Time{},
+	}
+}
+
+func (m *memoryStore) Init(interface{}) error { return nil }
+
+func (m *memoryStore) SetKey(key string, _ string, val interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.kv[key], _ = json.Marshal(val)
+	return nil
+}
+
+func (m *memoryStore) GetKey(key string, _ string, val interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.kv[key]
+	if !ok {
+		return errors.New("not found")
+	}
+	return json.Unmarshal(v, val)
+}
+
+func (m *memoryStore) GetAll(string) []interface{} { return nil }
+
+func (m *memoryStore) DeleteKey(key string, _ string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.kv, key)
+	delete(m.sets, key)
+	delete(m.lists, key)
+	return nil
+}
+
+func (m *memoryStore) AddMember(key string, _ string, member string, _ time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.sets[key] == nil {
+		m.sets[key] = map[string]bool{}
+	}
+	m.sets[key][member] = true
+	return nil
+}
+
+func (m *memoryStore) Members(key string, _ string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	members := []string{}
+	for member := range m.sets[key] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (m *memoryStore) RemoveMember(key string, _ string, member string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sets[key], member)
+	return nil
+}
+
+func (m *memoryStore) PushCapped(key string, _ string, value []byte, size int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lists[key] = append([]string{string(value)}, m.lists[key]...)
+	if int64(len(m.lists[key])) > size {
+		m.lists[key] = m.lists[key][:size]
+	}
+	return nil
+}
+
+func (m *memoryStore) Range(key string, _ string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string{}, m.lists[key]...), nil
+}
+
+func (m *memoryStore) Schedule(schedule string, member string, at time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.schedules[schedule] == nil {
+		m.schedules[schedule] = map[string]time.Time{}
+	}
+	m.schedules[schedule][member] = at
+	return nil
+}
+
+func (m *memoryStore) Claim(schedule string, now time.Time, count int64, lease time.Duration) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	members := []string{}
+	for member, at := range m.schedules[schedule] {
+		if int64(len(members)) < count && !at.After(now) {
+			members = append(members, member)
+			m.schedules[schedule][member] = now.Add(lease)
+		}
+	}
+	return members, nil
+}
+
+func (m *memoryStore) Unschedule(schedule string, member string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.schedules[schedule], member)
+	return nil
+}
+
+// scheduled returns the number of deliveries in the schedule, each of them must have its job
+func (m *memoryStore) scheduled(t *testing.T) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id := range m.schedules[scheduleKey] {
+		assert.Contains(t, m.kv, jobPrefix+id)
+	}
+	return len(m.schedules[scheduleKey])
+}
+
+func newService(t *testing.T, store *memoryStore) *Service {
+	service, err := New(store, Settings{Enabled: true, MaxAttempts: 3})
+	require.NoError(t, err)
+	return service
+}
+
+func TestSubscriptions(t *testing.T) {
+	service := newService(t, newMemoryStore())
+
+	_, err := service.Add(Subscription{OrgID: "org", URL: "ftp://example.com", Events: []string{LoginSuccess}})
+	assert.Error(t, err)
+	_, err = service.Add(Subscription{OrgID: "org", URL: "https://example.com/hook"})
+	assert.Error(t, err)
+	_, err = service.Add(Subscription{OrgID: "org", URL: "https://example.com/hook", Events: []string{"login.maybe"}})
+	assert.Error(t, err)
+	_, err = service.Add(Subscription{URL: "https://example.com/hook", Events: []string{LoginSuccess}})
+	assert.Error(t, err)
+
+	sub, err := service.Add(Subscription{OrgID: "org", URL: "https://example.com/hook", Events: []string{LoginFailure}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, sub.ID)
+	assert.Len(t, sub.Secret, 64)
+	other, err := service.Add(Subscription{OrgID: "org", URL: "https://example.com/other", Secret: "shared", Events: Events})
+	require.NoError(t, err)
+	assert.Equal(t, "shared", other.Secret)
+
+	_, err = service.Get("another-org", sub.ID)
+	assert.Equal(t, ErrSubscriptionNotFound, err)
+	assert.Len(t, service.List("org"), 2)
+	assert.Empty(t, service.List("another-org"))
+
+	updated, err := service.Update(Subscription{ID: sub.ID, OrgID: "org", URL: "https://example.com/new", Events: []string{TokenIssued}, Disabled: true})
+	require.NoError(t, err)
+	assert.Equal(t, sub.Secret, updated.Secret)
+	assert.Equal(t, sub.Created, updated.Created)
+	_, err = service.Update(Subscription{ID: sub.ID, OrgID: "another-org", URL: "https://example.com/new", Events: []string{TokenIssued}})
+	assert.Equal(t, ErrSubscriptionNotFound, err)
+
+	assert.Equal(t, ErrSubscriptionNotFound, service.Delete("another-org", sub.ID))
+	assert.NoError(t, service.Delete("org", sub.ID))
+	assert.NoError(t, service.Delete("org", other.ID))
+	assert.Empty(t, service.List("org"))
+}
+
+func TestConcurrentSubscriptions(t *testing.T) {
+	service := newService(t, newMemoryStore())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := service.Add(Subscription{OrgID: "org", URL: "https://example.com/hook", Events: Events})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	subscriptions := service.List("org")
+	require.Len(t, subscriptions, 20)
+
+	for _, sub := range subscriptions[:10] {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			assert.NoError(t, service.Delete("org", id))
+		}(sub.ID)
+	}
+	wg.Wait()
+	assert.Len(t, service.List("org"), 10)
+}
+
+func TestDeliveryLog(t *testing.T) {
+	service, err := New(newMemoryStore(), Settings{DeliveryLogSize: 2})
+	require.NoError(t, err)
+	sub, err := service.Add(Subscription{OrgID: "org", URL: "https://example.com/hook", Events: Events})
+	require.NoError(t, err)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		service.record(sub, Delivery{ID: "delivery", Attempt: attempt})
+	}
+	deliveries, err := service.Deliveries("org", sub.ID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, 3, deliveries[0].Attempt)
+	assert.Equal(t, 2, deliveries[1].Attempt)
+}
+
+func TestDelivery(t *testing.T) {
+	var lock sync.Mutex
+	status := http.StatusOK
+	requests := []*http.Request{}
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	store := newMemoryStore()
+	service := newService(t, store)
+	now := time.Now()
+	service.now = func() time.Time { return now }
+	deliverDue := func() {
+		service.deliverDue()
+		service.inFlight.Wait()
+	}
+
+	sub, err := service.Add(Subscription{OrgID: "org", URL: server.URL, Events: []string{ProfileChanged, TokenRevoked}})
+	require.NoError(t, err)
+	_, err = service.Add(Subscription{OrgID: "org", URL: server.URL, Events: Events, Disabled: true})
+	require.NoError(t, err)
+
+	service.enqueue(audit.Event{Type: audit.LoginSuccess, OrgID: "org"})
+	service.enqueue(audit.Event{Type: audit.ProfileUpdated, OrgID: "other-org"})
+	assert.Equal(t, 0, store.scheduled(t))
+
+	t.Run("signed delivery", func(t *testing.T) {
+		service.enqueue(audit.Event{Type: audit.ProfileUpdated, OrgID: "org", ProfileID: "1", Actor: "sha256:abc"})
+		deliverDue()
+		require.Len(t, requests, 1)
+
+		r := requests[0]
+		assert.Equal(t, ProfileChanged, r.Header.Get(EventHeader))
+		assert.Equal(t, Sign(sub.Secret, now.Unix(), []byte(bodies[0])), r.Header.Get(SignatureHeader))
+		assert.True(t, strings.HasPrefix(r.Header.Get(SignatureHeader), "t="+strconv.FormatInt(now.Unix(), 10)+",v1="))
+
+		payload := Payload{}
+		require.NoError(t, json.Unmarshal([]byte(bodies[0]), &payload))
+		assert.Equal(t, r.Header.Get(DeliveryHeader), payload.ID)
+		assert.Equal(t, ProfileChanged, payload.Type)
+		assert.Equal(t, audit.ProfileUpdated, payload.Data.Type)
+		assert.Equal(t, "sha256:abc", payload.Data.Actor)
+	})
+
+	t.Run("retried with backoff", func(t *testing.T) {
+		status = http.StatusServiceUnavailable
+		service.enqueue(audit.Event{Type: audit.TokenRevoked, OrgID: "org"})
+		deliverDue()
+		require.Len(t, requests, 2)
+		assert.Equal(t, 1, store.scheduled(t))
+
+		// not due yet
+		deliverDue()
+		assert.Len(t, requests, 2)
+		assert.Equal(t, 1, store.scheduled(t))
+
+		status = http.StatusNoContent
+		now = now.Add(10 * time.Second)
+		deliverDue()
+		require.Len(t, requests, 3)
+		assert.Equal(t, requests[1].Header.Get(DeliveryHeader), requests[2].Header.Get(DeliveryHeader))
+		assert.Equal(t, bodies[1], bodies[2])
+		assert.Equal(t, 0, store.scheduled(t))
+		assert.NotContains(t, store.kv, jobPrefix+requests[2].Header.Get(DeliveryHeader))
+	})
+
+	t.Run("given up after the last attempt", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		service.enqueue(audit.Event{Type: audit.TokenRevoked, OrgID: "org"})
+		for i := 0; i < 5; i++ {
+			deliverDue()
+			now = now.Add(time.Hour)
+		}
+		assert.Len(t, requests, 6)
+		assert.Equal(t, 0, store.scheduled(t))
+	})
+
+	deliveries, err := service.Deliveries("org", sub.ID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 6)
+	assert.Equal(t, 3, deliveries[0].Attempt)
+	assert.False(t, deliveries[0].Succeeded)
+	assert.True(t, deliveries[0].NextAttempt.IsZero())
+	assert.Equal(t, http.StatusInternalServerError, deliveries[1].StatusCode)
+	assert.False(t, deliveries[1].NextAttempt.IsZero())
+	assert.True(t, deliveries[3].Succeeded)
+	assert.Equal(t, 2, deliveries[3].Attempt)
+	assert.NotEmpty(t, deliveries[4].Error)
+	assert.True(t, deliveries[5].Succeeded)
+
+	t.Run("claimed again once its lease runs out", func(t *testing.T) {
+		status = http.StatusOK
+		service.enqueue(audit.Event{Type: audit.TokenRevoked, OrgID: "org"})
+		// an instance that claimed the delivery stopped before delivering it
+		claimed, err := store.Claim(scheduleKey, now, 10, service.lease())
+		require.NoError(t, err)
+		require.Len(t, claimed, 1)
+
+		deliverDue()
+		assert.Len(t, requests, 6)
+		assert.Equal(t, 1, store.scheduled(t))
+
+		now = now.Add(service.lease())
+		deliverDue()
+		require.Len(t, requests, 7)
+		assert.Equal(t, claimed[0], requests[6].Header.Get(DeliveryHeader))
+		assert.Equal(t, 0, store.scheduled(t))
+	})
+
+	t.Run("dropped once the subscription is deleted", func(t *testing.T) {
+		service.enqueue(audit.Event{Type: audit.TokenRevoked, OrgID: "org"})
+		require.NoError(t, service.Delete("org", sub.ID))
+		deliverDue()
+		assert.Len(t, requests, 7)
+		assert.Equal(t, 0, store.scheduled(t))
+	})
+}
+
+func TestConcurrency(t *testing.T) {
+	var inFlight, most int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&inFlight, -1)
+	}))
+	defer server.Close()
+
+	store := newMemoryStore()
+	service, err := New(store, Settings{Enabled: true, Concurrency: 2})
+	require.NoError(t, err)
+	_, err = service.Add(Subscription{OrgID: "org", URL: server.URL, Events: []string{LoginFailure}})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		service.enqueue(audit.Event{Type: audit.LoginFailure, OrgID: "org"})
+	}
+
+	service.deliverDue()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&inFlight) == 2 }, time.Second, 10*time.Millisecond)
+	// no slot is free until a delivery is done
+	service.deliverDue()
+	close(release)
+	service.inFlight.Wait()
+	assert.Equal(t, 1, store.scheduled(t))
+
+	service.deliverDue()
+	service.inFlight.Wait()
+	assert.Equal(t, 0, store.scheduled(t))
+	assert.Equal(t, int32(2), most)
+}
+
+func TestBackoff(t *testing.T) {
+	service, err := New(newMemoryStore(), Settings{RetryBackoff: 10, MaxBackoff: 60})
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, service.backoff(1))
+	assert.Equal(t, 20*time.Second, service.backoff(2))
+	assert.Equal(t, 40*time.Second, service.backoff(3))
+	assert.Equal(t, 60*time.Second, service.backoff(4))
+	assert.Equal(t, 60*time.Second, service.backoff(50))
+}
+
+func TestStart(t *testing.T) {
+	store := newMemoryStore()
+	service := newService(t, store)
+	_, err := service.Add(Subscription{OrgID: "org", URL: "https://example.com/hook", Events: []string{LoginFailure}})
+	require.NoError(t, err)
+
+	service.Start()
+	defer service.Stop()
+	audit.Log(nil, audit.Event{Type: audit.LoginFailure, OrgID: "org", Reason: "access_denied"})
+	assert.Eventually(t, func() bool { return store.scheduled(t) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestNew(t *testing.T) {
+	// a backend that only stores keys cannot hold the schedule
+	_, err := New(struct{ tap.AuthRegisterBackend }{newMemoryStore()}, Settings{})
+	assert.Error(t, err)
+}